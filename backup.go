@@ -0,0 +1,207 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// backupAll() writes consistent snapshots of all db files into a new
+// timestamped directory below backupDir (e.g. backupDir/20220315-031500/).
+// Snapshots are taken in read transactions (skv.KV Snapshot()),
+// so they never catch a file mid-write and they do not block writers.
+// It is called by ticker3min() every backupPauseMinutes.
+// config.ini:
+// backupDir = /var/backups/webcall   (empty = no backups)
+// backupGzip = true                  (write rtcsig.db.gz etc.)
+// backupPauseMinutes = 720
+// backupKeepDaily = 7                (keep the latest backup of the last 7 days)
+// backupKeepWeekly = 4               (keep the latest backup of the last 4 weeks)
+// To restore, stop the server and copy (gunzip) the files of one backup into dbPath.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"time"
+	"sort"
+	"errors"
+	"strings"
+	"net/http"
+	"path/filepath"
+	"compress/gzip"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const backupTimeFormat = "20060102-150405"
+const backupTmpPrefix = ".tmp-"
+
+// kvByDbName returns the open store for a db file name or nil
+func kvByDbName(dbName string) skv.KV {
+	switch dbName {
+	case dbMainName:
+		return kvMain
+	case dbCallsName:
+		return kvCalls
+	case dbContactsName:
+		return kvContacts
+	case dbNotifName:
+		return kvNotif
+	case dbHashedPwName:
+		return kvHashedPw
+	}
+	return nil
+}
+
+// backupSnapshot writes a snapshot of one db file to w (optionally gzip compressed)
+func backupSnapshot(dbName string, w io.Writer, compress bool) (int64, error) {
+	kv := kvByDbName(dbName)
+	if kv==nil {
+		return 0, errors.New("unknown db "+dbName)
+	}
+	if !compress {
+		return kv.Snapshot(w)
+	}
+	gzipWriter := gzip.NewWriter(w)
+	n, err := kv.Snapshot(gzipWriter)
+	if err!=nil {
+		return n, err
+	}
+	return n, gzipWriter.Close()
+}
+
+func backupFile(dbName string, path string, compress bool) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err!=nil {
+		return 0, err
+	}
+	n, err := backupSnapshot(dbName, file, compress)
+	if err==nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err==nil {
+		err = errClose
+	}
+	return n, err
+}
+
+// backupAll writes all db files into a new directory below dir
+// the directory is renamed to its final name only after all files are written
+func backupAll(dir string, compress bool) error {
+	timeNow := time.Now()
+	name := timeNow.Format(backupTimeFormat)
+	tmpDir := filepath.Join(dir, backupTmpPrefix+name)
+	err := os.MkdirAll(tmpDir, 0700)
+	if err!=nil {
+		fmt.Printf("# backupAll mkdir %s err=%v\n", tmpDir, err)
+		return err
+	}
+	var total int64
+	for _,dbName := range dbFileNames {
+		fileName := dbName
+		if compress {
+			fileName += ".gz"
+		}
+		n, err := backupFile(dbName, filepath.Join(tmpDir,fileName), compress)
+		if err!=nil {
+			fmt.Printf("# backupAll %s err=%v\n", dbName, err)
+			os.RemoveAll(tmpDir)
+			return err
+		}
+		total += n
+	}
+	err = os.Rename(tmpDir, filepath.Join(dir, name))
+	if err!=nil {
+		fmt.Printf("# backupAll rename %s err=%v\n", tmpDir, err)
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	fmt.Printf("backupAll %s done %d bytes %v\n", filepath.Join(dir,name), total, time.Since(timeNow))
+	return nil
+}
+
+// backupPrune removes all backups below dir, except the latest backup of each of
+// the last keepDaily days and the latest backup of each of the last keepWeekly weeks
+// the latest backup is always kept
+func backupPrune(dir string, keepDaily int, keepWeekly int) {
+	entries, err := os.ReadDir(dir)
+	if err!=nil {
+		fmt.Printf("# backupPrune %s err=%v\n", dir, err)
+		return
+	}
+	type backup struct {
+		name string
+		time time.Time
+	}
+	var backups []backup
+	for _,entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), backupTmpPrefix) {
+			// left over from an interrupted backup
+			fmt.Printf("backupPrune remove %s\n", entry.Name())
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		backupTime, err := time.ParseInLocation(backupTimeFormat, entry.Name(), time.Local)
+		if err!=nil {
+			// not ours
+			continue
+		}
+		backups = append(backups, backup{entry.Name(), backupTime})
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i,b := range backups {
+		keep := i==0
+		day := b.time.Format("20060102")
+		if !days[day] {
+			days[day] = true
+			if len(days)<=keepDaily {
+				keep = true
+			}
+		}
+		year, week := b.time.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if !weeks[weekKey] {
+			weeks[weekKey] = true
+			if len(weeks)<=keepWeekly {
+				keep = true
+			}
+		}
+		if !keep {
+			fmt.Printf("backupPrune remove %s\n", b.name)
+			err := os.RemoveAll(filepath.Join(dir, b.name))
+			if err!=nil {
+				fmt.Printf("# backupPrune remove %s err=%v\n", b.name, err)
+			}
+		}
+	}
+}
+
+// adminApiSnapshot streams a live snapshot of one db file ("GET /admin/v1/snapshot/rtcsig.db[?gzip=1]")
+func adminApiSnapshot(w http.ResponseWriter, r *http.Request, dbName string, remoteAddr string) {
+	if kvByDbName(dbName)==nil {
+		adminApiError(w, http.StatusNotFound, "unknown db %s", dbName)
+		return
+	}
+	compress := r.URL.Query().Get("gzip")=="1"
+	fileName := dbName
+	contentType := "application/octet-stream"
+	if compress {
+		fileName += ".gz"
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+
+		time.Now().Format(backupTimeFormat)+"-"+fileName+"\"")
+	n, err := backupSnapshot(dbName, w, compress)
+	if err!=nil {
+		// the response is already on its way; the client will see a truncated file
+		fmt.Printf("# %s/snapshot %s err=%v rip=%s\n", adminApiPrefix, dbName, err, remoteAddr)
+		return
+	}
+	fmt.Printf("%s/snapshot %s %d bytes gzip=%v rip=%s\n", adminApiPrefix, dbName, n, compress, remoteAddr)
+}
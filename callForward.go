@@ -0,0 +1,175 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Call forwarding.
+// A callee can set one forwarding target per condition via /setsettings:
+// forwardOffline, forwardBusy and forwardNoAnswer (DbUser.Forward*).
+// A target is either another callee ID (on this server) or a link (http/https).
+// Instead of "notavail" or "busy", /online then answers "forward|<url>" with <url>
+// being the link or "/user/<target>?fwd=<chain>". If the callee does not pick up
+// within maxRingSecs, the caller receives "forward|<url>" over its websocket, before
+// the call is canceled.
+// The chain (url arg fwd, for /online and /ws) lists the callee IDs a call has been
+// forwarded from. A target that is already in the chain (A->B->A), or a chain of
+// maxForwardHops callees, ends forwarding. /setsettings also denies targets
+// leading back to the callee.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"strconv"
+	"net/url"
+)
+
+const maxForwardHops = 5
+
+const (
+	forwardOffline = "offline"
+	forwardBusy = "busy"
+	forwardNoAnswer = "noanswer"
+)
+
+func (dbUser *DbUser) forwardTarget(condition string) string {
+	switch condition {
+	case forwardOffline:
+		return dbUser.ForwardOffline
+	case forwardBusy:
+		return dbUser.ForwardBusy
+	case forwardNoAnswer:
+		return dbUser.ForwardNoAnswer
+	}
+	return ""
+}
+
+func isForwardLink(target string) bool {
+	return strings.HasPrefix(target,"https://") || strings.HasPrefix(target,"http://")
+}
+
+func getDbUserOfCallee(calleeID string) (*DbUser,error) {
+	var dbEntry DbEntry
+	err := kvMain.Get(dbRegisteredIDs, calleeID, &dbEntry)
+	if err!=nil {
+		return nil,err
+	}
+	var dbUser DbUser
+	err = kvMain.Get(dbUserBucket, fmt.Sprintf("%s_%d",calleeID,dbEntry.StartTime), &dbUser)
+	if err!=nil {
+		return nil,err
+	}
+	return &dbUser,nil
+}
+
+// parseForwardChain returns the callee IDs of url arg fwd
+func parseForwardChain(fwd string) []string {
+	var chain []string
+	for _,id := range strings.Split(fwd, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id!="" {
+			chain = append(chain, id)
+		}
+	}
+	return chain
+}
+
+// forwardURL returns where a caller of calleeID is forwarded to ("" = no forwarding)
+func forwardURL(calleeID string, target string, fwd string) string {
+	if target=="" {
+		return ""
+	}
+	if isForwardLink(target) {
+		return target
+	}
+	chain := parseForwardChain(fwd)
+	if len(chain) >= maxForwardHops {
+		fmt.Printf("# forward (%s) -> (%s) too many hops (%s)\n", calleeID, target, fwd)
+		return ""
+	}
+	chain = append(chain, calleeID)
+	for _,id := range chain {
+		if id==target {
+			fmt.Printf("# forward (%s) -> (%s) loop (%s)\n", calleeID, target, fwd)
+			return ""
+		}
+	}
+	return "/user/"+target+"?fwd="+url.QueryEscape(strings.Join(chain,","))
+}
+
+// forwardCaller answers /online with "forward|<url>", if calleeID has a target for condition
+func forwardCaller(w io.Writer, calleeID string, dbUser *DbUser, condition string, fwd string, remoteAddr string) bool {
+	if dbUser==nil {
+		var err error
+		dbUser,err = getDbUserOfCallee(calleeID)
+		if err!=nil {
+			return false
+		}
+	}
+	forwardUrl := forwardURL(calleeID, dbUser.forwardTarget(condition), fwd)
+	if forwardUrl=="" {
+		return false
+	}
+	fmt.Printf("/online (%s) forward %s -> %s %s\n", calleeID, condition, forwardUrl, remoteAddr)
+	fmt.Fprintf(w, "forward|%s", forwardUrl)
+	return true
+}
+
+// forwardNoAnswerURL is called when maxRingSecs is reached
+func (h *Hub) forwardNoAnswerURL(calleeID string, fwd string) string {
+	userKey := calleeID + "_" + strconv.FormatInt(h.registrationStartTime,10)
+	var dbUser DbUser
+	err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+	if err!=nil {
+		fmt.Printf("# forward (%s) failed to get dbUser err=%v\n", calleeID, err)
+		return ""
+	}
+	return forwardURL(calleeID, dbUser.ForwardNoAnswer, fwd)
+}
+
+// checkForwardTarget validates a forwarding target for calleeID (see /setsettings)
+func checkForwardTarget(calleeID string, target string) (string,error) {
+	if target=="" || isForwardLink(target) {
+		if len(target) > 1024 {
+			return "", fmt.Errorf("link too long")
+		}
+		return target, nil
+	}
+	target = strings.ToLower(target)
+	if target==calleeID {
+		return "", fmt.Errorf("forward to self")
+	}
+	if _,err := getDbUserOfCallee(target); err!=nil {
+		return "", fmt.Errorf("unknown callee %s", target)
+	}
+	// follow the forwarding rules of the targets (any condition): must not lead back to calleeID
+	visited := map[string]bool{calleeID:true}
+	next := []string{target}
+	for hops := 0; hops < maxForwardHops && len(next)>0; hops++ {
+		var following []string
+		for _,id := range next {
+			if visited[id] {
+				if id==calleeID {
+					return "", fmt.Errorf("forward loop via %s", target)
+				}
+				continue
+			}
+			visited[id] = true
+			dbUser,err := getDbUserOfCallee(id)
+			if err!=nil {
+				continue
+			}
+			for _,t := range []string{dbUser.ForwardOffline, dbUser.ForwardBusy, dbUser.ForwardNoAnswer} {
+				if t!="" && !isForwardLink(t) {
+					following = append(following, t)
+				}
+			}
+		}
+		next = following
+	}
+	for _,id := range next {
+		if id==calleeID {
+			return "", fmt.Errorf("forward loop via %s", target)
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,393 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// wcadmin is the command line admin tool for WebCall server.
+// It talks to the JSON admin API ("/admin/v1", see httpAdminApi.go).
+// The server URL and the bearer token are taken from the -server and
+// -token flags, or from the WCADMIN_SERVER and WCADMIN_TOKEN env vars.
+// Output is a table, or JSON if -json is given.
+// The exit code is 0 on success, 1 on a failed request and 2 on a usage error.
+//
+// wcadmin users list
+// wcadmin users show (id)
+// wcadmin users create [-days n] (id)   (the pw is read from stdin)
+// wcadmin users delete (id)
+// wcadmin users block (id)
+// wcadmin users unblock (id)
+// wcadmin online
+// wcadmin hubs
+// wcadmin turn
+// wcadmin news (date) (url)
+// wcadmin stats
+// wcadmin snapshot [-gzip] (dbname) (outfile)   live snapshot of a db file (e.g. rtcsig.db)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const apiPrefix = "/admin/v1"
+
+const (
+	exitOk = 0
+	exitFailed = 1
+	exitUsage = 2
+)
+
+var serverUrl = flag.String("server", envOr("WCADMIN_SERVER","http://127.0.0.1:8067"), "webcall server url")
+var token = flag.String("token", os.Getenv("WCADMIN_TOKEN"), "admin api bearer token")
+var jsonOutput = flag.Bool("json", false, "json output")
+var timeout = flag.Duration("timeout", 10*time.Second, "request timeout")
+
+var errUsage = errors.New("usage")
+
+// ApiError is returned for non-2xx responses
+type ApiError struct {
+	Status int
+	Msg string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Msg)
+}
+
+func envOr(key string, defaultValue string) string {
+	val := os.Getenv(key)
+	if val=="" {
+		return defaultValue
+	}
+	return val
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: wcadmin [flags] command [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  users list\n")
+	fmt.Fprintf(os.Stderr, "  users show (id)\n")
+	fmt.Fprintf(os.Stderr, "  users create [-days n] (id)   pw is read from stdin\n")
+	fmt.Fprintf(os.Stderr, "  users delete (id)\n")
+	fmt.Fprintf(os.Stderr, "  users block (id)\n")
+	fmt.Fprintf(os.Stderr, "  users unblock (id)\n")
+	fmt.Fprintf(os.Stderr, "  online\n")
+	fmt.Fprintf(os.Stderr, "  hubs\n")
+	fmt.Fprintf(os.Stderr, "  turn\n")
+	fmt.Fprintf(os.Stderr, "  news (date) (url)\n")
+	fmt.Fprintf(os.Stderr, "  stats\n")
+	fmt.Fprintf(os.Stderr, "  snapshot [-gzip] (dbname) (outfile)\n\n")
+	fmt.Fprintf(os.Stderr, "flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args)<1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	err := run(args)
+	if err==errUsage {
+		usage()
+		os.Exit(exitUsage)
+	}
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# wcadmin %s: %v\n", args[0], err)
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitOk)
+}
+
+func run(args []string) error {
+	switch args[0] {
+	case "users":
+		if len(args)<2 {
+			return errUsage
+		}
+		return runUsers(args[1], args[2:])
+	case "online":
+		return list("/online", "calleeID", "ip", "connectedCallerIp", "clientVersion", "userAgent")
+	case "hubs":
+		return list("/hubs", "calleeID", "calleeOnline", "connectedCallerIp")
+	case "turn":
+		return list("/turn", "calleeID", "ip", "secs")
+	case "news":
+		if len(args)!=3 {
+			return errUsage
+		}
+		return post("/news", map[string]string{"date":args[1], "url":args[2]})
+	case "stats":
+		var stats map[string]interface{}
+		err := request(http.MethodGet, "/stats", nil, &stats)
+		if err!=nil {
+			return err
+		}
+		return printObject(stats)
+	case "snapshot":
+		flagSet := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+		compress := flagSet.Bool("gzip", false, "gzip compressed")
+		if flagSet.Parse(args[1:])!=nil || flagSet.NArg()!=2 {
+			return errUsage
+		}
+		return snapshot(flagSet.Arg(0), flagSet.Arg(1), *compress)
+	}
+	return errUsage
+}
+
+// snapshot downloads a db file into outFile
+func snapshot(dbName string, outFile string, compress bool) error {
+	path := "/snapshot/"+url.PathEscape(dbName)
+	if compress {
+		path += "?gzip=1"
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*serverUrl,"/")+apiPrefix+path, nil)
+	if err!=nil {
+		return err
+	}
+	if *token!="" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	// no overall timeout: a snapshot can be big
+	resp, err := http.DefaultClient.Do(req)
+	if err!=nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode!=http.StatusOK {
+		return &ApiError{resp.StatusCode, http.StatusText(resp.StatusCode)}
+	}
+	file, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err!=nil {
+		return err
+	}
+	n, err := io.Copy(file, resp.Body)
+	if errClose := file.Close(); err==nil {
+		err = errClose
+	}
+	if err!=nil {
+		os.Remove(outFile)
+		return err
+	}
+	fmt.Printf("%s %d bytes\n", outFile, n)
+	return nil
+}
+
+func runUsers(cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		if len(args)!=0 {
+			return errUsage
+		}
+		return list("/users", "key", "callCounter", "connectedToPeerSecs",
+			"lastLoginTime", "lastLogoffTime", "serviceEndTime")
+	case "show":
+		if len(args)!=1 {
+			return errUsage
+		}
+		id := args[0]
+		var entry map[string]interface{}
+		err := request(http.MethodGet, "/registered/"+url.PathEscape(id), nil, &entry)
+		if err!=nil {
+			return err
+		}
+		var user map[string]interface{}
+		err = request(http.MethodGet, "/users/"+url.PathEscape(userKey(id,entry)), nil, &user)
+		if err!=nil {
+			return err
+		}
+		user["id"] = id
+		user["startTime"] = entry["startTime"]
+		var blocked map[string]interface{}
+		user["blocked"] = request(http.MethodGet, "/blocked/"+url.PathEscape(id), nil, &blocked)==nil
+		return printObject(user)
+	case "create":
+		flagSet := flag.NewFlagSet("users create", flag.ContinueOnError)
+		days := flagSet.Int("days", 0, "service days (0 = unlimited)")
+		if flagSet.Parse(args)!=nil || flagSet.NArg()!=1 {
+			return errUsage
+		}
+		// read the pw from stdin, so it will not show up in the process list
+		pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err!=nil && err!=io.EOF {
+			return err
+		}
+		pw = strings.TrimSpace(pw)
+		if len(pw)<6 {
+			return errors.New("pw (from stdin) must have at least 6 characters")
+		}
+		return post("/registered", map[string]interface{}{
+			"id":flagSet.Arg(0), "pw":pw, "serviceDays":*days})
+	case "delete":
+		if len(args)!=1 {
+			return errUsage
+		}
+		id := args[0]
+		var entry map[string]interface{}
+		err := request(http.MethodGet, "/registered/"+url.PathEscape(id), nil, &entry)
+		if err!=nil {
+			return err
+		}
+		// the server deletes the registered ID and the user data together
+		return request(http.MethodDelete, "/registered/"+url.PathEscape(id),
+			map[string]interface{}{"startTime":entry["startTime"]}, nil)
+	case "block":
+		if len(args)!=1 {
+			return errUsage
+		}
+		return post("/blocked", map[string]string{"id":args[0]})
+	case "unblock":
+		if len(args)!=1 {
+			return errUsage
+		}
+		id := args[0]
+		var entry map[string]interface{}
+		err := request(http.MethodGet, "/blocked/"+url.PathEscape(id), nil, &entry)
+		if err!=nil {
+			return err
+		}
+		return request(http.MethodDelete, "/blocked/"+url.PathEscape(id),
+			map[string]interface{}{"startTime":entry["startTime"]}, nil)
+	}
+	return errUsage
+}
+
+// userKey returns the key of the userData for a registered entry
+func userKey(id string, entry map[string]interface{}) string {
+	startTime, _ := entry["startTime"].(float64)
+	return fmt.Sprintf("%s_%d", id, int64(startTime))
+}
+
+// request sends body as json and decodes the json response into result (if not nil)
+func request(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body!=nil {
+		jsonBody, err := json.Marshal(body)
+		if err!=nil {
+			return err
+		}
+		reqBody = bytes.NewReader(jsonBody)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*serverUrl,"/")+apiPrefix+path, reqBody)
+	if err!=nil {
+		return err
+	}
+	if *token!="" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	if body!=nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err!=nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024*1024))
+	if err!=nil {
+		return err
+	}
+	if resp.StatusCode<200 || resp.StatusCode>299 {
+		var apiResult struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &apiResult)!=nil || apiResult.Error=="" {
+			apiResult.Error = http.StatusText(resp.StatusCode)
+		}
+		return &ApiError{resp.StatusCode, apiResult.Error}
+	}
+	if result!=nil {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+
+func post(path string, body interface{}) error {
+	var result map[string]interface{}
+	err := request(http.MethodPost, path, body, &result)
+	if err!=nil {
+		return err
+	}
+	return printObject(result)
+}
+
+// list fetches a json array and prints it with the given columns
+func list(path string, columns ...string) error {
+	var rows []map[string]interface{}
+	err := request(http.MethodGet, path, nil, &rows)
+	if err!=nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJson(rows)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _,row := range rows {
+		var cells []string
+		for _,column := range columns {
+			cells = append(cells, formatValue(column, row[column]))
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printObject prints a json object as "key value" lines
+func printObject(obj map[string]interface{}) error {
+	if *jsonOutput {
+		return printJson(obj)
+	}
+	var keys []string
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _,key := range keys {
+		fmt.Fprintf(tw, "%s\t%s\n", key, formatValue(key, obj[key]))
+	}
+	return tw.Flush()
+}
+
+func printJson(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// formatValue formats unix times ("...Time" columns) as date strings
+func formatValue(column string, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "-"
+	case float64:
+		if strings.HasSuffix(column,"Time") {
+			if v<=0 {
+				return "-"
+			}
+			return time.Unix(int64(v),0).Format("2006-01-02 15:04:05")
+		}
+		return fmt.Sprintf("%d", int64(v))
+	case string:
+		if v=="" {
+			return "-"
+		}
+		return v
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,100 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// wcpush is a local push service stand-in, to test the web push notifications
+// of WebCall server without a browser and without a real push service.
+// It plays the part of a browser (it creates the subscription keys) and of its
+// push service (it receives, verifies and decrypts the push messages).
+// On startup it prints three subscriptions, which can be registered for a callee
+// via "/pushsubscribe":
+//   http://(listen)/push/1      answers 201 and prints the decrypted message
+//   http://(listen)/gone/1      answers 410 (the server will remove this subscription)
+//   http://(listen)/notfound/1  answers 404 (same)
+// The server must run with "webpushTestService = true" to accept these endpoints.
+// A message is only accepted with a valid VAPID signature; set -vapid to also
+// require the public key of the server (vapidPublicKey in config.ini).
+//
+// wcpush [-listen 127.0.0.1:8079] [-vapid key]
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mehrvarz/webcall/webpush"
+)
+
+var listen = flag.String("listen", "127.0.0.1:8079", "listen address")
+var vapidPublicKey = flag.String("vapid", "", "vapid public key of the webcall server")
+
+func main() {
+	flag.Parse()
+	ua,err := webpush.NewUserAgent()
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# wcpush keys err=%v\n", err)
+		os.Exit(1)
+	}
+	origin := "http://"+*listen
+	fmt.Printf("subscriptions:\n")
+	for _,path := range []string{"/push/1", "/gone/1", "/notfound/1"} {
+		fmt.Printf("%s\n", ua.Subscription(origin+path))
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method!="POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		sub,err := webpush.VerifyAuthorization(authorization, origin)
+		if err!=nil {
+			fmt.Printf("# %s %s vapid err=%v\n", time.Now().Format("15:04:05"), r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if *vapidPublicKey!="" && !strings.HasSuffix(authorization, "k="+*vapidPublicKey) {
+			fmt.Printf("# %s %s vapid key mismatch\n", time.Now().Format("15:04:05"), r.URL.Path)
+			http.Error(w, "vapid key mismatch", http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/gone/") {
+			fmt.Printf("%s %s gone (%s)\n", time.Now().Format("15:04:05"), r.URL.Path, sub)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/notfound/") {
+			fmt.Printf("%s %s not found (%s)\n", time.Now().Format("15:04:05"), r.URL.Path, sub)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Content-Encoding")!="aes128gcm" {
+			http.Error(w, "aes128gcm only", http.StatusUnsupportedMediaType)
+			return
+		}
+		body,err := ioutil.ReadAll(r.Body)
+		if err!=nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message,err := ua.Decrypt(body)
+		if err!=nil {
+			fmt.Printf("# %s %s decrypt err=%v\n", time.Now().Format("15:04:05"), r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("%s %s ttl=%s urgency=%s (%s) %s\n", time.Now().Format("15:04:05"), r.URL.Path,
+			r.Header.Get("TTL"), r.Header.Get("Urgency"), sub, message)
+		w.WriteHeader(http.StatusCreated)
+	})
+	fmt.Printf("listening on %s\n", *listen)
+	err = http.ListenAndServe(*listen, nil)
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# wcpush err=%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,139 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// wcsmtp is a local smtp sink, to test the email notifications of WebCall server
+// without a mail server. It accepts every message (and every AUTH PLAIN/LOGIN)
+// and prints it, with the quoted-printable body decoded. It does not offer STARTTLS,
+// so the server needs "smtpStartTLS = false" and, for AUTH, smtpHost = localhost.
+//
+// wcsmtp [-listen 127.0.0.1:2525]
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+var listen = flag.String("listen", "127.0.0.1:2525", "listen address")
+
+func main() {
+	flag.Parse()
+	ln,err := net.Listen("tcp", *listen)
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# wcsmtp err=%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("listening on %s\n", *listen)
+	for {
+		conn,err := ln.Accept()
+		if err!=nil {
+			fmt.Fprintf(os.Stderr, "# wcsmtp accept err=%v\n", err)
+			continue
+		}
+		go session(conn)
+	}
+}
+
+func session(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+	reply("220 wcsmtp ready")
+	from, to := "", []string{}
+	for {
+		line,err := r.ReadString('\n')
+		if err!=nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(line)
+		if idx := strings.Index(verb, " "); idx>=0 {
+			verb = verb[:idx]
+		}
+		switch verb {
+		case "EHLO":
+			reply("250-wcsmtp")
+			reply("250-AUTH PLAIN LOGIN")
+			reply("250 8BITMIME")
+		case "HELO", "NOOP":
+			reply("250 ok")
+		case "AUTH":
+			if strings.HasPrefix(strings.ToUpper(line), "AUTH LOGIN") {
+				// username and password; not checked
+				reply("334 VXNlcm5hbWU6")
+				r.ReadString('\n')
+				reply("334 UGFzc3dvcmQ6")
+				r.ReadString('\n')
+			}
+			reply("235 accepted")
+		case "MAIL":
+			from, to = strings.TrimSpace(line[10:]), []string{}
+			reply("250 ok")
+		case "RCPT":
+			to = append(to, strings.TrimSpace(line[8:]))
+			reply("250 ok")
+		case "RSET":
+			from, to = "", []string{}
+			reply("250 ok")
+		case "DATA":
+			reply("354 end with <CRLF>.<CRLF>")
+			var data bytes.Buffer
+			for {
+				dataLine,err := r.ReadString('\n')
+				if err!=nil {
+					return
+				}
+				if dataLine==".\r\n" || dataLine==".\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			printMessage(from, to, data.Bytes())
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func printMessage(from string, to []string, data []byte) {
+	fmt.Printf("--- %s from %s to %s\n", time.Now().Format("15:04:05"), from, strings.Join(to, ","))
+	msg,err := mail.ReadMessage(bytes.NewReader(data))
+	if err!=nil {
+		fmt.Printf("# wcsmtp message err=%v\n%s\n", err, data)
+		return
+	}
+	for _,key := range []string{"From", "To", "Subject", "Date"} {
+		value := msg.Header.Get(key)
+		if decoded,err := new(mime.WordDecoder).DecodeHeader(value); err==nil {
+			value = decoded
+		}
+		fmt.Printf("%s: %s\n", key, value)
+	}
+	var body []byte
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		body,err = ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	} else {
+		body,err = ioutil.ReadAll(msg.Body)
+	}
+	if err!=nil {
+		fmt.Printf("# wcsmtp body err=%v\n", err)
+	}
+	fmt.Printf("\n%s\n", strings.Replace(string(body), "\r\n", "\n", -1))
+}
@@ -0,0 +1,368 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// dbCmd() implements "webcall db ..." for offline maintenance of the
+// database files. The server must not be running (a db file can only
+// be opened by one process). Files are given by name (e.g. "rtcsig.db"),
+// relative to the dbPath config keyword, or by path (containing a '/').
+//
+// webcall db buckets (file)                    list buckets and number of keys
+// webcall db keys (file) (bucket) [prefix]     list keys
+// webcall db get (file) (bucket) (key)         print value as JSON
+// webcall db put (file) (bucket) (key) (json)  store JSON value ("-" = read from stdin)
+// webcall db delete (file) (bucket) (key)
+// webcall db check [file...]                   check db integrity (default: all db files)
+// webcall db export [outfile]                  export all db files as JSONL (see dbExport.go)
+// webcall db import [-replace] (infile|-)      import an export file
+// webcall db rekey [file...]                   rewrite all values with the active key (see dbCrypt.go)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/base64"
+	"gopkg.in/ini.v1"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+var dbFileNames = []string{dbMainName, dbCallsName, dbContactsName, dbNotifName, dbHashedPwName}
+
+// dbValueForBucket returns a pointer to a value of the type stored in bucketName
+// or nil if the bucket is unknown
+func dbValueForBucket(bucketName string) interface{} {
+	switch bucketName {
+	case dbRegisteredIDs, dbBlockedIDs:
+		return &DbEntry{}
+	case dbUserBucket:
+		return &DbUser{}
+	case dbWaitingCaller, dbMissedCalls:
+		return &[]CallerInfo{}
+	case dbContactsBucket:
+		return &map[string]string{}
+	case dbSentNotifTweets:
+		return &NotifTweet{}
+	case dbHashedPwBucket:
+		return &PwIdCombo{}
+	case dbSessionsBucket:
+		return &map[string]Session{}
+	case dbPushSubscriptions:
+		return &map[string]PushSubscription{}
+	case dbWebhooks:
+		return &map[string]Webhook{}
+	case dbWebhookQueue:
+		return &WebhookDelivery{}
+	case dbWebhookLog:
+		return &[]WebhookLogEntry{}
+	case dbEmailVerify:
+		return &EmailVerify{}
+	case dbEmailDigest:
+		return &EmailDigest{}
+	}
+	return nil
+}
+
+func dbCmdUsage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  webcall db buckets (file)\n")
+	fmt.Fprintf(os.Stderr, "  webcall db keys (file) (bucket) [prefix]\n")
+	fmt.Fprintf(os.Stderr, "  webcall db get (file) (bucket) (key)\n")
+	fmt.Fprintf(os.Stderr, "  webcall db put (file) (bucket) (key) (json|-)\n")
+	fmt.Fprintf(os.Stderr, "  webcall db delete (file) (bucket) (key)\n")
+	fmt.Fprintf(os.Stderr, "  webcall db check [file...]\n")
+	fmt.Fprintf(os.Stderr, "  webcall db export [outfile]\n")
+	fmt.Fprintf(os.Stderr, "  webcall db import [-replace] (infile|-)\n")
+	fmt.Fprintf(os.Stderr, "  webcall db rekey [file...]\n")
+	fmt.Fprintf(os.Stderr, "files: %s\n", strings.Join(dbFileNames, " "))
+}
+
+// dbCmd returns the exit code
+func dbCmd(args []string) int {
+	if len(args)<1 {
+		dbCmdUsage()
+		return 2
+	}
+	// values may be encrypted
+	err := loadDbKeys(dbCmdConfig("dbKeyFile",""))
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# db keys err=%v\n", err)
+		return 1
+	}
+	switch {
+	case args[0]=="buckets" && len(args)==2:
+		err = dbCmdBuckets(args[1])
+	case args[0]=="keys" && (len(args)==3 || len(args)==4):
+		prefix := ""
+		if len(args)==4 {
+			prefix = args[3]
+		}
+		err = dbCmdKeys(args[1], args[2], prefix)
+	case args[0]=="get" && len(args)==4:
+		err = dbCmdGet(args[1], args[2], args[3])
+	case args[0]=="put" && len(args)==5:
+		err = dbCmdPut(args[1], args[2], args[3], args[4])
+	case args[0]=="delete" && len(args)==4:
+		err = dbCmdDelete(args[1], args[2], args[3])
+	case args[0]=="check":
+		files := args[1:]
+		if len(files)==0 {
+			files = dbFileNames
+		}
+		err = dbCmdCheck(files)
+	case args[0]=="export" && len(args)<=2:
+		outFile := ""
+		if len(args)==2 {
+			outFile = args[1]
+		}
+		err = dbExport(outFile)
+	case args[0]=="import" && len(args)==2:
+		err = dbImport(args[1], false)
+	case args[0]=="import" && len(args)==3 && args[1]=="-replace":
+		err = dbImport(args[2], true)
+	case args[0]=="rekey":
+		files := args[1:]
+		if len(files)==0 {
+			files = dbFileNames
+		}
+		err = dbCmdRekey(files)
+	default:
+		dbCmdUsage()
+		return 2
+	}
+	if err!=nil {
+		fmt.Fprintf(os.Stderr, "# db %s err=%v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// dbCmdPath returns the path of a db file
+func dbCmdPath(fileName string) string {
+	if strings.Index(fileName,"/")>=0 {
+		return fileName
+	}
+	myDbPath := dbCmdConfig("dbPath","db/")
+	if !strings.HasSuffix(myDbPath,"/") { myDbPath = myDbPath+"/" }
+	return myDbPath + fileName
+}
+
+// dbCmdConfig reads a keyword from config.ini (without logging the config)
+func dbCmdConfig(key string, defaultValue string) string {
+	configIni, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true,},configFileName)
+	if err==nil {
+		cfgValue,ok := readIniEntry(configIni, key)
+		if ok && cfgValue!="" {
+			return cfgValue
+		}
+	}
+	return defaultValue
+}
+
+// dbCmdOpen opens an existing db file without the server's runtime setup
+func dbCmdOpen(fileName string, readOnly bool) (skv.SKV, error) {
+	path := dbCmdPath(fileName)
+	if _,err := os.Stat(path); err!=nil {
+		return skv.SKV{}, err
+	}
+	return dbCmdOpenPath(path, readOnly)
+}
+
+func dbCmdOpenPath(path string, readOnly bool) (skv.SKV, error) {
+	kv, err := skv.Open(path, readOnly)
+	if err==skv.ErrLocked {
+		return kv, errors.New(path+" is locked (is the server running?)")
+	}
+	return kv, err
+}
+
+func dbCmdBuckets(fileName string) error {
+	kv, err := dbCmdOpen(fileName, true)
+	if err!=nil {
+		return err
+	}
+	defer kv.Close()
+	bucketNames, err := kv.Buckets()
+	if err!=nil {
+		return err
+	}
+	for _,bucketName := range bucketNames {
+		keys, err := kv.Keys(bucketName, "")
+		if err!=nil {
+			return err
+		}
+		fmt.Printf("%-20s %d\n", bucketName, len(keys))
+	}
+	return nil
+}
+
+func dbCmdKeys(fileName string, bucketName string, prefix string) error {
+	kv, err := dbCmdOpen(fileName, true)
+	if err!=nil {
+		return err
+	}
+	defer kv.Close()
+	return kv.ForEachRaw(bucketName, prefix, func(k string, data []byte) error {
+		fmt.Printf("%s %d\n", k, len(data))
+		return nil
+	})
+}
+
+func dbCmdGet(fileName string, bucketName string, key string) error {
+	kv, err := dbCmdOpen(fileName, true)
+	if err!=nil {
+		return err
+	}
+	defer kv.Close()
+	value := dbValueForBucket(bucketName)
+	if value==nil {
+		// unknown type: print raw
+		data, err := kv.GetRaw(bucketName, key)
+		if err!=nil {
+			return err
+		}
+		fmt.Printf("%s\n", base64.StdEncoding.EncodeToString(data))
+		return nil
+	}
+	err = kv.Get(bucketName, key, value)
+	if err!=nil {
+		return err
+	}
+	jsonStr, err := json.MarshalIndent(value, "", "  ")
+	if err!=nil {
+		return err
+	}
+	fmt.Printf("%s\n", jsonStr)
+	return nil
+}
+
+func dbCmdPut(fileName string, bucketName string, key string, jsonArg string) error {
+	value := dbValueForBucket(bucketName)
+	if value==nil {
+		return errors.New("unknown value type for bucket "+bucketName)
+	}
+	jsonData := []byte(jsonArg)
+	if jsonArg=="-" {
+		var err error
+		jsonData, err = io.ReadAll(os.Stdin)
+		if err!=nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(value)
+	if err!=nil {
+		return err
+	}
+
+	kv, err := dbCmdOpen(fileName, false)
+	if err!=nil {
+		return err
+	}
+	defer kv.Close()
+	return kv.Put(bucketName, key, value, false)
+}
+
+func dbCmdDelete(fileName string, bucketName string, key string) error {
+	kv, err := dbCmdOpen(fileName, false)
+	if err!=nil {
+		return err
+	}
+	defer kv.Close()
+	return kv.Delete(bucketName, key)
+}
+
+// dbCmdCheck runs the db file consistency check, decodes every value of the known buckets
+// and checks that every registered ID has a userData entry
+func dbCmdCheck(fileNames []string) error {
+	problems := 0
+	for _,fileName := range fileNames {
+		kv, err := dbCmdOpen(fileName, true)
+		if err!=nil {
+			fmt.Printf("# %s open err=%v\n", fileName, err)
+			problems++
+			continue
+		}
+		for _,err := range kv.Check() {
+			fmt.Printf("# %s check: %v\n", fileName, err)
+			problems++
+		}
+		bucketNames, err := kv.Buckets()
+		if err!=nil {
+			fmt.Printf("# %s err=%v\n", fileName, err)
+			problems++
+		}
+		for _,bucketName := range bucketNames {
+			count := 0
+			err := kv.ForEachRaw(bucketName, "", func(k string, data []byte) error {
+				count++
+				value := dbValueForBucket(bucketName)
+				if value==nil {
+					return nil
+				}
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+				if err!=nil {
+					fmt.Printf("# %s %s key=%s decode err=%v\n", fileName, bucketName, k, err)
+					problems++
+					return nil
+				}
+				if bucketName==dbRegisteredIDs {
+					dbEntry := value.(*DbEntry)
+					userKey := fmt.Sprintf("%s_%d", k, dbEntry.StartTime)
+					if _,err := kv.GetRaw(dbUserBucket, userKey); err!=nil {
+						fmt.Printf("# %s %s key=%s no %s entry %s\n",
+							fileName, bucketName, k, dbUserBucket, userKey)
+						problems++
+					}
+				}
+				return nil
+			})
+			if err!=nil {
+				fmt.Printf("# %s %s err=%v\n", fileName, bucketName, err)
+				problems++
+			}
+			fmt.Printf("%s %s %d keys\n", fileName, bucketName, count)
+		}
+		kv.Close()
+	}
+	if problems>0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Printf("no problems found\n")
+	return nil
+}
+
+func dbCmdRekey(files []string) error {
+	if !skv.Encrypted() {
+		return errors.New("no keys configured (dbKeyFile or "+dbKeysEnv+")")
+	}
+	for _,fileName := range files {
+		kv, err := dbCmdOpen(fileName, false)
+		if err!=nil {
+			if os.IsNotExist(err) {
+				fmt.Printf("%s skipped: %v\n", fileName, err)
+				continue
+			}
+			return err
+		}
+		count, err := kv.Rekey()
+		if err==nil && count>0 {
+			// old values remain in the freed pages of the file until they are reused
+			err = kv.CompactTo(dbCmdPath(fileName)+".rekey")
+		}
+		kv.Close()
+		if err==nil && count>0 {
+			err = os.Rename(dbCmdPath(fileName)+".rekey", dbCmdPath(fileName))
+		}
+		if err!=nil {
+			return fmt.Errorf("%s %v", fileName, err)
+		}
+		fmt.Printf("%s %d values rewritten\n", fileName, count)
+	}
+	return nil
+}
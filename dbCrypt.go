@@ -0,0 +1,94 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Optional encryption of all stored values (see skv/crypt.go).
+// Keys are taken from the environment variable WEBCALL_DB_KEYS or,
+// if it is not set, from the file given by the dbKeyFile config keyword.
+// Both hold one key per line (in WEBCALL_DB_KEYS lines may also be
+// separated by comma): "id:base64key", where id is 1..255 and key
+// is 32 random bytes, e.g. created with:
+//   echo "1:$(head -c32 /dev/urandom | base64)" > dbkeys; chmod 600 dbkeys
+// The first key encrypts, all keys decrypt. Lines starting with '#' are ignored.
+// Without keys, values are stored unencrypted.
+//
+// Encrypting existing db files (one-time migration):
+//   add a key, stop the server, run "webcall db rekey", start the server
+// Rotating keys:
+//   1. add the new key as the first line (keep the old key below it), restart the server
+//      (new writes now use the new key, old values remain readable)
+//   2. stop the server, run "webcall db rekey" (rewrites all values with the new key
+//      and compacts the files, so no old values remain in freed pages)
+//   3. remove the old key, start the server
+// Make sure the keys are backed up: db files and backups cannot be read without them.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"errors"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"encoding/base64"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbKeysEnv = "WEBCALL_DB_KEYS"
+
+// parseDbKeys parses key lines; error messages never contain key material
+func parseDbKeys(text string, separators string) ([]skv.Key, error) {
+	var keys []skv.Key
+	lines := strings.FieldsFunc(text, func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	})
+	for i,line := range lines {
+		line = strings.TrimSpace(line)
+		if line=="" || strings.HasPrefix(line,"#") {
+			continue
+		}
+		idx := strings.Index(line,":")
+		if idx<=0 {
+			return nil, fmt.Errorf("key %d: expected id:base64key", i+1)
+		}
+		id, err := strconv.Atoi(line[:idx])
+		if err!=nil || id<1 || id>255 {
+			return nil, fmt.Errorf("key %d: id must be 1..255", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[idx+1:]))
+		if err!=nil {
+			return nil, fmt.Errorf("key id %d: not base64", id)
+		}
+		keys = append(keys, skv.Key{ID:byte(id), Key:key})
+	}
+	return keys, nil
+}
+
+// loadDbKeys enables encryption of db values, if keys are configured
+// it must be called before any db file is opened
+func loadDbKeys(keyFile string) error {
+	var keys []skv.Key
+	var err error
+	source := ""
+	if env := os.Getenv(dbKeysEnv); env!="" {
+		source = dbKeysEnv
+		keys, err = parseDbKeys(env, ",\n")
+	} else if keyFile!="" {
+		source = keyFile
+		var data []byte
+		data, err = ioutil.ReadFile(keyFile)
+		if err==nil {
+			keys, err = parseDbKeys(string(data), "\n")
+		}
+	}
+	if err!=nil {
+		return errors.New(source+" "+err.Error())
+	}
+	if source!="" && len(keys)==0 {
+		return errors.New(source+" contains no keys")
+	}
+	err = skv.SetKeys(keys)
+	if err!=nil {
+		return errors.New(source+" "+err.Error())
+	}
+	return nil
+}
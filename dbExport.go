@@ -0,0 +1,297 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// "webcall db export" and "webcall db import" move all server data
+// between hosts in a portable format. Like all "webcall db" commands,
+// they must be run while the server is stopped.
+//
+// The export format is JSONL (one JSON object per line).
+// The first line is a header:
+//   {"format":"webcall-export","version":1,"created":1650000000}
+// Every following line is one record:
+//   {"db":"rtcsig.db","bucket":"activeIDs","key":"12345678","value":{...}}
+// Records that expire (see skv PutWithExpiry()) carry "expires" (unix seconds).
+// "value" is the JSON representation of the stored Go value
+// (DbEntry, DbUser, []CallerInfo, map[string]string, NotifTweet,
+// PwIdCombo or map[string]Session, see dbValueForBucket()).
+// Records of unknown buckets carry the raw bytes in "raw" (base64) instead.
+//
+// Import reads and validates the complete file before anything is written.
+// In merge mode (default) imported records overwrite records with the same
+// key and all other records are kept. With -replace all buckets of the
+// db files are emptied first, so the db files will hold the exported data only.
+// Every db file is written in a single transaction.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"io"
+	"time"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/base64"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const dbExportFormat = "webcall-export"
+const dbExportVersion = 1
+
+// dbFileBuckets lists the buckets of every db file
+var dbFileBuckets = map[string][]string{
+	dbMainName: {dbRegisteredIDs, dbBlockedIDs, dbUserBucket},
+	dbCallsName: {dbWaitingCaller, dbMissedCalls},
+	dbContactsName: {dbContactsBucket},
+	dbNotifName: {dbSentNotifTweets, dbPushSubscriptions, dbWebhooks, dbWebhookQueue, dbWebhookLog,
+		dbEmailVerify, dbEmailDigest},
+	dbHashedPwName: {dbHashedPwBucket, dbSessionsBucket},
+}
+
+type DbExportHeader struct {
+	Format string `json:"format"`
+	Version int `json:"version"`
+	Created int64 `json:"created"`
+}
+
+type DbExportRecord struct {
+	Db string `json:"db"`
+	Bucket string `json:"bucket"`
+	Key string `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Raw string `json:"raw,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// dbExport writes all records of all db files to outFile ("" = stdout)
+func dbExport(outFile string) error {
+	out := os.Stdout
+	if outFile!="" && outFile!="-" {
+		var err error
+		out, err = os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err!=nil {
+			return err
+		}
+		defer out.Close()
+	}
+	writer := bufio.NewWriter(out)
+	enc := json.NewEncoder(writer)
+	err := enc.Encode(DbExportHeader{dbExportFormat, dbExportVersion, time.Now().Unix()})
+	if err!=nil {
+		return err
+	}
+	count := 0
+	for _,fileName := range dbFileNames {
+		kv, err := dbCmdOpen(fileName, true)
+		if err!=nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "export %s skipped: %v\n", fileName, err)
+				continue
+			}
+			return err
+		}
+		bucketNames, err := kv.Buckets()
+		if err!=nil {
+			kv.Close()
+			return fmt.Errorf("%s buckets err=%v", fileName, err)
+		}
+		for _,bucketName := range bucketNames {
+			if skv.IsInternalBucket(bucketName) {
+				continue
+			}
+			err = kv.ForEachRaw(bucketName, "", func(k string, data []byte) error {
+				record := DbExportRecord{Db:fileName, Bucket:bucketName, Key:k}
+				record.Expires = kv.Expiration(bucketName, k)
+				value := dbValueForBucket(bucketName)
+				if value==nil {
+					record.Raw = base64.StdEncoding.EncodeToString(data)
+				} else {
+					err := gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+					if err!=nil {
+						return fmt.Errorf("%s %s key=%s decode err=%v", fileName, bucketName, k, err)
+					}
+					record.Value, err = json.Marshal(value)
+					if err!=nil {
+						return err
+					}
+				}
+				count++
+				return enc.Encode(record)
+			})
+			if err!=nil {
+				break
+			}
+		}
+		kv.Close()
+		if err!=nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err!=nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records\n", count)
+	return nil
+}
+
+// dbImportValidate decodes the value of a record and checks it for plausibility
+// it returns the gob-encoded value to be stored
+func dbImportValidate(record *DbExportRecord) ([]byte, error) {
+	buckets,ok := dbFileBuckets[record.Db]
+	if !ok {
+		return nil, errors.New("unknown db "+record.Db)
+	}
+	if record.Key=="" {
+		return nil, errors.New("empty key")
+	}
+	value := dbValueForBucket(record.Bucket)
+	if value==nil {
+		// bucket unknown to this version of the server: store as is
+		if record.Raw=="" {
+			return nil, errors.New("unknown bucket "+record.Bucket+" without raw data")
+		}
+		return base64.StdEncoding.DecodeString(record.Raw)
+	}
+	knownBucket := false
+	for _,bucketName := range buckets {
+		if bucketName==record.Bucket {
+			knownBucket = true
+		}
+	}
+	if !knownBucket {
+		return nil, errors.New("bucket "+record.Bucket+" does not belong to "+record.Db)
+	}
+	if len(record.Value)==0 {
+		return nil, errors.New("no value")
+	}
+	dec := json.NewDecoder(bytes.NewReader(record.Value))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(value)
+	if err!=nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case *DbEntry:
+		if v.StartTime<=0 {
+			return nil, errors.New("DbEntry without StartTime")
+		}
+	case *DbUser:
+		// key = calleeID_startTime
+		idxUnderline := strings.LastIndex(record.Key,"_")
+		if idxUnderline<=0 {
+			return nil, errors.New("DbUser key without _startTime")
+		}
+		if _,err := strconv.ParseInt(record.Key[idxUnderline+1:], 10, 64); err!=nil {
+			return nil, errors.New("DbUser key with bad startTime")
+		}
+	case *PwIdCombo:
+		// key = cookie value = calleeID&token
+		if strings.Index(record.Key,"&")<=0 {
+			return nil, errors.New("PwIdCombo key is not a cookie value")
+		}
+		if v.CalleeId=="" {
+			return nil, errors.New("PwIdCombo without CalleeId")
+		}
+	case *map[string]Session:
+		for sid,session := range *v {
+			if sid!=sessionID(session.CookieValue) {
+				return nil, errors.New("session id does not match cookie value")
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(value)
+	if err!=nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dbImport reads an export file (or stdin for "-") and writes its records to the db files
+func dbImport(inFile string, replace bool) error {
+	var in io.Reader = os.Stdin
+	if inFile!="-" {
+		file, err := os.Open(inFile)
+		if err!=nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	scanner := bufio.NewScanner(in)
+	// a single record (e.g. a big contacts map) may be large
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	// header
+	if !scanner.Scan() {
+		if scanner.Err()!=nil {
+			return scanner.Err()
+		}
+		return errors.New("empty import file")
+	}
+	var header DbExportHeader
+	err := json.Unmarshal(scanner.Bytes(), &header)
+	if err!=nil || header.Format!=dbExportFormat {
+		return errors.New("not a webcall export file")
+	}
+	if header.Version!=dbExportVersion {
+		return fmt.Errorf("unsupported export version %d (want %d)", header.Version, dbExportVersion)
+	}
+
+	// read and validate all records before writing anything
+	entries := make(map[string][]skv.Record) // db file -> records
+	lineNumber := 1
+	problems := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line)==0 {
+			continue
+		}
+		var record DbExportRecord
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&record)
+		if err==nil {
+			var data []byte
+			data, err = dbImportValidate(&record)
+			if err==nil {
+				entries[record.Db] = append(entries[record.Db], skv.Record{Bucket:record.Bucket, Key:record.Key, Data:data, Expiration:record.Expires})
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "# line %d %s %s key=%s err=%v\n",
+			lineNumber, record.Db, record.Bucket, record.Key, err)
+		problems++
+	}
+	if scanner.Err()!=nil {
+		return scanner.Err()
+	}
+	if problems>0 {
+		return fmt.Errorf("%d invalid records, nothing imported", problems)
+	}
+
+	for _,fileName := range dbFileNames {
+		if !replace && len(entries[fileName])==0 {
+			continue
+		}
+		kv, err := dbCmdOpenPath(dbCmdPath(fileName), false)
+		if err!=nil {
+			return err
+		}
+		err = kv.Load(entries[fileName], dbFileBuckets[fileName], replace)
+		kv.Close()
+		if err!=nil {
+			return fmt.Errorf("%s %v", fileName, err)
+		}
+		fmt.Fprintf(os.Stderr, "imported %s %d records\n", fileName, len(entries[fileName]))
+	}
+	return nil
+}
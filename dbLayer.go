@@ -1,43 +1,136 @@
 // WebCall Copyright 2022 timur.mobi. All rights reserved.
-// By default dbLayer.go will forward all calls to skvLayer.go
-// In the future other db-layers may be implemented
+// dbLayer.go forwards all hub-registry calls to the HubRegistry selected
+// by the hubRegistry config keyword:
+// "local"  (default) online callees are only known to this process (skvLayer.go)
+// "shared" online callees are also stored in hubRegistryDir, a directory shared
+//          by all webcall processes (nodes) serving the same user base (sharedLayer.go)
+//          all nodes must use the db files of one node (dbServer, see dbRemote.go)
 package main
 
-func isLocalDb() bool {
-	return true
+import (
+	"fmt"
+	"os"
+	"errors"
+)
+
+// HubRegistry keeps track of the callees that are online.
+// The *Hub of a callee served by this process is always kept in the local hubMap.
+type HubRegistry interface {
+	// GetOnlineCallee returns the global calleeID (calleeID or calleeID!ext for multiCallees)
+	// plus the local hub (callee is served by this process)
+	// or a copy of the global hub (callee is served by another process; CalleeClient==nil)
+	GetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,*Hub,error)
+	// StoreCalleeInHubMap reserves the global calleeID for a callee logging in
+	// and returns it with the number of callees online
+	StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error)
+	SetUnHiddenForCaller(calleeId string, callerIp string) error
+	StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error
+	SetCalleeHiddenState(calleeId string, hidden bool) error
+	GetRandomCalleeID() (string,error)
+	SearchCallerIpInHubMap(ipAddr string) (bool,string,error)
+	// DeleteFromHubMap returns the number of local and global callees left
+	DeleteFromHubMap(globalID string) (int64,int64)
+	// Heartbeat is called every 10s (see ticker10sec)
+	Heartbeat()
+	Close()
+}
+
+var hubRegistry HubRegistry = localHubRegistry{}
+
+// openHubRegistry selects the hub registry; called once on startup
+// node must be unique among the nodes (default: hostname:wsPort)
+func openHubRegistry(kind string, dir string, node string, nodeTimeoutSecs int) (HubRegistry,error) {
+	switch kind {
+	case "", "local":
+		return localHubRegistry{}, nil
+	case "shared":
+		if dir=="" {
+			return nil, errors.New("hubRegistry=shared requires hubRegistryDir")
+		}
+		if dbID=="" {
+			// the nodes must share the users, not only the hub registry (see dbRemote.go)
+			return nil, errors.New("hubRegistry=shared requires dbServer or dbServerListen")
+		}
+		if node=="" {
+			hostname,_ := os.Hostname()
+			node = fmt.Sprintf("%s:%d",hostname,wsPort)
+		}
+		if nodeTimeoutSecs<=10 {
+			// must be well above the heartbeat interval
+			return nil, errors.New("hubRegistryNodeTimeout must be >10 secs")
+		}
+		return newSharedHubRegistry(dir, node, int64(nodeTimeoutSecs))
+	}
+	return nil, errors.New("unknown hubRegistry "+kind)
 }
 
 func GetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,*Hub,error) { // actual calleeID, hostingServerIp
+	return hubRegistry.GetOnlineCallee(calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
+		callerIpAddr, comment)
+}
+
+func StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
+	return hubRegistry.StoreCalleeInHubMap(key, multiCallees, remoteAddrWithPort, wsClientID, skipConfirm)
+}
+
+func SetUnHiddenForCaller(calleeId string, callerIp string) (error) {
+	return hubRegistry.SetUnHiddenForCaller(calleeId, callerIp)
+}
+
+func StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
+	return hubRegistry.StoreCallerIpInHubMap(calleeId, callerIp, skipConfirm)
+}
+
+func SetCalleeHiddenState(calleeId string, hidden bool) (error) {
+	return hubRegistry.SetCalleeHiddenState(calleeId, hidden)
+}
+
+func GetRandomCalleeID() (string,error) {
+	return hubRegistry.GetRandomCalleeID()
+}
+
+func SearchCallerIpInHubMap(ipAddr string) (bool,string,error) {
+	return hubRegistry.SearchCallerIpInHubMap(ipAddr)
+}
+
+func DeleteFromHubMap(globalID string) (int64,int64) {
+	return hubRegistry.DeleteFromHubMap(globalID)
+}
+
+// localHubRegistry: all online callees are served by this process
+type localHubRegistry struct {}
+
+func (localHubRegistry) GetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,*Hub,error) {
 	urlID, locHub, err := locGetOnlineCallee(calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
 		callerIpAddr, comment)
 	return urlID, locHub, nil, err
 }
 
-func StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
+func (localHubRegistry) StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
 	return locStoreCalleeInHubMap(key, nil, multiCallees, remoteAddrWithPort, wsClientID, skipConfirm)
 }
 
-func SetUnHiddenForCaller(calleeId string, callerIp string) (error) {
+func (localHubRegistry) SetUnHiddenForCaller(calleeId string, callerIp string) error {
 	return locSetUnHiddenForCaller(calleeId, callerIp)
 }
 
-func StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
+func (localHubRegistry) StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
 	return locStoreCallerIpInHubMap(calleeId, callerIp, skipConfirm)
 }
 
-func SetCalleeHiddenState(calleeId string, hidden bool) (error) {
+func (localHubRegistry) SetCalleeHiddenState(calleeId string, hidden bool) error {
 	return locSetCalleeHiddenState(calleeId, hidden)
 }
 
-func GetRandomCalleeID() (string,error) {
+func (localHubRegistry) GetRandomCalleeID() (string,error) {
 	return locGetRandomCalleeID()
 }
 
-func SearchCallerIpInHubMap(ipAddr string) (bool,string,error) {
+func (localHubRegistry) SearchCallerIpInHubMap(ipAddr string) (bool,string,error) {
 	return locSearchCallerIpInHubMap(ipAddr)
 }
 
-func DeleteFromHubMap(globalID string) (int64,int64) {
+func (localHubRegistry) DeleteFromHubMap(globalID string) (int64,int64) {
 	hublen,err := locDeleteFromHubMap(globalID)
 	if err!=nil {
 		return int64(0),int64(0)
@@ -45,3 +138,8 @@ func DeleteFromHubMap(globalID string) (int64,int64) {
 	return hublen,int64(0)
 }
 
+func (localHubRegistry) Heartbeat() {
+}
+
+func (localHubRegistry) Close() {
+}
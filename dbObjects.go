@@ -4,7 +4,7 @@ package main
 type DbEntry struct {
 	StartTime int64
 	Ip string
-	Password string
+	Password string // pw-hash, see hashPw(); plaintext if stored by an older server version
 }
 
 type DbUser struct {
@@ -26,6 +26,13 @@ type DbUser struct {
 	RemoteP2pCounter int    // incremented by wsHub processTimeValues()
 	StoreContacts bool      // TODO could also be encoded in Int2
 	StoreMissedCalls bool	// TODO could also be encoded in Int2
+	ServiceEndTime int64    // set by admin (service days); 0 = unlimited
+	ForwardOffline string   // callee ID or link (see callForward.go)
+	ForwardBusy string
+	ForwardNoAnswer string
+	Email string            // verified address for email notifications (see emailNotify.go)
+	EmailPending string     // address waiting for verification
+	EmailMissedCalls int    // emailMissedCallsOff, emailMissedCallsEach or emailMissedCallsDigest
 }
 
 type NotifTweet struct { // key = TweetID string
@@ -0,0 +1,89 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// dbRemote.go lets several webcall processes (nodes) use the same db files,
+// so that accounts, passwords, sessions, missed calls and contacts are shared.
+// A bbolt file can only be opened by one process: the node configured with
+//   dbServerListen = 10.0.0.1:8090
+// opens the files and serves them to the other nodes, which are configured with
+//   dbServer = 10.0.0.1:8090
+// instead of opening the files themselves (see skv/remote.go).
+// All nodes need the same dbServerSecret and the same db keys (dbKeyFile).
+// Sweeping expired entries, backups and the jobs that work through all
+// accounts only run on the node serving the files (see isLocalDb()).
+package main
+
+import (
+	"fmt"
+	"net"
+	"errors"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+var dbClient *skv.Client
+var dbID = "" // identifies the db files used by this node (see sharedLayer.go)
+
+// dbConnect connects to dbServer; called on startup before any db is opened
+func dbConnect() error {
+	if dbServer=="" {
+		return nil
+	}
+	if dbServerListen!="" {
+		return errors.New("dbServer and dbServerListen are mutually exclusive")
+	}
+	if dbServerSecret=="" {
+		return errors.New("dbServer requires dbServerSecret")
+	}
+	var err error
+	dbClient,err = skv.Dial(dbServer, dbServerSecret)
+	if err!=nil {
+		return err
+	}
+	dbID,err = dbClient.ServerID()
+	if err!=nil {
+		return err
+	}
+	fmt.Printf("db served by %s (%s)\n", dbServer, dbID)
+	return nil
+}
+
+// dbOpen opens a db file or, with dbServer, the same db on the db server
+func dbOpen(dbName string) (skv.KV,error) {
+	if dbClient!=nil {
+		return dbClient.Open(dbName)
+	}
+	return skv.DbOpen(dbName,dbPath)
+}
+
+// dbServe serves our db files to the other nodes; called after all db files are open
+func dbServe() error {
+	if dbServerListen=="" {
+		return nil
+	}
+	if dbServerSecret=="" {
+		return errors.New("dbServerListen requires dbServerSecret")
+	}
+	stores := make(map[string]skv.SKV)
+	for _,dbName := range dbFileNames {
+		kv,ok := kvByDbName(dbName).(skv.SKV)
+		if !ok {
+			return errors.New("cannot serve db "+dbName)
+		}
+		stores[dbName] = kv
+	}
+	ln,err := net.Listen("tcp", dbServerListen)
+	if err!=nil {
+		return err
+	}
+	dbID = skv.ServerID(ln)
+	server := skv.NewRemoteServer(dbID, stores)
+	go func() {
+		err := server.Serve(ln, dbServerSecret)
+		fmt.Printf("# dbServe %s err=%v\n", dbServerListen, err)
+	}()
+	fmt.Printf("db served on %s (%s)\n", dbServerListen, dbID)
+	return nil
+}
+
+// isLocalDb tells if the db files are opened by this process (not by a dbServer)
+func isLocalDb() bool {
+	return dbClient==nil
+}
@@ -0,0 +1,471 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Email notifications via SMTP (config.ini):
+//   smtpHost = mail.example.com   (empty = no emails)
+//   smtpPort = 587
+//   smtpStartTLS = true           (the server must then offer STARTTLS)
+//   smtpUser = ...                (empty = no AUTH)
+//   smtpPassword = ...
+//   smtpFrom = webcall@example.com  (default: adminEmail)
+//   emailDigestMins = 60          (how long missed calls are collected for a digest)
+// A callee sets its address via /setsettings "email". The address is only used
+// after the callee has opened the link of the verification email (/emailverify).
+// /setsettings "emailMissedCalls" = "off", "each" (one email per missed call) or
+// "digest" (one email with all missed calls of emailDigestMins; see emailDigestFlush()).
+// Only calls stored by addMissedCall() are reported (dbUser.StoreMissedCalls).
+// Links in emails are built from wssUrl, wsUrl or hostname (see emailBaseUrl()).
+// Submissions to /message are forwarded to adminEmail (rate limited, see emailAdminMessage()).
+// For testing, cmd/wcsmtp is a local smtp sink (use smtpStartTLS = false).
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"net/smtp"
+	"time"
+	"strings"
+	"fmt"
+	"sync"
+	"bytes"
+	"mime"
+	"mime/quotedprintable"
+	"errors"
+	"crypto/tls"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+var errEmailVerifyInvalid = errors.New("invalid email verification")
+
+const (
+	emailMissedCallsOff = 0
+	emailMissedCallsEach = 1
+	emailMissedCallsDigest = 2
+)
+
+// a verification link is valid this long
+const emailVerifyTTL = 24 * time.Hour
+
+// a callee cannot request verification emails more often than this
+const emailVerifyPause = 10 * time.Minute
+
+// /message needs no login: one message per client ip per emailMessagePause,
+// and no more than emailMessageMaxPerHour messages from all clients
+const emailMessagePause = 10 * time.Minute
+const emailMessageMaxPerHour = 20
+
+const smtpTimeout = 30 * time.Second
+
+type EmailVerify struct {
+	CalleeID string
+	Email string
+}
+
+// missed calls collected for the next digest email
+type EmailDigest struct {
+	First int64 // time of the first missed call
+	Calls []CallerInfo
+}
+
+var emailVerifySentMap = make(map[string]time.Time) // calleeID -> time of the last verification email
+var emailVerifySentMutex sync.Mutex
+var emailDigestMutex sync.Mutex
+var emailMessageSentMap = make(map[string]time.Time) // client ip -> time of the last /message email
+var emailMessageSentTimes []time.Time // /message emails of the last hour
+var emailMessageSentMutex sync.Mutex
+
+var emailMissedCallsNames = []string{"off", "each", "digest"}
+
+func emailMissedCallsName(mode int) string {
+	if mode<0 || mode>=len(emailMissedCallsNames) {
+		return emailMissedCallsNames[emailMissedCallsOff]
+	}
+	return emailMissedCallsNames[mode]
+}
+
+// emailConfigured tells if smtpHost and a sender address are set
+func emailConfigured() bool {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return smtpHost!="" && (smtpFrom!="" || adminEmail!="")
+}
+
+// emailHeader removes line breaks (header injection) from a header value
+func emailHeader(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// emailSend sends a plain text email to one recipient
+func emailSend(to string, subject string, body string) error {
+	readConfigLock.RLock()
+	host := smtpHost
+	port := smtpPort
+	startTLS := smtpStartTLS
+	user := smtpUser
+	password := smtpPassword
+	from := smtpFrom
+	if from=="" {
+		from = adminEmail
+	}
+	skipVerify := insecureSkipVerify
+	readConfigLock.RUnlock()
+	if host=="" || from=="" {
+		return fmt.Errorf("smtp not configured")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", emailHeader(from))
+	fmt.Fprintf(&msg, "To: %s\r\n", emailHeader(to))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", emailHeader(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%d.%s>\r\n", time.Now().UnixNano(), emailHeader(from))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+
+	addr := net.JoinHostPort(host, fmt.Sprintf("%d",port))
+	conn,err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err!=nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c,err := smtp.NewClient(conn, host)
+	if err!=nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err = c.Hello(hostname); err!=nil {
+		return err
+	}
+	if startTLS {
+		if ok,_ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", addr)
+		}
+		if err = c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: skipVerify}); err!=nil {
+			return err
+		}
+	}
+	if user!="" {
+		// PlainAuth refuses to send the password over an unencrypted connection (except to localhost)
+		if err = c.Auth(smtp.PlainAuth("", user, password, host)); err!=nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err!=nil {
+		return err
+	}
+	if err = c.Rcpt(to); err!=nil {
+		return err
+	}
+	w,err := c.Data()
+	if err!=nil {
+		return err
+	}
+	if _,err = w.Write(msg.Bytes()); err!=nil {
+		return err
+	}
+	if err = w.Close(); err!=nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// emailCheckAddress returns the plain address of a user supplied email address
+func emailCheckAddress(address string) (string,error) {
+	a,err := mail.ParseAddress(address)
+	if err!=nil {
+		return "",err
+	}
+	if strings.ContainsAny(a.Address, "\r\n ") || strings.Index(a.Address,"@")<1 {
+		return "",fmt.Errorf("bad address")
+	}
+	return a.Address,nil
+}
+
+// emailBaseUrl returns the public server url for links in emails;
+// taken from the config (wssUrl, wsUrl, hostname), never from the Host header of a request
+func emailBaseUrl() string {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	if wssUrl!="" {
+		if u,err := url.Parse(wssUrl); err==nil && u.Host!="" {
+			return "https://"+u.Host
+		}
+	}
+	if httpsPort>0 {
+		return fmt.Sprintf("https://%s:%d", hostname, httpsPort)
+	}
+	if wsUrl!="" {
+		if u,err := url.Parse(wsUrl); err==nil && u.Host!="" {
+			return "http://"+u.Host
+		}
+	}
+	return fmt.Sprintf("http://%s:%d", hostname, httpPort)
+}
+
+// emailStartVerify sends the verification link for address to the callee
+func emailStartVerify(calleeID string, address string, baseUrl string) error {
+	emailVerifySentMutex.Lock()
+	lastSent,ok := emailVerifySentMap[calleeID]
+	if ok && time.Since(lastSent) < emailVerifyPause {
+		emailVerifySentMutex.Unlock()
+		return fmt.Errorf("verification email was sent %v ago", time.Since(lastSent).Truncate(time.Second))
+	}
+	emailVerifySentMap[calleeID] = time.Now()
+	for id,sent := range emailVerifySentMap {
+		if time.Since(sent) >= emailVerifyPause {
+			delete(emailVerifySentMap,id)
+		}
+	}
+	emailVerifySentMutex.Unlock()
+
+	token,err := newSessionToken()
+	if err!=nil {
+		return err
+	}
+	err = kvNotif.PutWithExpiry(dbEmailVerify, token, EmailVerify{calleeID, address},
+		time.Now().Add(emailVerifyTTL))
+	if err!=nil {
+		return err
+	}
+	link := baseUrl+"/rtcsig/emailverify?token="+token
+	go func() {
+		err := emailSend(address, "WebCall: please verify your email address",
+			"Please open this link to receive WebCall notifications for "+calleeID+" at this address:\n\n"+
+			link+"\n\nThe link is valid for 24 hours. If you did not ask for this, ignore this email.\n")
+		if err!=nil {
+			fmt.Printf("# emailStartVerify (%s) send err=%v\n", calleeID, err)
+		}
+	}()
+	return nil
+}
+
+// httpEmailVerify is the target of the verification link; no cookie is needed
+func httpEmailVerify(w http.ResponseWriter, r *http.Request, remoteAddr string) {
+	token := r.URL.Query().Get("token")
+	var emailVerify EmailVerify
+	if token=="" || kvNotif.Get(dbEmailVerify,token,&emailVerify)!=nil {
+		fmt.Printf("# /emailverify unknown token %s\n", remoteAddr)
+		fmt.Fprintf(w,"This link is not valid (anymore).\n")
+		return
+	}
+	kvNotif.Delete(dbEmailVerify,token)
+
+	// the user may be changed by a concurrent request (eg. /setsettings)
+	var email string
+	err := kvMain.Update(func(tx skv.Tx) error {
+		var dbEntry DbEntry
+		err := tx.Get(dbRegisteredIDs,emailVerify.CalleeID,&dbEntry)
+		if err!=nil {
+			return errEmailVerifyInvalid
+		}
+		dbUserKey := fmt.Sprintf("%s_%d",emailVerify.CalleeID, dbEntry.StartTime)
+		var dbUser DbUser
+		err = tx.Get(dbUserBucket, dbUserKey, &dbUser)
+		if err!=nil || dbUser.EmailPending!=emailVerify.Email {
+			// the callee has changed the address in the meantime
+			return errEmailVerifyInvalid
+		}
+		dbUser.Email = dbUser.EmailPending
+		dbUser.EmailPending = ""
+		email = dbUser.Email
+		return tx.Put(dbUserBucket, dbUserKey, dbUser)
+	})
+	if err==errEmailVerifyInvalid {
+		fmt.Printf("# /emailverify (%s) unregistered or address changed %s\n", emailVerify.CalleeID, remoteAddr)
+		fmt.Fprintf(w,"This link is not valid (anymore).\n")
+		return
+	}
+	if err!=nil {
+		fmt.Printf("# /emailverify (%s) store db=%s bucket=%s %s err=%v\n",
+			emailVerify.CalleeID, dbMainName, dbUserBucket, remoteAddr, err)
+		fmt.Fprintf(w,"Sorry, something went wrong. Please try again later.\n")
+		return
+	}
+	fmt.Printf("/emailverify (%s) verified %s\n", emailVerify.CalleeID, remoteAddr)
+	fmt.Fprintf(w,"Your email address %s is now verified.\n", email)
+}
+
+// emailMissedCall is called by addMissedCall()
+func emailMissedCall(calleeID string, caller CallerInfo) {
+	if !emailConfigured() {
+		return
+	}
+	var dbEntry DbEntry
+	err := kvMain.Get(dbRegisteredIDs,calleeID,&dbEntry)
+	if err!=nil {
+		return
+	}
+	var dbUser DbUser
+	err = kvMain.Get(dbUserBucket, fmt.Sprintf("%s_%d",calleeID, dbEntry.StartTime), &dbUser)
+	if err!=nil || dbUser.Email=="" || dbUser.EmailMissedCalls==emailMissedCallsOff {
+		return
+	}
+	// CallTime of some missed calls is not a unix time (see missedCall())
+	caller.CallTime = time.Now().Unix()
+
+	if dbUser.EmailMissedCalls==emailMissedCallsEach {
+		err = emailSend(dbUser.Email, "WebCall: missed call from "+emailCallerName(caller),
+			"You have missed a call on "+calleeID+":\n\n"+emailCallerLine(caller))
+		if err!=nil {
+			fmt.Printf("# emailMissedCall (%s) send err=%v\n", calleeID, err)
+		} else if logWantedFor("email") {
+			fmt.Printf("emailMissedCall (%s) sent\n", calleeID)
+		}
+		return
+	}
+
+	emailDigestMutex.Lock()
+	defer emailDigestMutex.Unlock()
+	var emailDigest EmailDigest
+	err = kvNotif.Get(dbEmailDigest,calleeID,&emailDigest)
+	if err!=nil || len(emailDigest.Calls)==0 {
+		emailDigest = EmailDigest{caller.CallTime, nil}
+	}
+	emailDigest.Calls = append(emailDigest.Calls, caller)
+	err = kvNotif.Put(dbEmailDigest, calleeID, emailDigest, false)
+	if err!=nil {
+		fmt.Printf("# emailMissedCall (%s) db=%s bucket=%s err=%v\n", calleeID, dbNotifName, dbEmailDigest, err)
+	}
+}
+
+func emailCallerName(caller CallerInfo) string {
+	if caller.CallerName!="" {
+		return caller.CallerName
+	}
+	if caller.CallerID!="" {
+		return caller.CallerID
+	}
+	return "unknown caller"
+}
+
+func emailCallerLine(caller CallerInfo) string {
+	line := time.Unix(caller.CallTime,0).Format("2006-01-02 15:04")+"  "+emailCallerName(caller)
+	if caller.CallerID!="" && caller.CallerName!="" {
+		line += " ("+caller.CallerID+")"
+	}
+	if caller.Msg!="" {
+		line += "\n  "+caller.Msg
+	}
+	return line+"\n"
+}
+
+// emailDigestFlush sends the digests that have been collected for emailDigestMins (see ticker3min)
+func emailDigestFlush() {
+	if !emailConfigured() {
+		return
+	}
+	readConfigLock.RLock()
+	digestSecs := int64(emailDigestMins)*60
+	readConfigLock.RUnlock()
+	now := time.Now().Unix()
+
+	emailDigestMutex.Lock()
+	dueMap := make(map[string]EmailDigest)
+	keys,err := kvNotif.Keys(dbEmailDigest, "")
+	if err!=nil {
+		fmt.Printf("# emailDigestFlush db=%s bucket=%s err=%v\n", dbNotifName, dbEmailDigest, err)
+	}
+	for _,calleeID := range keys {
+		var emailDigest EmailDigest
+		if kvNotif.Get(dbEmailDigest,calleeID,&emailDigest)!=nil || len(emailDigest.Calls)==0 {
+			kvNotif.Delete(dbEmailDigest,calleeID)
+			continue
+		}
+		if now-emailDigest.First < digestSecs {
+			continue
+		}
+		dueMap[calleeID] = emailDigest
+	}
+	emailDigestMutex.Unlock()
+
+	for calleeID,emailDigest := range dueMap {
+		// the callee may have changed its settings since the calls were collected
+		var dbEntry DbEntry
+		if kvMain.Get(dbRegisteredIDs,calleeID,&dbEntry)!=nil {
+			emailDigestRemove(calleeID, len(emailDigest.Calls))
+			continue
+		}
+		var dbUser DbUser
+		err = kvMain.Get(dbUserBucket, fmt.Sprintf("%s_%d",calleeID, dbEntry.StartTime), &dbUser)
+		if err!=nil || dbUser.Email=="" || dbUser.EmailMissedCalls==emailMissedCallsOff {
+			emailDigestRemove(calleeID, len(emailDigest.Calls))
+			continue
+		}
+		var body strings.Builder
+		fmt.Fprintf(&body, "You have missed %d calls on %s:\n\n", len(emailDigest.Calls), calleeID)
+		for _,caller := range emailDigest.Calls {
+			body.WriteString(emailCallerLine(caller))
+		}
+		err = emailSend(dbUser.Email, fmt.Sprintf("WebCall: %d missed calls", len(emailDigest.Calls)), body.String())
+		if err!=nil {
+			// the digest stays, to be sent on the next flush
+			fmt.Printf("# emailDigestFlush (%s) send err=%v\n", calleeID, err)
+			continue
+		}
+		if logWantedFor("email") {
+			fmt.Printf("emailDigestFlush (%s) sent %d calls\n", calleeID, len(emailDigest.Calls))
+		}
+		emailDigestRemove(calleeID, len(emailDigest.Calls))
+	}
+}
+
+// emailDigestRemove removes the first count calls of a digest;
+// calls added while the digest was being sent are kept for the next one
+func emailDigestRemove(calleeID string, count int) {
+	emailDigestMutex.Lock()
+	defer emailDigestMutex.Unlock()
+	var emailDigest EmailDigest
+	err := kvNotif.Get(dbEmailDigest,calleeID,&emailDigest)
+	if err!=nil || count>=len(emailDigest.Calls) {
+		kvNotif.Delete(dbEmailDigest,calleeID)
+		return
+	}
+	emailDigest.Calls = emailDigest.Calls[count:]
+	emailDigest.First = emailDigest.Calls[0].CallTime
+	err = kvNotif.Put(dbEmailDigest, calleeID, emailDigest, false)
+	if err!=nil {
+		fmt.Printf("# emailDigestRemove (%s) db=%s bucket=%s err=%v\n", calleeID, dbNotifName, dbEmailDigest, err)
+	}
+}
+
+// emailAdminMessage forwards a /message submission to adminEmail
+func emailAdminMessage(message string, remoteAddr string) {
+	readConfigLock.RLock()
+	to := adminEmail
+	readConfigLock.RUnlock()
+	if to=="" || !emailConfigured() {
+		return
+	}
+	emailMessageSentMutex.Lock()
+	for ip,sent := range emailMessageSentMap {
+		if time.Since(sent) >= emailMessagePause {
+			delete(emailMessageSentMap,ip)
+		}
+	}
+	for len(emailMessageSentTimes)>0 && time.Since(emailMessageSentTimes[0]) >= time.Hour {
+		emailMessageSentTimes = emailMessageSentTimes[1:]
+	}
+	_,ok := emailMessageSentMap[remoteAddr]
+	if ok || len(emailMessageSentTimes) >= emailMessageMaxPerHour {
+		emailMessageSentMutex.Unlock()
+		fmt.Printf("# emailAdminMessage rate limit (last hour %d) %s\n", len(emailMessageSentTimes), remoteAddr)
+		return
+	}
+	emailMessageSentMap[remoteAddr] = time.Now()
+	emailMessageSentTimes = append(emailMessageSentTimes, time.Now())
+	emailMessageSentMutex.Unlock()
+
+	go func() {
+		err := emailSend(to, "WebCall message", "Message from "+remoteAddr+":\n\n"+message+"\n")
+		if err!=nil {
+			fmt.Printf("# emailAdminMessage send err=%v\n", err)
+		}
+	}()
+}
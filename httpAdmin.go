@@ -6,14 +6,10 @@ import (
 	"fmt"
 	"time"
 	"strconv"
-	"errors"
-	"bytes"
-	"encoding/gob"
 	"github.com/mehrvarz/webcall/skv"
-	bolt "go.etcd.io/bbolt"
 )
 
-func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath string, urlID string, remoteAddr string) bool {
+func httpAdmin(kv skv.KV, w http.ResponseWriter, r *http.Request, urlPath string, urlID string, remoteAddr string) bool {
 	printFunc := func(w http.ResponseWriter, format string, a ...interface{}) {
 		// printFunc writes to the console AND to the localhost http client
 		fmt.Printf(format, a...)
@@ -23,36 +19,27 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 	if urlPath=="/dumpuser" {
 		bucketName := dbUserBucket
 		printFunc(w,"/dumpuser dbName=%s bucketName=%s\n", dbMainName, bucketName)
-		db := kv.Db
 		nowTimeUnix := time.Now().Unix()
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			if b==nil {
-				return errors.New("read bucket error "+bucketName)
+		err := kv.ForEach(bucketName, "", func(k string, decode skv.Decoder) error {
+			var dbUser DbUser
+			decode(&dbUser)
+			lastActivity := dbUser.LastLogoffTime;
+			if dbUser.LastLoginTime > dbUser.LastLogoffTime {
+				lastActivity = dbUser.LastLoginTime
 			}
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				var dbUser DbUser
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbUser)
-				lastActivity := dbUser.LastLogoffTime;
-				if dbUser.LastLoginTime > dbUser.LastLogoffTime {
-					lastActivity = dbUser.LastLoginTime
-				}
-				secsSinceLastActivity := "-"
-				if lastActivity > 0 {
-					secsSinceLastActivity = fmt.Sprintf("%d",nowTimeUnix-lastActivity)
-				}
-				fmt.Fprintf(w, "user %22s calls=%4d p2p=%4d/%4d talk=%6d %d %s %s %s\n",
-					k,
-					dbUser.CallCounter,
-					dbUser.LocalP2pCounter, dbUser.RemoteP2pCounter,
-					dbUser.ConnectedToPeerSecs,
-					dbUser.Int2,
-					time.Unix(dbUser.LastLoginTime,0).Format("2006-01-02 15:04:05"),
-					time.Unix(dbUser.LastLogoffTime,0).Format("2006-01-02 15:04:05"),
-					secsSinceLastActivity)
+			secsSinceLastActivity := "-"
+			if lastActivity > 0 {
+				secsSinceLastActivity = fmt.Sprintf("%d",nowTimeUnix-lastActivity)
 			}
+			fmt.Fprintf(w, "user %22s calls=%4d p2p=%4d/%4d talk=%6d %d %s %s %s\n",
+				k,
+				dbUser.CallCounter,
+				dbUser.LocalP2pCounter, dbUser.RemoteP2pCounter,
+				dbUser.ConnectedToPeerSecs,
+				dbUser.Int2,
+				time.Unix(dbUser.LastLoginTime,0).Format("2006-01-02 15:04:05"),
+				time.Unix(dbUser.LastLogoffTime,0).Format("2006-01-02 15:04:05"),
+				secsSinceLastActivity)
 			return nil
 		})
 		if err!=nil {
@@ -67,17 +54,11 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		// show the list of callee-IDs that have been registered and are not yet outdated
 		bucketName := dbRegisteredIDs
 		printFunc(w,"/dumpregistered dbName=%s bucketName=%s\n", dbMainName, bucketName)
-		db := kv.Db
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			c := b.Cursor()
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				var dbEntry DbEntry
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
-				fmt.Fprintf(w,"registered id=%s %d=%s\n",
-					k, dbEntry.StartTime, time.Unix(dbEntry.StartTime,0).Format("2006-01-02 15:04:05"))
-			}
+		err := kv.ForEach(bucketName, "", func(k string, decode skv.Decoder) error {
+			var dbEntry DbEntry
+			decode(&dbEntry)
+			fmt.Fprintf(w,"registered id=%s %d=%s\n",
+				k, dbEntry.StartTime, time.Unix(dbEntry.StartTime,0).Format("2006-01-02 15:04:05"))
 			return nil
 		})
 		if err!=nil {
@@ -92,18 +73,12 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		// show the list of callee-IDs that are blocked (for various reasons)
 		bucketName := dbBlockedIDs
 		printFunc(w,"/dumpblocked dbName=%s bucketName=%s\n", dbMainName, bucketName)
-		db := kv.Db
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			c := b.Cursor()
-			for id, v := c.First(); id != nil; id, v = c.Next() {
-				var dbEntry DbEntry
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
-				starttime := time.Unix(dbEntry.StartTime,0)
-				fmt.Fprintf(w,"blocked id=%s start=%d=%s rip=%s\n",
-					id, dbEntry.StartTime, starttime.Format("2006-01-02 15:04:05"), dbEntry.Ip)
-			}
+		err := kv.ForEach(bucketName, "", func(id string, decode skv.Decoder) error {
+			var dbEntry DbEntry
+			decode(&dbEntry)
+			starttime := time.Unix(dbEntry.StartTime,0)
+			fmt.Fprintf(w,"blocked id=%s start=%d=%s rip=%s\n",
+				id, dbEntry.StartTime, starttime.Format("2006-01-02 15:04:05"), dbEntry.Ip)
 			return nil
 		})
 		if err!=nil {
@@ -124,7 +99,7 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		urlTime := url_arg_array[0]
 		urlTimei64, err := strconv.ParseInt(urlTime, 10, 64)
 		if err!=nil {
-			printFunc(w,"# /deluserid error converting arg 'time'=%d to int64 %v\n",urlTime,err)
+			printFunc(w,"# /deluserid error converting arg 'time'=%s to int64 %v\n",urlTime,err)
 			return true
 		}
 		userKey := fmt.Sprintf("%s_%d",urlID, urlTimei64)
@@ -251,24 +226,28 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 		urlPw := url_arg_array[0]
 
 		fmt.Printf("/makeregistered dbName=%s\n", dbMainName)
+		hashedPw,err := hashPw(urlPw)
+		if err!=nil {
+			printFunc(w,"# /makeregistered hashPw err=%v\n", err)
+			return true
+		}
 
 		unixTime := time.Now().Unix()
 		dbUserKey := fmt.Sprintf("%s_%d",urlID, unixTime)
 		dbUser := DbUser{Ip1:remoteAddr}
-		err = kv.Put(dbUserBucket, dbUserKey, dbUser, false)
-		if err!=nil {
-			printFunc(w,"# /makeregistered error db=%s bucket=%s put key=%s err=%v\n",
-				dbMainName,dbUserBucket,urlID,err)
-		} else {
-			err = kv.Put(dbRegisteredIDs, urlID,
-				DbEntry{unixTime, remoteAddr, urlPw}, false)
+		err = kv.Update(func(tx skv.Tx) error {
+			err := tx.Put(dbUserBucket, dbUserKey, dbUser)
 			if err!=nil {
-				printFunc(w,"# /makeregistered error db=%s bucket=%s put key=%s err=%v\n",
-					dbMainName,dbRegisteredIDs,urlID,err)
-			} else {
-				printFunc(w,"/makeregistered db=%s bucket=%s new id=%s created\n",
-					dbMainName,dbRegisteredIDs,urlID)
+				return err
 			}
+			return tx.Put(dbRegisteredIDs, urlID, DbEntry{unixTime, remoteAddr, hashedPw})
+		})
+		if err!=nil {
+			printFunc(w,"# /makeregistered error db=%s put key=%s err=%v\n",
+				dbMainName,urlID,err)
+		} else {
+			printFunc(w,"/makeregistered db=%s bucket=%s new id=%s created\n",
+				dbMainName,dbRegisteredIDs,urlID)
 		}
 		if err!=nil {
 			printFunc(w,"# /makeregistered id=%s err=%v\n", urlID, err)
@@ -335,15 +314,19 @@ func httpAdmin(kv skv.SKV, w http.ResponseWriter, r *http.Request, urlPath strin
 	}
 
 	if urlPath=="/dumpping" {
-		hubMapMutex.RLock()
-		defer hubMapMutex.RUnlock()
-		for calleeID := range hubMap {
+		for _,entry := range hubMap.Snapshot() {
+			entry.Hub.HubMutex.RLock()
+			calleeClient := entry.Hub.CalleeClient
+			entry.Hub.HubMutex.RUnlock()
+			if calleeClient==nil {
+				continue
+			}
 			fmt.Fprintf(w,"/dumpping %-20s pingSent/pongReceived pingReceived/pongSent %v/%v %v/%v\n",
-				calleeID,
-				hubMap[calleeID].CalleeClient.pingSent,
-				hubMap[calleeID].CalleeClient.pongReceived,
-				hubMap[calleeID].CalleeClient.pingReceived,
-				hubMap[calleeID].CalleeClient.pongSent)
+				entry.GlobalID,
+				calleeClient.pingSent,
+				calleeClient.pongReceived,
+				calleeClient.pingReceived,
+				calleeClient.pongSent)
 		}
 		return true
 	}
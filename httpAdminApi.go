@@ -0,0 +1,663 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// httpAdminApiHandler() serves the JSON admin API under adminApiPrefix.
+// Unlike the text dumps in httpAdmin(), the admin API is not restricted
+// to localhost. Every request must carry "Authorization: Bearer (token)".
+// Tokens are configured in config.ini:
+// adminApiReadKey = token1,token2   (read-only: GET requests)
+// adminApiWriteKey = token3         (read-write: all requests)
+// Both keywords are re-read by readConfig(), so tokens can be rotated
+// without a restart. If neither is set, the admin API is disabled.
+//
+// GET    /admin/v1/users              list of users (?limit=n&after=key, see X-Next-After)
+// GET    /admin/v1/users/(key)        one user (key = calleeID_startTime)
+// DELETE /admin/v1/users/(key)
+// GET    /admin/v1/registered         list of registered IDs (?limit=n&after=id)
+// GET    /admin/v1/registered/(id)
+// POST   /admin/v1/registered         {"id":"...","pw":"...","serviceDays":...}
+// DELETE /admin/v1/registered/(id)    {"startTime":...} (also deletes the user data)
+// GET    /admin/v1/blocked            list of blocked IDs (?limit=n&after=id)
+// GET    /admin/v1/blocked/(id)
+// POST   /admin/v1/blocked            {"id":"..."} (an online callee will be disconnected)
+// DELETE /admin/v1/blocked/(id)       {"startTime":...}
+// POST   /admin/v1/news               {"date":"...","url":"..."} send news link to all online callees
+// GET    /admin/v1/stats              live stats (see collectStats())
+// GET    /admin/v1/online             online callees
+// GET    /admin/v1/hubs               all hubs with their connected caller
+// GET    /admin/v1/turn               current turn sessions
+// GET    /admin/v1/ping               ping/pong counters of online callees
+// GET    /admin/v1/logincount         callee logins during the last 30 minutes
+// GET    /admin/v1/requestcount       client requests during the last 30 minutes
+// GET    /admin/v1/snapshot/(dbname)  live snapshot of a db file, ?gzip=1 (read-write token only)
+// GET    /admin/v1/webhooks           webhooks for the events of all callees (see webHooks.go)
+// POST   /admin/v1/webhooks           {"url":"...","events":[...]} returns the secret
+// DELETE /admin/v1/webhooks/(id)
+// GET    /admin/v1/webhooks/(id)/log  the last deliveries of a webhook
+
+package main
+
+import (
+	"net/http"
+	"fmt"
+	"time"
+	"strings"
+	"sort"
+	"strconv"
+	"io"
+	"errors"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+const adminApiPrefix = "/admin/v1"
+
+var errAdminApiStartTime = errors.New("startTime mismatch")
+
+type AdminApiUser struct {
+	Key string `json:"key"`
+	Name string `json:"name"`
+	Ip1 string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	LastLoginTime int64 `json:"lastLoginTime"`
+	LastLogoffTime int64 `json:"lastLogoffTime"`
+	Int2 int `json:"int2"`
+	CallCounter int `json:"callCounter"`
+	ConnectedToPeerSecs int `json:"connectedToPeerSecs"`
+	LocalP2pCounter int `json:"localP2pCounter"`
+	RemoteP2pCounter int `json:"remoteP2pCounter"`
+	StoreContacts bool `json:"storeContacts"`
+	StoreMissedCalls bool `json:"storeMissedCalls"`
+	ServiceEndTime int64 `json:"serviceEndTime"`
+}
+
+type AdminApiEntry struct {
+	Id string `json:"id"`
+	StartTime int64 `json:"startTime"`
+	Ip string `json:"ip"`
+}
+
+type AdminApiOnline struct {
+	CalleeID string `json:"calleeID"`
+	Ip string `json:"ip"`
+	ConnectedCallerIp string `json:"connectedCallerIp"`
+	ClientVersion string `json:"clientVersion"`
+	UserAgent string `json:"userAgent"`
+}
+
+type AdminApiHub struct {
+	CalleeID string `json:"calleeID"`
+	ConnectedCallerIp string `json:"connectedCallerIp"`
+	CalleeOnline bool `json:"calleeOnline"`
+}
+
+type AdminApiTurn struct {
+	CalleeID string `json:"calleeID"`
+	Ip string `json:"ip"`
+	Secs int64 `json:"secs"`
+}
+
+type AdminApiPing struct {
+	CalleeID string `json:"calleeID"`
+	PingSent uint64 `json:"pingSent"`
+	PongReceived uint64 `json:"pongReceived"`
+	PingReceived uint64 `json:"pingReceived"`
+	PongSent uint64 `json:"pongSent"`
+}
+
+type AdminApiCount struct {
+	Id string `json:"id"`
+	Count int `json:"count"`
+}
+
+type AdminApiRegisterRequest struct {
+	Id string `json:"id"`
+	Pw string `json:"pw"`
+	ServiceDays int `json:"serviceDays"` // 0 = unlimited
+}
+
+type AdminApiBlockRequest struct {
+	Id string `json:"id"`
+}
+
+type AdminApiNewsRequest struct {
+	Date string `json:"date"`
+	Url string `json:"url"`
+}
+
+type AdminApiDeleteRequest struct {
+	StartTime int64 `json:"startTime"`
+}
+
+type AdminApiResult struct {
+	Ok bool `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// adminApiScope returns "rw", "ro" or "" (not authorized) for the bearer token in r
+func adminApiScope(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth,"Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[7:])
+	if token=="" {
+		return ""
+	}
+	readConfigLock.RLock()
+	writeTokens := adminApiWriteKey
+	readTokens := adminApiReadKey
+	readConfigLock.RUnlock()
+	tokenMatch := func(tokens string) bool {
+		match := false
+		for _,tok := range strings.Split(tokens,",") {
+			tok = strings.TrimSpace(tok)
+			if tok!="" && subtle.ConstantTimeCompare([]byte(tok),[]byte(token))==1 {
+				match = true
+			}
+		}
+		return match
+	}
+	if tokenMatch(writeTokens) {
+		return "rw"
+	}
+	if tokenMatch(readTokens) {
+		return "ro"
+	}
+	return ""
+}
+
+func adminApiReply(w http.ResponseWriter, status int, v interface{}) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("# %s json.Marshal err=%v\n", adminApiPrefix, err)
+		status = http.StatusInternalServerError
+		jsonStr = []byte(`{"ok":false,"error":"json"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonStr)
+}
+
+func adminApiError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	adminApiReply(w, status, AdminApiResult{false, fmt.Sprintf(format, a...)})
+}
+
+func httpAdminApiHandler(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := r.RemoteAddr
+	if strings.HasPrefix(remoteAddr,"[::1]") {
+		remoteAddr = "127.0.0.1"+remoteAddr[5:]
+	}
+	altIp := r.Header.Get("X-Real-IP")
+	if len(altIp) >= 7 {
+		remoteAddr = altIp
+	}
+	idxPort := strings.Index(remoteAddr,":")
+	if idxPort>=0 {
+		remoteAddr = remoteAddr[:idxPort]
+	}
+
+	scope := adminApiScope(r)
+	if scope=="" {
+		fmt.Printf("# %s %s %s unauthorized rip=%s\n", adminApiPrefix, r.Method, r.URL.Path, remoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		adminApiError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if r.Method!=http.MethodGet && scope!="rw" {
+		fmt.Printf("# %s %s %s read-only token rip=%s\n", adminApiPrefix, r.Method, r.URL.Path, remoteAddr)
+		adminApiError(w, http.StatusForbidden, "read-only token")
+		return
+	}
+	if logWantedFor("admin") {
+		fmt.Printf("%s %s %s scope=%s rip=%s\n", adminApiPrefix, r.Method, r.URL.Path, scope, remoteAddr)
+	}
+
+	kv := kvMain
+
+	// "/admin/v1/users/abc_123" -> resource="users" arg="abc_123"
+	resource := strings.TrimPrefix(r.URL.Path, adminApiPrefix+"/")
+	arg := ""
+	if idxSlash := strings.Index(resource,"/"); idxSlash>=0 {
+		arg = resource[idxSlash+1:]
+		resource = resource[:idxSlash]
+	}
+
+	switch {
+	case resource=="users" && arg=="" && r.Method==http.MethodGet:
+		adminApiGetUsers(kv, w, r)
+	case resource=="users" && arg!="" && r.Method==http.MethodGet:
+		var dbUser DbUser
+		err := kv.Get(dbUserBucket, arg, &dbUser)
+		if err!=nil {
+			adminApiError(w, http.StatusNotFound, "user %s not found", arg)
+			return
+		}
+		adminApiReply(w, http.StatusOK, adminApiUserFromDbUser(arg,&dbUser))
+	case resource=="users" && arg!="" && r.Method==http.MethodDelete:
+		var dbUser DbUser
+		err := kv.Get(dbUserBucket, arg, &dbUser)
+		if err!=nil {
+			adminApiError(w, http.StatusNotFound, "user %s not found", arg)
+			return
+		}
+		err = kv.Delete(dbUserBucket, arg)
+		if err!=nil {
+			fmt.Printf("# %s delete user key=%s err=%v\n", adminApiPrefix, arg, err)
+			adminApiError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		fmt.Printf("%s deleted user key=%s rip=%s\n", adminApiPrefix, arg, remoteAddr)
+		adminApiReply(w, http.StatusOK, AdminApiResult{Ok:true})
+
+	case (resource=="registered" || resource=="blocked") && arg=="" && r.Method==http.MethodGet:
+		bucketName := dbRegisteredIDs
+		if resource=="blocked" {
+			bucketName = dbBlockedIDs
+		}
+		adminApiGetEntries(kv, w, r, bucketName)
+	case (resource=="registered" || resource=="blocked") && arg!="" && r.Method==http.MethodGet:
+		bucketName := dbRegisteredIDs
+		if resource=="blocked" {
+			bucketName = dbBlockedIDs
+		}
+		var dbEntry DbEntry
+		err := kv.Get(bucketName, arg, &dbEntry)
+		if err!=nil {
+			adminApiError(w, http.StatusNotFound, "id %s not found", arg)
+			return
+		}
+		adminApiReply(w, http.StatusOK, AdminApiEntry{arg, dbEntry.StartTime, dbEntry.Ip})
+	case resource=="registered" && arg=="" && r.Method==http.MethodPost:
+		adminApiRegister(kv, w, r, remoteAddr)
+	case resource=="blocked" && arg=="" && r.Method==http.MethodPost:
+		adminApiBlock(kv, w, r, remoteAddr)
+	case (resource=="registered" || resource=="blocked") && arg!="" && r.Method==http.MethodDelete:
+		bucketName := dbRegisteredIDs
+		if resource=="blocked" {
+			bucketName = dbBlockedIDs
+		}
+		adminApiDeleteEntry(kv, w, r, bucketName, arg, remoteAddr)
+
+	case resource=="online" && r.Method==http.MethodGet:
+		adminApiGetOnline(w)
+	case resource=="hubs" && r.Method==http.MethodGet:
+		adminApiGetHubs(w)
+	case resource=="turn" && r.Method==http.MethodGet:
+		adminApiGetTurn(w)
+	case resource=="ping" && r.Method==http.MethodGet:
+		adminApiGetPing(w)
+	case resource=="logincount" && r.Method==http.MethodGet:
+		calleeLoginMutex.RLock()
+		countSlice := adminApiCount(calleeLoginMap)
+		calleeLoginMutex.RUnlock()
+		adminApiReply(w, http.StatusOK, countSlice)
+	case resource=="requestcount" && r.Method==http.MethodGet:
+		clientRequestsMutex.RLock()
+		countSlice := adminApiCount(clientRequestsMap)
+		clientRequestsMutex.RUnlock()
+		adminApiReply(w, http.StatusOK, countSlice)
+
+	case resource=="news" && r.Method==http.MethodPost:
+		var req AdminApiNewsRequest
+		err := json.NewDecoder(io.LimitReader(r.Body,4096)).Decode(&req)
+		if err!=nil || req.Date=="" || req.Url=="" || strings.Index(req.Date+req.Url,"|")>=0 {
+			adminApiError(w, http.StatusBadRequest, "date and url required")
+			return
+		}
+		fmt.Printf("%s/news date=%s url=%s rip=%s\n", adminApiPrefix, req.Date, req.Url, remoteAddr)
+		broadcastNewsLink(req.Date, req.Url)
+		adminApiReply(w, http.StatusOK, AdminApiResult{Ok:true})
+	case resource=="stats" && r.Method==http.MethodGet:
+		adminApiReply(w, http.StatusOK, collectStats())
+	case resource=="snapshot" && arg!="" && r.Method==http.MethodGet:
+		// a snapshot contains pw-hashes and session cookies
+		if scope!="rw" {
+			adminApiError(w, http.StatusForbidden, "read-only token")
+			return
+		}
+		adminApiSnapshot(w, r, arg, remoteAddr)
+
+	case resource=="webhooks" && arg=="" && r.Method==http.MethodGet:
+		adminApiReply(w, http.StatusOK, webhookList(webhookAllCallees))
+	case resource=="webhooks" && arg=="" && r.Method==http.MethodPost:
+		req,err := webhookParseRequest(r)
+		if err!=nil {
+			adminApiError(w, http.StatusBadRequest, "bad request body %v", err)
+			return
+		}
+		id,secret,err := webhookAdd(webhookAllCallees, req, true)
+		if err!=nil {
+			adminApiError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		fmt.Printf("%s/webhooks id=%s url=%s rip=%s\n", adminApiPrefix, id, req.Url, remoteAddr)
+		events := req.Events
+		if len(events)==0 {
+			events = webhookEvents
+		}
+		adminApiReply(w, http.StatusCreated, WebhookResponse{id, req.Url, events, time.Now().Unix(), secret})
+	case resource=="webhooks" && strings.HasSuffix(arg,"/log") && r.Method==http.MethodGet:
+		logSlice := webhookLog(webhookAllCallees, strings.TrimSuffix(arg,"/log"))
+		if logSlice==nil {
+			adminApiError(w, http.StatusNotFound, "webhook %s not found", strings.TrimSuffix(arg,"/log"))
+			return
+		}
+		adminApiReply(w, http.StatusOK, logSlice)
+	case resource=="webhooks" && arg!="" && r.Method==http.MethodDelete:
+		if webhookRemove(webhookAllCallees, arg)==0 {
+			adminApiError(w, http.StatusNotFound, "webhook %s not found", arg)
+			return
+		}
+		fmt.Printf("%s/webhooks deleted id=%s rip=%s\n", adminApiPrefix, arg, remoteAddr)
+		adminApiReply(w, http.StatusOK, AdminApiResult{Ok:true})
+
+	case resource=="users" || resource=="registered" || resource=="blocked" || resource=="online" ||
+			resource=="hubs" || resource=="turn" || resource=="ping" ||
+			resource=="logincount" || resource=="requestcount" || resource=="news" || resource=="stats" ||
+			resource=="snapshot" || resource=="webhooks":
+		adminApiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	default:
+		fmt.Printf("# %s unknown resource (%s) rip=%s\n", adminApiPrefix, r.URL.Path, remoteAddr)
+		adminApiError(w, http.StatusNotFound, "unknown resource")
+	}
+}
+
+func adminApiUserFromDbUser(key string, dbUser *DbUser) AdminApiUser {
+	return AdminApiUser{key, dbUser.Name, dbUser.Ip1, dbUser.UserAgent,
+		dbUser.LastLoginTime, dbUser.LastLogoffTime, dbUser.Int2, dbUser.CallCounter,
+		dbUser.ConnectedToPeerSecs, dbUser.LocalP2pCounter, dbUser.RemoteP2pCounter,
+		dbUser.StoreContacts, dbUser.StoreMissedCalls, dbUser.ServiceEndTime}
+}
+
+// adminApiPage reads the optional paging args "limit" and "after" of a list request
+func adminApiPage(r *http.Request) (int,string) {
+	limit,_ := strconv.Atoi(r.URL.Query().Get("limit"))
+	return limit, r.URL.Query().Get("after")
+}
+
+// adminApiNext tells the client where the next page starts
+func adminApiNext(w http.ResponseWriter, next string) {
+	if next!="" {
+		w.Header().Set("X-Next-After", next)
+	}
+}
+
+func adminApiGetUsers(kv skv.KV, w http.ResponseWriter, r *http.Request) {
+	userSlice := []AdminApiUser{}
+	limit,after := adminApiPage(r)
+	next,err := kv.Range(dbUserBucket, after, limit, func(k string, decode skv.Decoder) error {
+		var dbUser DbUser
+		decode(&dbUser)
+		userSlice = append(userSlice, adminApiUserFromDbUser(k,&dbUser))
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# %s/users err=%v\n", adminApiPrefix, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	adminApiNext(w, next)
+	adminApiReply(w, http.StatusOK, userSlice)
+}
+
+func adminApiGetEntries(kv skv.KV, w http.ResponseWriter, r *http.Request, bucketName string) {
+	entrySlice := []AdminApiEntry{}
+	limit,after := adminApiPage(r)
+	next,err := kv.Range(bucketName, after, limit, func(k string, decode skv.Decoder) error {
+		var dbEntry DbEntry
+		decode(&dbEntry)
+		entrySlice = append(entrySlice, AdminApiEntry{k, dbEntry.StartTime, dbEntry.Ip})
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# %s %s err=%v\n", adminApiPrefix, bucketName, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	adminApiNext(w, next)
+	adminApiReply(w, http.StatusOK, entrySlice)
+}
+
+func adminApiRegister(kv skv.KV, w http.ResponseWriter, r *http.Request, remoteAddr string) {
+	var req AdminApiRegisterRequest
+	err := json.NewDecoder(io.LimitReader(r.Body,4096)).Decode(&req)
+	if err!=nil {
+		adminApiError(w, http.StatusBadRequest, "bad request body %v", err)
+		return
+	}
+	req.Id = strings.ToLower(strings.TrimSpace(req.Id))
+	if req.Id=="" || req.Pw=="" {
+		adminApiError(w, http.StatusBadRequest, "id and pw required")
+		return
+	}
+	if isRingGroupID(req.Id) {
+		adminApiError(w, http.StatusConflict, "id %s is a ring group", req.Id)
+		return
+	}
+	var dbEntry DbEntry
+	err = kv.Get(dbRegisteredIDs, req.Id, &dbEntry)
+	if err==nil {
+		adminApiError(w, http.StatusConflict, "id %s already registered", req.Id)
+		return
+	}
+	hashedPw,err := hashPw(req.Pw)
+	if err!=nil {
+		fmt.Printf("# %s/registered hashPw err=%v\n", adminApiPrefix, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	if req.ServiceDays<0 {
+		adminApiError(w, http.StatusBadRequest, "serviceDays must not be negative")
+		return
+	}
+
+	unixTime := time.Now().Unix()
+	dbUserKey := fmt.Sprintf("%s_%d",req.Id, unixTime)
+	dbUser := DbUser{Ip1:remoteAddr}
+	if req.ServiceDays>0 {
+		dbUser.ServiceEndTime = unixTime + int64(req.ServiceDays)*24*60*60
+	}
+	err = kv.Update(func(tx skv.Tx) error {
+		if tx.Get(dbRegisteredIDs, req.Id, nil)==nil {
+			return errAlreadyRegistered
+		}
+		err := tx.Put(dbUserBucket, dbUserKey, dbUser)
+		if err!=nil {
+			return err
+		}
+		return tx.Put(dbRegisteredIDs, req.Id, DbEntry{unixTime, remoteAddr, hashedPw})
+	})
+	if err==errAlreadyRegistered {
+		adminApiError(w, http.StatusConflict, "id %s already registered", req.Id)
+		return
+	}
+	if err!=nil {
+		fmt.Printf("# %s/registered error db=%s put key=%s err=%v\n",
+			adminApiPrefix, dbMainName, req.Id, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	fmt.Printf("%s/registered new id=%s created rip=%s\n", adminApiPrefix, req.Id, remoteAddr)
+	adminApiReply(w, http.StatusCreated, AdminApiEntry{req.Id, unixTime, remoteAddr})
+}
+
+func adminApiBlock(kv skv.KV, w http.ResponseWriter, r *http.Request, remoteAddr string) {
+	var req AdminApiBlockRequest
+	err := json.NewDecoder(io.LimitReader(r.Body,4096)).Decode(&req)
+	if err!=nil {
+		adminApiError(w, http.StatusBadRequest, "bad request body %v", err)
+		return
+	}
+	req.Id = strings.ToLower(strings.TrimSpace(req.Id))
+	if req.Id=="" {
+		adminApiError(w, http.StatusBadRequest, "id required")
+		return
+	}
+	var dbEntry DbEntry
+	err = kv.Get(dbBlockedIDs, req.Id, &dbEntry)
+	if err==nil {
+		adminApiError(w, http.StatusConflict, "id %s already blocked", req.Id)
+		return
+	}
+	unixTime := time.Now().Unix()
+	err = kv.Put(dbBlockedIDs, req.Id, DbEntry{unixTime, remoteAddr, ""}, false)
+	if err!=nil {
+		fmt.Printf("# %s/blocked error db=%s bucket=%s put key=%s err=%v\n",
+			adminApiPrefix, dbMainName, dbBlockedIDs, req.Id, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	fmt.Printf("%s/blocked id=%s rip=%s\n", adminApiPrefix, req.Id, remoteAddr)
+
+	// disconnect the callee if it is online; it's next /login will be denied
+	_, locHub, _, err := GetOnlineCallee(req.Id, true, true, true, "", "/admin/blocked")
+	if err==nil && locHub!=nil {
+		locHub.HubMutex.RLock()
+		calleeClient := locHub.CalleeClient
+		locHub.HubMutex.RUnlock()
+		if calleeClient!=nil {
+			calleeClient.Close("blocked by admin")
+		}
+	}
+	adminApiReply(w, http.StatusCreated, AdminApiEntry{req.Id, unixTime, remoteAddr})
+}
+
+func adminApiDeleteEntry(kv skv.KV, w http.ResponseWriter, r *http.Request, bucketName string, id string, remoteAddr string) {
+	// the startTime of the entry must be given to make sure the right entry gets deleted
+	var req AdminApiDeleteRequest
+	err := json.NewDecoder(io.LimitReader(r.Body,4096)).Decode(&req)
+	if err!=nil {
+		adminApiError(w, http.StatusBadRequest, "bad request body %v", err)
+		return
+	}
+	// a registered ID is deleted together with its user data
+	var startTime int64
+	err = kv.Update(func(tx skv.Tx) error {
+		var dbEntry DbEntry
+		err := tx.Get(bucketName, id, &dbEntry)
+		if err!=nil {
+			return skv.ErrNotFound
+		}
+		startTime = dbEntry.StartTime
+		if dbEntry.StartTime!=req.StartTime {
+			return errAdminApiStartTime
+		}
+		err = tx.Delete(bucketName, id)
+		if err!=nil || bucketName!=dbRegisteredIDs {
+			return err
+		}
+		err = tx.Delete(dbUserBucket, fmt.Sprintf("%s_%d",id,dbEntry.StartTime))
+		if err==skv.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err==skv.ErrNotFound {
+		adminApiError(w, http.StatusNotFound, "id %s not found", id)
+		return
+	}
+	if err==errAdminApiStartTime {
+		adminApiError(w, http.StatusConflict, "startTime %d != %d", req.StartTime, startTime)
+		return
+	}
+	if err!=nil {
+		fmt.Printf("# %s delete db=%s bucket=%s id=%s err=%v\n", adminApiPrefix, dbMainName, bucketName, id, err)
+		adminApiError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	fmt.Printf("%s deleted db=%s bucket=%s id=%s rip=%s\n", adminApiPrefix, dbMainName, bucketName, id, remoteAddr)
+	adminApiReply(w, http.StatusOK, AdminApiResult{Ok:true})
+}
+
+func adminApiGetOnline(w http.ResponseWriter) {
+	onlineSlice := []AdminApiOnline{}
+	for _,entry := range hubMap.Snapshot() {
+		hub := entry.Hub
+		hub.HubMutex.RLock()
+		if hub.CalleeClient != nil {
+			ua := hub.CalleeClient.userAgent
+			if ua=="" {
+				ua = hub.calleeUserAgent
+			}
+			onlineSlice = append(onlineSlice, AdminApiOnline{hub.CalleeClient.calleeID,
+				hub.CalleeClient.RemoteAddrNoPort, hub.ConnectedCallerIp,
+				hub.CalleeClient.clientVersion, ua})
+		}
+		hub.HubMutex.RUnlock()
+	}
+	sort.Slice(onlineSlice, func(i, j int) bool {
+		return onlineSlice[i].CalleeID < onlineSlice[j].CalleeID
+	})
+	adminApiReply(w, http.StatusOK, onlineSlice)
+}
+
+func adminApiGetHubs(w http.ResponseWriter) {
+	hubSlice := []AdminApiHub{}
+	for _,entry := range hubMap.Snapshot() {
+		hub := entry.Hub
+		hub.HubMutex.RLock()
+		hubSlice = append(hubSlice, AdminApiHub{entry.GlobalID, hub.ConnectedCallerIp, hub.CalleeClient!=nil})
+		hub.HubMutex.RUnlock()
+	}
+	sort.Slice(hubSlice, func(i, j int) bool {
+		return hubSlice[i].CalleeID < hubSlice[j].CalleeID
+	})
+	adminApiReply(w, http.StatusOK, hubSlice)
+}
+
+func adminApiGetTurn(w http.ResponseWriter) {
+	turnSlice := []AdminApiTurn{}
+	timeNow := time.Now()
+	recentTurnCalleeIpMutex.RLock()
+	for ipAddr,turnCallee := range recentTurnCalleeIps {
+		turnSlice = append(turnSlice, AdminApiTurn{turnCallee.CalleeID, ipAddr,
+			int64(timeNow.Sub(turnCallee.TimeStored).Seconds())})
+	}
+	recentTurnCalleeIpMutex.RUnlock()
+	sort.Slice(turnSlice, func(i, j int) bool {
+		return turnSlice[i].CalleeID < turnSlice[j].CalleeID
+	})
+	adminApiReply(w, http.StatusOK, turnSlice)
+}
+
+func adminApiGetPing(w http.ResponseWriter) {
+	pingSlice := []AdminApiPing{}
+	for _,entry := range hubMap.Snapshot() {
+		hub := entry.Hub
+		hub.HubMutex.RLock()
+		calleeClient := hub.CalleeClient
+		hub.HubMutex.RUnlock()
+		if calleeClient!=nil {
+			pingSlice = append(pingSlice, AdminApiPing{entry.GlobalID,
+				calleeClient.pingSent, calleeClient.pongReceived,
+				calleeClient.pingReceived, calleeClient.pongSent})
+		}
+	}
+	sort.Slice(pingSlice, func(i, j int) bool {
+		return pingSlice[i].CalleeID < pingSlice[j].CalleeID
+	})
+	adminApiReply(w, http.StatusOK, pingSlice)
+}
+
+// adminApiCount returns the number of timestamps per ID within the last 30 minutes
+// must be called with the mutex of timeMap held
+func adminApiCount(timeMap map[string][]time.Time) []AdminApiCount {
+	countSlice := []AdminApiCount{}
+	for id,timeSlice := range timeMap {
+		count := 0
+		for _,t := range timeSlice {
+			if time.Now().Sub(t) < 30 * time.Minute {
+				count++
+			}
+		}
+		if count>0 {
+			countSlice = append(countSlice, AdminApiCount{id, count})
+		}
+	}
+	sort.Slice(countSlice, func(i, j int) bool {
+		return countSlice[i].Count > countSlice[j].Count
+	})
+	return countSlice
+}
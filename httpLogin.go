@@ -18,8 +18,9 @@ import (
 	"strings"
 	"fmt"
 	"io"
-	"math/rand"
 	"sync"
+	"crypto/subtle"
+	"github.com/mehrvarz/webcall/skv"
 )
 
 func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *http.Cookie, pw string, remoteAddr string, remoteAddrWithPort string, nocookie bool, startRequestTime time.Time, pwIdCombo PwIdCombo, userAgent string) {
@@ -34,6 +35,13 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		clientVersion = url_arg_array[0]
 	}
 
+	// a callee may be logged in with several devices (see wsDevices.go)
+	device := ""
+	url_arg_array, ok = r.URL.Query()["device"]
+	if ok && len(url_arg_array[0]) >= 1 {
+		device = cleanDeviceName(url_arg_array[0])
+	}
+
 	// answie and talkback can only log in from localhost
 	if strings.HasPrefix(urlID, "answie") || strings.HasPrefix(urlID, "talkback") {
 		if remoteAddr!="127.0.0.1" && remoteAddr!=outboundIP {
@@ -120,9 +128,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	}
 
 	// reached maxCallees?
-	hubMapMutex.RLock()
-	lenHubMap := len(hubMap)
-	hubMapMutex.RUnlock()
+	lenHubMap := int(hubMap.Len())
 	readConfigLock.RLock()
 	myMaxCallees := maxCallees
 	readConfigLock.RUnlock()
@@ -137,6 +143,14 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	myMultiCallees := multiCallees
 	readConfigLock.RUnlock()
 
+	var joinHub *Hub
+	deviceFromUA := false
+	if device=="" && strings.Index(myMultiCallees, "|"+urlID+"|") < 0 {
+		// clients that do not send device= are told apart by their user agent
+		device = deviceNameFromUserAgent(userAgent)
+		deviceFromUA = true
+	}
+
 	if strings.Index(myMultiCallees, "|"+urlID+"|") < 0 {
 		// urlID is NOT a multiCallee user
 		// so if urlID is already logged-in, we must abort
@@ -149,23 +163,37 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		if err != nil {
 			fmt.Printf("# /login (%s) GetOnlineCallee() err=%v v=%s\n", key, err, clientVersion)
 		}
-		if key != "" {
+		if key != "" && device != "" {
+			// the callee is logged in with another device: this device may join
+			// (unless this is the same device logging in again)
+			if hub := hubMap.Get(key); hub!=nil && hub.acceptsDevice() &&
+					!(deviceFromUA && hub.primaryDeviceName()==device) {
+				joinHub = hub
+			}
+		}
+		if key != "" && joinHub == nil {
 			// found "already logged in"
 			// delay a bit to see if we receive a parallel exitFunc that might delete this key
 			time.Sleep(1000 * time.Millisecond)
 			// check again
-			key, _, _, err = GetOnlineCallee(urlID, ejectOn1stFound, reportBusyCallee, 
+			var globHub *Hub
+			key, _, globHub, err = GetOnlineCallee(urlID, ejectOn1stFound, reportBusyCallee, 
 				reportHiddenCallee, remoteAddr, "/login")
 			if err != nil {
 				fmt.Printf("# /login (%s) GetOnlineCallee() err=%v v=%s\n", key, err, clientVersion)
 			}
+			if key != "" && globHub != nil {
+				// logged in on another node (see sharedLayer.go)
+				fmt.Printf("/login (%s) already logged in on %s <- %s v=%s ua=%s\n",
+					key, globHub.WsUrl, remoteAddrWithPort, clientVersion, userAgent)
+				fmt.Fprintf(w,"fatal")
+				return
+			}
 			if key != "" {
 				// a login request for a user that is still logged in
 				// maybe it has logged out and we didn't find out yet
 				// if remoteAddr == hub.CalleeClient.RemoteAddrNoPort: unregister old entry
-				hubMapMutex.RLock()
-				hub := hubMap[key]
-				hubMapMutex.RUnlock()
+				hub := hubMap.Get(key)
 				offlineReason := 0
 				calleeIP := ""
 
@@ -212,12 +240,20 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 					return
 				}
 
+				if hub!=nil && hub.endSuspension(nil, "relogin") {
+					// the old callee has lost its ws-connection and did not resume
+					fmt.Printf("/login (%s) ended resume grace window %s v=%s\n",
+						key, remoteAddrWithPort, clientVersion)
+				}
+
 				// the new login is valid (the old callee is not online anymore)
 				// there is no need to hub.doUnregister(hub.CalleeClient, ""); just continue with the login
 			}
 		}
 	}
 
+	// pw from the cookie is not the password itself, but the pw-hash the cookie was issued for
+	pwFromCookie := cookie!=nil && pw!=""
 	postBuf := make([]byte, 128)
 	length, _ := io.ReadFull(r.Body, postBuf)
 	if length > 0 {
@@ -231,6 +267,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 				pwFromPost := tok[3:]
 				if(pwFromPost!="") {
 					pw = pwFromPost
+					pwFromCookie = false
 					//fmt.Printf("/login pw from httpPost (%s)\n", pw)
 					break
 				}
@@ -263,7 +300,17 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		return
 	}
 
-	err := kvMain.Get(dbRegisteredIDs, urlID, &dbEntry)
+	var dbEntryBlocked DbEntry
+	err := kvMain.Get(dbBlockedIDs, urlID, &dbEntryBlocked)
+	if err == nil {
+		// blocked by admin
+		fmt.Printf("/login (%s) blocked since %d %s v=%s\n",
+			urlID, dbEntryBlocked.StartTime, remoteAddr, clientVersion)
+		fmt.Fprintf(w, "blocked")
+		return
+	}
+
+	err = kvMain.Get(dbRegisteredIDs, urlID, &dbEntry)
 	if err != nil {
 		// err is most likely "skv key not found"
 		// log "skv key not found" only if "login" is wanted
@@ -290,7 +337,41 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		fmt.Fprintf(w, "notregistered")
 		return
 	}
-	if pw != dbEntry.Password {
+	pwOk := false
+	if pwFromCookie && isPwHash(pw) {
+		// the cookie was issued for this pw-hash; it becomes invalid when the pw is changed
+		pwOk = subtle.ConstantTimeCompare([]byte(pw),[]byte(dbEntry.Password))==1
+	} else {
+		upgradeNeeded := false
+		pwOk,upgradeNeeded = verifyPw(pw, dbEntry.Password)
+		if pwOk && upgradeNeeded {
+			// replace plaintext pw (stored by an older server version) with a pw-hash
+			hashedPw,err := hashPw(pw)
+			if err!=nil {
+				fmt.Printf("# /login (%s) hashPw err=%v\n", urlID, err)
+			} else {
+				dbEntry.Password = hashedPw
+				err = kvMain.Put(dbRegisteredIDs, urlID, dbEntry, false)
+				if err!=nil {
+					fmt.Printf("# /login (%s) error db=%s bucket=%s put hashed pw err=%v\n",
+						urlID, dbMainName, dbRegisteredIDs, err)
+				} else {
+					fmt.Printf("/login (%s) pw upgraded to hash %s\n", urlID, remoteAddr)
+				}
+			}
+		}
+		if pwOk && pwFromCookie {
+			// PwIdCombo of an older server version holds the plaintext pw: replace it with the pw-hash
+			pwIdCombo.Pw = dbEntry.Password
+			err = kvHashedPw.PutWithExpiry(dbHashedPwBucket, cookie.Value, pwIdCombo,
+				pwIdComboExpiration(&pwIdCombo))
+			if err!=nil {
+				fmt.Printf("# /login (%s) error db=%s bucket=%s put PwIdCombo err=%v\n",
+					urlID, dbHashedPwName, dbHashedPwBucket, err)
+			}
+		}
+	}
+	if !pwOk {
 		fmt.Printf("/login (%s) fail wrong password %d %s\n", urlID, len(calleeLoginSlice), remoteAddr)
 		// delay to make pw guessing harder
 		time.Sleep(2000 * time.Millisecond)
@@ -307,6 +388,14 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		fmt.Fprintf(w, "error")
 		return
 	}
+	if dbUser.ServiceEndTime>0 {
+		serviceSecs = int(dbUser.ServiceEndTime - time.Now().Unix())
+		if serviceSecs<=0 {
+			fmt.Printf("/login (%s) service ended %s v=%s\n", urlID, remoteAddr, clientVersion)
+			fmt.Fprintf(w, "noservice")
+			return
+		}
+	}
 	//fmt.Printf("/login dbUserKey=%v dbUser.Int=%d (hidden) rt=%v\n",
 	//	dbUserKey, dbUser.Int2, time.Since(startRequestTime)) // rt=75ms
 
@@ -320,6 +409,21 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 		return
 	}
 
+	if joinHub != nil {
+		// another device of a callee that is logged in already
+		if cookie == nil && !nocookie {
+			err,cookieValue := createCookie(w, urlID, dbEntry.Password, &pwIdCombo, userAgent, remoteAddr)
+			if err != nil {
+				fmt.Printf("# /login (%s) device persist PwIdCombo error db=%s bucket=%s cookie=%s err=%v v=%s\n",
+					urlID, dbHashedPwName, dbHashedPwBucket, cookieValue, err, clientVersion)
+				fmt.Fprintf(w, "noservice")
+				return
+			}
+		}
+		loginDevice(w, r, joinHub, urlID, device, dbEntry, dbUser, clientVersion, remoteAddrWithPort, serviceSecs)
+		return
+	}
+
 	// create new unique wsClientID
 	wsClientMutex.Lock()
 	wsClientID = getNewWsClientID()
@@ -338,7 +442,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	//	globalID, urlID, remoteAddr, time.Since(startRequestTime))
 
 	if cookie == nil && !nocookie {
-		err,cookieValue := createCookie(w, urlID, pw, &pwIdCombo)
+		err,cookieValue := createCookie(w, urlID, dbEntry.Password, &pwIdCombo, userAgent, remoteAddr)
 		if err != nil {
 			if globalID != "" {
 				_,lenGlobalHubMap = DeleteFromHubMap(globalID)
@@ -417,6 +521,8 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 			}
 		}
 
+		webhookFire(urlID, WebhookEvent{Event:"offline", Cause:comment})
+
 		myHubMutex.Lock()
 		if hub != nil {
 			if globalID != "" {
@@ -444,13 +550,12 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	hub.calleeUserAgent = userAgent
 
 	wsClientMutex.Lock()
-	wsClientMap[wsClientID] = wsClientDataType{hub, dbEntry, dbUser, urlID, globalID, clientVersion, false}
+	wsClientMap[wsClientID] = wsClientDataType{hub, dbEntry, dbUser, urlID, globalID, clientVersion, false,
+		device, false}
 	wsClientMutex.Unlock()
 
 	//fmt.Printf("/login newHub store in local hubMap with globalID=%s\n", globalID)
-	hubMapMutex.Lock()
-	hubMap[globalID] = hub
-	hubMapMutex.Unlock()
+	hubMap.Set(globalID, hub)
 
 	//fmt.Printf("/login run hub id=%s durationSecs=%d/%d rt=%v\n",
 	//	urlID,maxRingSecs,maxTalkSecsIfNoP2p, time.Since(startRequestTime)) // rt=44ms, 113ms
@@ -512,9 +617,7 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 				time.Sleep(1 * time.Second)
 				waitedFor++
 				myHubMutex.Lock()
-				hubMapMutex.RLock()
-				hub = hubMap[globalID]
-				hubMapMutex.RUnlock()
+				hub = hubMap.Get(globalID)
 				if hub == nil {
 					// callee is already gone
 					myHubMutex.Unlock()
@@ -578,17 +681,78 @@ func httpLogin(w http.ResponseWriter, r *http.Request, urlID string, cookie *htt
 	return
 }
 
-func createCookie(w http.ResponseWriter, urlID string, pw string, pwIdCombo *PwIdCombo) (error,string) {
+// cookieLifetime is the validity of a "webcallid" cookie and of its PwIdCombo
+const cookieLifetime = 6 * 31 * 24 * time.Hour
+
+func pwIdComboExpiration(pwIdCombo *PwIdCombo) time.Time {
+	if pwIdCombo.Expiration<=0 {
+		// stored by an older server version
+		return time.Now().Add(cookieLifetime)
+	}
+	return time.Unix(pwIdCombo.Expiration,0)
+}
+
+// pwIdComboSetExpiry is called on startup to hand PwIdCombo.Expiration to the db
+// for entries that were stored without expiry by an older server version
+func pwIdComboSetExpiry() {
+	pwIdCombos := make(map[string]PwIdCombo)
+	err := kvHashedPw.ForEach(dbHashedPwBucket, "", func(cookieValue string, decode skv.Decoder) error {
+		var pwIdCombo PwIdCombo
+		if decode(&pwIdCombo)==nil {
+			pwIdCombos[cookieValue] = pwIdCombo
+		}
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# pwIdComboSetExpiry ForEach err=%v\n", err)
+		return
+	}
+	// entries stored by this server version already have their expiry
+	for cookieValue := range pwIdCombos {
+		if kvHashedPw.Expiration(dbHashedPwBucket,cookieValue)>0 {
+			delete(pwIdCombos,cookieValue)
+		}
+	}
+	if len(pwIdCombos)==0 {
+		return
+	}
+	countExpired := 0
+	err = kvHashedPw.Update(func(tx skv.Tx) error {
+		for cookieValue,pwIdCombo := range pwIdCombos {
+			expiration := pwIdComboExpiration(&pwIdCombo)
+			if expiration.Before(time.Now()) {
+				countExpired++
+			}
+			// already expired entries will be removed by the next Sweep()
+			err := tx.PutWithExpiry(dbHashedPwBucket, cookieValue, pwIdCombo, expiration)
+			if err!=nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# pwIdComboSetExpiry err=%v\n", err)
+		return
+	}
+	fmt.Printf("pwIdComboSetExpiry %d entries, %d expired\n", len(pwIdCombos), countExpired)
+}
+
+// createCookie() stores the pw-hash (not the pw) in PwIdCombo
+func createCookie(w http.ResponseWriter, urlID string, hashedPw string, pwIdCombo *PwIdCombo, userAgent string, remoteAddr string) (error,string) {
 	// create new cookie with name=webcallid value=urlID
 	// store only if url parameter nocookie is NOT set
-	cookieSecret := fmt.Sprintf("%d", rand.Int63n(99999999999))
+	cookieSecret,err := newSessionToken()
+	if err!=nil {
+		return err,""
+	}
 
 	// we need urlID in cookieName only for answie#
 	cookieName := "webcallid"
 	if strings.HasPrefix(urlID, "answie") {
 		cookieName = "webcallid-" + urlID
 	}
-	expiration := time.Now().Add(6 * 31 * 24 * time.Hour)
+	expiration := time.Now().Add(cookieLifetime)
 	cookieValue := fmt.Sprintf("%s&%s", urlID, string(cookieSecret))
 	cookieObj := http.Cookie{Name: cookieName, Value: cookieValue,
 		Path:     "/",
@@ -601,12 +765,16 @@ func createCookie(w http.ResponseWriter, urlID string, pw string, pwIdCombo *PwI
 		fmt.Printf("/login cookie created (%v)\n", cookieValue)
 	}
 
-	pwIdCombo.Pw = pw
+	pwIdCombo.Pw = hashedPw
 	pwIdCombo.CalleeId = urlID
 	pwIdCombo.Created = time.Now().Unix()
 	pwIdCombo.Expiration = expiration.Unix()
 
-	skipConfirm := true
-	return kvHashedPw.Put(dbHashedPwBucket, cookieValue, pwIdCombo, skipConfirm), cookieValue
+	err = kvHashedPw.PutWithExpiry(dbHashedPwBucket, cookieValue, pwIdCombo, expiration)
+	if err!=nil {
+		return err, cookieValue
+	}
+	sessionAdd(urlID, cookieValue, userAgent, remoteAddr)
+	return nil, cookieValue
 }
 
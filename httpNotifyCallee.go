@@ -31,7 +31,6 @@ import (
 	"sync"
 	"github.com/mehrvarz/webcall/twitter"
 	"github.com/mrjones/oauth"
-//	webpush "github.com/SherClockHolmes/webpush-go"
 )
 
 var twitterClient *twitter.DesktopClient = nil
@@ -108,40 +107,12 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 		} else if callerId!="" {
 			msg = callerId + " is waiting for you to pick up the phone."
 		}
-/*
-		if dbUser.Str2 != "" {
-			// web push device 1 subscription is specified
-			// here we use web push to send a notification
-			err, statusCode := webpushSend(dbUser.Str2, msg, urlID)
-			if err != nil {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 err=%v\n", urlID, err)
-			} else if statusCode == 201 {
-				notificationSent |= 1
-			} else if statusCode == 410 {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 delete subscr\n", urlID)
-				dbUser.Str2 = ""
-			} else {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device1 status=%d\n",	urlID, statusCode)
-			}
+		// web push to all subscriptions of this callee (see webPush.go)
+		webpushMigrate(urlID, dbUserKey, &dbUser)
+		if webpushNotify(urlID, msg) > 0 {
+			notificationSent |= 1
 		}
 
-		if dbUser.Str3 != "" {
-			// web push device 2 subscription is specified
-			// here we use web push to send a notification
-			err, statusCode := webpushSend(dbUser.Str3, msg, urlID)
-			if err != nil {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 err=%v\n", urlID, err)
-			} else if statusCode == 201 {
-				notificationSent |= 2
-			} else if statusCode == 410 {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 delete subscr\n", urlID)
-				dbUser.Str3 = ""
-			} else {
-				fmt.Printf("# /notifyCallee (%s) webpush fail device2 status=%d\n",
-					urlID, statusCode)
-			}
-		}
-*/
 		// notify urlID via twitter message
 		// here we use twitter message (or twitter direct message) to send a notification
 		if dbUser.Email2 != "" {
@@ -253,10 +224,10 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 							fmt.Printf("SendTweet (%s) OK twHandle=%s tweetId=%s\n",
 								urlID, dbUser.Email2[:maxlen], tweet.IdStr)
 
-//							// in 1hr we want to delete this tweet in ticker3min() via tweet.Id
-//							// so we store tweet.Id dbSentNotifTweets
+//							// we store tweet.Id in dbSentNotifTweets for sentNotifTweetTTL
 //							notifTweet := NotifTweet{time.Now().Unix(), msg}
-//							err = kvNotif.Put(dbSentNotifTweets, tweet.IdStr, notifTweet, false)
+//							err = kvNotif.PutWithExpiry(dbSentNotifTweets, tweet.IdStr, notifTweet,
+//								time.Now().Add(sentNotifTweetTTL))
 //							if err != nil {
 //								fmt.Printf("# /notifyCallee (%s) failed to store dbSentNotifTweets (%s)\n",
 //									urlID, tweet.IdStr)
@@ -289,12 +260,10 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 	waitingCaller := CallerInfo{remoteAddrWithPort, callerName, time.Now().Unix(), callerId, ""}
 
 	var calleeWsClient *WsClient = nil
-	hubMapMutex.RLock()
-	myhub := hubMap[urlID]
+	myhub := hubMap.Get(urlID)
 	if myhub!=nil {
 		calleeWsClient = myhub.CalleeClient
 	}
-	hubMapMutex.RUnlock()
 
 	var waitingCallerSlice []CallerInfo
 	err = kvCalls.Get(dbWaitingCaller, urlID, &waitingCallerSlice)
@@ -313,7 +282,8 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 
 		// send a waitingCaller json-update (containing remoteAddrWithPort + callerName) to hidden callee
 		waitingCallerSlice = append(waitingCallerSlice, waitingCaller)
-		err = kvCalls.Put(dbWaitingCaller, urlID, waitingCallerSlice, false)
+		err = kvCalls.PutWithExpiry(dbWaitingCaller, urlID, waitingCallerSlice,
+			time.Now().Add(waitingCallerTTL))
 		if err != nil {
 			fmt.Printf("# /notifyCallee (%s) failed to store dbWaitingCaller\n", urlID)
 		}
@@ -362,9 +332,7 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 					fmt.Printf("# /notifyCallee (%s) SetUnHiddenForCaller ip=%s err=%v\n",
 						glUrlID, remoteAddr, err)
 				} else {
-					hubMapMutex.RLock()
-					calleeWsClient = hubMap[glUrlID].CalleeClient
-					hubMapMutex.RUnlock()
+					calleeWsClient = hubMap.Get(glUrlID).CalleeClient
 
 					// clear unHiddenForCaller after a while, say, after 3 min
 					go func() {
@@ -379,9 +347,7 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 						if glUrlID == "" {
 							return
 						}
-						hubMapMutex.RLock()
-						myhub := hubMap[glUrlID]
-						hubMapMutex.RUnlock()
+						myhub := hubMap.Get(glUrlID)
 						if myhub!=nil {
 							if myhub.IsUnHiddenForCallerAddr == remoteAddr {
 								myhub.IsUnHiddenForCallerAddr = ""
@@ -409,9 +375,7 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 				// urlID is not online
 				fmt.Printf("/notifyCallee (%s/%s) GetOnlineCallee() is empty\n", urlID, glUrlID)
 			} else {
-				hubMapMutex.RLock()
-				calleeWsClient = hubMap[glUrlID].CalleeClient
-				hubMapMutex.RUnlock()
+				calleeWsClient = hubMap.Get(glUrlID).CalleeClient
 			}
 		}
 
@@ -429,7 +393,8 @@ func httpNotifyCallee(w http.ResponseWriter, r *http.Request, urlID string, remo
 			if waitingCallerSlice[idx].AddrPort == remoteAddrWithPort {
 				//fmt.Printf("/notifyCallee (%s) remove caller from waitingCallerSlice + store\n", urlID)
 				waitingCallerSlice = append(waitingCallerSlice[:idx], waitingCallerSlice[idx+1:]...)
-				err = kvCalls.Put(dbWaitingCaller, urlID, waitingCallerSlice, false)
+				err = kvCalls.PutWithExpiry(dbWaitingCaller, urlID, waitingCallerSlice,
+					time.Now().Add(waitingCallerTTL))
 				if err != nil {
 					fmt.Printf("# /notifyCallee (%s) failed to store dbWaitingCaller\n", urlID)
 				}
@@ -497,6 +462,10 @@ func missedCall(callerInfo string, remoteAddr string, cause string) {
 	}
 	calleeId := tok[0]
 // TODO check calleeId for size and content
+	if group := lookupRingGroup(calleeId); group!=nil {
+		// missed call to a group of callees (see ringGroup.go)
+		calleeId = group.missedCallsID
+	}
 
 	// find current state of dbUser.StoreMissedCalls via calleeId
 	var dbEntry DbEntry
@@ -569,9 +538,7 @@ func missedCall(callerInfo string, remoteAddr string, cause string) {
 		}
 		if calleeIsHiddenOnline {
 			var calleeWsClient *WsClient = nil
-			hubMapMutex.RLock()
-			myhub := hubMap[calleeId]
-			hubMapMutex.RUnlock()
+			myhub := hubMap.Get(calleeId)
 			if myhub!=nil {
 				calleeWsClient = myhub.CalleeClient
 			}
@@ -643,6 +610,11 @@ func httpCanbenotified(w http.ResponseWriter, r *http.Request, urlID string, rem
 
 	calleeHasPushChannel := false
 	if !calleeIsHiddenOnline {
+		// has web push subscriptions?
+		webpushMigrate(urlID, dbUserKey, &dbUser)
+		if webpushHasSubscriptions(urlID) {
+			calleeHasPushChannel = true
+		}
 		// has twitter account?
 		if dbUser.Email2!="" && dbUser.Str1!="" {
 			// if a follower?
@@ -711,6 +683,9 @@ func addMissedCall(urlID string, caller CallerInfo, cause string) (error, []Call
 		fmt.Printf("missedCall (%s) <- (%s) name=%s ip=%s msg=(%s) cause=(%s)\n",
 			urlID, caller.CallerID, caller.CallerName, caller.AddrPort, caller.Msg, cause)
 	}
+	webhookFire(urlID, WebhookEvent{Event:"missed", CallerID:caller.CallerID, CallerName:caller.CallerName,
+		Msg:caller.Msg, Cause:cause})
+	go emailMissedCall(urlID, caller)
 	return err,missedCallsSlice
 }
 
@@ -751,35 +726,6 @@ func addContact(calleeID string, callerID string, callerName string, cause strin
 	return nil
 }
 
-/*
-func webpushSend(subscription string, msg string, urlID string) (error,int) {
-	// Decode subscription
-	s := &webpush.Subscription{}
-	json.Unmarshal([]byte(subscription), s)
-	//fmt.Printf("unmarshalled subscription (%v)\n",s)
-
-	// Send Notification
-	readConfigLock.RLock()
-	httpResponse, err := webpush.SendNotification([]byte(msg), s, &webpush.Options{
-		Subscriber:      adminEmail, // Do not use "mailto:"
-		VAPIDPublicKey:  vapidPublicKey,
-		VAPIDPrivateKey: vapidPrivateKey,
-		TTL:             60,
-	})
-	readConfigLock.RUnlock()
-	if err != nil {
-		maxlen:=30; if len(subscription)<30 { maxlen=len(subscription) }
-		fmt.Printf("# webpush.SendNotif err=%v (id=%s) (%s)\n",
-			urlID, err, subscription[:maxlen])
-		return err, 0
-	}
-	// httpResponse.StatusCode should be 201
-	fmt.Printf("webpush.SendNotif OK id=%s (httpRespCode=%v) (%s)\n", urlID, httpResponse.StatusCode, subscription)
-	httpResponse.Body.Close()
-	return err, httpResponse.StatusCode
-}
-*/
-
 func twitterAuth() {
 	// twitterClientLock must be set outside
 	if twitterAuthFailedCount>3 {
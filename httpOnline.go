@@ -16,8 +16,12 @@ import (
 	"time"
 	"fmt"
 	"io"
+	"errors"
+	"github.com/mehrvarz/webcall/skv"
 )
 
+var errAlreadyRegistered = errors.New("already registered")
+
 func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr string) {
 	// a caller uses this to check if a callee is online and available
 	// NOTE: here the variable naming is twisted
@@ -49,6 +53,19 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 		wait = true
 	}
 
+	// callee IDs this call was forwarded from (see callForward.go)
+	fwd := ""
+	url_arg_array, ok = r.URL.Query()["fwd"]
+	if ok && len(url_arg_array[0]) >= 1 {
+		fwd = url_arg_array[0]
+	}
+
+	if group := lookupRingGroup(urlID); group!=nil {
+		// a group of callees (see ringGroup.go)
+		httpOnlineRingGroup(w, r, group, remoteAddr, callerId)
+		return
+	}
+
 	// we look for urlID either in the local or in the global hubmap
 	reportHiddenCallee := true
 	reportBusyCallee := true
@@ -101,6 +118,9 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 		} else {
 			// use dbUser.LastLogoffTime to see how long it has been offline
 			secsSinceLogoff = time.Now().Unix() - dbUser.LastLogoffTime
+			if !wait && forwardCaller(w, urlID, &dbUser, forwardOffline, fwd, remoteAddr) {
+				return
+			}
 		}
 		if secsSinceLogoff>0 && secsSinceLogoff < 8*60 {
 			// callee may come back very soon
@@ -203,11 +223,15 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 				urlID, glUrlID, locHub.ConnectedCallerIp, locHub.CallerClient!=nil, locHub.IsCalleeHidden)
 		}
 
-		if locHub.ConnectedCallerIp != "" {
+		if (locHub.ConnectedCallerIp != "" && !locHub.acceptsWaitingCallerLocked()) ||
+				locHub.nextCaller != nil {
 			// this callee (urlID/glUrlID) is online but currently busy
 			fmt.Printf("/online (%s) busy callerIp=%s %s v=%s\n",
 				urlID, locHub.ConnectedCallerIp, remoteAddr, clientVersion)
 			locHub.HubMutex.RUnlock()
+			if forwardCaller(w, urlID, nil, forwardBusy, fwd, remoteAddr) {
+				return
+			}
 			// remoteAddr is now eligible to send xhr /missedCall
 			missedCallAllowedMutex.Lock()
 			missedCallAllowedMap[remoteAddr] = time.Now()
@@ -242,21 +266,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 			return
 		}
 
-		wsAddr := fmt.Sprintf("ws://%s:%d/ws", hostname, wsPort)
-		readConfigLock.RLock()
-		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-			if wssUrl != "" {
-				wsAddr = wssUrl
-			} else {
-				wsAddr = fmt.Sprintf("wss://%s:%d/ws", hostname, wssPort)
-			}
-		} else {
-			if wsUrl != "" {
-				wsAddr = wsUrl
-			}
-		}
-		readConfigLock.RUnlock()
-		wsAddr = fmt.Sprintf("%s?wsid=%d", wsAddr, wsClientID)
+		wsAddr := onlineWsAddr(r, wsClientID)
 		if !strings.HasPrefix(glUrlID,"answie") && !strings.HasPrefix(glUrlID,"talkback") {
 			if logWantedFor("online") {
 				fmt.Printf("/online (%s) avail wsAddr=%s %s <- %s (%s) v=%s ua=%s\n",
@@ -275,6 +285,9 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 			// this callee (urlID/glUrlID) is online but currently busy
 			fmt.Printf("/online (%s/%s) busy callerIp=(%s) %s v=%s ua=%s\n",
 				urlID, glUrlID, globHub.ConnectedCallerIp, remoteAddr, clientVersion, r.UserAgent())
+			if forwardCaller(w, urlID, nil, forwardBusy, fwd, remoteAddr) {
+				return
+			}
 			fmt.Fprintf(w, "busy")
 			return
 		}
@@ -293,11 +306,7 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 			return
 		}
 
-		wsAddr = globHub.WsUrl
-		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-			wsAddr = globHub.WssUrl
-		}
-		wsAddr = fmt.Sprintf("%s?wsid=%d", wsAddr, wsClientID)
+		wsAddr = globHubWsAddr(r, globHub)
 		if logWantedFor("online") {
 			if !strings.HasPrefix(glUrlID,"answie") && !strings.HasPrefix(glUrlID,"talkback") {
 				fmt.Printf("/online (%s) avail wsAddr=%s (%s) %s v=%s ua=%s\n",
@@ -318,6 +327,34 @@ func httpOnline(w http.ResponseWriter, r *http.Request, urlID string, remoteAddr
 	return
 }
 
+// onlineWsAddr returns the ws-address for a callee managed by this server
+func onlineWsAddr(r *http.Request, wsClientID uint64) string {
+	wsAddr := fmt.Sprintf("ws://%s:%d/ws", hostname, wsPort)
+	readConfigLock.RLock()
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		if wssUrl != "" {
+			wsAddr = wssUrl
+		} else {
+			wsAddr = fmt.Sprintf("wss://%s:%d/ws", hostname, wssPort)
+		}
+	} else {
+		if wsUrl != "" {
+			wsAddr = wsUrl
+		}
+	}
+	readConfigLock.RUnlock()
+	return fmt.Sprintf("%s?wsid=%d", wsAddr, wsClientID)
+}
+
+// globHubWsAddr returns the ws-address for a callee managed by a remote server
+func globHubWsAddr(r *http.Request, globHub *Hub) string {
+	wsAddr := globHub.WsUrl
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		wsAddr = globHub.WssUrl
+	}
+	return fmt.Sprintf("%s?wsid=%d", wsAddr, globHub.WsClientID)
+}
+
 func httpNewId(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, remoteAddr string) {
 	// get a random ID that is not yet used in hubmap
 	if !allowNewAccounts {
@@ -371,6 +408,12 @@ func httpRegister(w http.ResponseWriter, r *http.Request, urlID string, urlPath
 		fmt.Printf("/register (%s) %s v=%s ua=%s\n",
 			registerID, remoteAddr, clientVersion, r.UserAgent())
 
+		if isRingGroupID(registerID) {
+			fmt.Printf("/register (%s) fail is a ring group ID\n",registerID)
+			fmt.Fprintf(w, "was already registered")
+			return
+		}
+
 		postBuf := make([]byte, 128)
 		length,_ := io.ReadFull(r.Body, postBuf)
 		if length>0 {
@@ -403,53 +446,67 @@ func httpRegister(w http.ResponseWriter, r *http.Request, urlID string, urlPath
 				return
 			}
 
+			hashedPw,err := hashPw(pw)
+			if err!=nil {
+				fmt.Printf("# /register (%s) hashPw err=%v\n", registerID, err)
+				fmt.Fprintf(w,"cannot register user")
+				return
+			}
+
 			unixTime := startRequestTime.Unix()
 			dbUserKey := fmt.Sprintf("%s_%d",registerID, unixTime)
 			dbUser := DbUser{Ip1:remoteAddr, UserAgent:r.UserAgent()}
 			dbUser.StoreContacts = true
 			dbUser.StoreMissedCalls = true
-			err = kvMain.Put(dbUserBucket, dbUserKey, dbUser, false)
-			if err!=nil {
-				fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
-					registerID, dbMainName, dbUserBucket, err)
+			// store user data and registered ID together
+			err = kvMain.Update(func(tx skv.Tx) error {
+				err := tx.Get(dbRegisteredIDs, registerID, nil)
+				if err==nil {
+					// registered by a concurrent request
+					return errAlreadyRegistered
+				}
+				err = tx.Put(dbUserBucket, dbUserKey, dbUser)
+				if err!=nil {
+					return err
+				}
+				return tx.Put(dbRegisteredIDs, registerID, DbEntry{unixTime, remoteAddr, hashedPw})
+			})
+			if err==errAlreadyRegistered {
+				fmt.Printf("/register (%s) fail db=%s bucket=%s already registered\n",
+					registerID, dbMainName, dbRegisteredIDs)
+				fmt.Fprintf(w, "was already registered")
+			} else if err!=nil {
+				fmt.Printf("# /register (%s) error db=%s put err=%v\n",
+					registerID, dbMainName, err)
 				fmt.Fprintf(w,"cannot register user")
 			} else {
-				err = kvMain.Put(dbRegisteredIDs, registerID,
-						DbEntry{unixTime, remoteAddr, pw}, false)
+				//fmt.Printf("/register (%s) db=%s bucket=%s stored OK\n",
+				//	registerID, dbMainName, dbRegisteredIDs)
+				// registerID is now available for use
+				var pwIdCombo PwIdCombo
+				err,cookieValue := createCookie(w, registerID, hashedPw, &pwIdCombo, r.UserAgent(), remoteAddr)
 				if err!=nil {
-					fmt.Printf("# /register (%s) error db=%s bucket=%s put err=%v\n",
-						registerID,dbMainName,dbRegisteredIDs,err)
-					fmt.Fprintf(w,"cannot register ID")
-					// TODO this is bad! got to role back kvMain.Put((dbUser...) from above
-				} else {
-					//fmt.Printf("/register (%s) db=%s bucket=%s stored OK\n",
-					//	registerID, dbMainName, dbRegisteredIDs)
-					// registerID is now available for use
-					var pwIdCombo PwIdCombo
-					err,cookieValue := createCookie(w, registerID, pw, &pwIdCombo)
-					if err!=nil {
-						fmt.Printf("/register (%s) create cookie error cookie=%s err=%v\n",
-							registerID, cookieValue, err)
-						// not fatal, but user needs to enter pw again now
-					}
-
-					// preload contacts with 2 Answie accounts
-					var callerInfoMap map[string]string // callerID -> name
-					err = kvContacts.Get(dbContactsBucket, registerID, &callerInfoMap)
-					if err!=nil {
-						callerInfoMap = make(map[string]string)
-					}
-					callerInfoMap["answie"] = "Answie Spoken"
-					callerInfoMap["answie7"] = "Answie Jazz"
-					err = kvContacts.Put(dbContactsBucket, registerID, callerInfoMap, false)
-					if err!=nil {
-						fmt.Printf("# /register (%s) kvContacts.Put err=%v\n", registerID, err)
-					} else {
-						//fmt.Printf("/register (%s) kvContacts.Put OK\n", registerID)
-					}
+					fmt.Printf("/register (%s) create cookie error cookie=%s err=%v\n",
+						registerID, cookieValue, err)
+					// not fatal, but user needs to enter pw again now
+				}
 
-					fmt.Fprintf(w, "OK")
+				// preload contacts with 2 Answie accounts
+				var callerInfoMap map[string]string // callerID -> name
+				err = kvContacts.Get(dbContactsBucket, registerID, &callerInfoMap)
+				if err!=nil {
+					callerInfoMap = make(map[string]string)
 				}
+				callerInfoMap["answie"] = "Answie Spoken"
+				callerInfoMap["answie7"] = "Answie Jazz"
+				err = kvContacts.Put(dbContactsBucket, registerID, callerInfoMap, false)
+				if err!=nil {
+					fmt.Printf("# /register (%s) kvContacts.Put err=%v\n", registerID, err)
+				} else {
+					//fmt.Printf("/register (%s) kvContacts.Put OK\n", registerID)
+				}
+
+				fmt.Fprintf(w, "OK")
 			}
 		}
 	} else {
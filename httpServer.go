@@ -24,7 +24,6 @@ import (
 	"path/filepath"
 	"crypto/tls"
 	"embed"
-	"github.com/mehrvarz/webcall/skv"
 )
 
 // note: if we use go:embed, config keyword 'htmlPath' must be set to the default value "webroot"
@@ -35,6 +34,7 @@ var embeddedFsShouldBeUsed = false
 
 func httpServer() {
 	http.HandleFunc("/rtcsig/", httpApiHandler)
+	http.HandleFunc(adminApiPrefix+"/", httpAdminApiHandler)
 
 	http.HandleFunc("/callee/", substituteUserNameHandler)
 	http.HandleFunc("/user/", substituteUserNameHandler)
@@ -475,7 +475,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		//fmt.Printf("httpApi cookie avail(%s) req=(%s) ref=(%s) callee=(%s)\n", 
 		//	cookie.Value[:maxlen], r.URL.Path, referer, calleeID)
 
-		// cookie.Value has format: calleeID + "&" + hashedPW
+		// cookie.Value has format: calleeID + "&" + session token
 		idxAmpasent := strings.Index(cookie.Value,"&")
 		if idxAmpasent<0 {
 			fmt.Printf("# httpApi error no ampasent in cookie.Value (%s) clear cookie\n", cookie.Value)
@@ -531,6 +531,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 					//fmt.Printf("httpApi cookie available for id=(%s) (%s)(%s) reqPath=%s ref=%s rip=%s\n",
 					//	pwIdCombo.CalleeId, calleeID, urlID, r.URL.Path, referer, remoteAddrWithPort)
 					pw = pwIdCombo.Pw
+					sessionTouch(pwIdCombo.CalleeId, cookie.Value, &pwIdCombo, r.UserAgent(), remoteAddr)
 				}
 			}
 		}
@@ -592,6 +593,46 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		httpTwFollower(w, r, urlID, calleeID, cookie, remoteAddr)
 		return
 	}
+	if urlPath=="/sessions" {
+		httpGetSessions(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/revokesession" {
+		httpRevokeSession(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/pushsubscribe" {
+		httpPushSubscribe(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/pushsubscriptions" {
+		httpPushSubscriptions(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/pushunsubscribe" {
+		httpPushUnsubscribe(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/emailverify" {
+		httpEmailVerify(w, r, remoteAddr)
+		return
+	}
+	if urlPath=="/webhookadd" {
+		httpWebhookAdd(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/webhooks" {
+		httpWebhooks(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/webhooklog" {
+		httpWebhookLog(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
+	if urlPath=="/webhookremove" {
+		httpWebhookRemove(w, r, urlID, calleeID, cookie, remoteAddr)
+		return
+	}
 	if strings.HasPrefix(urlPath,"/register/") {
 		httpRegister(w, r, urlID, urlPath, remoteAddr, startRequestTime)
 		return
@@ -636,7 +677,7 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 				// skip this
 			} else {
 				fmt.Printf("/message=(%s)\n", message)
-				// TODO here could send an email to adminEmail
+				emailAdminMessage(message, remoteAddr)
 			}
 		}
 		return
@@ -661,17 +702,15 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		if urlPath=="/dumponline" {
 			// show list of online callees (with their ports) sorted by CalleeClient.RemoteAddrNoPort
 			printFunc(w,"/dumponline %s %s\n", time.Now().Format("2006-01-02 15:04:05"), remoteAddr)
-			hubMapMutex.RLock()
-			defer hubMapMutex.RUnlock()
+			// the registry is not locked while we write to w
 			var hubSlice []*Hub
-			for _,hub := range hubMap {
-				if hub!=nil {
-					hub.HubMutex.RLock()
-					if hub.CalleeClient != nil {
-						hubSlice = append(hubSlice,hub)
-					}
-					hub.HubMutex.RUnlock()
+			for _,entry := range hubMap.Snapshot() {
+				hub := entry.Hub
+				hub.HubMutex.RLock()
+				if hub.CalleeClient != nil {
+					hubSlice = append(hubSlice,hub)
 				}
+				hub.HubMutex.RUnlock()
 			}
 			sortableIpAddrFunc := func(remoteAddr string) string {
 				// takes "192.168.3.29" and returns "192168003029"
@@ -715,6 +754,9 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 					hubSlice[idx].ConnectedCallerIp,
 					hubSlice[idx].CalleeClient.clientVersion,
 					ua)
+				for _,line := range hubSlice[idx].dumpDevices() {
+					fmt.Fprintf(w,"%s\n",line)
+				}
 			}
 			return
 		}
@@ -734,16 +776,12 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 		if urlPath=="/hubinfo" {
 			// show all hubs with the connected client
 			printFunc(w,"/hubinfo rip=%s\n",remoteAddr)
-			hubMapMutex.RLock()
-			defer hubMapMutex.RUnlock()
 			var hubinfoSlice []string
-			for calleeID,hub := range hubMap {
-				if hub!=nil {
-					if hub.ConnectedCallerIp!="" {
-						hubinfoSlice = append(hubinfoSlice,calleeID+" caller: "+hub.ConnectedCallerIp)
-					} else {
-						hubinfoSlice = append(hubinfoSlice,calleeID+" idle")
-					}
+			for _,entry := range hubMap.Snapshot() {
+				if entry.Hub.ConnectedCallerIp!="" {
+					hubinfoSlice = append(hubinfoSlice,entry.GlobalID+" caller: "+entry.Hub.ConnectedCallerIp)
+				} else {
+					hubinfoSlice = append(hubinfoSlice,entry.GlobalID+" idle")
 				}
 			}
 			sort.Slice(hubinfoSlice, func(i, j int) bool {
@@ -755,13 +793,8 @@ func httpApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, ok := kvMain.(skv.SKV)
-		if !ok {
-			// TODO log: httpAdmin() only works with local db
-		} else {
-			if httpAdmin(kvMain.(skv.SKV), w, r, urlPath, urlID, remoteAddr) {
-				return
-			}
+		if httpAdmin(kvMain, w, r, urlPath, urlID, remoteAddr) {
+			return
 		}
 	}
 
@@ -794,6 +827,7 @@ func clearCookie(w http.ResponseWriter, r *http.Request, urlID string, remoteAdd
 	if err == nil {
 		fmt.Printf("clrcookie (%s) cookie.Value=%s ip=%s '%s'\n",
 			urlID, cookie.Value, remoteAddr, comment)
+		sessionRemove(sessionCalleeID(cookie.Value), cookie.Value)
 		err = kvHashedPw.Delete(dbHashedPwBucket, cookie.Value)
 		if err==nil {
 			//fmt.Printf("clrcookie (%s) dbHashedPw.Delete OK db=%s bucket=%s key=%s\n",
@@ -0,0 +1,300 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Every "webcallid" cookie issued by createCookie() is a session.
+// Sessions are recorded per callee in dbSessionsBucket, so that
+// a callee can list all devices that are logged in to its account
+// ("/sessions") and revoke a single session or all of them
+// ("/revokesession?sid=..." or "/revokesession?sid=all").
+// A revoked session loses its PwIdCombo in dbHashedPwBucket.
+// A session whose PwIdCombo has expired is removed by sessionsSweep().
+// The next request with this cookie will be treated as an
+// unknown cookie and the device will need to enter the pw again.
+
+package main
+
+import (
+	"net/http"
+	"time"
+	"strings"
+	"fmt"
+	"sync"
+	"sort"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// sessionTokenLen is the number of random bytes in a cookie secret (256 bit)
+const sessionTokenLen = 32
+
+// lastUse will only be written to the db if it is older than this
+const sessionTouchInterval = 5 * time.Minute
+
+type Session struct {
+	CookieValue string
+	Created int64
+	LastUse int64
+	UserAgent string
+	Ip string
+}
+
+// sessionsMutex protects the read-modify-write of a callee's map of sessions
+var sessionsMutex sync.Mutex
+
+// newSessionToken returns a url-safe random string to be used as cookie secret
+func newSessionToken() (string,error) {
+	buf := make([]byte, sessionTokenLen)
+	_,err := rand.Read(buf)
+	if err!=nil {
+		return "",err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// sessionID derives the public ID of a session from its cookie value
+// the cookie value itself is never handed out by "/sessions"
+func sessionID(cookieValue string) string {
+	sum := sha256.Sum256([]byte(cookieValue))
+	return hex.EncodeToString(sum[:8])
+}
+
+func sessionCalleeID(cookieValue string) string {
+	idxAmpasent := strings.Index(cookieValue,"&")
+	if idxAmpasent<0 {
+		return ""
+	}
+	return cookieValue[:idxAmpasent]
+}
+
+func sessionsGet(calleeID string) map[string]Session {
+	var sessionMap map[string]Session // sessionID -> Session
+	err := kvHashedPw.Get(dbSessionsBucket,calleeID,&sessionMap)
+	if err!=nil || sessionMap==nil {
+		// no sessions yet
+		sessionMap = make(map[string]Session)
+	}
+	return sessionMap
+}
+
+func sessionsPut(calleeID string, sessionMap map[string]Session) error {
+	if len(sessionMap)==0 {
+		err := kvHashedPw.Delete(dbSessionsBucket,calleeID)
+		if err!=nil && strings.Index(err.Error(),"key not found")<0 {
+			return err
+		}
+		return nil
+	}
+	return kvHashedPw.Put(dbSessionsBucket, calleeID, sessionMap, true)
+}
+
+// sessionAdd is called by createCookie() for every new cookie
+func sessionAdd(calleeID string, cookieValue string, userAgent string, remoteAddr string) {
+	now := time.Now().Unix()
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessionMap := sessionsGet(calleeID)
+	sessionMap[sessionID(cookieValue)] = Session{cookieValue, now, now, userAgent, remoteAddr}
+	err := sessionsPut(calleeID,sessionMap)
+	if err!=nil {
+		fmt.Printf("# sessionAdd (%s) db=%s bucket=%s err=%v\n",
+			calleeID, dbHashedPwName, dbSessionsBucket, err)
+	}
+}
+
+// sessionTouch is called by httpApiHandler() for every request with a valid cookie
+// cookies issued before the session registry existed will be added here
+func sessionTouch(calleeID string, cookieValue string, pwIdCombo *PwIdCombo, userAgent string, remoteAddr string) {
+	now := time.Now()
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessionMap := sessionsGet(calleeID)
+	sid := sessionID(cookieValue)
+	session,ok := sessionMap[sid]
+	if ok && now.Sub(time.Unix(session.LastUse,0)) < sessionTouchInterval &&
+			session.Ip==remoteAddr && session.UserAgent==userAgent {
+		// nothing worth writing
+		return
+	}
+	if !ok {
+		session = Session{CookieValue:cookieValue, Created:pwIdCombo.Created}
+	}
+	session.LastUse = now.Unix()
+	session.UserAgent = userAgent
+	session.Ip = remoteAddr
+	sessionMap[sid] = session
+	err := sessionsPut(calleeID,sessionMap)
+	if err!=nil {
+		fmt.Printf("# sessionTouch (%s) db=%s bucket=%s err=%v\n",
+			calleeID, dbHashedPwName, dbSessionsBucket, err)
+	}
+}
+
+// sessionRemove is called by clearCookie()
+func sessionRemove(calleeID string, cookieValue string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessionMap := sessionsGet(calleeID)
+	sid := sessionID(cookieValue)
+	if _,ok := sessionMap[sid]; !ok {
+		return
+	}
+	delete(sessionMap,sid)
+	err := sessionsPut(calleeID,sessionMap)
+	if err!=nil {
+		fmt.Printf("# sessionRemove (%s) db=%s bucket=%s err=%v\n",
+			calleeID, dbHashedPwName, dbSessionsBucket, err)
+	}
+}
+
+// sessionRevoke removes one session (or all of them, if sid=="all")
+// it returns the number of revoked sessions and true if the current session was among them
+func sessionRevoke(calleeID string, sid string, currentCookieValue string) (int,bool) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessionMap := sessionsGet(calleeID)
+	count := 0
+	revokedCurrent := false
+	for id,session := range sessionMap {
+		if sid!="all" && id!=sid {
+			continue
+		}
+		err := kvHashedPw.Delete(dbHashedPwBucket, session.CookieValue)
+		if err!=nil && strings.Index(err.Error(),"key not found")<0 {
+			fmt.Printf("# sessionRevoke (%s) db=%s bucket=%s sid=%s err=%v\n",
+				calleeID, dbHashedPwName, dbHashedPwBucket, id, err)
+			continue
+		}
+		delete(sessionMap,id)
+		if session.CookieValue==currentCookieValue {
+			revokedCurrent = true
+		}
+		count++
+	}
+	if count>0 {
+		err := sessionsPut(calleeID,sessionMap)
+		if err!=nil {
+			fmt.Printf("# sessionRevoke (%s) db=%s bucket=%s err=%v\n",
+				calleeID, dbHashedPwName, dbSessionsBucket, err)
+		}
+	}
+	return count,revokedCurrent
+}
+
+// sessionsSweep removes the sessions whose PwIdCombo has expired; called by ticker3min after Sweep()
+func sessionsSweep() {
+	calleeIDs,err := kvHashedPw.Keys(dbSessionsBucket,"")
+	if err!=nil {
+		fmt.Printf("# sessionsSweep db=%s bucket=%s err=%v\n", dbHashedPwName, dbSessionsBucket, err)
+		return
+	}
+	count := 0
+	for _,calleeID := range calleeIDs {
+		sessionsMutex.Lock()
+		sessionMap := sessionsGet(calleeID)
+		countExpired := 0
+		for id,session := range sessionMap {
+			var pwIdCombo PwIdCombo
+			err := kvHashedPw.Get(dbHashedPwBucket, session.CookieValue, &pwIdCombo)
+			if err!=nil && strings.Index(err.Error(),"key not found")>=0 {
+				delete(sessionMap,id)
+				countExpired++
+			}
+		}
+		if countExpired>0 {
+			err := sessionsPut(calleeID,sessionMap)
+			if err!=nil {
+				fmt.Printf("# sessionsSweep (%s) db=%s bucket=%s err=%v\n",
+					calleeID, dbHashedPwName, dbSessionsBucket, err)
+			} else {
+				count += countExpired
+			}
+		}
+		sessionsMutex.Unlock()
+	}
+	if count>0 && logWantedFor("sweep") {
+		fmt.Printf("sessionsSweep deleted %d sessions\n", count)
+	}
+}
+
+func httpGetSessions(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if calleeID=="" {
+		fmt.Printf("# /sessions calleeID empty urlID=%s %s\n",urlID, remoteAddr)
+		return
+	}
+	if cookie==nil {
+		fmt.Printf("# /sessions (%s) fail no cookie %s\n", calleeID, remoteAddr)
+		return
+	}
+	if urlID!="" && urlID!=calleeID {
+		fmt.Printf("# /sessions urlID=%s != calleeID=%s %s\n",urlID,calleeID, remoteAddr)
+		return
+	}
+
+	type SessionResponse struct {
+		Id string `json:"id"`
+		Created int64 `json:"created"`
+		LastUse int64 `json:"lastUse"`
+		UserAgent string `json:"userAgent"`
+		Ip string `json:"ip"`
+		Current bool `json:"current"`
+	}
+	sessionsMutex.Lock()
+	sessionMap := sessionsGet(calleeID)
+	sessionsMutex.Unlock()
+	var sessionSlice []SessionResponse
+	for id,session := range sessionMap {
+		sessionSlice = append(sessionSlice, SessionResponse{id, session.Created, session.LastUse,
+			session.UserAgent, session.Ip, session.CookieValue==cookie.Value})
+	}
+	sort.Slice(sessionSlice, func(i, j int) bool {
+		return sessionSlice[i].LastUse > sessionSlice[j].LastUse
+	})
+	jsonStr, err := json.Marshal(sessionSlice)
+	if err != nil {
+		fmt.Printf("# /sessions (%s) failed on json.Marshal %s err=%v\n", calleeID, remoteAddr, err)
+		return
+	}
+	if logWantedFor("cookie") {
+		fmt.Printf("/sessions (%s) send %d elements %s\n", calleeID, len(sessionSlice), remoteAddr)
+	}
+	fmt.Fprintf(w,"%s",jsonStr)
+}
+
+func httpRevokeSession(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if calleeID=="" {
+		fmt.Printf("# /revokesession calleeID empty urlID=%s %s\n",urlID, remoteAddr)
+		return
+	}
+	if cookie==nil {
+		fmt.Printf("# /revokesession (%s) fail no cookie %s\n", calleeID, remoteAddr)
+		return
+	}
+	if urlID!="" && urlID!=calleeID {
+		fmt.Printf("# /revokesession urlID=%s != calleeID=%s %s\n",urlID,calleeID, remoteAddr)
+		return
+	}
+	sid := ""
+	url_arg_array, ok := r.URL.Query()["sid"]
+	if ok && len(url_arg_array[0]) > 0 {
+		sid = url_arg_array[0]
+	}
+	if sid=="" {
+		fmt.Printf("# /revokesession (%s) no sid %s\n", calleeID, remoteAddr)
+		fmt.Fprintf(w,"error")
+		return
+	}
+
+	count,revokedCurrent := sessionRevoke(calleeID, sid, cookie.Value)
+	fmt.Printf("/revokesession (%s) sid=%s revoked=%d current=%v %s\n",
+		calleeID, sid, count, revokedCurrent, remoteAddr)
+	if revokedCurrent {
+		clearCookie(w, r, calleeID, remoteAddr, "/revokesession")
+	}
+	if count==0 {
+		fmt.Fprintf(w,"notfound")
+		return
+	}
+	fmt.Fprintf(w,"ok")
+}
@@ -56,6 +56,8 @@ func httpGetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 		fmt.Printf("# /getsettings (%s) fail on dbUserBucket %s\n", calleeID, remoteAddr)
 		return
 	}
+	// subscriptions of an older server version; listed by /pushsubscriptions
+	webpushMigrate(calleeID, dbUserKey, &dbUser)
 
 	var reqBody []byte
 	readConfigLock.RLock() // for vapidPublicKey
@@ -65,11 +67,13 @@ func httpGetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 		"twid": dbUser.Str1, // twitter user_id
 		"storeContacts": strconv.FormatBool(dbUser.StoreContacts),
 		"storeMissedCalls": strconv.FormatBool(dbUser.StoreMissedCalls),
-		"webPushSubscription1": dbUser.Str2,
-		"webPushUA1": dbUser.Str2ua,
-		"webPushSubscription2": dbUser.Str3,
-		"webPushUA2": dbUser.Str3ua,
 		"vapidPublicKey": vapidPublicKey,
+		"forwardOffline": dbUser.ForwardOffline,
+		"forwardBusy": dbUser.ForwardBusy,
+		"forwardNoAnswer": dbUser.ForwardNoAnswer,
+		"email": dbUser.Email,
+		"emailPending": dbUser.EmailPending,
+		"emailMissedCalls": emailMissedCallsName(dbUser.EmailMissedCalls),
 	})
 	readConfigLock.RUnlock()
 	if err != nil {
@@ -153,6 +157,59 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 				dbUser.Str1 = val
 				queryFollowerIDsNeeded.Set(true)
 			}
+		case "forwardOffline", "forwardBusy", "forwardNoAnswer":
+			target,err := checkForwardTarget(calleeID, strings.TrimSpace(val))
+			if err!=nil {
+				fmt.Printf("# /setsettings (%s) %s (%s) denied %s err=%v\n", calleeID, key, val, remoteAddr, err)
+				continue
+			}
+			var dbUserTarget *string
+			switch(key) {
+			case "forwardOffline":
+				dbUserTarget = &dbUser.ForwardOffline
+			case "forwardBusy":
+				dbUserTarget = &dbUser.ForwardBusy
+			default:
+				dbUserTarget = &dbUser.ForwardNoAnswer
+			}
+			if target != *dbUserTarget {
+				fmt.Printf("/setsettings (%s) new %s (%s) (old:%s) %s\n",
+					calleeID, key, target, *dbUserTarget, remoteAddr)
+				*dbUserTarget = target
+			}
+		case "email":
+			// a new address is only used after verification (see emailNotify.go)
+			val = strings.TrimSpace(val)
+			if val=="" {
+				if dbUser.Email!="" || dbUser.EmailPending!="" {
+					fmt.Printf("/setsettings (%s) clear email %s\n", calleeID, remoteAddr)
+					dbUser.Email = ""
+					dbUser.EmailPending = ""
+				}
+				continue
+			}
+			address,err := emailCheckAddress(val)
+			if err!=nil {
+				fmt.Printf("# /setsettings (%s) email (%s) denied %s err=%v\n", calleeID, val, remoteAddr, err)
+				continue
+			}
+			if address==dbUser.Email || address==dbUser.EmailPending || !emailConfigured() {
+				continue
+			}
+			err = emailStartVerify(calleeID, address, emailBaseUrl())
+			if err!=nil {
+				fmt.Printf("# /setsettings (%s) email (%s) verify %s err=%v\n", calleeID, address, remoteAddr, err)
+				continue
+			}
+			fmt.Printf("/setsettings (%s) new email pending (%s) %s\n", calleeID, address, remoteAddr)
+			dbUser.EmailPending = address
+		case "emailMissedCalls":
+			for mode,name := range emailMissedCallsNames {
+				if val==name && mode!=dbUser.EmailMissedCalls {
+					fmt.Printf("/setsettings (%s) new emailMissedCalls (%s) %s\n", calleeID, val, remoteAddr)
+					dbUser.EmailMissedCalls = mode
+				}
+			}
 		case "storeContacts":
 			if(val=="true") {
 				if dbUser.StoreContacts != true {
@@ -174,9 +231,7 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 						calleeID,val,dbUser.StoreMissedCalls)
 					dbUser.StoreMissedCalls = true
 					// show missedCalls on callee web client (if avail)
-					hubMapMutex.RLock()
-					hub := hubMap[calleeID]
-					hubMapMutex.RUnlock()
+					hub := hubMap.Get(calleeID)
 					if hub!=nil && hub.CalleeClient!=nil {
 						var callsWhileInAbsence []CallerInfo
 						err := kvCalls.Get(dbMissedCalls,calleeID,&callsWhileInAbsence)
@@ -203,99 +258,12 @@ func httpSetSettings(w http.ResponseWriter, r *http.Request, urlID string, calle
 						calleeID, val, dbUser.StoreMissedCalls, remoteAddr)
 					dbUser.StoreMissedCalls = false
 					// hide missedCalls on callee web client
-					hubMapMutex.RLock()
-					hub := hubMap[calleeID]
-					hubMapMutex.RUnlock()
+					hub := hubMap.Get(calleeID)
 					if hub!=nil && hub.CalleeClient!=nil {
 						hub.CalleeClient.Write([]byte("missedCalls|")) // need websocket
 					}
 				}
 			}
-/*
-		case "webPushSubscription1":
-			newVal,err := url.QueryUnescape(val)
-			if err!=nil {
-				fmt.Printf("# /setsettings (%s) url.QueryUnescape webPushSubscription1 err=%v\n",
-					calleeID, err)
-			} else if newVal != dbUser.Str2 {
-				fmt.Printf("/setsettings (%s) new webPushSubscription1 (%s) (old:%s)\n",
-					calleeID, newVal, dbUser.Str2)
-				if dbUser.Str2 != newVal {
-					dbUser.Str2 = newVal
-					if newVal!="" {
-						// send welcome/verification push-msg
-						msg := "You will from now on receive a WebPush notification for every call"+
-								" you receive while not being connected to the WebCall server."
-						err,statusCode := webpushSend(dbUser.Str2,msg,calleeID)
-						if err!=nil {
-							fmt.Printf("# setsettings (%s) webpush fail device1 err=%v\n",calleeID,err)
-						} else if statusCode==201 {
-							// success
-						} else if statusCode==410 {
-							fmt.Printf("# setsettings (%s) webpush fail device1 delete subscr\n",
-								calleeID)
-							dbUser.Str2 = ""
-						} else {
-							fmt.Printf("# setsettings (%s) webpush fail device1 status=%d\n",
-								calleeID, statusCode)
-						}
-					}
-				}
-			}
-
-		case "webPushUA1":
-			newVal,err := url.QueryUnescape(val)
-			if err!=nil {
-				fmt.Printf("# /setsettings (%s) url.QueryUnescape webPushUA1 err=%v\n",
-					calleeID, err)
-			} else if newVal != dbUser.Str2ua {
-				fmt.Printf("/setsettings (%s) new webPushUA1 (%s) (old:%s)\n",
-					calleeID, newVal, dbUser.Str2ua)
-				dbUser.Str2ua = newVal
-			}
-
-		case "webPushSubscription2":
-			newVal,err := url.QueryUnescape(val)
-			if err!=nil {
-				fmt.Printf("# /setsettings (%s) url.QueryUnescape webPushSubscription2 err=%v\n",
-					calleeID, err)
-			} else if newVal != dbUser.Str3 {
-				fmt.Printf("/setsettings (%s) new webPushSubscription2 (%s) (old:%s)\n",
-					calleeID, newVal, dbUser.Str3)
-				if dbUser.Str3 != newVal {
-					dbUser.Str3 = newVal
-					if newVal!="" {
-						// send welcome/verification push-msg
-						msg := "You will from now on receive a WebPush notification for every call"+
-								" you receive while not being connected to the WebCall server."
-						err,statusCode := webpushSend(dbUser.Str3,msg,calleeID)
-						if err!=nil {
-							fmt.Printf("# /setsettings (%s) webpush fail device2 err=%v\n",calleeID,err)
-						} else if statusCode==201 {
-							// success
-						} else if statusCode==410 {
-							fmt.Printf("# /setsettings (%s) webpush fail device2 delete subscr\n",
-								calleeID)
-							dbUser.Str3 = ""
-						} else {
-							fmt.Printf("# /setsettings (%s) webpush fail device2 status=%d\n",
-								calleeID, statusCode)
-						}
-					}
-				}
-			}
-
-		case "webPushUA2":
-			newVal,err := url.QueryUnescape(val)
-			if err!=nil {
-				fmt.Printf("# /setsettings (%s) url.QueryUnescape webPushUA2 err=%v\n",
-					calleeID, err)
-			} else if newVal != dbUser.Str3ua {
-				fmt.Printf("/setsettings (%s) new webPushUA2 (%s) (old:%s)\n",
-					calleeID, newVal, dbUser.Str3ua)
-				dbUser.Str3ua = newVal
-			}
-*/
 		}
 	}
 
@@ -603,7 +571,7 @@ func httpTwFollower(w http.ResponseWriter, r *http.Request, twId string, calleeI
 
 	twid, err := strconv.ParseInt(twId, 10, 64)
 	if err!=nil {
-		fmt.Printf("# /twfollower (%s) ParseInt64 fail twid=(%s) %s err=%v\n", calleeID, twid, remoteAddr, err)
+		fmt.Printf("# /twfollower (%s) ParseInt64 fail twid=(%s) %s err=%v\n", calleeID, twId, remoteAddr, err)
 		fmt.Fprintf(w,"error format "+err.Error())
 	} else {
 		foundId := false
@@ -0,0 +1,190 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// HubMap holds the hubs of all callees served by this process (globalID -> *Hub).
+// It is split into hubMapShards shards, each with its own lock, so that lookups
+// for different callees do not contend. All globalIDs of a calleeID (calleeID and
+// calleeID!ext for multiCallees) are kept in the same shard, so GetOnlineCallee()
+// only needs to look at a single shard.
+// The shard locks only protect the map itself and must never be held while writing
+// to a client or to the network. To walk all hubs, use Snapshot() and iterate
+// over the returned slice without any registry lock held.
+package main
+
+import (
+	"sync"
+	"strings"
+	"sync/atomic"
+	"hash/fnv"
+)
+
+const hubMapShards = 64
+
+type HubMapEntry struct {
+	GlobalID string
+	Hub *Hub
+}
+
+type hubMapShard struct {
+	sync.RWMutex
+	callees map[string]map[string]*Hub // calleeID -> globalID -> *Hub
+}
+
+type HubMap struct {
+	shards [hubMapShards]hubMapShard
+	count int64 // atomic
+}
+
+func newHubMap() *HubMap {
+	m := &HubMap{}
+	for i := range m.shards {
+		m.shards[i].callees = make(map[string]map[string]*Hub)
+	}
+	return m
+}
+
+// calleeIdOfGlobalID returns calleeID for calleeID!ext
+func calleeIdOfGlobalID(globalID string) string {
+	if idxExcl := strings.Index(globalID,"!"); idxExcl>=0 {
+		return globalID[:idxExcl]
+	}
+	return globalID
+}
+
+func (m *HubMap) shard(calleeID string) *hubMapShard {
+	h := fnv.New32a()
+	h.Write([]byte(calleeID))
+	return &m.shards[h.Sum32()%hubMapShards]
+}
+
+// Len returns the number of hubs
+func (m *HubMap) Len() int64 {
+	return atomic.LoadInt64(&m.count)
+}
+
+// Lookup returns the hub stored for globalID (which may be nil during login)
+func (m *HubMap) Lookup(globalID string) (*Hub,bool) {
+	calleeID := calleeIdOfGlobalID(globalID)
+	s := m.shard(calleeID)
+	s.RLock()
+	defer s.RUnlock()
+	hub,ok := s.callees[calleeID][globalID]
+	return hub,ok
+}
+
+func (m *HubMap) Get(globalID string) *Hub {
+	hub,_ := m.Lookup(globalID)
+	return hub
+}
+
+// setLocked stores hub for globalID; the shard must be write locked
+func (m *HubMap) setLocked(s *hubMapShard, calleeID string, globalID string, hub *Hub) {
+	hubs := s.callees[calleeID]
+	if hubs==nil {
+		hubs = make(map[string]*Hub)
+		s.callees[calleeID] = hubs
+	}
+	if _,ok := hubs[globalID]; !ok {
+		atomic.AddInt64(&m.count, 1)
+	}
+	hubs[globalID] = hub
+}
+
+func (m *HubMap) Set(globalID string, hub *Hub) {
+	calleeID := calleeIdOfGlobalID(globalID)
+	s := m.shard(calleeID)
+	s.Lock()
+	m.setLocked(s, calleeID, globalID, hub)
+	s.Unlock()
+}
+
+// SetIfAbsent stores hub for globalID, unless globalID is already taken
+func (m *HubMap) SetIfAbsent(globalID string, hub *Hub) bool {
+	calleeID := calleeIdOfGlobalID(globalID)
+	s := m.shard(calleeID)
+	s.Lock()
+	defer s.Unlock()
+	if _,ok := s.callees[calleeID][globalID]; ok {
+		return false
+	}
+	m.setLocked(s, calleeID, globalID, hub)
+	return true
+}
+
+// Delete removes globalID and returns the number of hubs left
+func (m *HubMap) Delete(globalID string) int64 {
+	calleeID := calleeIdOfGlobalID(globalID)
+	s := m.shard(calleeID)
+	s.Lock()
+	if hubs := s.callees[calleeID]; hubs!=nil {
+		if _,ok := hubs[globalID]; ok {
+			delete(hubs,globalID)
+			atomic.AddInt64(&m.count, -1)
+			if len(hubs)==0 {
+				delete(s.callees,calleeID)
+			}
+		}
+	}
+	s.Unlock()
+	return m.Len()
+}
+
+// Modify calls fn with the hub of globalID while the shard is write locked
+// it returns false if there is no hub for globalID
+func (m *HubMap) Modify(globalID string, fn func(hub *Hub)) bool {
+	calleeID := calleeIdOfGlobalID(globalID)
+	s := m.shard(calleeID)
+	s.Lock()
+	defer s.Unlock()
+	hub := s.callees[calleeID][globalID]
+	if hub==nil {
+		return false
+	}
+	fn(hub)
+	return true
+}
+
+// WithCallee calls fn with all hubs of calleeID (globalID -> *Hub) while the shard
+// is read locked; fn must not modify the map
+func (m *HubMap) WithCallee(calleeID string, fn func(hubs map[string]*Hub)) {
+	s := m.shard(calleeID)
+	s.RLock()
+	defer s.RUnlock()
+	fn(s.callees[calleeID])
+}
+
+// Find returns the first hub for which fn returns true; fn is called with
+// one shard read locked at a time and must be quick (no network writes)
+func (m *HubMap) Find(fn func(globalID string, hub *Hub) bool) (string,*Hub) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for _,hubs := range s.callees {
+			for globalID,hub := range hubs {
+				if fn(globalID,hub) {
+					s.RUnlock()
+					return globalID,hub
+				}
+			}
+		}
+		s.RUnlock()
+	}
+	return "",nil
+}
+
+// Snapshot returns all entries; shards are locked one at a time, so the result
+// is not an atomic view of the whole map. Entries with a nil hub are skipped.
+func (m *HubMap) Snapshot() []HubMapEntry {
+	entries := make([]HubMapEntry, 0, m.Len())
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for _,hubs := range s.callees {
+			for globalID,hub := range hubs {
+				if hub!=nil {
+					entries = append(entries, HubMapEntry{globalID,hub})
+				}
+			}
+		}
+		s.RUnlock()
+	}
+	return entries
+}
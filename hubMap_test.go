@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+	"strconv"
+	"testing"
+	"math/rand"
+	"sync/atomic"
+)
+
+// the hub registry (HubMap) with this many simulated callees
+// go test -run NONE -bench HubMap
+const benchCallees = 100000
+
+func benchHubMap(b *testing.B) {
+	b.Helper()
+	hubMap = newHubMap()
+	for i:=0; i<benchCallees; i++ {
+		hubMap.Set(strconv.Itoa(10000000000+i), newHub(0,0,0))
+	}
+	b.ResetTimer()
+}
+
+// benchOnline looks up a random callee (as done by /online)
+func benchOnline(b *testing.B, rnd *rand.Rand) {
+	calleeID := strconv.Itoa(10000000000+rnd.Intn(benchCallees))
+	key,_,_ := locGetOnlineCallee(calleeID, true, true, true, "", "bench")
+	if key=="" {
+		b.Errorf("%s not found", calleeID)
+	}
+}
+
+var benchLoginCounter int64
+
+// benchLogin stores and deletes a new callee (as done by /login and exitFunc)
+func benchLogin() {
+	calleeID := "bench"+strconv.FormatInt(atomic.AddInt64(&benchLoginCounter,1),10)
+	globalID,_,_ := locStoreCalleeInHubMap(calleeID, newHub(0,0,0), "", "", 0, false)
+	locDeleteFromHubMap(globalID)
+}
+
+// benchParallel runs op on all CPUs, each with its own rand
+func benchParallel(b *testing.B, op func(rnd *rand.Rand)) {
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed,1)))
+		for pb.Next() {
+			op(rnd)
+		}
+	})
+}
+
+func BenchmarkHubMapOnline(b *testing.B) {
+	benchHubMap(b)
+	benchParallel(b, func(rnd *rand.Rand) {
+		benchOnline(b, rnd)
+	})
+}
+
+func BenchmarkHubMapLogin(b *testing.B) {
+	benchHubMap(b)
+	benchParallel(b, func(rnd *rand.Rand) {
+		benchLogin()
+	})
+}
+
+// 90% online, 10% login, while a broadcast walks a Snapshot() every 100ms
+func BenchmarkHubMapMixed(b *testing.B) {
+	benchHubMap(b)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	snapshots := 0
+	var snapshotTime time.Duration
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(100*time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				snapshotStart := time.Now()
+				hubMap.Snapshot()
+				snapshotTime += time.Since(snapshotStart)
+				snapshots++
+			}
+		}
+	}()
+	benchParallel(b, func(rnd *rand.Rand) {
+		if rnd.Intn(10)==0 {
+			benchLogin()
+		} else {
+			benchOnline(b, rnd)
+		}
+	})
+	close(stop)
+	<-done
+	if snapshots>0 {
+		b.ReportMetric(float64(snapshotTime.Nanoseconds()/int64(snapshots)), "ns/snapshot")
+	}
+}
@@ -57,6 +57,7 @@ const dbUserBucket = "userData2"
 var	kvCalls skv.KV
 const dbCallsName = "rtccalls.db"
 const dbWaitingCaller = "waitingCallers"
+const waitingCallerTTL = 10 * time.Minute
 const dbMissedCalls = "missedCalls"
 type CallerInfo struct {
 	AddrPort string
@@ -73,12 +74,20 @@ const dbContactsBucket = "contacts" // calleeID -> map[callerID]name
 var	kvNotif skv.KV
 const dbNotifName = "rtcnotif.db"
 const dbSentNotifTweets = "sentNotifTweets"
+const sentNotifTweetTTL = time.Hour
+const dbPushSubscriptions = "pushSubscriptions" // calleeID -> map[subscriptionID]PushSubscription
+const dbWebhooks = "webhooks" // calleeID (or webhookAllCallees) -> map[webhookID]Webhook
+const dbWebhookQueue = "webhookQueue" // deliveryID -> WebhookDelivery
+const dbWebhookLog = "webhookLog" // webhookID -> []WebhookLogEntry
+const dbEmailVerify = "emailVerify" // token -> EmailVerify
+const dbEmailDigest = "emailDigest" // calleeID -> EmailDigest
 
 var	kvHashedPw skv.KV
 const dbHashedPwName = "rtchashedpw.db"
 const dbHashedPwBucket = "hashedpwbucket"
+const dbSessionsBucket = "sessions" // calleeID -> map[sessionID]Session
 type PwIdCombo struct {
-	Pw string
+	Pw string // pw-hash the cookie was issued for
 	CalleeId string
 	Created int64
 	Expiration int64
@@ -94,8 +103,7 @@ var readConfigLock sync.RWMutex
 var	shutdownStarted atombool.AtomBool
 var queryFollowerIDsNeeded atombool.AtomBool
 
-var hubMap map[string]*Hub
-var hubMapMutex sync.RWMutex
+var hubMap *HubMap
 
 // ws-connect timeout blocker
 var blockMap map[string]time.Time
@@ -133,6 +141,8 @@ type wsClientDataType struct {
 	globalID string
 	clientVersion string
 	removeFlag bool
+	deviceName string
+	extraDevice bool // joins the hub of the callee (see wsDevices.go)
 }
 // wsClientMap[wsid] contains wsClientDataType at the moment of a callee login
 var wsClientMap map[uint64]wsClientDataType
@@ -157,17 +167,28 @@ var turnRealm = ""
 var turnDebugLevel = 0
 var pprofPort = 0
 var dbPath = ""
+var dbKeyFile = ""
+var dbServer = ""
+var dbServerListen = ""
+var dbServerSecret = ""
+var hubRegistryKind = ""
+var hubRegistryDir = ""
+var hubRegistryNode = ""
+var hubRegistryNodeTimeout = 0
 var wsUrl = ""
 var wssUrl = ""
 var twitterKey = ""
 var twitterSecret = ""
+var turnSecret = ""
 var vapidPublicKey = ""
 var vapidPrivateKey = ""
+var webpushTestService = false
 var timeLocationString = ""
 var timeLocation *time.Location = nil
 var maintenanceMode = false
 var allowNewAccounts = true
 var multiCallees = ""
+var ringGroups = ""
 var logevents = ""
 var logeventMap map[string]bool
 var logeventMutex sync.RWMutex
@@ -175,10 +196,25 @@ var disconCalleeOnPeerConnected = false
 var disconCallerOnPeerConnected = true
 var maxRingSecs = 0
 var maxTalkSecsIfNoP2p = 0
+var resumeGraceSecs = 0
+var callWaiting = true
+var maxDevices = 0
 var adminID = ""
 var adminEmail = ""
-var	backupScript = ""
-var	backupPauseMinutes = 0
+var smtpHost = ""
+var smtpPort = 0
+var smtpStartTLS = true
+var smtpUser = ""
+var smtpPassword = ""
+var smtpFrom = ""
+var emailDigestMins = 0
+var adminApiReadKey = ""
+var adminApiWriteKey = ""
+var backupDir = ""
+var backupGzip = false
+var backupPauseMinutes = 0
+var backupKeepDaily = 0
+var backupKeepWeekly = 0
 var maxCallees = 0
 var cspString = ""
 var thirtySecStats = false
@@ -196,10 +232,18 @@ func main() {
 		fmt.Printf("builddate %s\n",builddate)
 		return
 	}
+	if flag.Arg(0)=="db" {
+		// offline db maintenance, see dbCmd.go
+		os.Exit(dbCmd(flag.Args()[1:]))
+	}
+	if flag.Arg(0)=="vapidkeys" {
+		// new key pair for web push, see webPush.go
+		os.Exit(vapidKeysCmd())
+	}
 
 	fmt.Printf("--------------- webcall %s %s startup ---------------\n", codetag, builddate)
 	serverStartTime = time.Now()
-	hubMap = make(map[string]*Hub) // calleeID -> *Hub
+	hubMap = newHubMap() // globalID -> *Hub
 	blockMap = make(map[string]time.Time)
 	calleeLoginMap = make(map[string][]time.Time)
 	clientRequestsMap = make(map[string][]time.Time)
@@ -208,8 +252,20 @@ func main() {
 	wsClientMap = make(map[uint64]wsClientDataType) // wsClientID -> wsClientData
 	readConfig(true)
 
-	var err error
-	kvMain,err = skv.DbOpen(dbMainName,dbPath)
+	err := loadDbKeys(dbKeyFile)
+	if err!=nil {
+		fmt.Printf("# error db keys %v\n",err)
+		return
+	}
+	if skv.Encrypted() {
+		fmt.Printf("db values are encrypted\n")
+	}
+	err = dbConnect()
+	if err!=nil {
+		fmt.Printf("# error dbServer %s err=%v\n",dbServer,err)
+		return
+	}
+	kvMain,err = dbOpen(dbMainName)
 	if err!=nil {
 		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbMainName,dbPath,err)
 		return
@@ -232,7 +288,7 @@ func main() {
 		kvMain.Close()
 		return
 	}
-	kvCalls,err = skv.DbOpen(dbCallsName,dbPath)
+	kvCalls,err = dbOpen(dbCallsName)
 	if err!=nil {
 		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbCallsName,dbPath,err)
 		return
@@ -249,7 +305,7 @@ func main() {
 		kvCalls.Close()
 		return
 	}
-	kvNotif,err = skv.DbOpen(dbNotifName,dbPath)
+	kvNotif,err = dbOpen(dbNotifName)
 	if err!=nil {
 		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbNotifName,dbPath,err)
 		return
@@ -260,7 +316,43 @@ func main() {
 		kvNotif.Close()
 		return
 	}
-	kvHashedPw,err = skv.DbOpen(dbHashedPwName,dbPath)
+	err = kvNotif.CreateBucket(dbPushSubscriptions)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbPushSubscriptions,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbWebhooks)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbWebhooks,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbWebhookQueue)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbWebhookQueue,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbWebhookLog)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbWebhookLog,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbEmailVerify)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbEmailVerify,err)
+		kvNotif.Close()
+		return
+	}
+	err = kvNotif.CreateBucket(dbEmailDigest)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbNotifName,dbEmailDigest,err)
+		kvNotif.Close()
+		return
+	}
+	kvHashedPw,err = dbOpen(dbHashedPwName)
 	if err!=nil {
 		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbHashedPwName,dbPath,err)
 		return
@@ -271,7 +363,16 @@ func main() {
 		kvHashedPw.Close()
 		return
 	}
-	kvContacts,err = skv.DbOpen(dbContactsName,dbPath)
+	err = kvHashedPw.CreateBucket(dbSessionsBucket)
+	if err!=nil {
+		fmt.Printf("# error db %s CreateBucket %s err=%v\n",dbHashedPwName,dbSessionsBucket,err)
+		kvHashedPw.Close()
+		return
+	}
+	if isLocalDb() {
+		pwIdComboSetExpiry()
+	}
+	kvContacts,err = dbOpen(dbContactsName)
 	if err!=nil {
 		fmt.Printf("# error DbOpen %s path %s err=%v\n",dbContactsName,dbPath,err)
 		return
@@ -283,6 +384,18 @@ func main() {
 		return
 	}
 
+	err = dbServe()
+	if err!=nil {
+		fmt.Printf("# error dbServerListen %s err=%v\n",dbServerListen,err)
+		return
+	}
+
+	hubRegistry,err = openHubRegistry(hubRegistryKind, hubRegistryDir, hubRegistryNode, hubRegistryNodeTimeout)
+	if err!=nil {
+		fmt.Printf("# error hubRegistry %s err=%v\n",hubRegistryKind,err)
+		return
+	}
+
 	rand.Seed(time.Now().UnixNano())
 	queryFollowerIDsNeeded.Set(true)
 
@@ -291,6 +404,14 @@ func main() {
 	outboundIP,err = iptools.GetOutboundIP()
 	fmt.Printf("outboundIP %s\n",outboundIP)
 
+	// ring, talk and ping deadlines
+	go timerWheel.run()
+
+	// retries of webhook deliveries (see webHooks.go)
+	if isLocalDb() {
+		webhookResumeQueue()
+	}
+
 	// websocket handler
 	if wsPort > 0 {
 		wsAddr = fmt.Sprintf(":%d", wsPort)
@@ -362,7 +483,7 @@ func main() {
 	go runTurnServer()
 	go ticker3hours()  // check time since last login
 	go ticker20min()   // update news notifieer
-	go ticker3min()    // backupScript + delete old tw notifications
+	go ticker3min()    // backups + sweep expired db entries
 	go ticker30sec()   // log stats
 	go ticker10sec()   // readConfig()
 	go ticker2sec()    // check for new day
@@ -387,6 +508,7 @@ func main() {
 	// but it will not end ListenAndServe() servers; this is why we call os.Exit() below
 	shutdownStarted.Set(true)
 	writeStatsFile()
+	hubRegistry.Close()
 	time.Sleep(2 * time.Second)
 
 	fmt.Printf("kvContacts.Close...\n")
@@ -418,38 +540,54 @@ func main() {
 	os.Exit(0)
 }
 
-// getStats() creates a string with live info about the number of 
+type Stats struct {
+	Callees int64 `json:"callees"`
+	Callers int64 `json:"callers"`
+	PureP2pCalls int `json:"pureP2pCalls"`
+	CallsToday int `json:"callsToday"`
+	CallSecsToday int64 `json:"callSecsToday"`
+	PingSent int64 `json:"pingSent"`
+	PongSent int64 `json:"pongSent"`
+	Goroutines int `json:"goroutines"`
+	UptimeSecs int64 `json:"uptimeSecs"`
+}
+
+// collectStats() returns live info about the number of 
 // callees, callers (the number of current calls), how many are p2p,
 // and the total number of calls and call seconds since midnight
-func getStats() string {
-	var numberOfOnlineCallees int64
-	var numberOfOnlineCallers int64
-	numberOfActivePureP2pCalls := 0
-	hubMapMutex.RLock()
-	for _,hub := range hubMap {
-		if hub!=nil {
-			numberOfOnlineCallees++
-			hub.HubMutex.RLock()
-			if hub.lastCallStartTime>0 && hub.CallerClient!=nil {
-				numberOfOnlineCallers++
-				if hub.LocalP2p && hub.RemoteP2p {
-					numberOfActivePureP2pCalls++
-				}
+func collectStats() Stats {
+	var stats Stats
+	for _,entry := range hubMap.Snapshot() {
+		hub := entry.Hub
+		stats.Callees++
+		hub.HubMutex.RLock()
+		if hub.lastCallStartTime>0 && hub.CallerClient!=nil {
+			stats.Callers++
+			if hub.LocalP2p && hub.RemoteP2p {
+				stats.PureP2pCalls++
 			}
-			hub.HubMutex.RUnlock()
 		}
+		hub.HubMutex.RUnlock()
 	}
-	hubMapMutex.RUnlock()
 
 	numberOfCallsTodayMutex.RLock()
-	retStr := fmt.Sprintf("stats callees:%d callers:%d/%d calls:%d callSecs:%d ping:%d pong:%d gor:%d",
-		numberOfOnlineCallees, numberOfOnlineCallers, numberOfActivePureP2pCalls,
-		numberOfCallsToday, numberOfCallSecondsToday, // feed by hub.processTimeValues()
-		atomic.LoadInt64(&pingSentCounter),
-		atomic.LoadInt64(&pongSentCounter),
-		runtime.NumGoroutine())
+	stats.CallsToday = numberOfCallsToday // feed by hub.processTimeValues()
+	stats.CallSecsToday = numberOfCallSecondsToday
 	numberOfCallsTodayMutex.RUnlock()
-	return retStr
+	stats.PingSent = atomic.LoadInt64(&pingSentCounter)
+	stats.PongSent = atomic.LoadInt64(&pongSentCounter)
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.UptimeSecs = int64(time.Since(serverStartTime).Seconds())
+	return stats
+}
+
+// getStats() creates a string from collectStats()
+func getStats() string {
+	stats := collectStats()
+	return fmt.Sprintf("stats callees:%d callers:%d/%d calls:%d callSecs:%d ping:%d pong:%d gor:%d",
+		stats.Callees, stats.Callers, stats.PureP2pCalls,
+		stats.CallsToday, stats.CallSecsToday,
+		stats.PingSent, stats.PongSent, stats.Goroutines)
 }
 
 // if timeLocationString is specified, operationalNow() will return
@@ -506,9 +644,19 @@ func readConfig(init bool) {
 		turnIP = readIniString(configIni, "turnIP", turnIP, "")
 		turnPort = readIniInt(configIni, "turnPort", turnPort, 0, 1) // 3739
 		turnRealm = readIniString(configIni, "turnRealm", turnRealm, "")
+		turnSecret = readIniString(configIni, "turnSecret", turnSecret, "")
 		pprofPort = readIniInt(configIni, "pprofPort", pprofPort, 0, 1) // 8980
 		dbPath = readIniString(configIni, "dbPath", dbPath, "db/")
 		if dbPath!="" && !strings.HasSuffix(dbPath,"/") { dbPath = dbPath+"/" }
+		dbKeyFile = readIniString(configIni, "dbKeyFile", dbKeyFile, "")
+		// db files served by one node to the other nodes (see dbRemote.go)
+		dbServer = readIniString(configIni, "dbServer", dbServer, "")
+		dbServerListen = readIniString(configIni, "dbServerListen", dbServerListen, "")
+		dbServerSecret = readIniString(configIni, "dbServerSecret", dbServerSecret, "")
+		hubRegistryKind = readIniString(configIni, "hubRegistry", hubRegistryKind, "local")
+		hubRegistryDir = readIniString(configIni, "hubRegistryDir", hubRegistryDir, "")
+		hubRegistryNode = readIniString(configIni, "hubRegistryNode", hubRegistryNode, "")
+		hubRegistryNodeTimeout = readIniInt(configIni, "hubRegistryNodeTimeout", hubRegistryNodeTimeout, 30, 1)
 		timeLocationString = readIniString(configIni, "timeLocation", timeLocationString, "")
 		wsUrl = readIniString(configIni, "wsUrl", wsUrl, "")
 		wssUrl = readIniString(configIni, "wssUrl", wssUrl, "")
@@ -516,15 +664,23 @@ func readConfig(init bool) {
 		twitterKey = readIniString(configIni, "twitterKey", twitterKey, "")
 		twitterSecret = readIniString(configIni, "twitterSecret", twitterSecret, "")
 
-		// currently not used
+		// web push (see webPush.go); create with "webcall vapidkeys"
 		vapidPublicKey = readIniString(configIni, "vapidPublicKey", vapidPublicKey, "")
 		vapidPrivateKey = readIniString(configIni, "vapidPrivateKey", vapidPrivateKey, "")
+		// allow the endpoints of cmd/wcpush on loopback; for testing only
+		webpushTestService = readIniBoolean(configIni, "webpushTestService", webpushTestService, false)
 	}
 
 	maintenanceMode = readIniBoolean(configIni, "maintenanceMode", maintenanceMode, false)
 	allowNewAccounts = readIniBoolean(configIni, "allowNewAccounts", allowNewAccounts, true)
 
 	multiCallees = readIniString(configIni, "multiCallees", multiCallees, "")
+	// several callees sharing one call link (see ringGroup.go)
+	newRingGroups := readIniString(configIni, "ringGroups", ringGroups, "")
+	if newRingGroups!=ringGroups || ringGroupMap==nil {
+		ringGroups = newRingGroups
+		ringGroupMap = parseRingGroups(ringGroups)
+	}
 
 	logevents = readIniString(configIni, "logevents", logevents, "")
 	logeventSlice := strings.Split(logevents, ",")
@@ -542,14 +698,36 @@ func readConfig(init bool) {
 
 	maxRingSecs = readIniInt(configIni, "maxRingSecs", maxRingSecs, 120, 1)
 	maxTalkSecsIfNoP2p = readIniInt(configIni, "maxTalkSecsIfNoP2p", maxTalkSecsIfNoP2p, 600, 1)
+	// how long a callee that lost its ws-connection during a call may resume (see wsResume.go); 0 = off
+	resumeGraceSecs = readIniInt(configIni, "resumeGraceSecs", resumeGraceSecs, 20, 1)
+	// callee clients that support call waiting may receive a 2nd caller (see wsCallWaiting.go)
+	callWaiting = readIniBoolean(configIni, "callWaiting", callWaiting, true)
+	// a callee may be logged in with this many devices; calls ring on all of them (see wsDevices.go)
+	maxDevices = readIniInt(configIni, "maxDevices", maxDevices, 4, 1)
 
 	turnDebugLevel = readIniInt(configIni, "turnDebugLevel", turnDebugLevel, 3, 1)
 
 	adminID = readIniString(configIni, "adminID", adminID, "")
 	adminEmail = readIniString(configIni, "adminEmail", adminEmail, "")
-
-	backupScript = readIniString(configIni, "backupScript", backupScript, "")
+	// email notifications (see emailNotify.go)
+	smtpHost = readIniString(configIni, "smtpHost", smtpHost, "")
+	smtpPort = readIniInt(configIni, "smtpPort", smtpPort, 587, 1)
+	smtpStartTLS = readIniBoolean(configIni, "smtpStartTLS", smtpStartTLS, true)
+	smtpUser = readIniString(configIni, "smtpUser", smtpUser, "")
+	smtpPassword = readIniString(configIni, "smtpPassword", smtpPassword, "")
+	smtpFrom = readIniString(configIni, "smtpFrom", smtpFrom, "")
+	emailDigestMins = readIniInt(configIni, "emailDigestMins", emailDigestMins, 60, 1)
+	adminApiReadKey = readIniString(configIni, "adminApiReadKey", adminApiReadKey, "")
+	adminApiWriteKey = readIniString(configIni, "adminApiWriteKey", adminApiWriteKey, "")
+
+	backupDir = readIniString(configIni, "backupDir", backupDir, "")
+	backupGzip = readIniBoolean(configIni, "backupGzip", backupGzip, false)
 	backupPauseMinutes = readIniInt(configIni, "backupPauseMinutes", backupPauseMinutes, 720, 1)
+	backupKeepDaily = readIniInt(configIni, "backupKeepDaily", backupKeepDaily, 7, 1)
+	backupKeepWeekly = readIniInt(configIni, "backupKeepWeekly", backupKeepWeekly, 4, 1)
+	if _,ok := readIniEntry(configIni, "backupScript"); ok && init {
+		fmt.Printf("# backupScript is not supported anymore, use backupDir (see backup.go)\n")
+	}
 
 	maxCallees = readIniInt(configIni, "maxCallees", maxCallees, 10000, 1)
 
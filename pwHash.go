@@ -0,0 +1,95 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Callee passwords are never stored in clear. hashPw() creates
+// a salted argon2id hash in the form of:
+// "$argon2id$v=19$m=65536,t=1,p=2$(salt)$(hash)"
+// The leading tag allows us to tell hashed passwords from
+// plaintext passwords stored by older server versions. And it
+// will allow us to change the hash parameters in the future.
+// verifyPw() accepts both and reports if the stored value
+// should be replaced by a fresh hash.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/argon2"
+)
+
+const pwHashTag = "$argon2id$"
+const pwHashTime = 1
+const pwHashMemory = 64*1024
+const pwHashThreads = 2
+const pwHashKeyLen = 32
+const pwHashSaltLen = 16
+
+func hashPw(pw string) (string,error) {
+	salt := make([]byte, pwHashSaltLen)
+	_,err := rand.Read(salt)
+	if err!=nil {
+		return "",err
+	}
+	hash := argon2.IDKey([]byte(pw), salt, pwHashTime, pwHashMemory, pwHashThreads, pwHashKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", pwHashTag, argon2.Version,
+		pwHashMemory, pwHashTime, pwHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func isPwHash(storedPw string) bool {
+	return strings.HasPrefix(storedPw,pwHashTag)
+}
+
+// verifyPw() returns true if pw matches storedPw
+// the 2nd return value is true if storedPw is outdated (plaintext or other hash params)
+// and should be replaced by hashPw(pw)
+func verifyPw(pw string, storedPw string) (bool,bool) {
+	if !isPwHash(storedPw) {
+		// stored by an older server version: plaintext
+		if subtle.ConstantTimeCompare([]byte(pw),[]byte(storedPw))==1 {
+			return true,true
+		}
+		return false,false
+	}
+
+	// "$argon2id$v=19$m=65536,t=1,p=2$salt$hash" -> "", "argon2id", "v=19", "m=..", salt, hash
+	tok := strings.Split(storedPw,"$")
+	if len(tok)!=6 {
+		fmt.Printf("# verifyPw malformed hash len(tok)=%d\n",len(tok))
+		return false,false
+	}
+	var version int
+	_,err := fmt.Sscanf(tok[2],"v=%d",&version)
+	if err!=nil || version!=argon2.Version {
+		fmt.Printf("# verifyPw unsupported version (%s) err=%v\n",tok[2],err)
+		return false,false
+	}
+	var memory uint32
+	var iterations uint32
+	var threads uint8
+	_,err = fmt.Sscanf(tok[3],"m=%d,t=%d,p=%d",&memory,&iterations,&threads)
+	if err!=nil {
+		fmt.Printf("# verifyPw malformed params (%s) err=%v\n",tok[3],err)
+		return false,false
+	}
+	salt,err := base64.RawStdEncoding.DecodeString(tok[4])
+	if err!=nil {
+		fmt.Printf("# verifyPw malformed salt err=%v\n",err)
+		return false,false
+	}
+	hash,err := base64.RawStdEncoding.DecodeString(tok[5])
+	if err!=nil {
+		fmt.Printf("# verifyPw malformed hash err=%v\n",err)
+		return false,false
+	}
+	pwHash := argon2.IDKey([]byte(pw), salt, iterations, memory, threads, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(pwHash,hash)!=1 {
+		return false,false
+	}
+	upgradeNeeded := memory!=pwHashMemory || iterations!=pwHashTime || threads!=pwHashThreads
+	return true,upgradeNeeded
+}
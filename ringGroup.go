@@ -0,0 +1,435 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Ring groups and hunt groups.
+// A group ID lets several callees share one call link (/user/<groupID>).
+// Groups are configured in config.ini (reloadable):
+//   ringGroups = support:parallel:alice/20,bob/30,carol:alice|sales:hunt:dave,erin/15
+// Every entry is groupID:mode:members[:missedCallsID]. A member may be given its own
+// ring time in seconds (default maxRingSecs). Missed calls to the group go to
+// missedCallsID (default: the first member).
+// hunt: /online returns the wsAddr of the first available member, with url args
+//   &grp=<groupID>&gm=<member index>. If that member does not pick up within its ring
+//   time, the caller receives "forward|/user/<groupID>?grp=<next index>" (see
+//   callForward.go) and /online?grp=<next index> continues with the next member.
+// parallel: /online answers "ringgroup"; the caller then repeats /online with url arg
+//   ringgroup=1 (and a long timeout). All available members, whose callee clients have
+//   sent "ringGroupCalls|true", are rung at the same time; /online?ringgroup=1 waits
+//   for the first member to take the call:
+//   member <- "groupCall|{"token":..,"group":..,"callerId":..,"callerName":..,"ringSecs":..}"
+//   member -> "groupPickup|<token>" or "groupReject|<token>"
+//   member <- "groupCallEnded|{"token":..,"reason":"answered|timeout|canceled|rejected"}"
+//   The member that sent groupPickup receives no groupCallEnded. Its hub is returned
+//   to the caller and the call is set up as usual; the client should pick up this call
+//   right away. If the member is not available anymore, it receives groupCallEnded
+//   (canceled), the caller gets "notavail" and the missed call is stored for the group.
+// If no member is available (or nobody picks up), /online returns "notavail" and the
+// caller may leave a missed call for the group (see missedCall()).
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"encoding/json"
+)
+
+const (
+	ringGroupHunt = "hunt"
+	ringGroupParallel = "parallel"
+	// caller.js gives up on /online after 2 minutes
+	maxParallelRingSecs = 110
+)
+
+type RingGroup struct {
+	id string
+	mode string
+	members []RingGroupMember
+	missedCallsID string
+}
+
+type RingGroupMember struct {
+	calleeID string
+	ringSecs int // 0 = maxRingSecs
+}
+
+// ringGroupMap is set by readConfig() (guarded by readConfigLock); a RingGroup is never modified
+var ringGroupMap map[string]*RingGroup
+
+func parseRingGroups(cfg string) map[string]*RingGroup {
+	groups := make(map[string]*RingGroup)
+	for _,entry := range strings.Split(cfg, "|") {
+		entry = strings.TrimSpace(entry)
+		if entry=="" {
+			continue
+		}
+		tok := strings.Split(entry, ":")
+		if len(tok)<3 {
+			fmt.Printf("# ringGroups invalid entry (%s)\n", entry)
+			continue
+		}
+		group := &RingGroup{id:strings.ToLower(strings.TrimSpace(tok[0])), mode:strings.TrimSpace(tok[1])}
+		if group.id=="" || (group.mode!=ringGroupHunt && group.mode!=ringGroupParallel) {
+			fmt.Printf("# ringGroups invalid entry (%s)\n", entry)
+			continue
+		}
+		for _,member := range strings.Split(tok[2], ",") {
+			member = strings.TrimSpace(member)
+			if member=="" {
+				continue
+			}
+			ringSecs := 0
+			if idx := strings.Index(member,"/"); idx>=0 {
+				secs,err := strconv.Atoi(member[idx+1:])
+				if err!=nil || secs<0 {
+					fmt.Printf("# ringGroups (%s) invalid member (%s)\n", group.id, member)
+					continue
+				}
+				member = member[:idx]
+				ringSecs = secs
+			}
+			group.members = append(group.members, RingGroupMember{strings.ToLower(member), ringSecs})
+		}
+		if len(group.members)==0 {
+			fmt.Printf("# ringGroups (%s) no members\n", group.id)
+			continue
+		}
+		group.missedCallsID = group.members[0].calleeID
+		if len(tok)>=4 && strings.TrimSpace(tok[3])!="" {
+			group.missedCallsID = strings.ToLower(strings.TrimSpace(tok[3]))
+		}
+		groups[group.id] = group
+	}
+	return groups
+}
+
+func lookupRingGroup(id string) *RingGroup {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return ringGroupMap[id]
+}
+
+// isRingGroupID tells if id is a group ID; a group ID can not be registered as a callee
+func isRingGroupID(id string) bool {
+	return lookupRingGroup(strings.ToLower(id))!=nil
+}
+
+func (group *RingGroup) memberRingSecs(idx int) int {
+	secs := group.members[idx].ringSecs
+	if secs<=0 {
+		readConfigLock.RLock()
+		secs = maxRingSecs
+		readConfigLock.RUnlock()
+	}
+	return secs
+}
+
+// nextMemberURL is sent to a hunt group caller, if member idx does not pick up
+func (group *RingGroup) nextMemberURL(idx int) string {
+	if group.mode!=ringGroupHunt || idx+1>=len(group.members) {
+		return ""
+	}
+	return "/user/"+group.id+"?grp="+strconv.Itoa(idx+1)
+}
+
+// ringGroupRingSecs returns the ring time for a caller that was sent to member idx of groupID
+func ringGroupRingSecs(groupID string, idx int, defaultSecs int) int {
+	group := lookupRingGroup(groupID)
+	if group==nil || idx<0 || idx>=len(group.members) {
+		return defaultSecs
+	}
+	return group.memberRingSecs(idx)
+}
+
+// ringGroupMemberWsAddr returns the wsAddr of member calleeID, if it is available
+// localOnly: do not return members managed by a remote server
+func ringGroupMemberWsAddr(r *http.Request, calleeID string, remoteAddr string, localOnly bool) (string,*Hub) {
+	glID, locHub, globHub, err := GetOnlineCallee(calleeID, true, true, true, remoteAddr, "/online")
+	if err!=nil || glID=="" {
+		return "",nil
+	}
+	if locHub!=nil {
+		locHub.HubMutex.RLock()
+		wsClientID := locHub.WsClientID
+		avail := locHub.CalleeClient!=nil && locHub.ConnectedCallerIp=="" && !locHub.IsCalleeHidden &&
+			wsClientID!=0 && locHub.suspendedCallee==nil
+		locHub.HubMutex.RUnlock()
+		if !avail {
+			return "",nil
+		}
+		return onlineWsAddr(r, wsClientID), locHub
+	}
+	if globHub!=nil && !localOnly {
+		if globHub.ConnectedCallerIp!="" || globHub.IsCalleeHidden || globHub.WsClientID==0 {
+			return "",nil
+		}
+		return globHubWsAddr(r, globHub), nil
+	}
+	return "",nil
+}
+
+// httpOnlineRingGroup is httpOnline() for a group ID
+func httpOnlineRingGroup(w http.ResponseWriter, r *http.Request, group *RingGroup, remoteAddr string, callerId string) {
+	if group.mode==ringGroupParallel {
+		url_arg_array, ok := r.URL.Query()["ringgroup"]
+		if !ok || len(url_arg_array[0])<1 {
+			// only this request of the caller waits for a member to pick up
+			fmt.Fprintf(w, "ringgroup")
+			return
+		}
+		ringGroupParallelCall(w, r, group, remoteAddr, callerId)
+		return
+	}
+	// hunt: the first member to try (after a ring timeout: the next member)
+	start := 0
+	url_arg_array, ok := r.URL.Query()["grp"]
+	if ok && len(url_arg_array[0]) >= 1 {
+		start,_ = strconv.Atoi(url_arg_array[0])
+		if start<0 {
+			start = 0
+		}
+	}
+	for idx := start; idx < len(group.members); idx++ {
+		wsAddr,_ := ringGroupMemberWsAddr(r, group.members[idx].calleeID, remoteAddr, false)
+		if wsAddr!="" {
+			fmt.Printf("/online (%s) hunt group member %d (%s) (%s) %s\n",
+				group.id, idx, group.members[idx].calleeID, callerId, remoteAddr)
+			fmt.Fprintf(w, "%s&grp=%s&gm=%d", wsAddr, url.QueryEscape(group.id), idx)
+			return
+		}
+	}
+	ringGroupNotAvail(w, group, remoteAddr)
+}
+
+func ringGroupNotAvail(w http.ResponseWriter, group *RingGroup, remoteAddr string) {
+	fmt.Printf("/online (%s) ring group notavail (missed calls: %s) %s\n",
+		group.id, group.missedCallsID, remoteAddr)
+	// remoteAddr is now eligible to send xhr /missedCall (for group.missedCallsID)
+	missedCallAllowedMutex.Lock()
+	missedCallAllowedMap[remoteAddr] = time.Now()
+	missedCallAllowedMutex.Unlock()
+	fmt.Fprintf(w, "notavail")
+}
+
+// ringGroupMissedCall stores a missed call of a group caller for group.missedCallsID
+func ringGroupMissedCall(groupID string, caller CallerInfo, cause string) {
+	group := lookupRingGroup(groupID)
+	if group==nil {
+		return
+	}
+	dbUser,err := getDbUserOfCallee(group.missedCallsID)
+	if err!=nil {
+		fmt.Printf("# ring group (%s) missed call for (%s) err=%v\n", groupID, group.missedCallsID, err)
+		return
+	}
+	if dbUser.StoreMissedCalls {
+		addMissedCall(group.missedCallsID, caller, "group "+groupID+" "+cause)
+	}
+}
+
+// a parallel group call, from the caller's /online until a member picks up
+type ringGroupCall struct {
+	token string
+	group *RingGroup
+	mutex sync.Mutex
+	ringing map[int]*WsClient // member index -> callee client
+	timers map[int]*WheelTimer
+	pickedUp *WsClient // the callee client of the member that picked up
+	done bool
+	result chan int // the member that picked up; -1 = nobody
+}
+
+var ringGroupCalls = make(map[string]*ringGroupCall)
+var ringGroupCallsMutex sync.Mutex
+
+func ringGroupParallelCall(w http.ResponseWriter, r *http.Request, group *RingGroup, remoteAddr string, callerId string) {
+	callerName := ""
+	url_arg_array, ok := r.URL.Query()["name"]
+	if ok && len(url_arg_array[0]) >= 1 {
+		callerName = url_arg_array[0]
+	}
+	call := &ringGroupCall{token:newResumeToken(), group:group,
+		ringing:make(map[int]*WsClient), timers:make(map[int]*WheelTimer), result:make(chan int,1)}
+	for idx,member := range group.members {
+		_,hub := ringGroupMemberWsAddr(r, member.calleeID, remoteAddr, true)
+		if hub==nil {
+			continue
+		}
+		hub.HubMutex.RLock()
+		calleeClient := hub.CalleeClient
+		accepts := hub.ringGroupCalls
+		hub.HubMutex.RUnlock()
+		if calleeClient!=nil && accepts {
+			call.ringing[idx] = calleeClient
+		}
+	}
+	if call.token=="" || len(call.ringing)==0 {
+		ringGroupNotAvail(w, group, remoteAddr)
+		return
+	}
+
+	ringGroupCallsMutex.Lock()
+	ringGroupCalls[call.token] = call
+	ringGroupCallsMutex.Unlock()
+	defer func() {
+		ringGroupCallsMutex.Lock()
+		delete(ringGroupCalls, call.token)
+		ringGroupCallsMutex.Unlock()
+	}()
+
+	fmt.Printf("/online (%s) ring group members=%d (%s) %s\n",
+		group.id, len(call.ringing), callerId, remoteAddr)
+	call.mutex.Lock()
+	for idx,calleeClient := range call.ringing {
+		idx := idx
+		ringSecs := group.memberRingSecs(idx)
+		if ringSecs<=0 || ringSecs>maxParallelRingSecs {
+			ringSecs = maxParallelRingSecs
+		}
+		call.timers[idx] = timerWheel.AfterFunc(time.Duration(ringSecs)*time.Second, func() {
+			call.endMember(idx, "timeout")
+		})
+		groupCallJson,err := json.Marshal(map[string]interface{}{
+			"token": call.token,
+			"group": group.id,
+			"callerId": callerId,
+			"callerName": callerName,
+			"ringSecs": ringSecs,
+		})
+		if err!=nil {
+			fmt.Printf("# /online (%s) ring group json err=%v\n", group.id, err)
+			continue
+		}
+		calleeClient.Write([]byte("groupCall|"+string(groupCallJson)))
+	}
+	call.mutex.Unlock()
+
+	select {
+	case idx := <-call.result:
+		if idx>=0 {
+			wsAddr,_ := ringGroupMemberWsAddr(r, group.members[idx].calleeID, remoteAddr, true)
+			if wsAddr!="" {
+				fmt.Printf("/online (%s) ring group picked up by member %d (%s) (%s) %s\n",
+					group.id, idx, group.members[idx].calleeID, callerId, remoteAddr)
+				fmt.Fprintf(w, "%s&grp=%s&gm=%d", wsAddr, url.QueryEscape(group.id), idx)
+				return
+			}
+			// the member went offline or busy right after picking up
+			fmt.Printf("/online (%s) ring group member %d (%s) picked up but is not available (%s) %s\n",
+				group.id, idx, group.members[idx].calleeID, callerId, remoteAddr)
+			call.mutex.Lock()
+			pickedUp := call.pickedUp
+			call.mutex.Unlock()
+			if pickedUp!=nil {
+				writeGroupCallEnded(pickedUp, call.token, "canceled")
+			}
+			ringGroupMissedCall(group.id, CallerInfo{remoteAddr, callerName, time.Now().Unix(), callerId, ""},
+				"pickup failed")
+			fmt.Fprintf(w, "notavail")
+			return
+		}
+		ringGroupNotAvail(w, group, remoteAddr)
+	case <-r.Context().Done():
+		// caller gave up
+		call.endAll("canceled")
+		missedCallAllowedMutex.Lock()
+		missedCallAllowedMap[remoteAddr] = time.Now()
+		missedCallAllowedMutex.Unlock()
+	}
+}
+
+func writeGroupCallEnded(client *WsClient, token string, reason string) {
+	groupCallEndedJson,err := json.Marshal(map[string]string{"token": token, "reason": reason})
+	if err!=nil {
+		return
+	}
+	client.Write([]byte("groupCallEnded|"+string(groupCallEndedJson)))
+}
+
+// endMember stops ringing member idx; if it was the last one, nobody has picked up
+func (call *ringGroupCall) endMember(idx int, reason string) {
+	call.mutex.Lock()
+	client,ok := call.ringing[idx]
+	if !ok {
+		call.mutex.Unlock()
+		return
+	}
+	delete(call.ringing, idx)
+	timerWheel.Stop(call.timers[idx])
+	delete(call.timers, idx)
+	last := len(call.ringing)==0 && !call.done
+	if last {
+		call.done = true
+	}
+	call.mutex.Unlock()
+
+	writeGroupCallEnded(client, call.token, reason)
+	if last {
+		call.result <- -1
+	}
+}
+
+func (call *ringGroupCall) endAll(reason string) {
+	call.endAllExcept(-1, reason)
+}
+
+// endAllExcept stops ringing all members but the one that picked up; false if ended already
+func (call *ringGroupCall) endAllExcept(except int, reason string) bool {
+	call.mutex.Lock()
+	if call.done {
+		call.mutex.Unlock()
+		return false
+	}
+	call.done = true
+	ringing := call.ringing
+	call.pickedUp = ringing[except]
+	for _,timer := range call.timers {
+		timerWheel.Stop(timer)
+	}
+	call.ringing = make(map[int]*WsClient)
+	call.timers = make(map[int]*WheelTimer)
+	call.mutex.Unlock()
+
+	for idx,client := range ringing {
+		if idx!=except {
+			writeGroupCallEnded(client, call.token, reason)
+		}
+	}
+	return true
+}
+
+// ringGroupAnswer is called for "groupPickup" and "groupReject" of a member callee client
+func (c *WsClient) ringGroupAnswer(token string, pickup bool) {
+	ringGroupCallsMutex.Lock()
+	call := ringGroupCalls[token]
+	ringGroupCallsMutex.Unlock()
+	if call==nil {
+		// ended already
+		return
+	}
+	idx := -1
+	call.mutex.Lock()
+	for memberIdx,client := range call.ringing {
+		if client==c {
+			idx = memberIdx
+			break
+		}
+	}
+	call.mutex.Unlock()
+	if idx<0 {
+		return
+	}
+	if !pickup {
+		fmt.Printf("%s (%s) ring group (%s) rejected %s\n", c.connType, c.calleeID, call.group.id, c.RemoteAddr)
+		call.endMember(idx, "rejected")
+		return
+	}
+	if call.endAllExcept(idx, "answered") {
+		fmt.Printf("%s (%s) ring group (%s) pickup %s\n", c.connType, c.calleeID, call.group.id, c.RemoteAddr)
+		call.result <- idx
+	}
+}
@@ -1,4 +1,14 @@
 // WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// runTurnServer() runs the TURN relay. Clients authenticate with
+// time-limited credentials in the style of the TURN REST API:
+// username = "(expiry unix time):(calleeID)"
+// credential = base64(hmac-sha1(turnSecret, username))
+// newTurnCredentials() issues them per call via the signaling
+// channel ("turnCred|..."). AuthHandler recomputes the credential
+// from the username, so a client can only authenticate with a
+// credential that was signed by us and that has not yet expired.
+
 package main
 
 import (
@@ -8,6 +18,12 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 
 	//"github.com/pion/turn/v2" // see: https://github.com/pion/turn/issues/206#issuecomment-907091251
 	"github.com/mehrvarz/turn/v2" // this _is_ pion/turn but with a minor patch for FF on Android
@@ -24,6 +40,46 @@ type TurnCallee struct {
 var recentTurnCalleeIps map[string]TurnCallee
 var recentTurnCalleeIpMutex sync.RWMutex
 
+type TurnCredentials struct {
+	Username string `json:"username"`
+	Credential string `json:"credential"`
+}
+
+// turnCredential returns the credential for the given username
+func turnCredential(username string) string {
+	readConfigLock.RLock()
+	mac := hmac.New(sha1.New, []byte(turnSecret))
+	readConfigLock.RUnlock()
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTurnCredentials returns "turnCred|{json}" to be sent to a client
+// the credentials are valid for validSecs
+func newTurnCredentials(calleeID string, validSecs int) (string,error) {
+	expiry := time.Now().Unix() + int64(validSecs)
+	username := fmt.Sprintf("%d:%s", expiry, calleeID)
+	jsonStr, err := json.Marshal(TurnCredentials{username, turnCredential(username)})
+	if err != nil {
+		return "",err
+	}
+	return "turnCred|"+string(jsonStr), nil
+}
+
+// turnCredValidSecs returns for how long turn credentials issued for a call of hub shall be valid
+// a relayed call will be terminated after maxTalkSecsIfNoP2p anyway
+func turnCredValidSecs(hub *Hub) int {
+	if hub.maxTalkSecsIfNoP2p<=0 {
+		// unlimited talk time
+		return 24*60*60
+	}
+	ringSecs := hub.maxRingSecs
+	if ringSecs<=0 {
+		ringSecs = 60*60
+	}
+	return ringSecs + hub.maxTalkSecsIfNoP2p + 60
+}
+
 func runTurnServer() {
 	if turnPort <= 0 {
 		return
@@ -31,6 +87,21 @@ func runTurnServer() {
 
 	recentTurnCalleeIps = make(map[string]TurnCallee)
 
+	readConfigLock.Lock()
+	if turnSecret=="" {
+		// without a configured turnSecret, credentials are only valid until restart
+		secret := make([]byte, 32)
+		_,err := rand.Read(secret)
+		if err != nil {
+			readConfigLock.Unlock()
+			fmt.Printf("# turn server failed to create a random turnSecret: %s\n", err)
+			return
+		}
+		turnSecret = hex.EncodeToString(secret)
+		fmt.Printf("turn server no turnSecret configured, using a random secret\n")
+	}
+	readConfigLock.Unlock()
+
 	fmt.Printf("turn server listening on '%s' port=%d\n", turnIP, turnPort)
 	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(turnPort))
 	if err != nil {
@@ -47,102 +118,57 @@ func runTurnServer() {
 	_, err = turn.NewServer(turn.ServerConfig{
 		Realm: ourRealm,
 		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-			// AuthHandler callback is called everytime a caller tries to authenticate with the TURN server
-			// - username is the "iceServers" username from Javascript
-			// - srcAddr is ip:port of caller (we receive 2 calls: same caller ip, but two different ports)
-			// note that for a relay connection to become available for both sides,
-			// only ONE side needs to successfully authenticate
+			// AuthHandler callback is called everytime a client tries to authenticate with the TURN server
+			// - username is the "iceServers" username from Javascript: "(expiry):(calleeID)"
+			// - srcAddr is ip:port of the client (we receive 2 calls: same client ip, but two different ports)
 			// we will:
-			// - return authKey,true if we find a ConnectedCallerIp in the global hub == srcAddr (without port)
+			// - return authKey,true if username carries a calleeID and has not yet expired
+			//   the turn server will then verify the client's credential against authKey
 			// - otherwise we return nil,false
 			//if logWantedFor("turn") {
 			//	fmt.Printf("turnauth username=(%s) srcAddr=(%v)\n", username, srcAddr)
 			//}
 			timeNow := time.Now()
-			foundIp := false
-			foundByMap := false
-			foundCalleeId := ""
-			// search for ipAddr without the port number
-			// bc srcAddr is from the turn client and IpInHubMap is from the websocket client (different ports)
-			// TODO this could create issues; srcAddr should be same as IpInHubMap
-			// so we don't need to cut the port
-
-			// ipAddr is the caller ip without :port
+
+			// ipAddr is the client ip without :port
 			ipAddr := srcAddr.String()
 			if portIdx := strings.Index(ipAddr, ":"); portIdx >= 0 {
 				ipAddr = ipAddr[:portIdx]
 			}
 
-			recentTurnCalleeIpMutex.RLock()
-			turnCallee, ok := recentTurnCalleeIps[ipAddr]
-			recentTurnCalleeIpMutex.RUnlock()
-			if ok {
-				timeSinceFirstFound := timeNow.Sub(turnCallee.TimeStored)
-				if timeSinceFirstFound.Seconds() <= float64(maxTalkSecsIfNoP2p) {
-					foundIp = true
-					foundCalleeId = turnCallee.CalleeID
-					foundByMap = true
-					//fmt.Printf("turnauth session foundIp foundByMap %v\n", foundCalleeId)
-				} else {
-					// turn session is outdated, will not anymore be authenticated
-					// check if callee is offline or not connected, in which case we will not log session outdated
-					_, locHub, _, err := GetOnlineCallee(turnCallee.CalleeID, true, true, true, "", "turn")
-					if err==nil && locHub==nil {
-						// turnCallee.CalleeID is offline: don't log
-					} else if err==nil && locHub.ConnectedCallerIp == "" {
-						// turnCallee.CalleeID is online but not connected: don't log
-					} else {
-						fmt.Printf("turnauth (%s) session outdated %s %v %d\n",
-							turnCallee.CalleeID, ipAddr, timeSinceFirstFound.Seconds(), maxTalkSecsIfNoP2p)
-					}
-				}
-			} else {
-				// here I check if ipAddr is listed anywhere in hubMap as a callerIp
-				// in other words: the connection will be authenticated to use turn
-				// by the caller (!), not by the callee
-				// we do this bc only one of the two sides needs to authenticate
-
-				// SearchCallerIpInHubMap() returns the callee ip and ID for the given caller ipAddr
-				foundIp, foundCalleeId, err = SearchCallerIpInHubMap(ipAddr)
-				if err != nil {
-					fmt.Printf("# turnauth for %s err=%v\n", ipAddr, err)
-					return nil, false
-				}
-				if foundIp {
-					//fmt.Printf("turn service approved for (%s) %v\n", foundCalleeId, ipAddr)
-					if !foundByMap {
-						recentTurnCalleeIpMutex.Lock()
-						recentTurnCalleeIps[ipAddr] = TurnCallee{foundCalleeId, timeNow}
-						//if logWantedFor("turn") {
-						//	fmt.Printf("turn auth added (%s) to recentTurnCalleeIps len=%d\n",
-						//		ipAddr, len(recentTurnCalleeIps))
-						//}
-						recentTurnCalleeIpMutex.Unlock()
-
-						// NOTE: recentTurnCalleeIps[ipAddr] will be deleted
-						//       in wsClient.go peerConHasEnded() on 'peer callee discon'
-					}
-				} else {
-					//fmt.Printf("turn service not approved for %v\n", ipAddr)
+			idxColon := strings.Index(username, ":")
+			if idxColon<0 {
+				if logWantedFor("turn") {
+					fmt.Printf("turnauth denied for %v malformed username (%s)\n", ipAddr, username)
 				}
+				return nil, false
 			}
-			if foundIp {
-				if !foundByMap /*&& logWantedFor("turn") */ {
-					recentTurnCalleeIpMutex.RLock()
-					fmt.Printf("turnauth (%s) for caller %v %d\n",
-						foundCalleeId, ipAddr, len(recentTurnCalleeIps))
-					recentTurnCalleeIpMutex.RUnlock()
+			expiry, err := strconv.ParseInt(username[:idxColon], 10, 64)
+			calleeID := username[idxColon+1:]
+			if err!=nil || calleeID=="" {
+				if logWantedFor("turn") {
+					fmt.Printf("turnauth denied for %v malformed username (%s)\n", ipAddr, username)
 				}
-				// NOTE: the same key strings are used in caller.js and callee.js
-				// it doesn't matter what they are, but they must be the same
-				authKey := turn.GenerateAuthKey("c807ec29df3c9ff", realm, "736518fb4232d44")
-				return authKey, true
+				return nil, false
+			}
+			if timeNow.Unix() > expiry {
+				fmt.Printf("turnauth (%s) denied for %v credentials expired %ds ago\n",
+					calleeID, ipAddr, timeNow.Unix()-expiry)
+				return nil, false
 			}
 
-			if logWantedFor("turn") {
-				fmt.Printf("turnauth denied for %v\n", ipAddr)
+			recentTurnCalleeIpMutex.Lock()
+			_, ok := recentTurnCalleeIps[ipAddr]
+			if !ok {
+				recentTurnCalleeIps[ipAddr] = TurnCallee{calleeID, timeNow}
+				// NOTE: recentTurnCalleeIps[ipAddr] will be deleted
+				//       in wsClient.go peerConHasEnded() on 'peer callee discon'
+				fmt.Printf("turnauth (%s) for %v %d\n", calleeID, ipAddr, len(recentTurnCalleeIps))
 			}
-			return nil, false
+			recentTurnCalleeIpMutex.Unlock()
+
+			authKey := turn.GenerateAuthKey(username, realm, turnCredential(username))
+			return authKey, true
 		},
 		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
 		PacketConnConfigs: []turn.PacketConnConfig{
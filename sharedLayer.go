@@ -0,0 +1,629 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// sharedHubRegistry keeps the state of all online callees in a directory
+// that is shared by all webcall processes serving the same user base
+// (on the same host or on a shared filesystem).
+// Every online callee is stored as one JSON file (SharedHubEntry), named after
+// its global calleeID; the calleeID!ext files of multiCallees are kept in the
+// sub dir calleeID!, so a lookup never reads the whole directory.
+// A file is only written by the process (node) serving the callee.
+// The *Hub of a callee served by this process is also kept in the local hubMap
+// (see skvLayer.go), so all local lookups work as with localHubRegistry.
+//
+// Callers always meet the callee on the callee's node: /online on any node
+// hands out the ws url of the node serving the callee (see globHub in httpOnline.go).
+//
+// Node liveness: every node writes its SharedNode file to hubRegistryDir/nodes/
+// every 10s (Heartbeat), with the number of callees it serves. The entries of
+// a node whose file was not updated for hubRegistryNodeTimeout secs are ignored
+// and get removed by the other nodes.
+// A node removes its own entries on startup and shutdown.
+// The name of a node (hubRegistryNode, default hostname:wsPort) must be unique.
+//
+// Only the online callees are kept in hubRegistryDir. Accounts, passwords,
+// sessions, missed calls and contacts are in the db files, so all nodes must use
+// the db files of the same node (dbServerListen / dbServer, see dbRemote.go).
+// Every node file carries the DbID; a node refuses to start if a live node uses other db files.
+//
+// Several nodes on one machine, each in its own directory with its own config.ini:
+//   httpPort = 8067         httpPort = 8068
+//   wsPort = 8071           wsPort = 8072
+//   wsUrl = ws://host:8071/ws    wsUrl = ws://host:8072/ws
+//   hubRegistry = shared    hubRegistry = shared
+//   hubRegistryDir = /var/lib/webcall/hubs   (same for all nodes)
+//   dbServerListen = 127.0.0.1:8090          dbServer = 127.0.0.1:8090
+//   dbServerSecret = ...                     (same for all nodes)
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"sync"
+	"sync/atomic"
+	"errors"
+	"strings"
+	"net/url"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+)
+
+type SharedHubEntry struct {
+	GlobalID string
+	Node string // the webcall process serving the callee
+	WsUrl string
+	WssUrl string
+	WsClientID uint64
+	ConnectedCallerIp string
+	IsCalleeHidden bool
+	IsUnHiddenForCallerAddr string
+	Updated int64
+}
+
+type SharedNode struct {
+	Node string
+	WsUrl string
+	WssUrl string
+	Started int64
+	Updated int64
+	DbID string
+	Callees int64 // number of callees served by the node (at Updated)
+}
+
+type sharedHubRegistry struct {
+	dir string
+	node string
+	nodeTimeout int64 // secs
+	started int64
+	wsUrl string
+	wssUrl string
+	mutex sync.Mutex // serializes read-modify-write of our own entries
+	otherCallees int64 // callees of the other live nodes, as of the last Heartbeat (atomic)
+}
+
+func newSharedHubRegistry(dir string, node string, nodeTimeout int64) (*sharedHubRegistry,error) {
+	err := os.MkdirAll(filepath.Join(dir,"nodes"), 0700)
+	if err!=nil {
+		return nil, err
+	}
+	r := &sharedHubRegistry{dir:dir, node:node, nodeTimeout:nodeTimeout, started:time.Now().Unix()}
+
+	// the ws urls handed out to callers of our callees (see httpOnline.go)
+	readConfigLock.RLock()
+	r.wsUrl = wsUrl
+	if r.wsUrl=="" {
+		r.wsUrl = fmt.Sprintf("ws://%s:%d/ws", hostname, wsPort)
+	}
+	r.wssUrl = wssUrl
+	if r.wssUrl=="" {
+		if wssPort>0 {
+			r.wssUrl = fmt.Sprintf("wss://%s:%d/ws", hostname, wssPort)
+		} else {
+			r.wssUrl = r.wsUrl
+		}
+	}
+	readConfigLock.RUnlock()
+
+	// all live nodes must use the same db files
+	minUpdated := time.Now().Unix() - nodeTimeout
+	for _,other := range r.readNodes() {
+		if other.Node!=node && other.Updated >= minUpdated && other.DbID!=dbID {
+			return nil, fmt.Errorf("node %s uses db %s, this node uses db %s", other.Node, other.DbID, dbID)
+		}
+	}
+
+	// entries left behind by a previous run of this node are stale
+	count := r.removeOwnEntries()
+	fmt.Printf("hubRegistry shared dir=%s node=%s (removed %d stale entries)\n", dir, node, count)
+	err = r.writeNode()
+	if err!=nil {
+		return nil, err
+	}
+	// entries of nodes that are gone
+	r.removeDeadEntries(r.liveNodes())
+	return r, nil
+}
+
+func (r *sharedHubRegistry) nodePath(node string) string {
+	return filepath.Join(r.dir, "nodes", url.PathEscape(node)+".json")
+}
+
+func (r *sharedHubRegistry) writeNode() error {
+	data, err := json.Marshal(SharedNode{r.node, r.wsUrl, r.wssUrl, r.started, time.Now().Unix(), dbID,
+		hubMap.Len()})
+	if err!=nil {
+		return err
+	}
+	file, err := ioutil.TempFile(r.dir, ".tmp-")
+	if err!=nil {
+		return err
+	}
+	_,err = file.Write(data)
+	if err2 := file.Close(); err==nil {
+		err = err2
+	}
+	if err==nil {
+		err = os.Rename(file.Name(), r.nodePath(r.node))
+	}
+	if err!=nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// readNodes returns all nodes that have a node file (alive or not)
+func (r *sharedHubRegistry) readNodes() []SharedNode {
+	var nodes []SharedNode
+	files, err := ioutil.ReadDir(filepath.Join(r.dir, "nodes"))
+	if err!=nil {
+		fmt.Printf("# hubRegistry nodes dir=%s err=%v\n", r.dir, err)
+		return nil
+	}
+	for _,file := range files {
+		if !strings.HasSuffix(file.Name(),".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, "nodes", file.Name()))
+		if err!=nil {
+			continue
+		}
+		var node SharedNode
+		if json.Unmarshal(data, &node)==nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// liveNodes returns the names of the nodes with a recent heartbeat
+func (r *sharedHubRegistry) liveNodes() map[string]bool {
+	live := make(map[string]bool)
+	live[r.node] = true
+	minUpdated := time.Now().Unix() - r.nodeTimeout
+	for _,node := range r.readNodes() {
+		if node.Updated >= minUpdated {
+			live[node.Node] = true
+		}
+	}
+	return live
+}
+
+// removeDeadEntries removes all entries of nodes that are not live
+func (r *sharedHubRegistry) removeDeadEntries(live map[string]bool) int {
+	count := 0
+	for _,entry := range r.list(func(string) bool { return true }) {
+		if !live[entry.Node] {
+			if r.removeStale(entry) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// removeStale removes the entry file of globalID only if it still is the stale entry;
+// another node may have taken it over since stale was read
+func (r *sharedHubRegistry) removeStale(stale *SharedHubEntry) bool {
+	path := r.path(stale.GlobalID)
+	// moving the file away is atomic: only one node gets it
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".stale-%s-%d", url.PathEscape(r.node), time.Now().UnixNano()))
+	if os.Rename(path, tmpPath)!=nil {
+		// removed by someone else
+		return false
+	}
+	data, err := ioutil.ReadFile(tmpPath)
+	var entry SharedHubEntry
+	if err==nil && json.Unmarshal(data, &entry)==nil &&
+			(entry.Node!=stale.Node || entry.Updated!=stale.Updated) {
+		// a new entry: put it back (Link does not replace a file created in the meantime)
+		os.Link(tmpPath, path)
+		os.Remove(tmpPath)
+		return false
+	}
+	os.Remove(tmpPath)
+	return true
+}
+
+// Heartbeat tells the other nodes that we are alive and removes the entries of dead nodes
+func (r *sharedHubRegistry) Heartbeat() {
+	err := r.writeNode()
+	if err!=nil {
+		fmt.Printf("# hubRegistry heartbeat node=%s err=%v\n", r.node, err)
+	}
+	minUpdated := time.Now().Unix() - r.nodeTimeout
+	var deadNodes []SharedNode
+	var otherCallees int64
+	for _,node := range r.readNodes() {
+		if node.Node==r.node {
+			continue
+		}
+		if node.Updated < minUpdated {
+			deadNodes = append(deadNodes, node)
+		} else {
+			otherCallees += node.Callees
+		}
+	}
+	atomic.StoreInt64(&r.otherCallees, otherCallees)
+	if len(deadNodes)==0 {
+		return
+	}
+	count := r.removeDeadEntries(r.liveNodes())
+	for _,node := range deadNodes {
+		os.Remove(r.nodePath(node.Node))
+		fmt.Printf("hubRegistry node %s is gone (last heartbeat %ds ago)\n",
+			node.Node, time.Now().Unix()-node.Updated)
+	}
+	if count>0 {
+		fmt.Printf("hubRegistry removed %d entries of dead nodes\n", count)
+	}
+}
+
+// path: calleeID.json or, for multiCallees, calleeID!/calleeID!ext.json
+// so that all entries of a callee can be found without reading the whole dir
+func (r *sharedHubRegistry) path(globalID string) string {
+	if idxExcl := strings.Index(globalID,"!"); idxExcl>=0 {
+		return filepath.Join(r.extDir(globalID[:idxExcl]), url.PathEscape(globalID)+".json")
+	}
+	return filepath.Join(r.dir, url.PathEscape(globalID)+".json")
+}
+
+// extDir is the dir of the calleeID!ext entries of calleeID
+func (r *sharedHubRegistry) extDir(calleeID string) string {
+	return filepath.Join(r.dir, url.PathEscape(calleeID)+"!")
+}
+
+func (r *sharedHubRegistry) mkdir(globalID string) error {
+	if idxExcl := strings.Index(globalID,"!"); idxExcl>=0 {
+		return os.MkdirAll(r.extDir(globalID[:idxExcl]), 0700)
+	}
+	return nil
+}
+
+func (r *sharedHubRegistry) read(globalID string) (*SharedHubEntry,error) {
+	data, err := ioutil.ReadFile(r.path(globalID))
+	if err!=nil {
+		return nil, err
+	}
+	var entry SharedHubEntry
+	err = json.Unmarshal(data, &entry)
+	if err!=nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// create stores a new entry; fails with os.ErrExist if globalID is already taken
+func (r *sharedHubRegistry) create(entry *SharedHubEntry) error {
+	data, err := json.Marshal(entry)
+	if err!=nil {
+		return err
+	}
+	err = r.mkdir(entry.GlobalID)
+	if err!=nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path(entry.GlobalID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err!=nil {
+		return err
+	}
+	_,err = file.Write(data)
+	if err2 := file.Close(); err==nil {
+		err = err2
+	}
+	if err!=nil {
+		os.Remove(r.path(entry.GlobalID))
+	}
+	return err
+}
+
+// write replaces an entry atomically, so readers never see a partial file
+func (r *sharedHubRegistry) write(entry *SharedHubEntry) error {
+	data, err := json.Marshal(entry)
+	if err!=nil {
+		return err
+	}
+	err = r.mkdir(entry.GlobalID)
+	if err!=nil {
+		return err
+	}
+	file, err := ioutil.TempFile(r.dir, ".tmp-")
+	if err!=nil {
+		return err
+	}
+	_,err = file.Write(data)
+	if err2 := file.Close(); err==nil {
+		err = err2
+	}
+	if err==nil {
+		err = os.Rename(file.Name(), r.path(entry.GlobalID))
+	}
+	if err!=nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// update modifies the entry of one of our own callees
+func (r *sharedHubRegistry) update(globalID string, fn func(entry *SharedHubEntry)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, err := r.read(globalID)
+	if err!=nil {
+		return err
+	}
+	if entry.Node!=r.node {
+		return errors.New("entry owned by "+entry.Node)
+	}
+	fn(entry)
+	entry.Updated = time.Now().Unix()
+	return r.write(entry)
+}
+
+// entryNames returns the global calleeIDs of all entries in dir
+// plus the sub dirs holding calleeID!ext entries
+func entryNames(dir string) ([]string,[]string,error) {
+	files, err := ioutil.ReadDir(dir)
+	if err!=nil {
+		return nil, nil, err
+	}
+	var globalIDs, extDirs []string
+	for _,file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name,".") {
+			continue
+		}
+		if file.IsDir() {
+			if strings.HasSuffix(name,"!") {
+				extDirs = append(extDirs, filepath.Join(dir,name))
+			}
+			continue
+		}
+		if !strings.HasSuffix(name,".json") {
+			continue
+		}
+		globalID, err := url.PathUnescape(strings.TrimSuffix(name,".json"))
+		if err==nil {
+			globalIDs = append(globalIDs, globalID)
+		}
+	}
+	return globalIDs, extDirs, nil
+}
+
+// list returns all entries (of all nodes) for which fn returns true
+// it reads the whole dir; to look up one callee, use lookup()
+func (r *sharedHubRegistry) list(fn func(globalID string) bool) []*SharedHubEntry {
+	globalIDs, extDirs, err := entryNames(r.dir)
+	if err!=nil {
+		fmt.Printf("# hubRegistry list dir=%s err=%v\n", r.dir, err)
+		return nil
+	}
+	for _,extDir := range extDirs {
+		extIDs,_,err := entryNames(extDir)
+		if err==nil {
+			globalIDs = append(globalIDs, extIDs...)
+		}
+	}
+	var entries []*SharedHubEntry
+	for _,globalID := range globalIDs {
+		if !fn(globalID) {
+			continue
+		}
+		entry, err := r.read(globalID)
+		if err!=nil {
+			// may have been deleted in the meantime
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// lookup returns the entries of calleeID and of its calleeID!ext multiCallees
+func (r *sharedHubRegistry) lookup(calleeID string) []*SharedHubEntry {
+	var entries []*SharedHubEntry
+	if entry, err := r.read(calleeID); err==nil {
+		entries = append(entries, entry)
+	}
+	extIDs,_,err := entryNames(r.extDir(calleeID))
+	if err!=nil {
+		// no multiCallee of calleeID was ever online
+		return entries
+	}
+	for _,globalID := range extIDs {
+		if entry, err := r.read(globalID); err==nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (r *sharedHubRegistry) removeOwnEntries() int {
+	count := 0
+	for _,entry := range r.list(func(string) bool { return true }) {
+		if entry.Node==r.node {
+			if os.Remove(r.path(entry.GlobalID))==nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (r *sharedHubRegistry) GetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,*Hub,error) {
+	key, locHub, err := locGetOnlineCallee(calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
+		callerIpAddr, comment)
+	if err!=nil || key!="" {
+		return key, locHub, nil, err
+	}
+
+	// search the callees of the other nodes
+	entries := r.lookup(calleeID)
+	if len(entries)==0 {
+		return "", nil, nil, nil
+	}
+	live := r.liveNodes()
+	hubs := make(map[string]*Hub)
+	for _,entry := range entries {
+		if entry.Node==r.node {
+			// our own callees are in hubMap
+			continue
+		}
+		if !live[entry.Node] {
+			if logWantedFor("searchhub") {
+				fmt.Printf("GetOnlineCallee %s skip entry of dead node %s\n", entry.GlobalID, entry.Node)
+			}
+			continue
+		}
+		hubs[entry.GlobalID] = &Hub{
+			WsUrl: entry.WsUrl,
+			WssUrl: entry.WssUrl,
+			WsClientID: entry.WsClientID,
+			ConnectedCallerIp: entry.ConnectedCallerIp,
+			IsCalleeHidden: entry.IsCalleeHidden,
+			IsUnHiddenForCallerAddr: entry.IsUnHiddenForCallerAddr,
+		}
+	}
+	key, globHub := findOnlineCallee(hubs, calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
+		callerIpAddr, comment)
+	return key, nil, globHub, nil
+}
+
+func (r *sharedHubRegistry) StoreCalleeInHubMap(key string, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
+	for i:=0; i<10; i++ {
+		globalID, lenHubMap, err := locStoreCalleeInHubMap(key, nil, multiCallees, remoteAddrWithPort,
+			wsClientID, skipConfirm)
+		if err!=nil {
+			return globalID, lenHubMap, err
+		}
+		entry := &SharedHubEntry{GlobalID:globalID, Node:r.node, WsUrl:r.wsUrl, WssUrl:r.wssUrl,
+			WsClientID:wsClientID, Updated:time.Now().Unix()}
+		r.mutex.Lock()
+		err = r.create(entry)
+		if os.IsExist(err) {
+			oldEntry, err2 := r.read(globalID)
+			if err2==nil && oldEntry.Node==r.node {
+				// a leftover of ours: replace it
+				err = r.write(entry)
+			} else if err2==nil && !r.liveNodes()[oldEntry.Node] {
+				// a leftover of a dead node: take over; other nodes may try the same,
+				// only the one whose create() succeeds gets it
+				r.removeStale(oldEntry)
+				err = r.create(entry)
+				if err==nil {
+					fmt.Printf("hubRegistry StoreCalleeInHubMap (%s) takeover from dead node %s\n",
+						globalID, oldEntry.Node)
+				} else if os.IsExist(err) {
+					if newEntry, err3 := r.read(globalID); err3==nil {
+						err = errors.New(globalID+" is online on "+newEntry.Node)
+					}
+				}
+			} else if err2==nil {
+				err = errors.New(globalID+" is online on "+oldEntry.Node)
+			}
+		}
+		r.mutex.Unlock()
+		if err==nil {
+			return globalID, lenHubMap, nil
+		}
+		locDeleteFromHubMap(globalID)
+		if globalID==key {
+			// not a multiCallee: there is only this one globalID
+			return "", lenHubMap, err
+		}
+		// multiCallee: try another globalID
+		fmt.Printf("hubRegistry StoreCalleeInHubMap (%s) retry err=%v\n", globalID, err)
+	}
+	return "", 0, errors.New("no free globalID for "+key)
+}
+
+func (r *sharedHubRegistry) SetUnHiddenForCaller(calleeId string, callerIp string) error {
+	err := locSetUnHiddenForCaller(calleeId, callerIp)
+	if err==nil {
+		err = r.update(calleeId, func(entry *SharedHubEntry) {
+			entry.IsUnHiddenForCallerAddr = callerIp
+		})
+	}
+	return err
+}
+
+func (r *sharedHubRegistry) StoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
+	err := locStoreCallerIpInHubMap(calleeId, callerIp, skipConfirm)
+	if err==nil {
+		err = r.update(calleeId, func(entry *SharedHubEntry) {
+			entry.ConnectedCallerIp = callerIp
+		})
+	}
+	return err
+}
+
+func (r *sharedHubRegistry) SetCalleeHiddenState(calleeId string, hidden bool) error {
+	err := locSetCalleeHiddenState(calleeId, hidden)
+	if err==nil {
+		err = r.update(calleeId, func(entry *SharedHubEntry) {
+			entry.IsCalleeHidden = hidden
+		})
+	}
+	return err
+}
+
+func (r *sharedHubRegistry) GetRandomCalleeID() (string,error) {
+	for {
+		newCalleeId, err := locGetRandomCalleeID()
+		if err!=nil {
+			return "", err
+		}
+		if _,err = os.Stat(r.path(newCalleeId)); os.IsNotExist(err) {
+			return newCalleeId, nil
+		}
+	}
+}
+
+func (r *sharedHubRegistry) SearchCallerIpInHubMap(ipAddr string) (bool,string,error) {
+	found, calleeID, err := locSearchCallerIpInHubMap(ipAddr)
+	if found || err!=nil {
+		return found, calleeID, err
+	}
+	var live map[string]bool
+	for _,entry := range r.list(func(string) bool { return true }) {
+		if entry.Node!=r.node && strings.HasPrefix(entry.ConnectedCallerIp,ipAddr) {
+			if live==nil {
+				live = r.liveNodes()
+			}
+			if !live[entry.Node] {
+				continue
+			}
+			calleeID = entry.GlobalID
+			if idxExcl := strings.Index(calleeID,"!"); idxExcl>=0 {
+				calleeID = calleeID[:idxExcl]
+			}
+			return true, calleeID, nil
+		}
+	}
+	return false, "", nil
+}
+
+func (r *sharedHubRegistry) DeleteFromHubMap(globalID string) (int64,int64) {
+	lenHubMap,err := locDeleteFromHubMap(globalID)
+	if err!=nil {
+		return int64(0),int64(0)
+	}
+	r.mutex.Lock()
+	entry, err := r.read(globalID)
+	if err==nil && entry.Node==r.node {
+		err = os.Remove(r.path(globalID))
+		if err!=nil {
+			fmt.Printf("# hubRegistry DeleteFromHubMap (%s) err=%v\n", globalID, err)
+		}
+	}
+	r.mutex.Unlock()
+	// the callees of the other nodes are counted by their heartbeats, no need to read the dir
+	return lenHubMap, lenHubMap + atomic.LoadInt64(&r.otherCallees)
+}
+
+// Close removes the entries of this node (on shutdown)
+func (r *sharedHubRegistry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeOwnEntries()
+	os.Remove(r.nodePath(r.node))
+}
@@ -0,0 +1,191 @@
+package skv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Values can optionally be encrypted with AES-256-GCM before they are written.
+// SetKeys() must be called before any store is opened. The first key is used
+// to encrypt, all keys are used to decrypt, so keys can be rotated: put a new
+// key first, keep the old ones until all values have been rewritten (Rekey()).
+// Encrypted values are stored as:
+//   cryptMagic | key id (1 byte) | nonce (12 bytes) | sealed gob
+// bucket name and key are authenticated along with the value, so an encrypted
+// value cannot be moved to another key. Values without cryptMagic are read as
+// plain gob, so existing databases keep working until they are migrated.
+// The internal expiration buckets are not encrypted.
+
+var cryptMagic = []byte("skvE")
+
+var (
+	ErrDecrypt = errors.New("skv cannot decrypt value")
+	ErrNoKey = errors.New("skv value encrypted with unknown key")
+)
+
+// Key is an encryption key with its id. Key must be 32 bytes long (AES-256).
+type Key struct {
+	ID  byte
+	Key []byte
+}
+
+var cryptActiveID byte
+var cryptAEADs map[byte]cipher.AEAD // nil = encryption off
+
+// SetKeys enables encryption (or disables it, if keys is empty).
+func SetKeys(keys []Key) error {
+	if len(keys) == 0 {
+		cryptAEADs = nil
+		return nil
+	}
+	aeads := make(map[byte]cipher.AEAD)
+	for _, key := range keys {
+		if len(key.Key) != 32 {
+			return fmt.Errorf("skv key %d must have 32 bytes (has %d)", key.ID, len(key.Key))
+		}
+		if _, ok := aeads[key.ID]; ok {
+			return fmt.Errorf("skv key id %d used twice", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		aeads[key.ID] = aead
+	}
+	cryptActiveID = keys[0].ID
+	cryptAEADs = aeads
+	return nil
+}
+
+// Encrypted tells if SetKeys() has enabled encryption.
+func Encrypted() bool {
+	return cryptAEADs != nil
+}
+
+func cryptAD(bucketName string, key string) []byte {
+	return []byte(bucketName + "\x00" + key)
+}
+
+// seal encrypts the gob-encoded value of an entry (if encryption is enabled)
+func seal(bucketName string, key string, data []byte) ([]byte, error) {
+	if cryptAEADs == nil || IsInternalBucket(bucketName) {
+		return data, nil
+	}
+	aead := cryptAEADs[cryptActiveID]
+	out := make([]byte, 0, len(cryptMagic)+1+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(out, cryptMagic...)
+	out = append(out, cryptActiveID)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, cryptAD(bucketName, key)), nil
+}
+
+// unseal returns the gob-encoded value of an entry
+func unseal(bucketName string, key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, cryptMagic) || IsInternalBucket(bucketName) {
+		// plain value
+		return data, nil
+	}
+	if len(data) < len(cryptMagic)+1 {
+		return nil, ErrDecrypt
+	}
+	aead, ok := cryptAEADs[data[len(cryptMagic)]]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	data = data[len(cryptMagic)+1:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], cryptAD(bucketName, key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func encodeValue(bucketName string, key string, value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return seal(bucketName, key, buf.Bytes())
+}
+
+func decodeValue(bucketName string, key string, data []byte, value interface{}) error {
+	plain, err := unseal(bucketName, key, data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(plain)).Decode(value)
+}
+
+// Rekey rewrites every value of the file with the active key in a single
+// transaction and returns the number of values rewritten. Values already sealed
+// with the active key are left alone. It is used to encrypt an existing file and
+// to retire an old key. With encryption off, there is nothing to do for plain
+// files, and encrypted values cannot be read (ErrNoKey).
+func (kvs SKV) Rekey() (int, error) {
+	count := 0
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	err := kvs.Db.Update(func(tx *bolt.Tx) error {
+		var bucketNames [][]byte
+		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !IsInternalBucket(string(name)) {
+				bucketNames = append(bucketNames, append([]byte{}, name...))
+			}
+			return nil
+		})
+		for _, name := range bucketNames {
+			bucketName := string(name)
+			b := tx.Bucket(name)
+			// collect first: a bucket must not be modified while a cursor walks it
+			var records []Record
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if v == nil {
+					// nested bucket
+					continue
+				}
+				if cryptAEADs == nil {
+					if !bytes.HasPrefix(v, cryptMagic) {
+						continue
+					}
+				} else if bytes.HasPrefix(v, cryptMagic) && len(v) > len(cryptMagic) && v[len(cryptMagic)] == cryptActiveID {
+					continue
+				}
+				plain, err := unseal(bucketName, string(k), v)
+				if err != nil {
+					return fmt.Errorf("%s %s: %v", bucketName, k, err)
+				}
+				records = append(records, Record{Bucket: bucketName, Key: string(k), Data: append([]byte{}, plain...)})
+			}
+			for _, record := range records {
+				data, err := seal(bucketName, record.Key, record.Data)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(record.Key), data); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
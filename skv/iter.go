@@ -0,0 +1,124 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Decoder decodes the value of the current entry into a pointer-typed value.
+// It is only valid during the callback it was handed to.
+type Decoder func(value interface{}) error
+
+// ErrStop can be returned by a ForEach() or Range() callback to end the
+// iteration early. It is not passed on to the caller.
+var ErrStop = errors.New("skv stop")
+
+func decoderFor(bucketName string, k []byte, v []byte) Decoder {
+	return func(value interface{}) error {
+		return decodeValue(bucketName, string(k), v, value)
+	}
+}
+
+// ForEach calls fn for every entry of the bucket whose key starts with prefix
+// (all entries if prefix is empty), in key order. The iteration runs in a read
+// transaction; fn must not write to the store. To modify entries, collect their
+// keys and call Update() afterwards.
+//
+//	err := store.ForEach("users", "", func(key string, decode skv.Decoder) error {
+//	    var user User
+//	    if err := decode(&user); err != nil {
+//	        return err
+//	    }
+//	    ...
+//	    return nil
+//	})
+func (kvs SKV) ForEach(bucketName string, prefix string, fn func(key string, decode Decoder) error) error {
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		now := time.Now().Unix()
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if expired(tx, bucketName, k, now) {
+				continue
+			}
+			if err := fn(string(k), decoderFor(bucketName, k, v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+// Keys returns all keys of the bucket starting with prefix, in key order.
+func (kvs SKV) Keys(bucketName string, prefix string) ([]string, error) {
+	var keys []string
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		now := time.Now().Unix()
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			if expired(tx, bucketName, k, now) {
+				continue
+			}
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Range calls fn for up to limit entries (limit<=0: no limit) whose keys follow
+// startAfter (from the first key if startAfter is empty), in key order.
+// It returns the last key handed to fn if there may be more entries, or an empty
+// string if the end of the bucket was reached. Pass the returned key as startAfter
+// to get the next page.
+func (kvs SKV) Range(bucketName string, startAfter string, limit int, fn func(key string, decode Decoder) error) (string, error) {
+	next := ""
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		c := b.Cursor()
+		k, v := c.Seek([]byte(startAfter))
+		if k != nil && startAfter != "" && string(k) == startAfter {
+			k, v = c.Next()
+		}
+		now := time.Now().Unix()
+		count := 0
+		for ; k != nil; k, v = c.Next() {
+			if expired(tx, bucketName, k, now) {
+				continue
+			}
+			if limit > 0 && count >= limit {
+				return nil
+			}
+			if err := fn(string(k), decoderFor(bucketName, k, v)); err != nil {
+				return err
+			}
+			count++
+			next = string(k)
+		}
+		// end of bucket
+		next = ""
+		return nil
+	})
+	if err == ErrStop {
+		return next, nil
+	}
+	return next, err
+}
@@ -0,0 +1,204 @@
+package skv
+
+import (
+	"fmt"
+	"os"
+	"bytes"
+	"errors"
+	"encoding/binary"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The functions in this file work on the raw (gob-encoded) values of a
+// database file. They are meant for offline maintenance ("webcall db ...")
+// and are not part of the KV interface.
+
+// ErrLocked is returned by Open() if the file is held by another process.
+var ErrLocked = errors.New("skv db file is locked by another process")
+
+// Record is a raw entry, as used by Load().
+type Record struct {
+	Bucket     string
+	Key        string
+	Data       []byte
+	Expiration int64 // unix seconds, 0 = none
+}
+
+// IsInternalBucket tells if a bucket is used by skv itself (e.g. for expirations).
+// Its entries are not meant to be exported.
+func IsInternalBucket(bucketName string) bool {
+	return bucketName == ttlBucket || bucketName == ttlIndexBucket
+}
+
+// Expiration returns the expiration of an entry (unix seconds) or 0 if it has none.
+func (kvs SKV) Expiration(bucketName string, key string) int64 {
+	var expiration int64
+	kvs.Db.View(func(tx *bolt.Tx) error {
+		if tb := tx.Bucket([]byte(ttlBucket)); tb != nil {
+			if v := tb.Get(ttlKey(bucketName, key)); v != nil {
+				expiration = int64(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+	return expiration
+}
+
+// Open opens a database file for maintenance. Unlike DbOpen() it does not log.
+// The file is created if needed, unless readOnly is set.
+func Open(path string, readOnly bool) (SKV, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return SKV{}, ErrLocked
+	}
+	if err != nil {
+		return SKV{}, err
+	}
+	return SKV{Db: db}, nil
+}
+
+// Buckets returns the names of all buckets in the file.
+func (kvs SKV) Buckets() ([]string, error) {
+	var names []string
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Check runs the consistency check of the file and returns all problems found.
+func (kvs SKV) Check() []error {
+	var errs []error
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// GetRaw returns the stored bytes of an entry.
+func (kvs SKV) GetRaw(bucketName string, key string) ([]byte, error) {
+	var data []byte
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		plain, err := unseal(bucketName, key, v)
+		if err != nil {
+			return err
+		}
+		data = append([]byte{}, plain...)
+		return nil
+	})
+	return data, err
+}
+
+// ForEachRaw is like ForEach(), but hands the stored bytes to fn.
+// data is only valid during the callback.
+func (kvs SKV) ForEachRaw(bucketName string, prefix string, fn func(key string, data []byte) error) error {
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			plain, err := unseal(bucketName, string(k), v)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", bucketName, k, err)
+			}
+			if err := fn(string(k), plain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+// Load stores raw records in a single transaction. The buckets in bucketNames
+// (and those used by the records) are created if needed. If replace is set,
+// all buckets of the file are deleted first.
+func (kvs SKV) Load(records []Record, bucketNames []string, replace bool) error {
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	return kvs.Db.Update(func(tx *bolt.Tx) error {
+		if replace {
+			var names [][]byte
+			tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				names = append(names, append([]byte{}, name...))
+				return nil
+			})
+			for _, name := range names {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, bucketName := range bucketNames {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+				return err
+			}
+		}
+		for _, record := range records {
+			b, err := tx.CreateBucketIfNotExists([]byte(record.Bucket))
+			if err != nil {
+				return err
+			}
+			data, err := seal(record.Bucket, record.Key, record.Data)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(record.Key), data); err != nil {
+				return fmt.Errorf("%s %s: %v", record.Bucket, record.Key, err)
+			}
+			if record.Expiration > 0 {
+				err = ttlSet(tx, record.Bucket, record.Key, record.Expiration)
+			} else {
+				err = ttlClear(tx, record.Bucket, record.Key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CompactTo writes a compacted copy of the file to path (which must not exist).
+// Unlike Snapshot() it does not copy freed pages, which may still hold old values.
+func (kvs SKV) CompactTo(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return os.ErrExist
+	}
+	dst, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, kvs.Db, 64*1024*1024)
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,711 @@
+package skv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A BoltDB file can only be opened by one process. To let several processes
+// use the same stores, the process holding the files calls Serve(), the others
+// use Dial() and Client.Open() instead of DbOpen(). The returned store
+// implements KV over net/rpc.
+//
+// The server only handles raw values: encoding (and encryption, see crypt.go)
+// is done by the client, so all processes must use the same keys.
+//
+// Update() on a remote store is optimistic: fn runs against the server, with
+// the raw value of every Get() recorded and Put()/Delete() buffered. On commit
+// the server checks, in one transaction, that none of the values read has
+// changed and applies the writes. On a conflict, fn is run again, so fn must
+// not have side effects outside of tx.
+// ForEach(), Keys() and Range() fetch the entries in pages; unlike with a
+// local store, the pages are not read in a single transaction.
+//
+// Connections are authenticated by a challenge/response over a shared secret.
+// The traffic is not encrypted, so the server must only be reachable over a
+// private network.
+
+var (
+	ErrConflict = errors.New("skv remote update conflict")
+	ErrAuth     = errors.New("skv remote authentication failed")
+	ErrRemote   = errors.New("skv not supported by a remote store")
+)
+
+const remoteNonceLen = 32
+const remoteMaxRetries = 10
+const remotePageSize = 500
+
+// RemoteKey addresses an entry (or a bucket, with an empty Key) of a served store.
+type RemoteKey struct {
+	Db     string
+	Bucket string
+	Key    string
+}
+
+// RemoteValue is the raw value of an entry.
+type RemoteValue struct {
+	Data       []byte
+	Found      bool
+	Expiration int64 // unix seconds, 0 = none
+}
+
+// RemoteRead is a value read during a remote Update(), to be validated on commit.
+type RemoteRead struct {
+	Bucket string
+	Key    string
+	Data   []byte
+	Found  bool
+}
+
+// RemoteWrite is a buffered Put() (Expiration>0: PutWithExpiry()) or Delete().
+type RemoteWrite struct {
+	Bucket     string
+	Key        string
+	Data       []byte
+	Expiration int64
+	Delete     bool
+}
+
+type RemoteCommit struct {
+	Db     string
+	Reads  []RemoteRead
+	Writes []RemoteWrite
+}
+
+// RemoteScan asks for up to Limit entries with Prefix following StartAfter.
+type RemoteScan struct {
+	Db         string
+	Bucket     string
+	Prefix     string
+	StartAfter string
+	Limit      int
+	KeysOnly   bool
+}
+
+// RemoteScanReply works like Range(): Next is the last key if there may be more entries.
+type RemoteScanReply struct {
+	Keys []string
+	Data [][]byte
+	Next string
+}
+
+// RemoteServer serves stores by name.
+type RemoteServer struct {
+	service *remoteService
+}
+
+// remoteService: its exported methods are the rpc interface
+type remoteService struct {
+	id     string
+	stores map[string]SKV
+}
+
+// NewRemoteServer returns a server for stores (name -> store).
+// id identifies the server to its clients (see Client.ServerID()).
+func NewRemoteServer(id string, stores map[string]SKV) *RemoteServer {
+	return &RemoteServer{&remoteService{id: id, stores: stores}}
+}
+
+// Serve accepts connections until ln is closed.
+func (s *RemoteServer) Serve(ln net.Listener, secret string) error {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("SKV", s.service); err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := remoteAccept(conn, secret); err != nil {
+				fmt.Printf("# skv remote %s err=%v\n", conn.RemoteAddr().String(), err)
+				conn.Close()
+				return
+			}
+			rpcServer.ServeConn(conn)
+		}()
+	}
+}
+
+// remoteAccept sends a nonce and expects hmac(secret,nonce) in return
+func remoteAccept(conn net.Conn, secret string) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	nonce := make([]byte, remoteNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	response := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if !hmac.Equal(response, remoteMac(secret, nonce)) {
+		conn.Write([]byte{0})
+		return ErrAuth
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func remoteMac(secret string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func (s *remoteService) store(name string) (SKV, error) {
+	kvs, ok := s.stores[name]
+	if !ok {
+		return SKV{}, fmt.Errorf("skv remote unknown db %s", name)
+	}
+	return kvs, nil
+}
+
+// rawGet returns the raw value of an entry, if present and not expired
+func rawGet(tx *bolt.Tx, bucketName string, key string) ([]byte, bool, error) {
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil, false, ErrNoBucket
+	}
+	v := b.Get([]byte(key))
+	if v == nil || expired(tx, bucketName, []byte(key), time.Now().Unix()) {
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
+func (s *remoteService) ID(args string, reply *string) error {
+	*reply = s.id
+	return nil
+}
+
+func (s *remoteService) Open(args string, reply *bool) error {
+	_, err := s.store(args)
+	*reply = err == nil
+	return err
+}
+
+func (s *remoteService) CreateBucket(args RemoteKey, reply *bool) error {
+	kvs, err := s.store(args.Db)
+	if err != nil {
+		return err
+	}
+	*reply = true
+	return kvs.CreateBucket(args.Bucket)
+}
+
+func (s *remoteService) Get(args RemoteKey, reply *RemoteValue) error {
+	kvs, err := s.store(args.Db)
+	if err != nil {
+		return err
+	}
+	return kvs.Db.View(func(tx *bolt.Tx) error {
+		data, found, err := rawGet(tx, args.Bucket, args.Key)
+		if err != nil || !found {
+			return err
+		}
+		// data is only valid during the transaction
+		reply.Data = append([]byte{}, data...)
+		reply.Found = true
+		if tb := tx.Bucket([]byte(ttlBucket)); tb != nil {
+			if v := tb.Get(ttlKey(args.Bucket, args.Key)); v != nil {
+				reply.Expiration = int64(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+}
+
+// Commit applies the writes if none of the reads has changed; reply tells if it did
+func (s *remoteService) Commit(args RemoteCommit, reply *bool) error {
+	kvs, err := s.store(args.Db)
+	if err != nil {
+		return err
+	}
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	*reply = false
+	return kvs.Db.Update(func(tx *bolt.Tx) error {
+		for _, read := range args.Reads {
+			data, found, err := rawGet(tx, read.Bucket, read.Key)
+			if err != nil {
+				return err
+			}
+			if found != read.Found || !bytes.Equal(data, read.Data) {
+				return nil
+			}
+		}
+		for _, write := range args.Writes {
+			b := tx.Bucket([]byte(write.Bucket))
+			if b == nil {
+				return ErrNoBucket
+			}
+			if write.Delete {
+				if b.Get([]byte(write.Key)) == nil {
+					return ErrNotFound
+				}
+				if err := b.Delete([]byte(write.Key)); err != nil {
+					return err
+				}
+				if err := ttlClear(tx, write.Bucket, write.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := b.Put([]byte(write.Key), write.Data); err != nil {
+				return err
+			}
+			if write.Expiration > 0 {
+				err = ttlSet(tx, write.Bucket, write.Key, write.Expiration)
+			} else {
+				err = ttlClear(tx, write.Bucket, write.Key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		*reply = true
+		return nil
+	})
+}
+
+func (s *remoteService) Sweep(args string, reply *int) error {
+	kvs, err := s.store(args)
+	if err != nil {
+		return err
+	}
+	*reply, err = kvs.Sweep()
+	return err
+}
+
+func (s *remoteService) Scan(args RemoteScan, reply *RemoteScanReply) error {
+	kvs, err := s.store(args.Db)
+	if err != nil {
+		return err
+	}
+	return kvs.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(args.Bucket))
+		if b == nil {
+			return ErrNoBucket
+		}
+		start := args.Prefix
+		if args.StartAfter > start {
+			start = args.StartAfter
+		}
+		c := b.Cursor()
+		k, v := c.Seek([]byte(start))
+		if k != nil && args.StartAfter != "" && string(k) == args.StartAfter {
+			k, v = c.Next()
+		}
+		now := time.Now().Unix()
+		p := []byte(args.Prefix)
+		for ; k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if expired(tx, args.Bucket, k, now) {
+				continue
+			}
+			if args.Limit > 0 && len(reply.Keys) >= args.Limit {
+				return nil
+			}
+			reply.Keys = append(reply.Keys, string(k))
+			if !args.KeysOnly {
+				reply.Data = append(reply.Data, append([]byte{}, v...))
+			}
+			reply.Next = string(k)
+		}
+		// end of bucket (or prefix)
+		reply.Next = ""
+		return nil
+	})
+}
+
+// Client is a connection to a RemoteServer. It reconnects if the connection was lost.
+type Client struct {
+	addr   string
+	secret string
+	mutex  sync.Mutex
+	rpc    *rpc.Client
+}
+
+// Dial connects to the RemoteServer at addr.
+func Dial(addr string, secret string) (*Client, error) {
+	c := &Client{addr: addr, secret: secret}
+	if _, err := c.conn(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) conn() (*rpc.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rpc != nil {
+		return c.rpc, nil
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	nonce := make([]byte, remoteNonceLen)
+	ok := make([]byte, 1)
+	if _, err = io.ReadFull(conn, nonce); err == nil {
+		if _, err = conn.Write(remoteMac(c.secret, nonce)); err == nil {
+			_, err = io.ReadFull(conn, ok)
+		}
+	}
+	if err == nil && ok[0] != 1 {
+		err = ErrAuth
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.rpc = rpc.NewClient(conn)
+	return c.rpc, nil
+}
+
+// call runs a remote method; a lost connection is re-established once
+func (c *Client) call(method string, args interface{}, reply interface{}) error {
+	for i := 0; ; i++ {
+		client, err := c.conn()
+		if err != nil {
+			return err
+		}
+		err = client.Call("SKV."+method, args, reply)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return remoteError(err)
+		}
+		// connection lost
+		c.mutex.Lock()
+		if c.rpc == client {
+			c.rpc.Close()
+			c.rpc = nil
+		}
+		c.mutex.Unlock()
+		if i > 0 {
+			return err
+		}
+	}
+}
+
+// remoteError restores the errors callers compare against
+func remoteError(err error) error {
+	for _, known := range []error{ErrNotFound, ErrNoBucket, ErrBadValue, ErrStop} {
+		if err.Error() == known.Error() {
+			return known
+		}
+	}
+	return err
+}
+
+// ServerID returns the id the server was created with.
+func (c *Client) ServerID() (string, error) {
+	var id string
+	err := c.call("ID", "", &id)
+	return id, err
+}
+
+// Open returns the store name served by the server.
+func (c *Client) Open(name string) (KV, error) {
+	var ok bool
+	if err := c.call("Open", name, &ok); err != nil {
+		return nil, err
+	}
+	fmt.Printf("DbOpen %s remote %s\n", name, c.addr)
+	return &remoteKV{client: c, db: name}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rpc == nil {
+		return nil
+	}
+	err := c.rpc.Close()
+	c.rpc = nil
+	return err
+}
+
+type remoteKV struct {
+	client *Client
+	db     string
+}
+
+func (r *remoteKV) CreateBucket(bucketName string) error {
+	var ok bool
+	return r.client.call("CreateBucket", RemoteKey{r.db, bucketName, ""}, &ok)
+}
+
+func (r *remoteKV) get(bucketName string, key string) (RemoteValue, error) {
+	var reply RemoteValue
+	err := r.client.call("Get", RemoteKey{r.db, bucketName, key}, &reply)
+	return reply, err
+}
+
+func (r *remoteKV) Get(bucketName string, key string, value interface{}) error {
+	reply, err := r.get(bucketName, key)
+	if err != nil {
+		return err
+	}
+	if !reply.Found {
+		return ErrNotFound
+	}
+	if value == nil {
+		return nil
+	}
+	return decodeValue(bucketName, key, reply.Data, value)
+}
+
+func (r *remoteKV) commit(reads []RemoteRead, writes []RemoteWrite) (bool, error) {
+	var ok bool
+	err := r.client.call("Commit", RemoteCommit{r.db, reads, writes}, &ok)
+	return ok, err
+}
+
+func (r *remoteKV) Put(bucketName string, key string, value interface{}, waitConfirm bool) error {
+	return r.PutWithExpiry(bucketName, key, value, time.Time{})
+}
+
+func (r *remoteKV) PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error {
+	write, err := remotePut(bucketName, key, value, expiration)
+	if err != nil {
+		return err
+	}
+	_, err = r.commit(nil, []RemoteWrite{write})
+	return err
+}
+
+func remotePut(bucketName string, key string, value interface{}, expiration time.Time) (RemoteWrite, error) {
+	if value == nil {
+		return RemoteWrite{}, ErrBadValue
+	}
+	data, err := encodeValue(bucketName, key, value)
+	if err != nil {
+		return RemoteWrite{}, err
+	}
+	write := RemoteWrite{Bucket: bucketName, Key: key, Data: data}
+	if !expiration.IsZero() {
+		write.Expiration = expiration.Unix()
+	}
+	return write, nil
+}
+
+func (r *remoteKV) Delete(bucketName string, key string) error {
+	_, err := r.commit(nil, []RemoteWrite{{Bucket: bucketName, Key: key, Delete: true}})
+	return err
+}
+
+func (r *remoteKV) Expiration(bucketName string, key string) int64 {
+	reply, err := r.get(bucketName, key)
+	if err != nil {
+		return 0
+	}
+	return reply.Expiration
+}
+
+func (r *remoteKV) Sweep() (int, error) {
+	var count int
+	err := r.client.call("Sweep", r.db, &count)
+	return count, err
+}
+
+func (r *remoteKV) Update(fn func(tx Tx) error) error {
+	for i := 0; i < remoteMaxRetries; i++ {
+		tx := &remoteTx{kv: r, reads: make(map[string]RemoteRead), writes: make(map[string]RemoteWrite)}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if len(tx.writes) == 0 {
+			return nil
+		}
+		var reads []RemoteRead
+		for _, read := range tx.reads {
+			reads = append(reads, read)
+		}
+		var writes []RemoteWrite
+		for _, write := range tx.writes {
+			writes = append(writes, write)
+		}
+		ok, err := r.commit(reads, writes)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// remoteTx records the values read and buffers the writes until commit
+// (writes go to different keys, so their order does not matter)
+type remoteTx struct {
+	kv     *remoteKV
+	reads  map[string]RemoteRead  // bucket+0+key
+	writes map[string]RemoteWrite // bucket+0+key
+}
+
+// read returns the value on the server, as read first in this tx
+func (t *remoteTx) read(bucketName string, key string) (RemoteRead, error) {
+	tk := string(ttlKey(bucketName, key))
+	if read, ok := t.reads[tk]; ok {
+		return read, nil
+	}
+	reply, err := t.kv.get(bucketName, key)
+	if err != nil {
+		return RemoteRead{}, err
+	}
+	read := RemoteRead{bucketName, key, reply.Data, reply.Found}
+	t.reads[tk] = read
+	return read, nil
+}
+
+func (t *remoteTx) Get(bucketName string, key string, value interface{}) error {
+	var data []byte
+	if write, ok := t.writes[string(ttlKey(bucketName, key))]; ok {
+		// our own write
+		if write.Delete || (write.Expiration > 0 && write.Expiration <= time.Now().Unix()) {
+			return ErrNotFound
+		}
+		data = write.Data
+	} else {
+		read, err := t.read(bucketName, key)
+		if err != nil {
+			return err
+		}
+		if !read.Found {
+			return ErrNotFound
+		}
+		data = read.Data
+	}
+	if value == nil {
+		return nil
+	}
+	return decodeValue(bucketName, key, data, value)
+}
+
+func (t *remoteTx) Put(bucketName string, key string, value interface{}) error {
+	return t.PutWithExpiry(bucketName, key, value, time.Time{})
+}
+
+func (t *remoteTx) PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error {
+	write, err := remotePut(bucketName, key, value, expiration)
+	if err != nil {
+		return err
+	}
+	t.writes[string(ttlKey(bucketName, key))] = write
+	return nil
+}
+
+func (t *remoteTx) Delete(bucketName string, key string) error {
+	// like a local tx: ErrNotFound if there is no such entry
+	if err := t.Get(bucketName, key, nil); err != nil {
+		return err
+	}
+	tk := string(ttlKey(bucketName, key))
+	if read, err := t.read(bucketName, key); err != nil {
+		return err
+	} else if !read.Found {
+		// the entry was only created in this tx
+		delete(t.writes, tk)
+		return nil
+	}
+	t.writes[tk] = RemoteWrite{Bucket: bucketName, Key: key, Delete: true}
+	return nil
+}
+
+func (r *remoteKV) scan(args RemoteScan) (RemoteScanReply, error) {
+	var reply RemoteScanReply
+	args.Db = r.db
+	err := r.client.call("Scan", args, &reply)
+	return reply, err
+}
+
+func (r *remoteKV) ForEach(bucketName string, prefix string, fn func(key string, decode Decoder) error) error {
+	args := RemoteScan{Bucket: bucketName, Prefix: prefix, Limit: remotePageSize}
+	for {
+		reply, err := r.scan(args)
+		if err != nil {
+			return err
+		}
+		for i, k := range reply.Keys {
+			if err := fn(k, decoderFor(bucketName, []byte(k), reply.Data[i])); err != nil {
+				if err == ErrStop {
+					return nil
+				}
+				return err
+			}
+		}
+		if reply.Next == "" {
+			return nil
+		}
+		args.StartAfter = reply.Next
+	}
+}
+
+func (r *remoteKV) Keys(bucketName string, prefix string) ([]string, error) {
+	var keys []string
+	args := RemoteScan{Bucket: bucketName, Prefix: prefix, Limit: remotePageSize, KeysOnly: true}
+	for {
+		reply, err := r.scan(args)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, reply.Keys...)
+		if reply.Next == "" {
+			return keys, nil
+		}
+		args.StartAfter = reply.Next
+	}
+}
+
+func (r *remoteKV) Range(bucketName string, startAfter string, limit int, fn func(key string, decode Decoder) error) (string, error) {
+	reply, err := r.scan(RemoteScan{Bucket: bucketName, StartAfter: startAfter, Limit: limit})
+	if err != nil {
+		return "", err
+	}
+	for i, k := range reply.Keys {
+		if err := fn(k, decoderFor(bucketName, []byte(k), reply.Data[i])); err != nil {
+			if err == ErrStop {
+				return k, nil
+			}
+			return "", err
+		}
+	}
+	return reply.Next, nil
+}
+
+func (r *remoteKV) Snapshot(w io.Writer) (int64, error) {
+	// backups are made by the process serving the files
+	return 0, ErrRemote
+}
+
+// Close does not close the connection, which is shared by all stores of the client.
+func (r *remoteKV) Close() error {
+	return nil
+}
+
+// ServerID returns a default id for a RemoteServer: hostname and listen address.
+func ServerID(ln net.Listener) string {
+	hostname, _ := os.Hostname()
+	return hostname + "/" + ln.Addr().String()
+}
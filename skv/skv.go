@@ -18,9 +18,8 @@ package skv
 
 import (
 	"fmt"
-	"bytes"
+	"io"
 	"errors"
-	"encoding/gob"
 	"time"
 	"sync"
 	bolt "go.etcd.io/bbolt"
@@ -32,9 +31,26 @@ type KV interface {
 	Get(bucketName string, key string, value interface{}) error
 	Put(bucketName string, key string, value interface{}, waitConfirm bool) error
 	Delete(bucketName string, key string) error
+	PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error
+	Expiration(bucketName string, key string) int64
+	Sweep() (int, error)
+	Update(fn func(tx Tx) error) error
+	ForEach(bucketName string, prefix string, fn func(key string, decode Decoder) error) error
+	Keys(bucketName string, prefix string) ([]string, error)
+	Range(bucketName string, startAfter string, limit int, fn func(key string, decode Decoder) error) (string, error)
+	Snapshot(w io.Writer) (int64, error)
 	Close() error
 }
 
+// Tx is handed to the function given to Update(). All of its Put() and Delete()
+// calls are committed together, or not at all if the function returns an error.
+type Tx interface {
+	Get(bucketName string, key string, value interface{}) error
+	Put(bucketName string, key string, value interface{}) error
+	PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error
+	Delete(bucketName string, key string) error
+}
+
 type SKV struct {
 	Db *bolt.DB
     Name string
@@ -47,6 +63,7 @@ var (
 	MyOutBoundIpAddr string
 	ErrNotFound = errors.New("skv key not found")
 	ErrBadValue = errors.New("skv bad value")
+	ErrNoBucket = errors.New("skv bucket not found")
 )
 
 // Open a key-value store. "path" is the full path to the database file, any
@@ -103,14 +120,21 @@ func (kvs SKV) Put(bucketName string, key string, value interface{}, waitConfirm
 	if value == nil {
 		return ErrBadValue
 	}
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+	data, err := encodeValue(bucketName, key, value)
+	if err != nil {
 		return err
 	}
 	DbMutex.Lock()
 	defer DbMutex.Unlock()
 	return kvs.Db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte(bucketName)).Put([]byte(key), buf.Bytes())
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		if err := b.Put([]byte(key), data); err != nil {
+			return err
+		}
+		return ttlClear(tx, bucketName, key)
 	})
 }
 
@@ -137,14 +161,19 @@ func (kvs SKV) Put(bucketName string, key string, value interface{}, waitConfirm
 //  }
 func (kvs SKV) Get(bucketName string, key string, value interface{}) error {
 	return kvs.Db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(bucketName)).Cursor()
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		c := b.Cursor()
 		if k, v := c.Seek([]byte(key)); k == nil || string(k) != key {
 			return ErrNotFound
+		} else if expired(tx, bucketName, k, time.Now().Unix()) {
+			return ErrNotFound
 		} else if value == nil {
 			return nil
 		} else {
-			d := gob.NewDecoder(bytes.NewReader(v))
-			return d.Decode(value)
+			return decodeValue(bucketName, key, v, value)
 		}
 	})
 }
@@ -155,13 +184,99 @@ func (kvs SKV) Delete(bucketName string, key string) error {
 	DbMutex.Lock()
 	defer DbMutex.Unlock()
 	return kvs.Db.Update(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(bucketName)).Cursor()
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return ErrNoBucket
+		}
+		c := b.Cursor()
 		if k, _ := c.Seek([]byte(key)); k == nil || string(k) != key {
 			return ErrNotFound
-		} else {
-			return c.Delete()
+		} else if err := c.Delete(); err != nil {
+			return err
 		}
+		return ttlClear(tx, bucketName, key)
+	})
+}
+
+// Update runs fn in a single read-write transaction. If fn returns an error,
+// none of the changes made through tx are stored.
+// fn must not call Put(), Delete() or Update() of any store (DbMutex is held).
+//
+//	err := store.Update(func(tx skv.Tx) error {
+//	    if err := tx.Put("users", "key42", user); err != nil {
+//	        return err
+//	    }
+//	    return tx.Put("ids", "42", id)
+//	})
+func (kvs SKV) Update(fn func(tx Tx) error) error {
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	return kvs.Db.Update(func(tx *bolt.Tx) error {
+		return fn(skvTx{tx})
+	})
+}
+
+type skvTx struct {
+	tx *bolt.Tx
+}
+
+func (t skvTx) Get(bucketName string, key string, value interface{}) error {
+	b := t.tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return ErrNoBucket
+	}
+	v := b.Get([]byte(key))
+	if v == nil || expired(t.tx, bucketName, []byte(key), time.Now().Unix()) {
+		return ErrNotFound
+	}
+	if value == nil {
+		return nil
+	}
+	return decodeValue(bucketName, key, v, value)
+}
+
+func (t skvTx) Put(bucketName string, key string, value interface{}) error {
+	if value == nil {
+		return ErrBadValue
+	}
+	b := t.tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return ErrNoBucket
+	}
+	data, err := encodeValue(bucketName, key, value)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(key), data); err != nil {
+		return err
+	}
+	return ttlClear(t.tx, bucketName, key)
+}
+
+func (t skvTx) Delete(bucketName string, key string) error {
+	b := t.tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return ErrNoBucket
+	}
+	if b.Get([]byte(key)) == nil {
+		return ErrNotFound
+	}
+	if err := b.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return ttlClear(t.tx, bucketName, key)
+}
+
+// Snapshot writes a consistent copy of the complete database file to w.
+// It runs in a read transaction, so writers are not blocked.
+func (kvs SKV) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := kvs.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
 	})
+	return n, err
 }
 
 // Close closes the key-value store file.
@@ -0,0 +1,159 @@
+package skv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Entries stored with PutWithExpiry() are hidden from Get(), ForEach(), Keys()
+// and Range() once their expiration has passed, and they are removed by Sweep().
+// The expirations are kept in two internal buckets of the same file:
+// ttlBucket maps bucketName+0+key to the expiration (unix seconds, 8 bytes big endian),
+// ttlIndexBucket maps expiration+bucketName+0+key to nothing, so Sweep() can
+// find all expired entries without scanning the data buckets.
+// Put() and Delete() remove the expiration of a key.
+const ttlBucket = "_skv_ttl"
+const ttlIndexBucket = "_skv_ttlidx"
+
+func ttlKey(bucketName string, key string) []byte {
+	return []byte(bucketName + "\x00" + key)
+}
+
+func ttlIndexKey(expiration int64, tk []byte) []byte {
+	ik := make([]byte, 8, 8+len(tk))
+	binary.BigEndian.PutUint64(ik, uint64(expiration))
+	return append(ik, tk...)
+}
+
+// expired tells if the entry has an expiration that has passed
+func expired(tx *bolt.Tx, bucketName string, key []byte, now int64) bool {
+	tb := tx.Bucket([]byte(ttlBucket))
+	if tb == nil {
+		return false
+	}
+	v := tb.Get(ttlKey(bucketName, string(key)))
+	if v == nil {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(v)) <= now
+}
+
+// ttlClear removes the expiration of an entry (if it has one)
+func ttlClear(tx *bolt.Tx, bucketName string, key string) error {
+	tb := tx.Bucket([]byte(ttlBucket))
+	if tb == nil {
+		return nil
+	}
+	tk := ttlKey(bucketName, key)
+	v := tb.Get(tk)
+	if v == nil {
+		return nil
+	}
+	if ib := tx.Bucket([]byte(ttlIndexBucket)); ib != nil {
+		if err := ib.Delete(ttlIndexKey(int64(binary.BigEndian.Uint64(v)), tk)); err != nil {
+			return err
+		}
+	}
+	return tb.Delete(tk)
+}
+
+func ttlSet(tx *bolt.Tx, bucketName string, key string, expiration int64) error {
+	if err := ttlClear(tx, bucketName, key); err != nil {
+		return err
+	}
+	tb, err := tx.CreateBucketIfNotExists([]byte(ttlBucket))
+	if err != nil {
+		return err
+	}
+	ib, err := tx.CreateBucketIfNotExists([]byte(ttlIndexBucket))
+	if err != nil {
+		return err
+	}
+	tk := ttlKey(bucketName, key)
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expiration))
+	if err = tb.Put(tk, v); err != nil {
+		return err
+	}
+	return ib.Put(ttlIndexKey(expiration, tk), []byte{})
+}
+
+func putWithExpiry(tx *bolt.Tx, bucketName string, key string, value interface{}, expiration time.Time) error {
+	if value == nil {
+		return ErrBadValue
+	}
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return ErrNoBucket
+	}
+	data, err := encodeValue(bucketName, key, value)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(key), data); err != nil {
+		return err
+	}
+	return ttlSet(tx, bucketName, key, expiration.Unix())
+}
+
+// PutWithExpiry stores an entry like Put(), which will be gone after expiration.
+//
+//	err := store.PutWithExpiry("tweets", id, tweet, time.Now().Add(time.Hour))
+func (kvs SKV) PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error {
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	return kvs.Db.Update(func(tx *bolt.Tx) error {
+		return putWithExpiry(tx, bucketName, key, value, expiration)
+	})
+}
+
+func (t skvTx) PutWithExpiry(bucketName string, key string, value interface{}, expiration time.Time) error {
+	return putWithExpiry(t.tx, bucketName, key, value, expiration)
+}
+
+// Sweep deletes all entries whose expiration has passed and returns their number.
+// It should be called periodically.
+func (kvs SKV) Sweep() (int, error) {
+	now := time.Now().Unix()
+	count := 0
+	DbMutex.Lock()
+	defer DbMutex.Unlock()
+	err := kvs.Db.Update(func(tx *bolt.Tx) error {
+		ib := tx.Bucket([]byte(ttlIndexBucket))
+		tb := tx.Bucket([]byte(ttlBucket))
+		if ib == nil || tb == nil {
+			return nil
+		}
+		// collect first: a bucket must not be modified while a cursor walks it
+		var indexKeys [][]byte
+		c := ib.Cursor()
+		for k, _ := c.First(); k != nil && len(k) > 8; k, _ = c.Next() {
+			if int64(binary.BigEndian.Uint64(k[:8])) > now {
+				break
+			}
+			indexKeys = append(indexKeys, append([]byte{}, k...))
+		}
+		for _, ik := range indexKeys {
+			tk := ik[8:]
+			idx := bytes.IndexByte(tk, 0)
+			if idx >= 0 {
+				if b := tx.Bucket(tk[:idx]); b != nil {
+					if err := b.Delete(tk[idx+1:]); err != nil {
+						return err
+					}
+				}
+			}
+			if err := tb.Delete(tk); err != nil {
+				return err
+			}
+			if err := ib.Delete(ik); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
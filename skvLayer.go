@@ -14,23 +14,31 @@ import (
 // GetOnlineCallee(ID) can tell us (with optional ejectOn1stFound yes/no):
 // "is calleeID online?", "is calleeID hidden online?", "is calleeID hidden online for my callerIpAddr?"
 func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub,error) { // actual calleeID, hostingServerIp
-	hubMapMutex.RLock()
-	defer hubMapMutex.RUnlock()
+	var key string
+	var hub *Hub
+	hubMap.WithCallee(calleeID, func(hubs map[string]*Hub) {
+		key,hub = findOnlineCallee(hubs, calleeID, ejectOn1stFound, reportBusyCallee, reportHiddenCallee,
+			callerIpAddr, comment)
+	})
+	return key, hub, nil
+}
 
+// findOnlineCallee searches hubs (locked by the caller) for calleeID
+func findOnlineCallee(hubs map[string]*Hub, calleeID string, ejectOn1stFound bool, reportBusyCallee bool, reportHiddenCallee bool, callerIpAddr string, comment string) (string,*Hub) {
 	if logWantedFor("searchhub") {
 		fmt.Printf("GetOnlineCallee %s (%s) ejectOn1stFound=%v reportBusy=%v reportHidden=%v callerIpAddr=%s\n",
 			calleeID,comment,ejectOn1stFound,reportBusyCallee, reportHiddenCallee,callerIpAddr)
 	}
 	calleeIdPlusExcl := calleeID+"!"
 	count:=0
-	for key := range hubMap {
+	for key := range hubs {
 		count++
 		// wenn nicht=calleeID && fängt auch nicht mit calleeID! an, dann weitersuchen
 		if key!=calleeID && !strings.HasPrefix(key,calleeIdPlusExcl) {
 			continue
 		}
 		// found a fitting calleeID
-		hub := hubMap[key]
+		hub := hubs[key]
 		if logWantedFor("searchhub") {
 			fmt.Printf("GetOnlineCallee found id=%s key=%s callerIP=%s hidden=%v\n", 
 				calleeID, key, hub.ConnectedCallerIp, hub.IsCalleeHidden)
@@ -42,9 +50,9 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 					fmt.Printf("GetOnlineCallee found callee %s busy with %s\n",key,hub.ConnectedCallerIp)
 				}
 				if reportBusyCallee {
-					return key, hub, nil
+					return key, hub
 				}
-				return "", nil, nil
+				return "", nil
 			}
 			continue
 		}
@@ -54,7 +62,7 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 			if logWantedFor("searchhub") {
 				fmt.Printf("GetOnlineCallee found callee %s is free + not hidden\n",key)
 			}
-			return key, hub, nil
+			return key, hub
 		}
 
 		if reportHiddenCallee {
@@ -62,7 +70,7 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 			if logWantedFor("searchhub") {
 				fmt.Printf("GetOnlineCallee found callee %s is free + hidden\n",key)
 			}
-			return key, hub, nil
+			return key, hub
 		}
 
 		// TODO not sure this is needed anymore; it is now taken care of in httoOnline.go
@@ -74,7 +82,7 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 			if logWantedFor("searchhub") {
 				fmt.Printf("GetOnlineCallee found callee %s free + hidden + visible to caller\n",key)
 			}
-			return key, hub, nil
+			return key, hub
 		}
 
 		// found a fitting calleeID but we are not supposed to report this callee
@@ -83,21 +91,12 @@ func locGetOnlineCallee(calleeID string, ejectOn1stFound bool, reportBusyCallee
 	if logWantedFor("searchhub") {
 		fmt.Printf("GetOnlineCallee nothing found for calleeID=%s count=%d\n",calleeID,count)
 	}
-	return "", nil, nil
+	return "", nil
 }
 
 func locStoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool) error {
 	var err error = nil
-	hubMapMutex.Lock()
-	defer hubMapMutex.Unlock()
-	hub := hubMap[calleeId]
-	if hub==nil {
-		if logWantedFor("searchhub") {
-			fmt.Printf("StoreCallerIpInHubMap calleeId=%s (not found) set callerIp=%s\n",
-				calleeId, callerIp)
-		}
-		err = skv.ErrNotFound
-	} else {
+	found := hubMap.Modify(calleeId, func(hub *Hub) {
 		if hub.ConnectedCallerIp != callerIp {
 
 			if callerIp == "" && recentTurnCalleeIps!=nil {
@@ -118,32 +117,36 @@ func locStoreCallerIpInHubMap(calleeId string, callerIp string, skipConfirm bool
 			}
 
 			hub.ConnectedCallerIp = callerIp
-			hubMap[calleeId] = hub
 		} else {
 			if logWantedFor("searchhub") {
 				fmt.Printf("StoreCallerIpInHubMap calleeId=%s set callerIp=%s was already set\n",
 					calleeId, callerIp)
 			}
 		}
+	})
+	if !found {
+		if logWantedFor("searchhub") {
+			fmt.Printf("StoreCallerIpInHubMap calleeId=%s (not found) set callerIp=%s\n",
+				calleeId, callerIp)
+		}
+		err = skv.ErrNotFound
 	}
 	return err
 }
 
 func locSearchCallerIpInHubMap(ip string) (bool,string,error) {
-	hubMapMutex.RLock()
-	defer hubMapMutex.RUnlock()
-	for id := range hubMap {
-		hub := hubMap[id]
-		if strings.HasPrefix(hub.ConnectedCallerIp,ip) {
-			if logWantedFor("ipinhub") {
-				fmt.Printf("SearchCallerIpInHubMap ip=%s found\n",ip)
-			}
-			//return true,hub.GlobalCalleeID,nil
-			if hub.CalleeClient!=nil {
-				return true,hub.CalleeClient.calleeID,nil
-			}
-			return true,"",nil
+	_,hub := hubMap.Find(func(id string, hub *Hub) bool {
+		return hub!=nil && strings.HasPrefix(hub.ConnectedCallerIp,ip)
+	})
+	if hub!=nil {
+		if logWantedFor("ipinhub") {
+			fmt.Printf("SearchCallerIpInHubMap ip=%s found\n",ip)
+		}
+		//return true,hub.GlobalCalleeID,nil
+		if hub.CalleeClient!=nil {
+			return true,hub.CalleeClient.calleeID,nil
 		}
+		return true,"",nil
 	}
 	if logWantedFor("ipinhub") {
 		fmt.Printf("SearchCallerIpInHubMap ip=%s not found\n",ip)
@@ -152,18 +155,12 @@ func locSearchCallerIpInHubMap(ip string) (bool,string,error) {
 }
 
 func locDeleteFromHubMap(id string) (int64,error) {
-	hubMapMutex.Lock()
-	defer hubMapMutex.Unlock()
-	delete(hubMap,id)
 	//fmt.Printf("exitFunc delete(globalHubMap,%s) done %d\n",releasedCalleeID,len(globalHubMap))
-	return int64(len(hubMap)),nil
+	return hubMap.Delete(id),nil
 }
 
 func locStoreCalleeInHubMap(key string, hub *Hub, multiCallees string, remoteAddrWithPort string, wsClientID uint64, skipConfirm bool) (string,int64,error) {
 	//fmt.Printf("StoreCalleeInHubMap start key=%s\n",key)
-	hubMapMutex.Lock()
-	defer hubMapMutex.Unlock()
-
 	if strings.Index(multiCallees,"|"+key+"|")>=0 {
 		newKey := ""
 		for i:=0; i<100; i++ {
@@ -172,11 +169,10 @@ func locStoreCalleeInHubMap(key string, hub *Hub, multiCallees string, remoteAdd
 				continue
 			}
 			newKey = key + "!" + strconv.FormatInt(int64(idExt),10)
-			_,ok := hubMap[newKey]
-			//fmt.Printf("StoreCalleeInHubMap try key=%s ok=%v idx=%d\n",newKey,ok,idx)
-			if !ok {
-				// newKey does not exist yet - found a free slot: exit loop
-				break
+			//fmt.Printf("StoreCalleeInHubMap try key=%s idx=%d\n",newKey,idx)
+			if hubMap.SetIfAbsent(newKey, hub) {
+				// newKey did not exist yet - found a free slot
+				return newKey, hubMap.Len(), nil
 			}
 			// newKey exists - must continue to search for a free slot
 			//if i>=98 {
@@ -186,14 +182,11 @@ func locStoreCalleeInHubMap(key string, hub *Hub, multiCallees string, remoteAdd
 		key = newKey
 	}
 	//fmt.Printf("StoreCalleeInHubMap final key=%s\n",key)
-	hubMap[key] = hub
-	return key, int64(len(hubMap)), nil
+	hubMap.Set(key, hub)
+	return key, hubMap.Len(), nil
 }
 
 func locGetRandomCalleeID() (string,error) {
-	hubMapMutex.RLock()
-	defer hubMapMutex.RUnlock()
-
 	newCalleeId := ""
 	tries := 0
 	for {
@@ -204,10 +197,13 @@ func locGetRandomCalleeID() (string,error) {
 		}
 		//newCalleeId = fmt.Sprintf("%d",intID)
 		newCalleeId = strconv.FormatInt(int64(intID),10)
-		hub := hubMap[newCalleeId]
+		hub := hubMap.Get(newCalleeId)
 		if hub!=nil {
 			continue;
 		}
+		if isRingGroupID(newCalleeId) {
+			continue;
+		}
 
 		var dbEntry DbEntry
 		err := kvMain.Get(dbRegisteredIDs,newCalleeId,&dbEntry)
@@ -231,41 +227,35 @@ func locGetRandomCalleeID() (string,error) {
 }
 
 func locSetCalleeHiddenState(calleeId string, hidden bool) (error) {
-	hubMapMutex.Lock()
-	defer hubMapMutex.Unlock()
-	hub := hubMap[calleeId]
-	if hub==nil {
+	if !hubMap.Modify(calleeId, func(hub *Hub) {
+		hub.IsCalleeHidden = hidden
+	}) {
 		return skv.ErrNotFound
 	}
-	hub.IsCalleeHidden = hidden
 	return nil
 }
 
 func locSetUnHiddenForCaller(calleeId string, callerIp string) (error) {
-	hubMapMutex.Lock()
-	defer hubMapMutex.Unlock()
-	hub := hubMap[calleeId]
-	if hub==nil {
+	if !hubMap.Modify(calleeId, func(hub *Hub) {
+		hub.IsUnHiddenForCallerAddr = callerIp
+	}) {
 		return skv.ErrNotFound
 	}
-	hub.IsUnHiddenForCallerAddr = callerIp
 	return nil
 }
 
 /*
 // return the number of callees (and callers) currently online
 func GetOnlineCalleeCount(countCallers bool) (int64,int64,error) {
-	hubMapMutex.RLock()
-	defer hubMapMutex.RUnlock()
 	var callers int64
 	if countCallers {
-		for id := range hubMap {
-			if hubMap[id].ConnectedCallerIp != "" {
+		for _,entry := range hubMap.Snapshot() {
+			if entry.Hub.ConnectedCallerIp != "" {
 				callers++
 			}
 		}
 	}
-	return int64(len(hubMap)), callers, nil
+	return hubMap.Len(), callers, nil
 }
 */
 
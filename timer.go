@@ -5,18 +5,14 @@ import (
 	"time"
 	"fmt"
 	"strings"
-	"bytes"
 	"unicode"
-	"encoding/gob"
 	"io"
 	"os"
-	"os/exec"
 	"sync"
 	"sync/atomic"
 	"github.com/mehrvarz/webcall/skv"
 	"github.com/mehrvarz/webcall/twitter"
 	"gopkg.in/ini.v1"
-	bolt "go.etcd.io/bbolt"
 )
 
 var followerIDs twitter.FollowerIDs
@@ -24,9 +20,7 @@ var followerIDsLock sync.RWMutex
 
 func ticker3hours() {
 	fmt.Printf("ticker3hours start\n")
-	kv := kvMain.(skv.SKV)
 	bucketName := dbRegisteredIDs
-	db := kv.Db
 
 	// put ticker3hours out of step with other tickers
 	time.Sleep(7 * time.Second)
@@ -39,80 +33,90 @@ func ticker3hours() {
 		if shutdownStarted.Get() {
 			break
 		}
+		if !isLocalDb() {
+			// outdated accounts are removed by the node serving the db files
+			continue
+		}
 
-		// loop all dbRegisteredIDs to delete outdated accounts
-		skv.DbMutex.Lock()
-		var dbUserBucketKeyArray1 []string  // for deleting
-		counterDeleted := 0
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketName))
-			c := b.Cursor()
-			counter := 0
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				// k = ID
-				//if strings.HasPrefix(k,"answie") || strings.HasPrefix(k,"talkback") 
-				if !isOnlyNumericString(string(k)) {
-					continue
-				}
-				var dbEntry DbEntry // DbEntry{unixTime, remoteAddr, urlPw}
-				d := gob.NewDecoder(bytes.NewReader(v))
-				d.Decode(&dbEntry)
-				// we now must find out when this user was using the account the last time
-				dbUserKey := fmt.Sprintf("%s_%d", k, dbEntry.StartTime)
-				var dbUser DbUser
-				err2 := kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
-				if err2 != nil {
-					fmt.Printf("# ticker3hours %d error read db=%s bucket=%s get key=%v err=%v\n",
-						counter, dbMainName, dbUserBucket, dbUserKey, err2)
-				} else {
-					lastLoginTime := dbUser.LastLoginTime
-					if(lastLoginTime==0) {
-						lastLoginTime = dbEntry.StartTime // created by httpRegister()
-					}
-					if(lastLoginTime==0) {
-						fmt.Printf("ticker3hours %d id=%s sinceLastLogin=0 StartTime=0\n", counter, k)
-					} else {
-						sinceLastLoginSecs := time.Now().Unix() - lastLoginTime
-						sinceLastLoginDays := sinceLastLoginSecs/(24*60*60)
-						if sinceLastLoginDays>180 { // maxUserIdleDays
-							// account is outdated, delete this entry
-							fmt.Printf("ticker3hours %d id=%s regist delete sinceLastLogin=%ds days=%d\n",
-								counter, k, sinceLastLoginSecs, sinceLastLoginDays)
-							err2 = c.Delete()
-							if err2!=nil {
-								fmt.Printf("ticker3hours %d id=%s regist delete err=%v\n", counter, k, err2)
-							} else {
-								counterDeleted++
-								//fmt.Printf("ticker3hours %d id=%s regist deleted %d\n",
-								//	counter, k, counterDeleted)
-								// we will delete dbUserKey from dbUserBucket after db.Update() is finished
-								dbUserBucketKeyArray1 = append(dbUserBucketKeyArray1,dbUserKey)
-							}
-						} else {
-							// this user account is not outdated
-						}
-					}
-				}
-				counter++
+		// loop all dbRegisteredIDs to find outdated accounts
+		type registeredAccount struct {
+			id string
+			startTime int64
+		}
+		var outdatedAccounts []registeredAccount
+		var registeredAccounts []registeredAccount
+		err := kvMain.ForEach(bucketName, "", func(k string, decode skv.Decoder) error {
+			// k = ID
+			//if strings.HasPrefix(k,"answie") || strings.HasPrefix(k,"talkback") 
+			if !isOnlyNumericString(k) {
+				return nil
 			}
+			var dbEntry DbEntry // DbEntry{unixTime, remoteAddr, urlPw}
+			decode(&dbEntry)
+			registeredAccounts = append(registeredAccounts, registeredAccount{k, dbEntry.StartTime})
 			return nil
 		})
-		skv.DbMutex.Unlock()
 		if err!=nil {
-			fmt.Printf("ticker3hours db.Update deleted=%d err=%v\n", counterDeleted, err)
-		} else if counterDeleted>0 {
-			fmt.Printf("ticker3hours db.Update deleted=%d no err\n",counterDeleted)
+			fmt.Printf("ticker3hours ForEach err=%v\n", err)
+		}
+		for counter,account := range registeredAccounts {
+			// we now must find out when this user was using the account the last time
+			dbUserKey := fmt.Sprintf("%s_%d", account.id, account.startTime)
+			var dbUser DbUser
+			err2 := kvMain.Get(dbUserBucket, dbUserKey, &dbUser)
+			if err2 != nil {
+				fmt.Printf("# ticker3hours %d error read db=%s bucket=%s get key=%v err=%v\n",
+					counter, dbMainName, dbUserBucket, dbUserKey, err2)
+				continue
+			}
+			lastLoginTime := dbUser.LastLoginTime
+			if(lastLoginTime==0) {
+				lastLoginTime = account.startTime // created by httpRegister()
+			}
+			if(lastLoginTime==0) {
+				fmt.Printf("ticker3hours %d id=%s sinceLastLogin=0 StartTime=0\n", counter, account.id)
+				continue
+			}
+			sinceLastLoginSecs := time.Now().Unix() - lastLoginTime
+			sinceLastLoginDays := sinceLastLoginSecs/(24*60*60)
+			if sinceLastLoginDays>180 { // maxUserIdleDays
+				// account is outdated, delete this entry
+				fmt.Printf("ticker3hours %d id=%s outdated sinceLastLogin=%ds days=%d\n",
+					counter, account.id, sinceLastLoginSecs, sinceLastLoginDays)
+				outdatedAccounts = append(outdatedAccounts, account)
+			}
 		}
-		for _,key := range dbUserBucketKeyArray1 {
-			fmt.Printf("ticker3hours id=%s user delete...\n", key)
-			err = kv.Delete(dbUserBucket, key)
+
+		// delete registration and user data of each outdated account together
+		counterDeleted := 0
+		for _,account := range outdatedAccounts {
+			dbUserKey := fmt.Sprintf("%s_%d", account.id, account.startTime)
+			err = kvMain.Update(func(tx skv.Tx) error {
+				var dbEntry DbEntry
+				err := tx.Get(bucketName, account.id, &dbEntry)
+				if err!=nil {
+					return err
+				}
+				if dbEntry.StartTime!=account.startTime {
+					// the ID was registered again in the meantime
+					return skv.ErrNotFound
+				}
+				err = tx.Delete(bucketName, account.id)
+				if err!=nil {
+					return err
+				}
+				return tx.Delete(dbUserBucket, dbUserKey)
+			})
 			if err!=nil {
-				fmt.Printf("ticker3hours key=%s user delete err=%v\n", key, err)
+				fmt.Printf("ticker3hours id=%s delete err=%v\n", account.id, err)
 			} else {
-				//fmt.Printf("ticker3hours key=%s user deleted\n", key)
+				counterDeleted++
 				// TODO I think we need to generate a blocked entry for each deleted account
 			}
 		}
+		if counterDeleted>0 {
+			fmt.Printf("ticker3hours deleted=%d\n", counterDeleted)
+		}
 		//fmt.Printf("ticker3hours done\n")
 	}
 }
@@ -281,32 +285,28 @@ func cleanupClientRequestsMap(w io.Writer, min int, title string) {
 
 // send url (pointing to update news) to all online callees
 func broadcastNewsLink(date string, url string) {
-	hubMapMutex.RLock()
-	defer hubMapMutex.RUnlock()
 	count := 0
 	countAll := 0
 	data := "news|"+date+"|"+url;
 	fmt.Printf("newsLink data=%s\n",data)
-	for calleeID,hub := range hubMap {
+	// no lock is held while we write to the clients
+	for _,entry := range hubMap.Snapshot() {
+		calleeID := entry.GlobalID
 		if strings.HasPrefix(calleeID,"answie") || 
 		   strings.HasPrefix(calleeID,"talkback") ||
 		   strings.HasPrefix(calleeID,"!") {
 			continue
 		}
 		countAll++
-		if hub!=nil {
-			hub.HubMutex.RLock()
-			if hub.CalleeClient!=nil {
-				//fmt.Printf("newsLink to=%s data=%s\n",calleeID,data)
-				hub.CalleeClient.Write([]byte(data))
-				hub.HubMutex.RUnlock()
-				count++
-			} else {
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("# newsLink hub.CalleeClient==nil to=%s data=%s\n",calleeID,data)
-			}
+		entry.Hub.HubMutex.RLock()
+		calleeClient := entry.Hub.CalleeClient
+		entry.Hub.HubMutex.RUnlock()
+		if calleeClient!=nil {
+			//fmt.Printf("newsLink to=%s data=%s\n",calleeID,data)
+			calleeClient.Write([]byte(data))
+			count++
 		} else {
-			fmt.Printf("newsLink hub==nil to=%s data=%s\n",calleeID,data)
+			//fmt.Printf("# newsLink hub.CalleeClient==nil to=%s data=%s\n",calleeID,data)
 		}
 	}
 	fmt.Printf("newsLink sent %d (%d) times\n",count,countAll)
@@ -324,96 +324,45 @@ func ticker3min() {
 		}
 
 		if isLocalDb() {
-			// delete old twitter notifications
-			readConfigLock.RLock()
-			mytwitterKey := twitterKey
-			mytwitterSecret := twitterSecret
-			readConfigLock.RUnlock()
-			if mytwitterKey!="" && mytwitterSecret!="" {
-				kv := kvNotif.(skv.SKV)
-
-				skv.DbMutex.Lock()
-				kv.Db.Update(func(tx *bolt.Tx) error {
-					unixNow := time.Now().Unix()
-					//fmt.Printf("ticker3min release outdated entries from db=%s bucket=%s\n",
-					//	dbNotifName, dbSentNotifTweets)
-					b := tx.Bucket([]byte(dbSentNotifTweets))
-					if b==nil {
-						fmt.Printf("# ticker3min bucket=(%s) no tx\n",dbSentNotifTweets)
-						return nil
-					}
-					c := b.Cursor()
-					deleteCount := 0
-					for k, v := c.First(); k != nil; k, v = c.Next() {
-						idStr := string(k)
-						d := gob.NewDecoder(bytes.NewReader(v))
-						var notifTweet NotifTweet
-						d.Decode(&notifTweet)
-						ageSecs := unixNow - notifTweet.TweetTime
-						if ageSecs >= 60*60 {
-							fmt.Printf("ticker3min outdated ID=%s ageSecs=%d > 1h (%s) deleting\n",
-								idStr, ageSecs, notifTweet.Comment)
-/* kvNotif is currently not fed from httpNotifyCallee.go
-							twitterClientLock.Lock()
-							if twitterClient==nil {
-								twitterAuth()
-							}
-							if twitterClient==nil {
-								fmt.Printf("# ticker3min failed on no twitterClient\n")
-								twitterClientLock.Unlock()
-								break
-							}
-							respdata,err := twitterClient.DeleteTweet(idStr)
-							twitterClientLock.Unlock()
-							if err!=nil {
-								fmt.Printf("# ticker3min DeleteTweet %s err=%v (%s)\n", idStr, err, respdata)
-							} else 
-*/
-							{
-								//fmt.Printf("ticker3min DeleteTweet %s OK\n", idStr)
-								err := c.Delete()
-								if err!=nil {
-									fmt.Printf("# ticker3min error db=%s bucket=%s delete id=%s err=%v\n",
-										dbMainName, dbSentNotifTweets, idStr, err)
-								} else {
-									deleteCount++
-								}
-							}
-						}
-					}
-					if deleteCount>0 {
-						//fmt.Printf("ticker3min db=%s bucket=%s deleted %d entries\n",
-						//	dbNotifName, dbSentNotifTweets, deleteCount)
-					}
-					return nil
-				})
-				skv.DbMutex.Unlock()
+			// remove expired entries (see skv PutWithExpiry())
+			for _,dbName := range dbFileNames {
+				count,err := kvByDbName(dbName).Sweep()
+				if err!=nil {
+					fmt.Printf("# ticker3min sweep db=%s err=%v\n", dbName, err)
+				} else if count>0 && logWantedFor("sweep") {
+					fmt.Printf("ticker3min sweep db=%s deleted %d entries\n", dbName, count)
+				}
 			}
+			sessionsSweep()
 
-			// call backupScript
+			// backup all db files
 			readConfigLock.RLock()
-			mybackupScript := backupScript
+			mybackupDir := backupDir
+			mybackupGzip := backupGzip
 			mybackupPauseMinutes := backupPauseMinutes
+			mybackupKeepDaily := backupKeepDaily
+			mybackupKeepWeekly := backupKeepWeekly
 			readConfigLock.RUnlock()
-			if mybackupScript!="" && mybackupPauseMinutes>0 {
+			if mybackupDir!="" && mybackupPauseMinutes>0 {
 				timeNow := time.Now()
 				diff := timeNow.Sub(lastBackupTime)
 				if diff < time.Duration(mybackupPauseMinutes) * time.Minute {
 					//fmt.Printf("ticker3min next bckupTime not yet reached (%d < %d)\n",
 					//	diff/time.Minute, mybackupPauseMinutes)
 				} else {
-					_,err := os.Stat(mybackupScript)
-					if err!=nil {
-						fmt.Printf("# ticker3min file %s err=%v\n",mybackupScript,err)
-					} else {
-						if callBackupScript(mybackupScript) == nil {
-							lastBackupTime = timeNow
-						}
+					if backupAll(mybackupDir, mybackupGzip) == nil {
+						lastBackupTime = timeNow
+						backupPrune(mybackupDir, mybackupKeepDaily, mybackupKeepWeekly)
 					}
 				}
 			}
 		}
 
+		// missed call digests (see emailNotify.go)
+		if isLocalDb() {
+			emailDigestFlush()
+		}
+
 		// tmtmtm cleanup missedCallAllowedMap
 		var deleteIpArray []string  // for deleting
 		missedCallAllowedMutex.Lock()
@@ -432,43 +381,6 @@ func ticker3min() {
 	}
 }
 
-func callBackupScript(scriptName string) error {
-	skv.DbMutex.Lock()
-	defer skv.DbMutex.Unlock()
-
-	fmt.Printf("callBackupScript sync db's (%s)\n",scriptName)
-
-	kv := kvMain.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvMain sync error: %s\n", err)
-	}
-	kv = kvCalls.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvCalls sync error: %s\n", err)
-	}
-	kv = kvContacts.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvContacts sync error: %s\n", err)
-	}
-	kv = kvNotif.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvNotif sync error: %s\n", err)
-	}
-	kv = kvHashedPw.(skv.SKV)
-	if err := kv.Db.Sync(); err != nil {
-		fmt.Printf("# callBackupScript kvHashedPw sync error: %s\n", err)
-	}
-
-	fmt.Printf("callBackupScript exec (%s)...\n",scriptName)
-	cmd, err := exec.Command("/bin/sh", scriptName).Output()
-	if err != nil {
-		fmt.Printf("# callBackupScript %s err=%s log=(%s)", scriptName, err, string(cmd))
-		return err
-	}
-	fmt.Printf("callBackupScript %s done log=(%s)\n",scriptName,string(cmd))
-	return nil
-}
-
 // ticker30sec: logs stats, cleanup recentTurnCalleeIps
 var ticker30secCounter=0;
 func ticker30sec() {
@@ -514,18 +426,15 @@ func ticker30sec() {
 		if(ticker30secCounter%20==0) {
 			// loop through all hubs
 			fmt.Printf("ticker10min %d\n",ticker30secCounter/20)
-			hubMapMutex.RLock()
-			for _,hub := range hubMap {
-				if hub!=nil {
-					err := hub.CalleeClient.Write([]byte("dummy|"+timeNow.String()))
-					if err != nil {
-						fmt.Printf("ticker10min send dummy id=%s err=%v\n",hub.CalleeClient.calleeID,err)
-					} else {
-						//fmt.Printf("ticker10min send dummy id=%s noerr\n",hub.CalleeClient.calleeID)
-					}
+			for _,entry := range hubMap.Snapshot() {
+				hub := entry.Hub
+				err := hub.CalleeClient.Write([]byte("dummy|"+timeNow.String()))
+				if err != nil {
+					fmt.Printf("ticker10min send dummy id=%s err=%v\n",hub.CalleeClient.calleeID,err)
+				} else {
+					//fmt.Printf("ticker10min send dummy id=%s noerr\n",hub.CalleeClient.calleeID)
 				}
 			}
-			hubMapMutex.RUnlock()
 		}
 */
 	}
@@ -541,6 +450,7 @@ func ticker10sec() {
 			break
 		}
 		readConfig(false)
+		hubRegistry.Heartbeat()
 	}
 }
 
@@ -0,0 +1,212 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+// TimerWheel is a hierarchical timing wheel that runs all ring, talk and ping
+// deadlines of the server (see Hub.setDeadline() and WsClient.setPingDeadline()).
+// A WheelTimer is a small struct sitting in a doubly linked list; there is no
+// goroutine and no channel per timer. Starting, resetting and stopping a timer
+// is O(1). The wheel advances in timerWheelTick steps; level 0 holds the timers
+// due within the next 64 ticks, level 1 within 64*64 ticks, etc. When a level
+// wraps around, the timers of the next slot of the level above are spread over
+// the levels below (cascade).
+// Expired timers are handed to a fixed number of workers (timerWheelWorkers),
+// so a slow callback cannot delay the wheel itself.
+//
+// Stop() returns false if the timer has already expired; its callback may then
+// be running (or about to run) concurrently. Owners that need race-free
+// cancellation keep a pointer to their current timer under their own lock
+// and let the callback return early if it is not the current timer anymore
+// (see Hub.deadlineReached()).
+package main
+
+import (
+	"time"
+	"sync"
+)
+
+const (
+	timerWheelTick = 100 * time.Millisecond
+	timerWheelBits = 6
+	timerWheelSlots = 1 << timerWheelBits // per level
+	timerWheelMask = timerWheelSlots - 1
+	timerWheelLevels = 4 // 64^4 ticks = 19 days
+	timerWheelWorkers = 4
+)
+
+type WheelTimer struct {
+	fn func()
+	expires uint64 // tick
+	prev *WheelTimer
+	next *WheelTimer
+	scheduled bool
+}
+
+type TimerWheel struct {
+	mutex sync.Mutex
+	start time.Time
+	now uint64 // the current tick
+	// every slot is a circular list with a sentinel
+	slots [timerWheelLevels][timerWheelSlots]WheelTimer
+	expired chan func()
+}
+
+var timerWheel = newTimerWheel()
+
+func newTimerWheel() *TimerWheel {
+	w := &TimerWheel{start: time.Now(), expired: make(chan func(), 1024)}
+	for level := range w.slots {
+		for slot := range w.slots[level] {
+			sentinel := &w.slots[level][slot]
+			sentinel.prev = sentinel
+			sentinel.next = sentinel
+		}
+	}
+	return w
+}
+
+// NewTimer returns a timer that is not scheduled yet (see Reset())
+func (w *TimerWheel) NewTimer(fn func()) *WheelTimer {
+	return &WheelTimer{fn: fn}
+}
+
+// AfterFunc calls fn (in a worker goroutine) after d
+func (w *TimerWheel) AfterFunc(d time.Duration, fn func()) *WheelTimer {
+	t := &WheelTimer{fn: fn}
+	w.Reset(t, d)
+	return t
+}
+
+// Reset (re)schedules t to expire after d, no matter if it is scheduled or has expired
+func (w *TimerWheel) Reset(t *WheelTimer, d time.Duration) {
+	// w.now may lag behind the clock; so we count from the start of the wheel
+	expires := uint64((time.Since(w.start) + d + timerWheelTick - 1) / timerWheelTick)
+	w.mutex.Lock()
+	w.unlink(t)
+	t.expires = expires
+	w.add(t)
+	w.mutex.Unlock()
+}
+
+// Stop unschedules t; returns false if t was not scheduled (expired or stopped before)
+func (w *TimerWheel) Stop(t *WheelTimer) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !t.scheduled {
+		return false
+	}
+	w.unlink(t)
+	return true
+}
+
+func (w *TimerWheel) unlink(t *WheelTimer) {
+	if t.scheduled {
+		t.prev.next = t.next
+		t.next.prev = t.prev
+		t.prev = nil
+		t.next = nil
+		t.scheduled = false
+	}
+}
+
+// add puts t into the slot of the lowest level that covers t.expires
+func (w *TimerWheel) add(t *WheelTimer) {
+	expires := t.expires
+	if expires <= w.now {
+		// due: expire with the next tick
+		expires = w.now + 1
+	}
+	delta := expires - w.now
+	level := 0
+	for ; level < timerWheelLevels-1; level++ {
+		if delta < uint64(1) << (timerWheelBits*(level+1)) {
+			break
+		}
+	}
+	if delta >= uint64(1) << (timerWheelBits*timerWheelLevels) {
+		// beyond the wheel: park it in the farthest slot, it will be cascaded again
+		expires = w.now + (uint64(1) << (timerWheelBits*timerWheelLevels)) - 1
+	}
+	sentinel := &w.slots[level][(expires >> (timerWheelBits*level)) & timerWheelMask]
+	t.prev = sentinel.prev
+	t.next = sentinel
+	sentinel.prev.next = t
+	sentinel.prev = t
+	t.scheduled = true
+}
+
+// takeSlot removes all timers from a slot and returns them
+func (w *TimerWheel) takeSlot(level int, slot uint64) []*WheelTimer {
+	var timers []*WheelTimer
+	sentinel := &w.slots[level][slot]
+	for t := sentinel.next; t != sentinel; {
+		next := t.next
+		t.prev = nil
+		t.next = nil
+		t.scheduled = false
+		timers = append(timers, t)
+		t = next
+	}
+	sentinel.prev = sentinel
+	sentinel.next = sentinel
+	return timers
+}
+
+// tick advances the wheel by one tick and returns the expired timers
+func (w *TimerWheel) tick() []*WheelTimer {
+	w.now++
+	var expired []*WheelTimer
+	// cascade: when a level wraps, spread the next slot of the level above
+	for level := 1; level < timerWheelLevels; level++ {
+		if (w.now >> (timerWheelBits*(level-1))) & timerWheelMask != 0 {
+			break
+		}
+		for _,t := range w.takeSlot(level, (w.now >> (timerWheelBits*level)) & timerWheelMask) {
+			if t.expires <= w.now {
+				// due now; add() would put it into the next tick
+				expired = append(expired, t)
+			} else {
+				w.add(t)
+			}
+		}
+	}
+	for _,t := range w.takeSlot(0, w.now & timerWheelMask) {
+		if t.expires <= w.now {
+			expired = append(expired, t)
+		} else {
+			// parked beyond the wheel
+			w.add(t)
+		}
+	}
+	return expired
+}
+
+// run advances the wheel until shutdown
+func (w *TimerWheel) run() {
+	for i := 0; i < timerWheelWorkers; i++ {
+		go func() {
+			for fn := range w.expired {
+				fn()
+			}
+		}()
+	}
+	ticker := time.NewTicker(timerWheelTick)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if shutdownStarted.Get() {
+			break
+		}
+		// catch up with the clock (the ticker may drop ticks)
+		target := uint64(time.Since(w.start) / timerWheelTick)
+		for {
+			w.mutex.Lock()
+			if w.now >= target {
+				w.mutex.Unlock()
+				break
+			}
+			expired := w.tick()
+			w.mutex.Unlock()
+			for _,t := range expired {
+				w.expired <- t.fn
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+	"testing"
+)
+
+// testSchedule schedules t to expire in ticks (relative to w.now)
+func testSchedule(w *TimerWheel, t *WheelTimer, ticks uint64) {
+	w.mutex.Lock()
+	w.unlink(t)
+	t.expires = w.now + ticks
+	w.add(t)
+	w.mutex.Unlock()
+}
+
+// testSyncClock lets the clock of w (used by Reset) match w.now, which tick() advances faster
+func testSyncClock(w *TimerWheel) {
+	w.start = time.Now().Add(-time.Duration(w.now) * timerWheelTick)
+}
+
+// testTicks drives w for n ticks and returns the tick at which each timer expired
+func testTicks(w *TimerWheel, n uint64) map[*WheelTimer]uint64 {
+	expiredAt := make(map[*WheelTimer]uint64)
+	for i := uint64(0); i < n; i++ {
+		w.mutex.Lock()
+		expired := w.tick()
+		w.mutex.Unlock()
+		for _,t := range expired {
+			expiredAt[t] = w.now
+		}
+	}
+	return expiredAt
+}
+
+func TestTimerWheelExpiryOrder(t *testing.T) {
+	level1 := uint64(timerWheelSlots)
+	level2 := level1 * timerWheelSlots
+	level3 := level2 * timerWheelSlots
+	delays := []uint64{1, 2, level1-1, level1, level1+1, 2*level1+5,
+		level2-1, level2, level2+1, 3*level2+7, level3-1, level3, level3+1}
+	// the cascades must work at any position of the wheel, not only from tick 0
+	for _,offset := range []uint64{0, 1000, level2-3} {
+		w := newTimerWheel()
+		testTicks(w, offset)
+		timers := make(map[*WheelTimer]uint64)
+		// add them in reverse order
+		for i := len(delays)-1; i >= 0; i-- {
+			timer := w.NewTimer(nil)
+			testSchedule(w, timer, delays[i])
+			timers[timer] = offset + delays[i]
+		}
+		expiredAt := testTicks(w, level3+2)
+		for timer,want := range timers {
+			got,ok := expiredAt[timer]
+			if !ok {
+				t.Fatalf("offset=%d delay=%d did not expire", offset, want-offset)
+			}
+			if got!=want {
+				t.Fatalf("offset=%d delay=%d expired at tick %d, want %d", offset, want-offset, got, want)
+			}
+		}
+		if len(expiredAt)!=len(timers) {
+			t.Fatalf("offset=%d %d timers expired, want %d", offset, len(expiredAt), len(timers))
+		}
+	}
+}
+
+func TestTimerWheelStopReset(t *testing.T) {
+	w := newTimerWheel()
+	timer := w.NewTimer(nil)
+	testSchedule(w, timer, 3)
+	expiredAt := testTicks(w, 5)
+	if expiredAt[timer]!=3 {
+		t.Fatalf("expired at tick %d, want 3", expiredAt[timer])
+	}
+
+	// Stop after expiry
+	if w.Stop(timer) {
+		t.Fatalf("Stop after expiry returned true")
+	}
+
+	// Reset after expiry schedules it again
+	testSyncClock(w)
+	w.Reset(timer, 10*timerWheelTick)
+	expiredAt = testTicks(w, 20)
+	got,ok := expiredAt[timer]
+	if !ok || got < w.now-20+10 || got > w.now-20+11 {
+		t.Fatalf("reset timer expired=%v at tick %d, want %d", ok, got, w.now-20+10)
+	}
+
+	// Stop before expiry: it does not expire anymore
+	testSchedule(w, timer, 5)
+	if !w.Stop(timer) {
+		t.Fatalf("Stop of a scheduled timer returned false")
+	}
+	if w.Stop(timer) {
+		t.Fatalf("second Stop returned true")
+	}
+	if _,ok := testTicks(w, 10)[timer]; ok {
+		t.Fatalf("stopped timer expired")
+	}
+
+	// Reset of a scheduled timer moves it
+	testSchedule(w, timer, 5)
+	testSyncClock(w)
+	w.Reset(timer, 100*timerWheelTick)
+	if _,ok := testTicks(w, 50)[timer]; ok {
+		t.Fatalf("timer expired at its old time")
+	}
+	if _,ok := testTicks(w, 60)[timer]; !ok {
+		t.Fatalf("timer did not expire at its new time")
+	}
+}
@@ -0,0 +1,620 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Webhooks: the server POSTs a json event (WebhookEvent) to registered URLs.
+//   incoming   a caller rings the callee
+//   answered   the callee has picked up
+//   ended      a peer connection has ended (durationSecs, local/remote = p2p or relay, cause)
+//   missed     a missed call was stored (see addMissedCall())
+//   online     the callee has connected to the server
+//   offline    the callee has logged off
+// A callee registers webhooks for its own events:
+//   POST /webhookadd                body: {"url":"https://...","events":["missed","ended"]}
+//                                   no events = all events; returns "ok|(id)|(secret)"
+//   /webhooks                       list (json; without secrets)
+//   /webhooklog?wid=(id)            the last deliveries of a webhook (json)
+//   /webhookremove?wid=(id|all)
+// The admin registers webhooks for the events of all callees via the admin API
+// (/admin/v1/webhooks, see httpAdminApi.go). They are stored under webhookAllCallees
+// and may use plain http and any host. Callee webhooks must use https and cannot
+// reach loopback, private or link-local addresses: this is checked when the url is
+// added and again, on the resolved address, whenever a connection is made
+// (webhookCalleeClient), so a host name cannot be re-pointed to an internal address.
+// Every request carries these headers:
+//   X-Webcall-Event: (event)
+//   X-Webcall-Delivery: (delivery id; the same for all attempts of one event)
+//   X-Webcall-Signature: t=(unix time),v1=(hex hmac-sha256 of "(t).(body)" keyed with the secret)
+// A receiver should verify the signature and reject old timestamps.
+// Any 2xx answer is a successful delivery. 4xx answers (except 408 and 429) are final.
+// Otherwise the delivery is retried after webhookBackoff[attempt-1]. Every delivery is
+// stored in dbWebhookQueue before the first attempt and removed when it is done, so
+// deliveries pending at a restart are resumed (webhookResumeQueue()).
+// The outcome of every attempt is appended to dbWebhookLog.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+	"strings"
+	"strconv"
+	"fmt"
+	"sync"
+	"sort"
+	"bytes"
+	"io"
+	"net"
+	"errors"
+	"syscall"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+)
+
+// the owner of the webhooks the admin has registered for all callees
+const webhookAllCallees = "*"
+
+// a callee (and the admin) cannot register more webhooks than this
+const maxWebhooks = 8
+
+// the number of log entries kept per webhook
+const webhookLogLen = 50
+
+const webhookTimeout = 10 * time.Second
+
+// delay before attempt 2, 3, ...
+var webhookBackoff = []time.Duration{
+	10*time.Second, 30*time.Second, 2*time.Minute, 10*time.Minute, 30*time.Minute, time.Hour, 3*time.Hour}
+
+var webhookEvents = []string{"incoming", "answered", "ended", "missed", "online", "offline"}
+
+type Webhook struct {
+	Url string
+	Secret string
+	Events []string // empty = all events
+	Created int64
+}
+
+type WebhookEvent struct {
+	Event string `json:"event"`
+	Time int64 `json:"time"`
+	CalleeID string `json:"calleeID"`
+	CallerID string `json:"callerID,omitempty"`
+	CallerName string `json:"callerName,omitempty"`
+	Msg string `json:"msg,omitempty"`
+	DurationSecs int64 `json:"durationSecs,omitempty"`
+	Local string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Cause string `json:"cause,omitempty"`
+}
+
+// a pending delivery in dbWebhookQueue
+type WebhookDelivery struct {
+	ID string
+	Owner string // calleeID or webhookAllCallees
+	WebhookID string
+	Event string
+	Body string
+	Attempts int
+	NextTry int64
+}
+
+type WebhookLogEntry struct {
+	DeliveryID string `json:"deliveryID"`
+	Event string `json:"event"`
+	Time int64 `json:"time"`
+	Attempt int `json:"attempt"`
+	Status int `json:"status"` // http status; 0 = no answer
+	Error string `json:"error,omitempty"`
+}
+
+type WebhookResponse struct {
+	Id string `json:"id"`
+	Url string `json:"url"`
+	Events []string `json:"events"`
+	Created int64 `json:"created"`
+	Secret string `json:"secret,omitempty"` // only on creation
+}
+
+type WebhookRequest struct {
+	Url string `json:"url"`
+	Events []string `json:"events"`
+}
+
+// webhooksMutex protects the read-modify-write of an owner's map of webhooks
+var webhooksMutex sync.Mutex
+var webhookLogMutex sync.Mutex
+
+// limits the number of concurrent deliveries
+var webhookSem = make(chan struct{}, 16)
+
+// a redirect is not followed; it counts as a failed attempt
+func webhookNoRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// for the webhooks of the admin
+var webhookAdminClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: webhookNoRedirect,
+}
+
+// for the webhooks of callees: every connection is checked after name resolution
+var webhookCalleeClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: webhookNoRedirect,
+	Transport: &http.Transport{
+		// no proxy: the proxy would make the connection for us
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns: 16,
+		IdleConnTimeout: 90 * time.Second,
+	},
+}
+
+var errWebhookAddr = errors.New("webhook address not allowed")
+
+// webhookDialControl is called with the resolved address of every connection
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	host,_,err := net.SplitHostPort(address)
+	if err!=nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip==nil || webhookInternalIP(ip) {
+		return errWebhookAddr
+	}
+	return nil
+}
+
+var webhookInternalNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _,cidr := range []string{
+			"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // private
+			"100.64.0.0/10", // carrier-grade nat
+			"0.0.0.0/8", "fc00::/7"} {
+		_,ipNet,_ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// webhookInternalIP tells if ip is a loopback, private, link-local (or otherwise non-public) address
+func webhookInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+			ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _,ipNet := range webhookInternalNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookRandomID(n int) (string,error) {
+	buf := make([]byte, n)
+	_,err := rand.Read(buf)
+	if err!=nil {
+		return "",err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func webhooksGet(owner string) map[string]Webhook {
+	var webhookMap map[string]Webhook // webhookID -> Webhook
+	err := kvNotif.Get(dbWebhooks,owner,&webhookMap)
+	if err!=nil || webhookMap==nil {
+		webhookMap = make(map[string]Webhook)
+	}
+	return webhookMap
+}
+
+func webhooksPut(owner string, webhookMap map[string]Webhook) error {
+	if len(webhookMap)==0 {
+		err := kvNotif.Delete(dbWebhooks,owner)
+		if err!=nil && strings.Index(err.Error(),"key not found")<0 {
+			return err
+		}
+		return nil
+	}
+	return kvNotif.Put(dbWebhooks, owner, webhookMap, false)
+}
+
+// checkWebhookUrl allows anything http(s) for the admin
+// callee webhooks must use https and must not point to an internal address
+// (names are checked again when connecting, see webhookDialControl())
+func checkWebhookUrl(webhookUrl string, admin bool) error {
+	u,err := url.Parse(webhookUrl)
+	if err!=nil {
+		return err
+	}
+	if u.Host=="" {
+		return fmt.Errorf("url has no host")
+	}
+	if admin {
+		if u.Scheme=="https" || u.Scheme=="http" {
+			return nil
+		}
+		return fmt.Errorf("url must be http or https")
+	}
+	if u.Scheme!="https" {
+		return fmt.Errorf("url must be https")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host=="localhost" || strings.HasSuffix(host,".localhost") {
+		return errWebhookAddr
+	}
+	if ip := net.ParseIP(host); ip!=nil && webhookInternalIP(ip) {
+		return errWebhookAddr
+	}
+	return nil
+}
+
+// webhookAdd stores a new webhook; it returns the webhook ID and its secret
+func webhookAdd(owner string, req WebhookRequest, admin bool) (string,string,error) {
+	if err := checkWebhookUrl(req.Url, admin); err!=nil {
+		return "","",err
+	}
+	for _,event := range req.Events {
+		known := false
+		for _,webhookEvent := range webhookEvents {
+			if event==webhookEvent {
+				known = true
+			}
+		}
+		if !known {
+			return "","",fmt.Errorf("unknown event %s", event)
+		}
+	}
+	id,err := webhookRandomID(8)
+	if err!=nil {
+		return "","",err
+	}
+	secret,err := webhookRandomID(32)
+	if err!=nil {
+		return "","",err
+	}
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	webhookMap := webhooksGet(owner)
+	if len(webhookMap) >= maxWebhooks {
+		return "","",fmt.Errorf("too many webhooks")
+	}
+	webhookMap[id] = Webhook{req.Url, secret, req.Events, time.Now().Unix()}
+	return id, secret, webhooksPut(owner,webhookMap)
+}
+
+// webhookRemove removes one webhook (or all of them, if id=="all") together with its log
+func webhookRemove(owner string, id string) int {
+	webhooksMutex.Lock()
+	webhookMap := webhooksGet(owner)
+	var removed []string
+	for webhookID := range webhookMap {
+		if id=="all" || webhookID==id {
+			delete(webhookMap,webhookID)
+			removed = append(removed, webhookID)
+		}
+	}
+	if len(removed)>0 {
+		err := webhooksPut(owner,webhookMap)
+		if err!=nil {
+			fmt.Printf("# webhookRemove (%s) db=%s bucket=%s err=%v\n", owner, dbNotifName, dbWebhooks, err)
+		}
+	}
+	webhooksMutex.Unlock()
+
+	webhookLogMutex.Lock()
+	for _,webhookID := range removed {
+		kvNotif.Delete(dbWebhookLog,webhookID)
+	}
+	webhookLogMutex.Unlock()
+	// pending deliveries of a removed webhook are dropped by webhookDeliver()
+	return len(removed)
+}
+
+func webhookList(owner string) []WebhookResponse {
+	webhooksMutex.Lock()
+	webhookMap := webhooksGet(owner)
+	webhooksMutex.Unlock()
+	webhookSlice := []WebhookResponse{}
+	for id,webhook := range webhookMap {
+		events := webhook.Events
+		if len(events)==0 {
+			events = webhookEvents
+		}
+		webhookSlice = append(webhookSlice, WebhookResponse{id, webhook.Url, events, webhook.Created, ""})
+	}
+	sort.Slice(webhookSlice, func(i, j int) bool {
+		return webhookSlice[i].Created > webhookSlice[j].Created
+	})
+	return webhookSlice
+}
+
+// webhookLog returns the log of webhookID, latest entry first; nil if the webhook is not owned by owner
+func webhookLog(owner string, webhookID string) []WebhookLogEntry {
+	webhooksMutex.Lock()
+	_,ok := webhooksGet(owner)[webhookID]
+	webhooksMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	var logSlice []WebhookLogEntry
+	webhookLogMutex.Lock()
+	kvNotif.Get(dbWebhookLog,webhookID,&logSlice)
+	webhookLogMutex.Unlock()
+	result := []WebhookLogEntry{}
+	for i := len(logSlice)-1; i>=0; i-- {
+		result = append(result, logSlice[i])
+	}
+	return result
+}
+
+func webhookLogAppend(webhookID string, entry WebhookLogEntry) {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+	var logSlice []WebhookLogEntry
+	kvNotif.Get(dbWebhookLog,webhookID,&logSlice)
+	if len(logSlice) >= webhookLogLen {
+		logSlice = logSlice[len(logSlice)-(webhookLogLen-1):]
+	}
+	logSlice = append(logSlice, entry)
+	err := kvNotif.Put(dbWebhookLog, webhookID, logSlice, true)
+	if err!=nil {
+		fmt.Printf("# webhookLogAppend (%s) db=%s bucket=%s err=%v\n", webhookID, dbNotifName, dbWebhookLog, err)
+	}
+}
+
+// webhookFire sends ev to the webhooks of calleeID and to the webhooks for all callees
+// it does not block the caller
+func webhookFire(calleeID string, ev WebhookEvent) {
+	if calleeID=="" || kvNotif==nil {
+		return
+	}
+	ev.CalleeID = calleeID
+	ev.Time = time.Now().Unix()
+	go func() {
+		body,err := json.Marshal(ev)
+		if err!=nil {
+			fmt.Printf("# webhookFire (%s) %s json err=%v\n", calleeID, ev.Event, err)
+			return
+		}
+		for _,owner := range []string{calleeID, webhookAllCallees} {
+			webhooksMutex.Lock()
+			webhookMap := webhooksGet(owner)
+			webhooksMutex.Unlock()
+			for webhookID,webhook := range webhookMap {
+				if !webhookWants(webhook, ev.Event) {
+					continue
+				}
+				deliveryID,err := webhookRandomID(8)
+				if err!=nil {
+					fmt.Printf("# webhookFire (%s) deliveryID err=%v\n", calleeID, err)
+					continue
+				}
+				d := &WebhookDelivery{deliveryID, owner, webhookID, ev.Event, string(body), 0, time.Now().Unix()}
+				// stored before the first attempt, so it is not lost in a restart
+				err = kvNotif.Put(dbWebhookQueue, d.ID, d, false)
+				if err!=nil {
+					fmt.Printf("# webhookFire (%s) %s db=%s bucket=%s err=%v\n",
+						calleeID, d.ID, dbNotifName, dbWebhookQueue, err)
+				}
+				webhookDeliver(d)
+			}
+		}
+	}()
+}
+
+func webhookWants(webhook Webhook, event string) bool {
+	if len(webhook.Events)==0 {
+		return true
+	}
+	for _,e := range webhook.Events {
+		if e==event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSignature returns the X-Webcall-Signature header value for body
+func webhookSignature(secret string, timestamp int64, body string) string {
+	t := strconv.FormatInt(timestamp,10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t+"."+body))
+	return "t="+t+",v1="+hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPost posts the body of d once; it returns the http status (0 = no answer)
+func webhookPost(webhook Webhook, d *WebhookDelivery) (int,error) {
+	req,err := http.NewRequest("POST", webhook.Url, bytes.NewReader([]byte(d.Body)))
+	if err!=nil {
+		return 0,err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "WebCall-Webhook")
+	req.Header.Set("X-Webcall-Event", d.Event)
+	req.Header.Set("X-Webcall-Delivery", d.ID)
+	req.Header.Set("X-Webcall-Signature", webhookSignature(webhook.Secret, time.Now().Unix(), d.Body))
+	client := webhookCalleeClient
+	if d.Owner==webhookAllCallees {
+		client = webhookAdminClient
+	}
+	resp,err := client.Do(req)
+	if err!=nil {
+		return 0,err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return resp.StatusCode,nil
+}
+
+// webhookDeliver makes the next attempt of d and, if it fails, schedules a retry
+func webhookDeliver(d *WebhookDelivery) {
+	webhooksMutex.Lock()
+	webhook,ok := webhooksGet(d.Owner)[d.WebhookID]
+	webhooksMutex.Unlock()
+	if !ok {
+		// the webhook was removed
+		kvNotif.Delete(dbWebhookQueue,d.ID)
+		return
+	}
+
+	webhookSem <- struct{}{}
+	statusCode,err := webhookPost(webhook, d)
+	<-webhookSem
+	d.Attempts++
+
+	entry := WebhookLogEntry{d.ID, d.Event, time.Now().Unix(), d.Attempts, statusCode, ""}
+	if err!=nil {
+		entry.Error = err.Error()
+	}
+	webhookLogAppend(d.WebhookID, entry)
+
+	done := statusCode>=200 && statusCode<300
+	final := statusCode>=400 && statusCode<500 &&
+		statusCode!=http.StatusRequestTimeout && statusCode!=http.StatusTooManyRequests
+	if !done && !final && d.Attempts <= len(webhookBackoff) {
+		delay := webhookBackoff[d.Attempts-1]
+		d.NextTry = time.Now().Add(delay).Unix()
+		err2 := kvNotif.Put(dbWebhookQueue, d.ID, d, false)
+		if err2!=nil {
+			fmt.Printf("# webhookDeliver (%s) %s db=%s bucket=%s err=%v\n",
+				d.Owner, d.ID, dbNotifName, dbWebhookQueue, err2)
+		}
+		if logWantedFor("webhook") {
+			fmt.Printf("webhookDeliver (%s) %s %s attempt=%d status=%d retry in %v err=%v\n",
+				d.Owner, d.WebhookID, d.Event, d.Attempts, statusCode, delay, err)
+		}
+		webhookRetryAfter(d, delay)
+		return
+	}
+	kvNotif.Delete(dbWebhookQueue,d.ID)
+	if !done {
+		fmt.Printf("# webhookDeliver (%s) %s %s failed attempt=%d status=%d err=%v\n",
+			d.Owner, d.WebhookID, d.Event, d.Attempts, statusCode, err)
+	} else if logWantedFor("webhook") {
+		fmt.Printf("webhookDeliver (%s) %s %s attempt=%d status=%d\n",
+			d.Owner, d.WebhookID, d.Event, d.Attempts, statusCode)
+	}
+}
+
+func webhookRetryAfter(d *WebhookDelivery, delay time.Duration) {
+	timerWheel.AfterFunc(delay, func() {
+		// don't block the timerWheel workers
+		go webhookDeliver(d)
+	})
+}
+
+// webhookResumeQueue schedules the retries that were pending at the last shutdown
+func webhookResumeQueue() {
+	var pending []*WebhookDelivery
+	_,err := kvNotif.Range(dbWebhookQueue, "", 0, func(k string, decode skv.Decoder) error {
+		d := &WebhookDelivery{}
+		if decode(d)==nil {
+			pending = append(pending, d)
+		}
+		return nil
+	})
+	if err!=nil {
+		fmt.Printf("# webhookResumeQueue db=%s bucket=%s err=%v\n", dbNotifName, dbWebhookQueue, err)
+		return
+	}
+	now := time.Now()
+	for _,d := range pending {
+		delay := time.Unix(d.NextTry,0).Sub(now)
+		if delay < time.Second {
+			delay = time.Second
+		}
+		webhookRetryAfter(d, delay)
+	}
+	if len(pending)>0 {
+		fmt.Printf("webhookResumeQueue %d pending deliveries\n", len(pending))
+	}
+}
+
+// webhookParseRequest reads the json body of a /webhookadd request
+func webhookParseRequest(r *http.Request) (WebhookRequest,error) {
+	var req WebhookRequest
+	err := json.NewDecoder(io.LimitReader(r.Body,4096)).Decode(&req)
+	if err!=nil {
+		return req,err
+	}
+	req.Url = strings.TrimSpace(req.Url)
+	return req,nil
+}
+
+func httpWebhookAdd(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/webhookadd", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	req,err := webhookParseRequest(r)
+	if err!=nil {
+		fmt.Printf("# /webhookadd (%s) bad body %s err=%v\n", calleeID, remoteAddr, err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	id,secret,err := webhookAdd(calleeID, req, false)
+	if err!=nil {
+		fmt.Printf("# /webhookadd (%s) denied %s err=%v\n", calleeID, remoteAddr, err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	fmt.Printf("/webhookadd (%s) id=%s url=%s %s\n", calleeID, id, req.Url, remoteAddr)
+	fmt.Fprintf(w,"ok|%s|%s", id, secret)
+}
+
+func httpWebhooks(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/webhooks", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	jsonStr, err := json.Marshal(webhookList(calleeID))
+	if err != nil {
+		fmt.Printf("# /webhooks (%s) failed on json.Marshal %s err=%v\n", calleeID, remoteAddr, err)
+		return
+	}
+	fmt.Fprintf(w,"%s",jsonStr)
+}
+
+func httpWebhookLog(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/webhooklog", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	logSlice := webhookLog(calleeID, r.URL.Query().Get("wid"))
+	if logSlice==nil {
+		fmt.Fprintf(w,"notfound")
+		return
+	}
+	jsonStr, err := json.Marshal(logSlice)
+	if err != nil {
+		fmt.Printf("# /webhooklog (%s) failed on json.Marshal %s err=%v\n", calleeID, remoteAddr, err)
+		return
+	}
+	fmt.Fprintf(w,"%s",jsonStr)
+}
+
+func httpWebhookRemove(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/webhookremove", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	id := r.URL.Query().Get("wid")
+	if id=="" {
+		fmt.Printf("# /webhookremove (%s) no wid %s\n", calleeID, remoteAddr)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	count := webhookRemove(calleeID, id)
+	fmt.Printf("/webhookremove (%s) id=%s removed=%d %s\n", calleeID, id, count, remoteAddr)
+	if count==0 {
+		fmt.Fprintf(w,"notfound")
+		return
+	}
+	fmt.Fprintf(w,"ok")
+}
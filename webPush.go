@@ -0,0 +1,448 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Web push notifications (see package webpush).
+// A callee may register any number of push subscriptions, one per browser/device.
+// They are stored per callee in dbPushSubscriptions (kvNotif):
+//   POST /pushsubscribe             body: the PushSubscription json of the browser
+//   /pushsubscriptions              list (id, user agent, created, last push)
+//   /pushunsubscribe?sid=(id|all)   remove
+// /notifyCallee sends a VAPID signed message to all subscriptions of an offline
+// callee (see webpushNotify()). A subscription the push service answers with
+// 404 or 410 is removed. Subscriptions of older server versions (DbUser.Str2
+// and Str3) are moved into this list.
+// vapidPrivateKey and vapidPublicKey (config.ini) are created with "webcall vapidkeys".
+// Endpoints must use https and cannot reach loopback, private or link-local
+// addresses (checked on the resolved address, see webhookDialControl()).
+// For testing, cmd/wcpush is a push service stand-in on loopback; it can only be
+// used with "webpushTestService = true" in config.ini, which lifts these limits.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+	"strings"
+	"fmt"
+	"sync"
+	"sort"
+	"io"
+	"net"
+	"syscall"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mehrvarz/webcall/skv"
+	"github.com/mehrvarz/webcall/webpush"
+)
+
+// a callee cannot register more subscriptions than this
+const maxPushSubscriptions = 64
+
+const pushTimeout = 10 * time.Second
+
+type PushSubscription struct {
+	Subscription string // json of the browser PushSubscription
+	UserAgent string
+	Created int64
+	LastPush int64
+}
+
+// pushSubscriptionsMutex protects the read-modify-write of a callee's map of subscriptions
+var pushSubscriptionsMutex sync.Mutex
+
+var pushHttpClient = &http.Client{
+	Timeout: pushTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: pushTimeout,
+			Control: pushDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: pushTimeout,
+		MaxIdleConns: 16,
+		IdleConnTimeout: 90 * time.Second,
+	},
+}
+
+// pushDialControl is called with the resolved address of every connection
+func pushDialControl(network string, address string, c syscall.RawConn) error {
+	if pushTestService() {
+		return nil
+	}
+	return webhookDialControl(network, address, c)
+}
+
+// pushTestService tells if endpoints of a local push service stand-in (cmd/wcpush) are allowed
+func pushTestService() bool {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return webpushTestService
+}
+
+// pushSubscriptionID derives the ID of a subscription from its endpoint
+func pushSubscriptionID(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(sum[:8])
+}
+
+func pushSubscriptionsGet(calleeID string) map[string]PushSubscription {
+	var subscriptionMap map[string]PushSubscription // subscriptionID -> PushSubscription
+	err := kvNotif.Get(dbPushSubscriptions,calleeID,&subscriptionMap)
+	if err!=nil || subscriptionMap==nil {
+		subscriptionMap = make(map[string]PushSubscription)
+	}
+	return subscriptionMap
+}
+
+func pushSubscriptionsPut(calleeID string, subscriptionMap map[string]PushSubscription) error {
+	if len(subscriptionMap)==0 {
+		err := kvNotif.Delete(dbPushSubscriptions,calleeID)
+		if err!=nil && strings.Index(err.Error(),"key not found")<0 {
+			return err
+		}
+		return nil
+	}
+	return kvNotif.Put(dbPushSubscriptions, calleeID, subscriptionMap, false)
+}
+
+// checkPushEndpoint denies plain http and internal addresses,
+// except for a local push service stand-in (webpushTestService)
+func checkPushEndpoint(endpoint string) error {
+	u,err := url.Parse(endpoint)
+	if err!=nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	if pushTestService() {
+		if u.Scheme=="https" ||
+				(u.Scheme=="http" && (host=="127.0.0.1" || host=="localhost" || host=="::1")) {
+			return nil
+		}
+		return fmt.Errorf("endpoint must be https")
+	}
+	if u.Scheme!="https" || host=="" {
+		return fmt.Errorf("endpoint must be https")
+	}
+	if host=="localhost" || strings.HasSuffix(host,".localhost") {
+		return errWebhookAddr
+	}
+	if ip := net.ParseIP(host); ip!=nil && webhookInternalIP(ip) {
+		return errWebhookAddr
+	}
+	return nil
+}
+
+// pushSubscriptionAdd stores a subscription; it returns the subscription ID
+func pushSubscriptionAdd(calleeID string, subscription string, userAgent string) (string,error) {
+	s,err := webpush.ParseSubscription(subscription)
+	if err!=nil {
+		return "",err
+	}
+	if err = checkPushEndpoint(s.Endpoint); err!=nil {
+		return "",err
+	}
+	sid := pushSubscriptionID(s.Endpoint)
+	pushSubscriptionsMutex.Lock()
+	defer pushSubscriptionsMutex.Unlock()
+	subscriptionMap := pushSubscriptionsGet(calleeID)
+	if old,ok := subscriptionMap[sid]; ok {
+		// the keys of a subscription may change
+		old.Subscription = subscription
+		old.UserAgent = userAgent
+		subscriptionMap[sid] = old
+	} else {
+		if len(subscriptionMap) >= maxPushSubscriptions {
+			return "",fmt.Errorf("too many subscriptions")
+		}
+		subscriptionMap[sid] = PushSubscription{subscription, userAgent, time.Now().Unix(), 0}
+	}
+	return sid, pushSubscriptionsPut(calleeID,subscriptionMap)
+}
+
+// pushSubscriptionRemove removes one subscription (or all of them, if sid=="all")
+func pushSubscriptionRemove(calleeID string, sid string) int {
+	pushSubscriptionsMutex.Lock()
+	defer pushSubscriptionsMutex.Unlock()
+	subscriptionMap := pushSubscriptionsGet(calleeID)
+	count := 0
+	for id := range subscriptionMap {
+		if sid=="all" || id==sid {
+			delete(subscriptionMap,id)
+			count++
+		}
+	}
+	if count>0 {
+		err := pushSubscriptionsPut(calleeID,subscriptionMap)
+		if err!=nil {
+			fmt.Printf("# pushSubscriptionRemove (%s) db=%s bucket=%s err=%v\n",
+				calleeID, dbNotifName, dbPushSubscriptions, err)
+		}
+	}
+	return count
+}
+
+// webpushMigrate moves the subscriptions of DbUser.Str2/Str3 into dbPushSubscriptions
+func webpushMigrate(calleeID string, dbUserKey string, dbUser *DbUser) {
+	if dbUser.Str2=="" && dbUser.Str3=="" {
+		return
+	}
+	for _,old := range [][2]string{{dbUser.Str2,dbUser.Str2ua}, {dbUser.Str3,dbUser.Str3ua}} {
+		if old[0]!="" {
+			_,err := pushSubscriptionAdd(calleeID, old[0], old[1])
+			if err!=nil {
+				fmt.Printf("# webpushMigrate (%s) drop subscription err=%v\n", calleeID, err)
+			}
+		}
+	}
+	dbUser.Str2, dbUser.Str2ua, dbUser.Str3, dbUser.Str3ua = "", "", "", ""
+	// only clear the old fields; the user may have been changed in the meantime
+	err := kvMain.Update(func(tx skv.Tx) error {
+		var dbUserNow DbUser
+		err := tx.Get(dbUserBucket, dbUserKey, &dbUserNow)
+		if err!=nil {
+			return err
+		}
+		dbUserNow.Str2, dbUserNow.Str2ua, dbUserNow.Str3, dbUserNow.Str3ua = "", "", "", ""
+		return tx.Put(dbUserBucket, dbUserKey, dbUserNow)
+	})
+	if err!=nil {
+		fmt.Printf("# webpushMigrate (%s) kvMain.Put err=%v\n", calleeID, err)
+		return
+	}
+	fmt.Printf("webpushMigrate (%s) done\n", calleeID)
+}
+
+// webpushConfigured tells if vapid keys are set
+func webpushConfigured() bool {
+	readConfigLock.RLock()
+	defer readConfigLock.RUnlock()
+	return vapidPrivateKey!="" && vapidPublicKey!=""
+}
+
+func webpushHasSubscriptions(calleeID string) bool {
+	if !webpushConfigured() {
+		return false
+	}
+	pushSubscriptionsMutex.Lock()
+	defer pushSubscriptionsMutex.Unlock()
+	return len(pushSubscriptionsGet(calleeID))>0
+}
+
+// webpushSend sends msg to one subscription; it returns the http status of the push service
+func webpushSend(subscription string, msg string, urlID string) (error,int) {
+	s,err := webpush.ParseSubscription(subscription)
+	if err!=nil {
+		return err,0
+	}
+	readConfigLock.RLock()
+	options := &webpush.Options{
+		Subscriber:      adminEmail,
+		VAPIDPublicKey:  vapidPublicKey,
+		VAPIDPrivateKey: vapidPrivateKey,
+		TTL:             60,
+		Urgency:         "high",
+		HTTPClient:      pushHttpClient,
+	}
+	readConfigLock.RUnlock()
+	httpResponse, err := webpush.SendNotification([]byte(msg), s, options)
+	if err != nil {
+		fmt.Printf("# webpushSend (%s) err=%v (%s)\n", urlID, err, s.Endpoint)
+		return err, 0
+	}
+	io.Copy(io.Discard, io.LimitReader(httpResponse.Body, 4096))
+	httpResponse.Body.Close()
+	if logWantedFor("webpush") {
+		fmt.Printf("webpushSend (%s) status=%d (%s)\n", urlID, httpResponse.StatusCode, s.Endpoint)
+	}
+	return nil, httpResponse.StatusCode
+}
+
+// webpushNotify sends msg to all subscriptions of calleeID; it returns the number of delivered messages
+func webpushNotify(calleeID string, msg string) int {
+	if !webpushConfigured() {
+		return 0
+	}
+	pushSubscriptionsMutex.Lock()
+	subscriptionMap := pushSubscriptionsGet(calleeID)
+	pushSubscriptionsMutex.Unlock()
+
+	type pushResult struct {
+		sid string
+		statusCode int
+	}
+	results := make(chan pushResult, len(subscriptionMap))
+	for sid,subscription := range subscriptionMap {
+		go func(sid string, subscription string) {
+			err,statusCode := webpushSend(subscription, msg, calleeID)
+			if err!=nil {
+				statusCode = 0
+			}
+			results <- pushResult{sid, statusCode}
+		}(sid, subscription.Subscription)
+	}
+	sent := 0
+	var sentSids, goneSids []string
+	for range subscriptionMap {
+		result := <-results
+		switch {
+		case result.statusCode>=200 && result.statusCode<300:
+			sent++
+			sentSids = append(sentSids, result.sid)
+		case result.statusCode==http.StatusNotFound || result.statusCode==http.StatusGone:
+			// the subscription has expired or was unsubscribed
+			fmt.Printf("webpushNotify (%s) remove subscription %s status=%d\n",
+				calleeID, result.sid, result.statusCode)
+			goneSids = append(goneSids, result.sid)
+		case result.statusCode>0:
+			fmt.Printf("# webpushNotify (%s) subscription %s status=%d\n",
+				calleeID, result.sid, result.statusCode)
+		}
+	}
+
+	if len(sentSids)>0 || len(goneSids)>0 {
+		pushSubscriptionsMutex.Lock()
+		subscriptionMap = pushSubscriptionsGet(calleeID)
+		now := time.Now().Unix()
+		for _,sid := range sentSids {
+			if subscription,ok := subscriptionMap[sid]; ok {
+				subscription.LastPush = now
+				subscriptionMap[sid] = subscription
+			}
+		}
+		for _,sid := range goneSids {
+			delete(subscriptionMap, sid)
+		}
+		err := pushSubscriptionsPut(calleeID,subscriptionMap)
+		pushSubscriptionsMutex.Unlock()
+		if err!=nil {
+			fmt.Printf("# webpushNotify (%s) db=%s bucket=%s err=%v\n",
+				calleeID, dbNotifName, dbPushSubscriptions, err)
+		}
+	}
+	fmt.Printf("webpushNotify (%s) sent=%d/%d removed=%d\n", calleeID, sent, len(subscriptionMap)+len(goneSids),
+		len(goneSids))
+	return sent
+}
+
+// pushCheckCallee does the checks common to the /push* requests
+func pushCheckCallee(path string, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) bool {
+	if calleeID=="" {
+		fmt.Printf("# %s calleeID empty urlID=%s %s\n", path, urlID, remoteAddr)
+		return false
+	}
+	if cookie==nil {
+		fmt.Printf("# %s (%s) fail no cookie %s\n", path, calleeID, remoteAddr)
+		return false
+	}
+	if urlID!="" && urlID!=calleeID {
+		fmt.Printf("# %s urlID=%s != calleeID=%s %s\n", path, urlID, calleeID, remoteAddr)
+		return false
+	}
+	return true
+}
+
+func httpPushSubscribe(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/pushsubscribe", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	if !webpushConfigured() {
+		fmt.Printf("# /pushsubscribe (%s) no vapid keys %s\n", calleeID, remoteAddr)
+		fmt.Fprintf(w,"notavail")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err!=nil || len(data)==0 {
+		fmt.Printf("# /pushsubscribe (%s) no body %s err=%v\n", calleeID, remoteAddr, err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	subscription := strings.TrimSpace(string(data))
+	sid,err := pushSubscriptionAdd(calleeID, subscription, r.UserAgent())
+	if err!=nil {
+		fmt.Printf("# /pushsubscribe (%s) denied %s err=%v\n", calleeID, remoteAddr, err)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	fmt.Printf("/pushsubscribe (%s) sid=%s %s\n", calleeID, sid, remoteAddr)
+
+	// welcome message; also verifies the subscription
+	msg := "You will from now on receive a WebPush notification for every call"+
+			" you receive while not being connected to the WebCall server."
+	err,statusCode := webpushSend(subscription, msg, calleeID)
+	if err==nil && (statusCode==http.StatusNotFound || statusCode==http.StatusGone) {
+		fmt.Printf("# /pushsubscribe (%s) sid=%s gone status=%d\n", calleeID, sid, statusCode)
+		pushSubscriptionRemove(calleeID, sid)
+		fmt.Fprintf(w,"gone")
+		return
+	}
+	fmt.Fprintf(w,"ok|"+sid)
+}
+
+func httpPushSubscriptions(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/pushsubscriptions", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	type PushSubscriptionResponse struct {
+		Id string `json:"id"`
+		Endpoint string `json:"endpoint"`
+		UserAgent string `json:"userAgent"`
+		Created int64 `json:"created"`
+		LastPush int64 `json:"lastPush"`
+	}
+	pushSubscriptionsMutex.Lock()
+	subscriptionMap := pushSubscriptionsGet(calleeID)
+	pushSubscriptionsMutex.Unlock()
+	subscriptionSlice := []PushSubscriptionResponse{}
+	for id,subscription := range subscriptionMap {
+		endpoint := ""
+		if s,err := webpush.ParseSubscription(subscription.Subscription); err==nil {
+			endpoint = s.Endpoint
+		}
+		subscriptionSlice = append(subscriptionSlice, PushSubscriptionResponse{id, endpoint,
+			subscription.UserAgent, subscription.Created, subscription.LastPush})
+	}
+	sort.Slice(subscriptionSlice, func(i, j int) bool {
+		return subscriptionSlice[i].Created > subscriptionSlice[j].Created
+	})
+	jsonStr, err := json.Marshal(subscriptionSlice)
+	if err != nil {
+		fmt.Printf("# /pushsubscriptions (%s) failed on json.Marshal %s err=%v\n", calleeID, remoteAddr, err)
+		return
+	}
+	fmt.Fprintf(w,"%s",jsonStr)
+}
+
+func httpPushUnsubscribe(w http.ResponseWriter, r *http.Request, urlID string, calleeID string, cookie *http.Cookie, remoteAddr string) {
+	if !pushCheckCallee("/pushunsubscribe", urlID, calleeID, cookie, remoteAddr) {
+		return
+	}
+	sid := ""
+	url_arg_array, ok := r.URL.Query()["sid"]
+	if ok && len(url_arg_array[0]) > 0 {
+		sid = url_arg_array[0]
+	}
+	if sid=="" {
+		fmt.Printf("# /pushunsubscribe (%s) no sid %s\n", calleeID, remoteAddr)
+		fmt.Fprintf(w,"error")
+		return
+	}
+	count := pushSubscriptionRemove(calleeID, sid)
+	fmt.Printf("/pushunsubscribe (%s) sid=%s removed=%d %s\n", calleeID, sid, count, remoteAddr)
+	if count==0 {
+		fmt.Fprintf(w,"notfound")
+		return
+	}
+	fmt.Fprintf(w,"ok")
+}
+
+// vapidKeysCmd prints a new vapid key pair for config.ini ("webcall vapidkeys")
+func vapidKeysCmd() int {
+	privateKey,publicKey,err := webpush.GenerateVAPIDKeys()
+	if err!=nil {
+		fmt.Printf("# vapidkeys err=%v\n", err)
+		return 1
+	}
+	fmt.Printf("vapidPrivateKey = %s\n", privateKey)
+	fmt.Printf("vapidPublicKey = %s\n", publicKey)
+	return 0
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/mehrvarz/webcall/skv"
+	"github.com/mehrvarz/webcall/webpush"
+)
+
+// testOpenNotif opens an empty kvNotif in a temp dir
+func testOpenNotif(t *testing.T) {
+	t.Helper()
+	kv,err := skv.DbOpen(dbNotifName, t.TempDir()+"/")
+	if err!=nil {
+		t.Fatalf("DbOpen err=%v", err)
+	}
+	err = kv.CreateBucket(dbPushSubscriptions)
+	if err!=nil {
+		t.Fatalf("CreateBucket err=%v", err)
+	}
+	kvNotif = kv
+	t.Cleanup(func() {
+		kv.Close()
+		kvNotif = nil
+	})
+}
+
+func TestWebpushNotifyRemovesGone(t *testing.T) {
+	testOpenNotif(t)
+	privateKey,publicKey,err := webpush.GenerateVAPIDKeys()
+	if err!=nil {
+		t.Fatalf("GenerateVAPIDKeys err=%v", err)
+	}
+	readConfigLock.Lock()
+	vapidPrivateKey, vapidPublicKey, webpushTestService = privateKey, publicKey, true
+	readConfigLock.Unlock()
+	defer func() {
+		readConfigLock.Lock()
+		vapidPrivateKey, vapidPublicKey, webpushTestService = "", "", false
+		readConfigLock.Unlock()
+	}()
+
+	ua,err := webpush.NewUserAgent()
+	if err!=nil {
+		t.Fatalf("NewUserAgent err=%v", err)
+	}
+	var receivedMutex sync.Mutex
+	var received []string
+	// a push service: /ok delivers, /gone and /notfound are expired subscriptions, /fail is down
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			body,_ := io.ReadAll(r.Body)
+			message,err := ua.Decrypt(body)
+			if err!=nil {
+				t.Errorf("Decrypt err=%v", err)
+			}
+			receivedMutex.Lock()
+			received = append(received, string(message))
+			receivedMutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	calleeID := "12345678901"
+	subscriptionMap := make(map[string]PushSubscription)
+	for _,path := range []string{"/ok", "/gone", "/notfound", "/fail"} {
+		subscriptionMap[pushSubscriptionID(srv.URL+path)] =
+			PushSubscription{ua.Subscription(srv.URL+path), "test", 1, 0}
+	}
+	err = pushSubscriptionsPut(calleeID, subscriptionMap)
+	if err!=nil {
+		t.Fatalf("pushSubscriptionsPut err=%v", err)
+	}
+
+	if sent := webpushNotify(calleeID, "incoming call"); sent!=1 {
+		t.Fatalf("webpushNotify sent=%d want 1", sent)
+	}
+	if len(received)!=1 || received[0]!="incoming call" {
+		t.Fatalf("received %q", received)
+	}
+	subscriptionMap = pushSubscriptionsGet(calleeID)
+	if len(subscriptionMap)!=2 {
+		t.Fatalf("%d subscriptions left, want 2", len(subscriptionMap))
+	}
+	for _,path := range []string{"/gone", "/notfound"} {
+		if _,ok := subscriptionMap[pushSubscriptionID(srv.URL+path)]; ok {
+			t.Fatalf("subscription %s not removed", path)
+		}
+	}
+	if subscriptionMap[pushSubscriptionID(srv.URL+"/ok")].LastPush==0 {
+		t.Fatalf("LastPush of /ok not set")
+	}
+	if _,ok := subscriptionMap[pushSubscriptionID(srv.URL+"/fail")]; !ok {
+		t.Fatalf("subscription /fail removed on a server error")
+	}
+
+	// the last subscriptions removed: the entry is gone
+	pushSubscriptionRemove(calleeID, "all")
+	if webpushHasSubscriptions(calleeID) {
+		t.Fatalf("subscriptions left after remove all")
+	}
+}
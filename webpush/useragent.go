@@ -0,0 +1,156 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// The receiving side of a push message: what a browser and its push service do.
+// Used by the push service stand-in (cmd/wcpush) to test SendNotification.
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// UserAgent holds the keys a browser creates for its subscriptions
+type UserAgent struct {
+	private []byte
+	public []byte
+	authSecret []byte
+}
+
+func NewUserAgent() (*UserAgent, error) {
+	private,x,y,err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err!=nil {
+		return nil, err
+	}
+	authSecret := make([]byte, 16)
+	if _,err = rand.Read(authSecret); err!=nil {
+		return nil, err
+	}
+	return &UserAgent{private, elliptic.Marshal(elliptic.P256(), x, y), authSecret}, nil
+}
+
+// Subscription returns the subscription json for endpoint
+func (ua *UserAgent) Subscription(endpoint string) string {
+	subscription,_ := json.Marshal(Subscription{endpoint, Keys{
+		base64.RawURLEncoding.EncodeToString(ua.public),
+		base64.RawURLEncoding.EncodeToString(ua.authSecret)}})
+	return string(subscription)
+}
+
+// Decrypt returns the message of an aes128gcm body
+func (ua *UserAgent) Decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("body too short")
+	}
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	idLen := int(body[20])
+	if len(body) < 21+idLen || rs < 18 {
+		return nil, errors.New("bad header")
+	}
+	asPublic := body[21:21+idLen]
+	record := body[21+idLen:]
+	if uint32(len(record)) > rs {
+		return nil, errors.New("more than one record")
+	}
+	curve := elliptic.P256()
+	asX,asY := elliptic.Unmarshal(curve, asPublic)
+	if asX==nil {
+		return nil, errors.New("bad key id")
+	}
+	sharedX,_ := curve.ScalarMult(asX, asY, ua.private)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+	cek,nonce,err := contentKeys(ecdhSecret, ua.authSecret, ua.public, asPublic, salt)
+	if err!=nil {
+		return nil, err
+	}
+	block,err := aes.NewCipher(cek)
+	if err!=nil {
+		return nil, err
+	}
+	gcm,err := cipher.NewGCM(block)
+	if err!=nil {
+		return nil, err
+	}
+	plaintext,err := gcm.Open(nil, nonce, record, nil)
+	if err!=nil {
+		return nil, err
+	}
+	// strip padding and the last record delimiter
+	idx := bytes.LastIndexByte(plaintext, 2)
+	if idx<0 || len(bytes.Trim(plaintext[idx+1:], "\x00"))>0 {
+		return nil, errors.New("no last record delimiter")
+	}
+	return plaintext[:idx], nil
+}
+
+// VerifyAuthorization checks the VAPID Authorization header of a push request
+// and returns the subscriber (the sub claim)
+func VerifyAuthorization(authorization string, audience string) (string, error) {
+	if !strings.HasPrefix(authorization, "vapid ") {
+		return "", errors.New("no vapid authorization")
+	}
+	jwt,publicKey := "",""
+	for _,param := range strings.Split(authorization[6:], ",") {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "t=") {
+			jwt = param[2:]
+		} else if strings.HasPrefix(param, "k=") {
+			publicKey = param[2:]
+		}
+	}
+	key,err := decode(publicKey)
+	if err!=nil {
+		return "", err
+	}
+	x,y := elliptic.Unmarshal(elliptic.P256(), key)
+	if x==nil {
+		return "", errors.New("bad vapid public key")
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts)!=3 {
+		return "", errors.New("bad jwt")
+	}
+	signature,err := decode(parts[2])
+	if err!=nil || len(signature)!=64 {
+		return "", errors.New("bad jwt signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0]+"."+parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, hash[:], r, s) {
+		return "", errors.New("jwt signature does not verify")
+	}
+	claimsJson,err := decode(parts[1])
+	if err!=nil {
+		return "", err
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64 `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err = json.Unmarshal(claimsJson, &claims); err!=nil {
+		return "", err
+	}
+	if claims.Aud!=audience {
+		return "", errors.New("jwt aud is "+claims.Aud)
+	}
+	if claims.Exp < time.Now().Unix() || claims.Exp > time.Now().Add(24*time.Hour).Unix() {
+		return "", errors.New("jwt exp out of range")
+	}
+	return claims.Sub, nil
+}
@@ -0,0 +1,282 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Package webpush sends Web Push messages (RFC 8030).
+// The message is encrypted for the subscription of the user agent (RFC 8291,
+// content encoding aes128gcm) and the request is signed with the VAPID key pair
+// of the application server (RFC 8292).
+// VAPID keys are base64url strings: the private key is the 32 byte P-256 scalar,
+// the public key the 65 byte uncompressed point (as used by pushManager.subscribe()).
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// the size of the one record we send; the message must fit into it
+const recordSize = 4096
+
+// MaxMessageLen is the max length of a message (record minus delimiter and aes-gcm tag)
+const MaxMessageLen = recordSize - 16 - 1
+
+// Keys of a subscription, as created by the user agent
+type Keys struct {
+	P256dh string `json:"p256dh"`
+	Auth string `json:"auth"`
+}
+
+// Subscription is the json of a browser PushSubscription
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys Keys `json:"keys"`
+}
+
+type Options struct {
+	Subscriber string // email address (without "mailto:") or https url of the operator
+	VAPIDPublicKey string
+	VAPIDPrivateKey string
+	TTL int // secs the push service may keep an undelivered message
+	Urgency string // "very-low", "low", "normal" or "high"; "" = normal
+	HTTPClient *http.Client // nil = http.DefaultClient
+}
+
+// ParseSubscription decodes and checks the json of a PushSubscription
+func ParseSubscription(subscription string) (*Subscription, error) {
+	s := &Subscription{}
+	err := json.Unmarshal([]byte(subscription), s)
+	if err!=nil {
+		return nil, err
+	}
+	u,err := url.Parse(s.Endpoint)
+	if err!=nil {
+		return nil, err
+	}
+	if (u.Scheme!="https" && u.Scheme!="http") || u.Host=="" {
+		return nil, errors.New("bad endpoint")
+	}
+	if _,_,err = s.keys(); err!=nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// keys returns the decoded public key and auth secret of the user agent
+func (s *Subscription) keys() ([]byte, []byte, error) {
+	uaPublic,err := decode(s.Keys.P256dh)
+	if err!=nil {
+		return nil, nil, fmt.Errorf("p256dh %v", err)
+	}
+	if x,_ := elliptic.Unmarshal(elliptic.P256(), uaPublic); x==nil {
+		return nil, nil, errors.New("p256dh is not a P-256 point")
+	}
+	authSecret,err := decode(s.Keys.Auth)
+	if err!=nil {
+		return nil, nil, fmt.Errorf("auth %v", err)
+	}
+	if len(authSecret)!=16 {
+		return nil, nil, errors.New("auth must be 16 bytes")
+	}
+	return uaPublic, authSecret, nil
+}
+
+// decode accepts base64url and base64, with or without padding
+func decode(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.Replace(strings.Replace(s, "+", "-", -1), "/", "_", -1)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// GenerateVAPIDKeys returns a new VAPID key pair
+func GenerateVAPIDKeys() (privateKey string, publicKey string, err error) {
+	priv,x,y,err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err!=nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(priv),
+		base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)), nil
+}
+
+// SendNotification encrypts message for s and posts it to the push service
+// a push service answers 201 on success; 404 and 410 mean the subscription is gone
+func SendNotification(message []byte, s *Subscription, options *Options) (*http.Response, error) {
+	if len(message) > MaxMessageLen {
+		return nil, errors.New("message too long")
+	}
+	body,err := encrypt(message, s)
+	if err!=nil {
+		return nil, err
+	}
+	authorization,err := vapidAuthorization(s.Endpoint, options)
+	if err!=nil {
+		return nil, err
+	}
+
+	req,err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+	if err!=nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(options.TTL))
+	if options.Urgency!="" {
+		req.Header.Set("Urgency", options.Urgency)
+	}
+	req.Header.Set("Authorization", authorization)
+	client := options.HTTPClient
+	if client==nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// encrypt returns the aes128gcm body (header + one record) for message
+func encrypt(message []byte, s *Subscription) ([]byte, error) {
+	uaPublic,authSecret,err := s.keys()
+	if err!=nil {
+		return nil, err
+	}
+	// ephemeral key pair of the application server
+	asPrivate,_,_,err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err!=nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _,err = rand.Read(salt); err!=nil {
+		return nil, err
+	}
+	return encryptWith(message, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encryptWith encrypts with the given application server private key and salt
+func encryptWith(message []byte, uaPublic []byte, authSecret []byte, asPrivate []byte, salt []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX,uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX==nil {
+		return nil, errors.New("bad p256dh key")
+	}
+	asX,asY := curve.ScalarBaseMult(asPrivate)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sharedX,_ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+
+	cek,nonce,err := contentKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt)
+	if err!=nil {
+		return nil, err
+	}
+	block,err := aes.NewCipher(cek)
+	if err!=nil {
+		return nil, err
+	}
+	gcm,err := cipher.NewGCM(block)
+	if err!=nil {
+		return nil, err
+	}
+
+	// header: salt, record size, key id (the public key of the application server)
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(recordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	// the only (and last) record ends with delimiter 0x02; no padding
+	plaintext := append(append([]byte{}, message...), 2)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// contentKeys derives the content encryption key and nonce (RFC 8291 section 3.4)
+func contentKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) ([]byte, []byte, error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _,err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err!=nil {
+		return nil, nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _,err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err!=nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 12)
+	if _,err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err!=nil {
+		return nil, nil, err
+	}
+	return cek, nonce, nil
+}
+
+// vapidAuthorization returns the Authorization header for a request to endpoint
+func vapidAuthorization(endpoint string, options *Options) (string, error) {
+	u,err := url.Parse(endpoint)
+	if err!=nil {
+		return "", err
+	}
+	privateKey,err := vapidPrivateKey(options.VAPIDPrivateKey)
+	if err!=nil {
+		return "", err
+	}
+	subscriber := options.Subscriber
+	if !strings.HasPrefix(subscriber, "https:") && !strings.HasPrefix(subscriber, "mailto:") {
+		subscriber = "mailto:"+subscriber
+	}
+	claims,err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme+"://"+u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subscriber,
+	})
+	if err!=nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	r,s,err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+	if err!=nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	jwt := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	publicKey := options.VAPIDPublicKey
+	if publicKey=="" {
+		publicKey = base64.RawURLEncoding.EncodeToString(
+			elliptic.Marshal(elliptic.P256(), privateKey.X, privateKey.Y))
+	}
+	return "vapid t="+jwt+", k="+publicKey, nil
+}
+
+func vapidPrivateKey(key string) (*ecdsa.PrivateKey, error) {
+	d,err := decode(key)
+	if err!=nil {
+		return nil, fmt.Errorf("vapid private key %v", err)
+	}
+	if len(d)!=32 {
+		return nil, errors.New("vapid private key must be 32 bytes")
+	}
+	privateKey := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	privateKey.PublicKey.Curve = elliptic.P256()
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = elliptic.P256().ScalarBaseMult(d)
+	return privateKey, nil
+}
@@ -0,0 +1,88 @@
+package webpush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// the example of RFC 8291 Appendix A
+const (
+	rfcMessage = "When I grow up, I want to be a watermelon"
+	rfcAsPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcAsPublic = "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8"
+	rfcUaPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcUaPublic = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcAuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcSalt = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcBody = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	data,err := base64.RawURLEncoding.DecodeString(s)
+	if err!=nil {
+		t.Fatalf("decode %s err=%v", s, err)
+	}
+	return data
+}
+
+func rfcUserAgent(t *testing.T) *UserAgent {
+	return &UserAgent{mustDecode(t,rfcUaPrivate), mustDecode(t,rfcUaPublic), mustDecode(t,rfcAuthSecret)}
+}
+
+func TestEncryptRFC8291(t *testing.T) {
+	body,err := encryptWith([]byte(rfcMessage), mustDecode(t,rfcUaPublic), mustDecode(t,rfcAuthSecret),
+		mustDecode(t,rfcAsPrivate), mustDecode(t,rfcSalt))
+	if err!=nil {
+		t.Fatalf("encryptWith err=%v", err)
+	}
+	// the key id of the header is the public key of the application server
+	if !bytes.Equal(body[21:21+65], mustDecode(t,rfcAsPublic)) {
+		t.Fatalf("key id %x", body[21:21+65])
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got!=rfcBody {
+		t.Fatalf("body\n got %s\nwant %s", got, rfcBody)
+	}
+}
+
+func TestDecryptRFC8291(t *testing.T) {
+	message,err := rfcUserAgent(t).Decrypt(mustDecode(t,rfcBody))
+	if err!=nil {
+		t.Fatalf("Decrypt err=%v", err)
+	}
+	if string(message)!=rfcMessage {
+		t.Fatalf("message %q", message)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	ua,err := NewUserAgent()
+	if err!=nil {
+		t.Fatalf("NewUserAgent err=%v", err)
+	}
+	s,err := ParseSubscription(ua.Subscription("https://push.example.com/1"))
+	if err!=nil {
+		t.Fatalf("ParseSubscription err=%v", err)
+	}
+	for _,message := range []string{"", "hello", string(bytes.Repeat([]byte{2}, MaxMessageLen))} {
+		body,err := encrypt([]byte(message), s)
+		if err!=nil {
+			t.Fatalf("encrypt len=%d err=%v", len(message), err)
+		}
+		decrypted,err := ua.Decrypt(body)
+		if err!=nil {
+			t.Fatalf("Decrypt len=%d err=%v", len(message), err)
+		}
+		if string(decrypted)!=message {
+			t.Fatalf("round trip len=%d got len=%d", len(message), len(decrypted))
+		}
+	}
+
+	// another user agent cannot decrypt it
+	other,_ := NewUserAgent()
+	body,_ := encrypt([]byte("hello"), s)
+	if _,err := other.Decrypt(body); err==nil {
+		t.Fatalf("Decrypt with the wrong keys succeeded")
+	}
+}
@@ -26,6 +26,13 @@ const menuExitElement = document.getElementById('menuExit');
 const iconContactsElement = document.getElementById('iconContacts');
 const dialIdElement = document.getElementById('dialId');
 const exclamationElement = document.getElementById('exclamation');
+const callWaitingElement = document.getElementById('callWaiting');
+const callWaitingTextElement = document.getElementById('callWaitingText');
+const callWaitingHoldButton = document.querySelector('button#callWaitingHold');
+const heldCallElement = document.getElementById('heldCall');
+const heldCallTextElement = document.getElementById('heldCallText');
+const groupCallElement = document.getElementById('groupCall');
+const groupCallTextElement = document.getElementById('groupCallText');
 const autoReconnectDelay = 15;
 const singlebutton = false;
 const calleeMode = true;
@@ -36,6 +43,7 @@ var ringtoneIsPlaying = false;
 var busySignalSound = null;
 var notificationSound = null;
 var wsAddr = "";
+var resumeToken = "";
 var talkSecs = 0;
 var outboundIP = "";
 var serviceSecs = 0;
@@ -82,6 +90,9 @@ var fileSendAbort=false;
 var fileReceiveAbort=false;
 var loginResponse=false;
 var minNewsDate=0;
+var answerNextCall=false; // auto-answer the accepted waiting caller, the unheld caller or a group call
+var groupCallToken="";
+var groupPickupToken=""; // the group call we have picked up
 
 window.onload = function() {
 	if(!navigator.mediaDevices) {
@@ -950,14 +961,46 @@ function wsOnClose(evt) {
 	}
 	if(goOnlineButton.disabled && evt) {
 		// this is not a user-intended offline; we should be online
-		let delay = autoReconnectDelay + Math.floor(Math.random() * 10) - 5;
-		gLog('reconnecting to signaling server in sec '+delay);
-		showStatus("Reconnecting to signaling server...",-1);
-		missedCallsElement.style.display = "none";
-		missedCallsTitleElement.style.display = "none";
-		// if conditions are right after delay secs this will call login()
-		delayedWsAutoReconnect(delay);
+		if(resumeToken!="" && mediaConnect && (typeof Android === "undefined" || Android === null)) {
+			// in a call: resume the signaling session without a new login (see wsResume.go)
+			showStatus("Reconnecting to signaling server...",-1);
+			setTimeout(resumeSignaling,2000);
+			return;
+		}
+		wsReconnect();
+	}
+}
+
+function wsReconnect() {
+	resumeToken = "";
+	clearCallWaiting();
+	let delay = autoReconnectDelay + Math.floor(Math.random() * 10) - 5;
+	gLog('reconnecting to signaling server in sec '+delay);
+	showStatus("Reconnecting to signaling server...",-1);
+	missedCallsElement.style.display = "none";
+	missedCallsTitleElement.style.display = "none";
+	// if conditions are right after delay secs this will call login()
+	delayedWsAutoReconnect(delay);
+}
+
+function resumeSignaling() {
+	// repeated by wsOnClose until the server answers "resumed" or "cancel|resume"
+	if(!goOnlineButton.disabled || wsConn!=null) {
+		return;
 	}
+	if(!mediaConnect || resumeToken=="") {
+		// the call has ended meanwhile
+		wsReconnect();
+		return;
+	}
+	gLog('resume signaling session '+calleeID);
+	tryingToOpenWebSocket = true;
+	wsSendMessage = "";
+	wsConn = new WebSocket(wsAddr+"&resume="+resumeToken);
+	wsConn.onopen = wsOnOpen;
+	wsConn.onerror = wsOnError;
+	wsConn.onclose = wsOnClose;
+	wsConn.onmessage = wsOnMessage;
 }
 
 function wsOnClose2() {
@@ -997,6 +1040,17 @@ function signalingCommand(message) {
 	} else if(cmd=="dummy") {
 		gLog('dummy '+payload);
 
+	} else if(cmd=="resumeToken") {
+		resumeToken = payload;
+
+	} else if(cmd=="resumed") {
+		// signaling session resumed; payload = number of queued messages to follow
+		gLog('resumed '+payload);
+		showStatus("Reconnected",2000);
+
+	} else if(cmd=="turnCred") {
+		setTurnCredentials(payload);
+
 	} else if(cmd=="callerOffer" || cmd=="callerOfferUpd") {
 		if(peerCon==null) {
 			console.warn('callerOffer but no peerCon');
@@ -1170,6 +1224,10 @@ function signalingCommand(message) {
 			}
 			stopAllAudioEffects("incoming cancel2");
 			endWebRtcSession(false,true); // -> peerConCloseFunc
+		} else if(payload=="resume") {
+			// resume denied (grace window expired); wsOnClose will login again
+			console.log('cmd cancel resume');
+			resumeToken = "";
 		} else {
 			stopAllAudioEffects("ignore cancel");
 			// TODO no endWebRtcSession ? android service will not know that ringing has ended
@@ -1190,6 +1248,42 @@ function signalingCommand(message) {
 		// callee has checked in
 		//clientVersion = payload;
 		showOnlineReadyMsg();
+		// we can handle a 2nd caller while in a call
+		wsSend("callWaiting|true");
+		// and calls to a parallel ring group we are a member of
+		wsSend("ringGroupCalls|true");
+
+	} else if(cmd=="groupCall") {
+		// a caller is ringing the members of a group (see ringGroup.go)
+		showGroupCall(JSON.parse(payload));
+
+	} else if(cmd=="groupCallEnded") {
+		let groupCallEnded = JSON.parse(payload);
+		gLog('groupCallEnded '+groupCallEnded.reason);
+		if(groupCallEnded.token==groupCallToken) {
+			groupCallToken = "";
+			groupCallElement.style.display = "none";
+		} else if(groupCallEnded.token==groupPickupToken) {
+			// we picked up, but the caller could not be connected to us
+			groupPickupToken = "";
+			answerNextCall = false;
+		}
+
+	} else if(cmd=="callWaiting") {
+		// a 2nd caller while we are in a call (see wsCallWaiting.go)
+		showCallWaiting(JSON.parse(payload));
+
+	} else if(cmd=="callWaitingEnded") {
+		gLog('callWaitingEnded');
+		callWaitingElement.style.display = "none";
+
+	} else if(cmd=="heldCallerEnded") {
+		gLog('heldCallerEnded');
+		heldCallElement.style.display = "none";
+		if(!rtcConnect) {
+			// it was about to be connected
+			answerNextCall = false;
+		}
 
 	} else if(cmd=="sessionDuration") { // in call
 		if(isP2pCon()) {
@@ -1464,6 +1558,130 @@ function showMissedCalls() {
 	}
 }
 
+function showCallWaiting(callerInfo) {
+	let name = callerInfo.CallerName;
+	if(name=="") {
+		name = callerInfo.CallerID;
+	}
+	if(name=="") {
+		name = halfShowIpAddr(callerInfo.AddrPort);
+	}
+	gLog('callWaiting '+name);
+	callWaitingTextElement.textContent = "Call waiting: "+name;
+	// only one caller can be on hold
+	if(heldCallElement.style.display=="none") {
+		callWaitingHoldButton.style.display = "inline-block";
+	} else {
+		callWaitingHoldButton.style.display = "none";
+	}
+	callWaitingElement.style.display = "block";
+	notificationSound.play().catch(function(error) { });
+}
+
+function callWaitingAccept(mode) {
+	callWaitingElement.style.display = "none";
+	answerNextCall = true;
+	wsSend("callWaitingAccept|"+mode);
+	if(mode=="hold") {
+		showHeldCall();
+		// let "hold" reach the current caller before our peer connection ends
+		setTimeout(function() { endWebRtcSession(false,true); },1000);
+	} else {
+		endWebRtcSession(true,true);
+	}
+}
+
+function callWaitingReject() {
+	callWaitingElement.style.display = "none";
+	wsSend("callWaitingReject|");
+}
+
+function callWaitingBusy() {
+	let text = prompt("Busy message","I will call you back");
+	if(text===null) {
+		return;
+	}
+	callWaitingElement.style.display = "none";
+	wsSend("callWaitingBusy|"+text.replace(/\|/g," ").substring(0,100));
+}
+
+function showHeldCall() {
+	// the current caller goes on hold
+	let name = callerName;
+	if(name=="") {
+		name = callerID;
+	}
+	if(name=="") {
+		name = listOfClientIps;
+	}
+	heldCallTextElement.textContent = "On hold: "+name;
+	heldCallElement.style.display = "block";
+}
+
+function heldCallSwap() {
+	answerNextCall = true;
+	wsSend("callWaitingSwap|");
+	if(rtcConnect) {
+		showHeldCall();
+		setTimeout(function() { endWebRtcSession(false,true); },1000);
+	} else {
+		heldCallElement.style.display = "none";
+	}
+}
+
+function heldCallDrop() {
+	heldCallElement.style.display = "none";
+	wsSend("callWaitingDrop|");
+}
+
+function clearCallWaiting() {
+	// the server drops waiting and held callers when we go offline
+	answerNextCall = false;
+	groupCallToken = "";
+	callWaitingElement.style.display = "none";
+	heldCallElement.style.display = "none";
+	groupCallElement.style.display = "none";
+}
+
+function showGroupCall(groupCall) {
+	let name = groupCall.callerName;
+	if(name=="") {
+		name = groupCall.callerId;
+	}
+	gLog('groupCall '+groupCall.group+' '+name);
+	groupCallToken = groupCall.token;
+	groupCallTextElement.textContent = "Call to "+groupCall.group+": "+name;
+	groupCallElement.style.display = "block";
+	notificationSound.play().catch(function(error) { });
+}
+
+function groupCallPickup() {
+	if(groupCallToken=="") {
+		return;
+	}
+	groupCallElement.style.display = "none";
+	// the caller is now sent to us and connects as usual
+	answerNextCall = true;
+	wsSend("groupPickup|"+groupCallToken);
+	groupPickupToken = groupCallToken;
+	groupCallToken = "";
+	setTimeout(function() {
+		if(!rtcConnect) {
+			// the caller did not show up
+			answerNextCall = false;
+		}
+	},30000);
+}
+
+function groupCallReject() {
+	if(groupCallToken=="") {
+		return;
+	}
+	groupCallElement.style.display = "none";
+	wsSend("groupReject|"+groupCallToken);
+	groupCallToken = "";
+}
+
 function halfShowIpAddr(ipAddr) {
 	let idxFirstDot = ipAddr.indexOf(".");
 	if(idxFirstDot>=0) {
@@ -1881,7 +2099,8 @@ function peerConnected2() {
 		goOfflineButton.style.display = "none";
 		answerButton.style.display = "inline-block";
 		rejectButton.style.display = "inline-block";
-		if(autoanswerCheckbox.checked) {
+		if(autoanswerCheckbox.checked || answerNextCall) {
+			answerNextCall = false;
 			var pickupFunc = function() {
 				// may have received "onmessage disconnect (caller)" and/or "cmd cancel (server)" in the meantime
 				if(!buttonBlinking) {
@@ -2219,6 +2438,7 @@ function endWebRtcSession(disconnectCaller,goOnlineAfter) {
 }
 
 function goOffline() {
+	clearCallWaiting();
 	wsAutoReconnecting = false;
 	//goOfflineButton.disabled = true;
 	//goOnlineButton.disabled = false;
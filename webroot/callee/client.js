@@ -44,17 +44,39 @@ var connectionstatechangeCounter = 0;
 var playDialSounds = true;
 var pickupAfterLocalStream = false; // not used in caller
 
+// the turn server entry is added by setTurnCredentials() once the server has sent "turnCred|"
 var ICE_config = {
 	"iceServers": [
 		{	'urls': 'stun:'+window.location.hostname+':3739' },
-		{	'urls': 'turn:'+window.location.hostname+':3739',
-			'username': 'c807ec29df3c9ff',
-			'credential': '736518fb4232d44'
-		}
 	]
 	,"iceTransportPolicy": "all" // "all" / "relay"
 };
 
+function setTurnCredentials(payload) {
+	// payload is JSON {"username":"(expiry):(calleeID)","credential":"..."}, valid for the current call only
+	let turnCred = null;
+	try {
+		turnCred = JSON.parse(payload);
+	} catch(ex) {
+		console.warn("setTurnCredentials "+ex.message);
+		return;
+	}
+	ICE_config.iceServers = [
+		{	'urls': 'stun:'+window.location.hostname+':3739' },
+		{	'urls': 'turn:'+window.location.hostname+':3739',
+			'username': turnCred.username,
+			'credential': turnCred.credential
+		}
+	];
+	if(peerCon) {
+		try {
+			peerCon.setConfiguration(ICE_config);
+		} catch(ex) {
+			console.warn("setTurnCredentials setConfiguration "+ex.message);
+		}
+	}
+}
+
 var defaultConstraintString = '"width": {"min":320,"ideal":1920, "max":4096 },"height": {"min":240, "ideal":1080, "max":2160 },"frameRate": { "min":10, "max":30 }';
 
 var constraintString = defaultConstraintString;
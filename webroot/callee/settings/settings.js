@@ -2,12 +2,9 @@
 'use strict';
 const form = document.querySelector('form#settings');
 const formPw = document.querySelector('input#nickname');
-const webpush1button = document.getElementById("webpush1but");
-const webpush2button = document.getElementById("webpush2but");
-const webpush1subscrElement = document.getElementById("webpush1subscr");
-const webpush2subscrElement = document.getElementById("webpush2subscr");
-const webpush1uaElement = document.getElementById("webpush1ua");
-const webpush2uaElement = document.getElementById("webpush2ua");
+const webpushElement = document.getElementById("webpush");
+const webpushListElement = document.getElementById("webpushlist");
+const webpushButton = document.getElementById("webpushbut");
 var calleeID = "";
 var calleeLink = "";
 var vapidPublicKey = ""
@@ -105,84 +102,16 @@ function prepareSettings(xhrresponse) {
 			document.getElementById("storeMissedCalls").checked = false;
 		}
 	}
-/*
-	if(typeof serverSettings.webPushSubscription1!=="undefined") {
-		//if(!gentle) console.log('serverSettings.webPushSubscription1',serverSettings.webPushSubscription1);
-		if(serverSettings.webPushSubscription1=="") {
-			webpush1button.innerHTML = "Subscribe";
-		} else {
-			webpush1button.innerHTML = "Unsubscribe";
-			let subscriptionObj = JSON.parse(serverSettings.webPushSubscription1);
-			//console.log('subscription',subscriptionObj);
-			if(subscriptionObj && subscriptionObj.endpoint) {
-				if(subscriptionObj.endpoint.length>50) {
-					webpush1subscrElement.innerHTML = subscriptionObj.endpoint.substring(0,50)+"...";
-				} else {
-					webpush1subscrElement.innerHTML = subscriptionObj.endpoint;
-				}
-			}
-		}
-	}
-	if(typeof serverSettings.webPushUA1!=="undefined") {
-		if(serverSettings.webPushUA1==navigator.userAgent) {
-			webpush1uaElement.innerHTML = serverSettings.webPushUA1 + " (THIS DEVICE)";
-		} else {
-			webpush1uaElement.innerHTML = serverSettings.webPushUA1;
-		}
-	}
-	if(typeof serverSettings.webPushSubscription2!=="undefined") {
-		//if(!gentle) console.log('serverSettings.webPushSubscription2',serverSettings.webPushSubscription2);
-		if(serverSettings.webPushSubscription2=="") {
-			webpush2button.innerHTML = "Subscribe";
-		} else {
-			webpush2button.innerHTML = "Unsubscribe";
-			let subscriptionObj = JSON.parse(serverSettings.webPushSubscription2);
-			//console.log('subscription',subscriptionObj);
-			if(subscriptionObj && subscriptionObj.endpoint) {
-				if(subscriptionObj.endpoint.length>50) {
-					webpush2subscrElement.innerHTML = subscriptionObj.endpoint.substring(0,50)+"...";
-				} else {
-					webpush2subscrElement.innerHTML = subscriptionObj.endpoint;
-				}
-			}
-		}
-	}
-	if(typeof serverSettings.webPushUA2!=="undefined") {
-		if(serverSettings.webPushUA2==navigator.userAgent) {
-			webpush2uaElement.innerHTML = serverSettings.webPushUA2 + " (THIS DEVICE)";
-		} else {
-			webpush2uaElement.innerHTML = serverSettings.webPushUA2;
-		}
-	}
-
-	webpush1button.onclick = function() {
-		if(serverSettings.webPushSubscription1=="") {
-			webPushSubscribe(1);
-		} else {
-			console.log('unsubscribe webPushSubscription1');
-			serverSettings.webPushSubscription1 = "";
-			webpush1subscrElement.innerHTML = "";
-			serverSettings.webPushUA1 = "";
-			webpush1uaElement.innerHTML = "";
-			webpush1button.innerHTML = "Subscribe";
-			submitForm(false);
+	if(vapidPublicKey!="" && 'serviceWorker' in navigator && 'PushManager' in window &&
+			parent!=null && parent.pushRegistration) {
+		// the subscriptions of all devices of this callee
+		webpushElement.style.display = "block";
+		webpushButton.onclick = function() {
+			webPushSubscribe();
 		}
+		requestPushSubscriptions();
 	}
 
-	webpush2button.onclick = function() {
-		if(serverSettings.webPushSubscription2=="") {
-			webPushSubscribe(2);
-		} else {
-			console.log('unsubscribe webPushSubscription2');
-			serverSettings.webPushSubscription2 = "";
-			webpush2subscrElement.innerHTML = "";
-			serverSettings.webPushUA2 = "";
-			webpush2uaElement.innerHTML = "";
-			webpush2button.innerHTML = "Subscribe";
-			submitForm(false);
-		}
-	}
-*/
 	form.style.display = "block";
 	setTimeout(function() {
 		formPw.focus();
@@ -190,152 +119,105 @@ function prepareSettings(xhrresponse) {
 	// data will be stored in submitForm()
 }
 
-/*
-function webPushSubscribe(deviceNumber) {
-	if(!('serviceWorker' in navigator)) {
-		console.warn("no serviceWorker in navigator");
-		alert("WebPush fail: no serviceWorker support");
-		return
-	}
+function requestPushSubscriptions() {
+	let api = apiPath+"/pushsubscriptions?id="+calleeID;
+	ajaxFetch(new XMLHttpRequest(), "GET", api, function(xhr) {
+		let subscriptions = [];
+		try {
+			subscriptions = JSON.parse(xhr.responseText);
+		} catch(e) {
+			console.log('/pushsubscriptions parse error',e);
+		}
+		showPushSubscriptions(subscriptions);
+	}, errorAction);
+}
 
-	if(!('PushManager' in window)) {
-		console.warn("no pushManager in window");
-		alert("WebPush fail: no pushManager support");
-		return
+function showPushSubscriptions(subscriptions) {
+	webpushListElement.innerHTML = "";
+	if(!subscriptions || subscriptions.length==0) {
+		webpushListElement.innerHTML = "No device subscribed";
+		return;
 	}
+	subscriptions.forEach(function(subscription) {
+		let row = document.createElement("div");
+		row.style = "display:grid; grid-template-columns: 6fr 5fr; width:100%; margin-bottom:12px;";
+		let text = document.createElement("div");
+		text.style = "font-size:0.9em; overflow-wrap:anywhere;";
+		let endpoint = subscription.endpoint;
+		if(endpoint.length>50) {
+			endpoint = endpoint.substring(0,50)+"...";
+		}
+		let ua = subscription.userAgent;
+		if(ua==navigator.userAgent) {
+			ua += " (THIS DEVICE)";
+		}
+		text.textContent = endpoint+" "+ua;
+		let button = document.createElement("button");
+		button.innerHTML = "Unsubscribe";
+		button.onclick = function() {
+			pushUnsubscribe(subscription.id, subscription.endpoint);
+		}
+		row.appendChild(text);
+		row.appendChild(button);
+		webpushListElement.appendChild(row);
+	});
+}
 
-//	console.log("webPushSubscribe device=%d -> serviceWorker.register...",deviceNumber);
-//	let ret = navigator.serviceWorker.register('service-worker.js');
-//	// get access to the registration (and registration.pushManager) object.
-//	console.log("webPushSubscribe serviceWorker.ready...");
-//	navigator.serviceWorker.ready
-//	.then(function(registration) {
-//		console.log("webPushSubscribe serviceWorker.register =",ret);
-		let registration = parent.pushRegistration
-		console.log("webPushSubscribe registration =",registration);
-		console.log("webPushSubscribe pushManager.getSubscription()");
-		registration.pushManager.getSubscription()
-		.then(pushSubscription => {
-			console.log("webPushSubscribe scope =",registration.scope);
-			if(!pushSubscription){
-				//the device is not subscribed
-				console.log("pushSubscription must be invoked...");
-				subscribe(registration);
-			} else {
-				console.log("pushSubscription exists already");
-				//check if user was subscribed with a different key
-				let json = pushSubscription.toJSON();
-				console.log("pushSubscription exists json",json);
-				let public_key = json.keys.p256dh;
-				console.log("pushSubscription exists public_key",public_key);
-				
-				if(public_key != vapidPublicKey){
-					console.log("pushSubscription old public_key != current key");
-					pushSubscription.unsubscribe().then(successful => {
-						// You've successfully unsubscribed
-						console.log("pushSubscription create a new...");
-						subscribe(registration);
-					}).catch(e => {
-						// Unsubscription failed
-						console.log("unsubscription failed",e);
-						alert("Unsubscription of old pushSubscription failed\n"+e);
-					})
-				} else {
-					console.log("pushSubscription old public_key == current key");
-					deliverSubscription(pushSubscription);
-				}
-			}
-		}).catch(err => {
-			// after pushManager.getSubscription()
-			// fennec shows: Uncaught (in promise) DOMException: Error retrieving push subscription.
-			// FF 90 Nightly: does the same, but it takes a little while
-			// this means that GCM is not enabled on Android
-			console.log("webPushSubscribe getSubscription err",err);
-			alert("webPushSubscribe getSubscription error\n"+err);
-		});
-//	}).catch(err => {
-//		console.log("webPushSubscribe getSubscription err",err);
-//		alert("webPushSubscribe getSubscription error\n"+err);
-//	});
+function pushUnsubscribe(sid, endpoint) {
+	console.log('pushUnsubscribe',sid);
+	let api = apiPath+"/pushunsubscribe?id="+calleeID+"&sid="+sid;
+	ajaxFetch(new XMLHttpRequest(), "GET", api, function(xhr) {
+		requestPushSubscriptions();
+	}, errorAction);
+	// if it is the subscription of this device, also end it in the browser
+	parent.pushRegistration.pushManager.getSubscription().then(function(pushSubscription) {
+		if(pushSubscription && pushSubscription.endpoint==endpoint) {
+			pushSubscription.unsubscribe();
+		}
+	}).catch(function(err) {
+		console.log("pushUnsubscribe getSubscription err",err);
+	});
+}
+
+let urlBase64ToUint8Array = function(base64String) {
+	const padding = '='.repeat((4 - (base64String.length % 4)) % 4);
+	const base64 = (base64String + padding)
+		.replace(/\-/g, '+')
+		.replace(/_/g, '/');
+	const rawData = window.atob(base64);
+	return Uint8Array.from([...rawData].map(char => char.charCodeAt(0)));
+}
+
+let uint8ArrayToUrlBase64 = function(uint8Array) {
+	return window.btoa(String.fromCharCode(...uint8Array))
+		.replace(/\+/g, '-')
+		.replace(/\//g, '_')
+		.replace(/=+$/, '');
+}
+
+// webPushSubscribe subscribes this device (the browser) and hands the subscription to the server
+function webPushSubscribe() {
+	let registration = parent.pushRegistration;
+	console.log("webPushSubscribe scope",registration.scope);
 
 	let deliverSubscription = function(subscr) {
 		// subscr will be used for webpush.SendNotification()
-		let webPushSubscriptionChanged = false;
-		if(deviceNumber==1) {
-			console.log("webPushSubscribe 1 deliverSubscription",subscr);
-			let newSubscr = JSON.stringify(subscr);
-			if(newSubscr!="" && serverSettings.webPushSubscription1!=newSubscr) {
-				serverSettings.webPushSubscription1 = newSubscr;
-				if(subscr && subscr.endpoint) {
-					if(subscr.endpoint.length>50) {
-						webpush1subscrElement.innerHTML = subscr.endpoint.substr(0,50)+"...";
-					} else {
-						webpush1subscrElement.innerHTML = subscr.endpoint;
-					}
-					if(serverSettings.webPushUA1==navigator.userAgent) {
-						webpush1uaElement.innerHTML = serverSettings.webPushUA1 + " (THIS DEVICE)";
-					} else {
-						webpush1uaElement.innerHTML = serverSettings.webPushUA1;
-					}
-					serverSettings.webPushUA1 = navigator.userAgent;
-					webpush1button.innerHTML = "Unsubscribe";
-				} else {
-					// this should never happen
-					webpush1subscrElement.innerHTML = "";
-					webpush1uaElement.innerHTML = "";
-					serverSettings.webPushUA1 = "";
-					webpush1button.innerHTML = "Subscribe";
-				}
-				webPushSubscriptionChanged = true;
-			}
-		} else {
-			console.log("webPushSubscribe 2 deliverSubscription",subscr);
-			let newSubscr = JSON.stringify(subscr);
-			if(newSubscr!="" && serverSettings.webPushSubscription2!=newSubscr) {
-				serverSettings.webPushSubscription2 = newSubscr;
-				if(subscr && subscr.endpoint) {
-					if(subscr.endpoint.length>50) {
-						webpush2subscrElement.innerHTML = subscr.endpoint.substr(0,50)+"...";
-					} else {
-						webpush2subscrElement.innerHTML = subscr.endpoint;
-					}
-					if(serverSettings.webPushUA2==navigator.userAgent) {
-						webpush2uaElement.innerHTML = serverSettings.webPushUA2 + " (THIS DEVICE)";
-					} else {
-						webpush2uaElement.innerHTML = serverSettings.webPushUA2;
-					}
-					serverSettings.webPushUA2 = navigator.userAgent;
-					webpush2button.innerHTML = "Unsubscribe";
-				} else {
-					// this should never happen
-					webpush2subscrElement.innerHTML = "";
-					webpush2uaElement.innerHTML = "";
-					serverSettings.webPushUA2 = "";
-					webpush2button.innerHTML = "Subscribe";
-				}
-				webPushSubscriptionChanged = true;
+		let api = apiPath+"/pushsubscribe?id="+calleeID;
+		ajaxFetch(new XMLHttpRequest(), "POST", api, function(xhr) {
+			console.log('/pushsubscribe',xhr.responseText);
+			if(xhr.responseText.startsWith("ok|")) {
+				requestPushSubscriptions();
+			} else if(xhr.responseText=="gone") {
+				alert("The push service has rejected the subscription");
+			} else {
+				alert("Web push subscription failed: "+xhr.responseText);
 			}
-		}
-		if(webPushSubscriptionChanged) {
-			// auto store (but don't close settings)
-			submitForm(false);
-		}
-	}
-
-	let urlBase64ToUint8Array = function(base64String) {
-		const padding = '='.repeat((4 - (base64String.length % 4)) % 4);
-		const base64 = (base64String + padding)
-			.replace(/\-/g, '+')
-			.replace(/_/g, '/');
-		const rawData = window.atob(base64);
-		return Uint8Array.from([...rawData].map(char => char.charCodeAt(0)));
+		}, errorAction, JSON.stringify(subscr));
 	}
 
-	let subscribe = function(registration) {
+	let subscribe = function() {
 		console.log("registration.pushManager.subscribe()");
-		// TODO in ungoo-chromium, this is often the last line logged
-		// this means: no success - and there is no error msg
-		// we need to build a timeout functionality
+		// in some browsers subscribe() never returns: no success and no error msg
 		let gotResponse = 0;
 		setTimeout(function() {
 			if(gotResponse==0) {
@@ -348,17 +230,43 @@ function webPushSubscribe(deviceNumber) {
 		})
 		.then(function(subscription) {
 			gotResponse = 1;
-			console.log("function(subscription)",subscription);
 			deliverSubscription(subscription);
 		})
 		.catch(function(err) {
 			gotResponse = 2;
-			console.log("	",err);
+			console.log("webPushSubscribe subscribe err",err);
 			alert("webPushSubscribe subscribe error\n"+err);
 		});
 	}
+
+	registration.pushManager.getSubscription()
+	.then(pushSubscription => {
+		if(!pushSubscription) {
+			// the device is not subscribed
+			subscribe();
+			return;
+		}
+		// check if the device was subscribed with a different server key
+		let key = pushSubscription.options ? pushSubscription.options.applicationServerKey : null;
+		if(key && uint8ArrayToUrlBase64(new Uint8Array(key))!=vapidPublicKey) {
+			console.log("pushSubscription of another server key: create a new one");
+			pushSubscription.unsubscribe().then(successful => {
+				subscribe();
+			}).catch(e => {
+				console.log("unsubscription failed",e);
+				alert("Unsubscription of old pushSubscription failed\n"+e);
+			})
+		} else {
+			deliverSubscription(pushSubscription);
+		}
+	}).catch(err => {
+		// fennec shows: Uncaught (in promise) DOMException: Error retrieving push subscription.
+		// this means that GCM is not enabled on Android
+		console.log("webPushSubscribe getSubscription err",err);
+		alert("webPushSubscribe getSubscription error\n"+err);
+	});
 }
-*/
+
 
 var xhrTimeout = 50000;
 function ajaxFetch(xhr, type, apiPath, processData, errorFkt, postData) {
@@ -409,17 +317,11 @@ function submitForm(autoclose) {
 
 	var store = function() {
 		if(!gentle) console.log('submitForm store twName='+valueTwName+" twID="+valueTwID);
-		// we use encodeURI to encode the subscr-strings bc these strings are themselves json 
-		// and cannot just be packaged inside json
 		var newSettings = '{ "nickname":"'+document.getElementById("nickname").value.trim()+'",'+
 			'"twname":"'+valueTwName+'",'+
 			'"twid":"'+valueTwID+'",'+
 			'"storeContacts":"'+document.getElementById("storeContacts").checked+'",'+
-			'"storeMissedCalls":"'+document.getElementById("storeMissedCalls").checked+'",'+
-			'"webPushSubscription1":"'+encodeURI(serverSettings.webPushSubscription1)+'",'+
-			'"webPushUA1":"'+encodeURI(serverSettings.webPushUA1)+'",'+
-			'"webPushSubscription2":"'+encodeURI(serverSettings.webPushSubscription2)+'",'+
-			'"webPushUA2":"'+encodeURI(serverSettings.webPushUA2)+'"'+
+			'"storeMissedCalls":"'+document.getElementById("storeMissedCalls").checked+'"'+
 		'}';
 		if(!gentle) console.log('submitForm newSettings',newSettings);
 
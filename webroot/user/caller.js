@@ -37,6 +37,8 @@ var candidateResultString = "";
 var wsAddr = "";
 var wsAddrTime;
 var calleeID = ""; // who we are calling
+var forwardChain = ""; // callee IDs this call was forwarded from (url arg fwd)
+var ringGroupPos = ""; // next member of a hunt group (url arg grp)
 var sessionDuration = 0;
 var dataChannelSendMsg = "";
 var iframeParent;
@@ -75,6 +77,7 @@ var goodbyDone = false;
 var haveBeenWaitingForCalleeOnline=false;
 var lastOnlineStatus = "";
 var contactAutoStore = false;
+var onHold = false; // the callee has put us on hold (see holdCall())
 
 var extMessage = function(e) {
 	// prevent an error on split() below when extensions emit unrelated, non-string 'message' events to the window
@@ -135,6 +138,14 @@ window.onload = function() {
 		callerName = "";
 	}
 	gLog("onload callerId=("+callerId+") callerName=("+callerName+")");
+	forwardChain = getUrlParams("fwd");
+	if(typeof forwardChain=="undefined") {
+		forwardChain = "";
+	}
+	ringGroupPos = getUrlParams("grp");
+	if(typeof ringGroupPos=="undefined") {
+		ringGroupPos = "";
+	}
 
 	let text = getUrlParams("readyText");
 	if(typeof text!=="undefined" && text!="") {
@@ -549,11 +560,20 @@ function getUrlParams(param) {
 	}
 }
 
-function checkCalleeOnline(waitForCallee) {
+function checkCalleeOnline(waitForCallee,ringGroupWait) {
 	let api = apiPath+"/online?id="+calleeID;
 	if(callerId!=="" && callerId!=="undefined") {
 		api += "&callerId="+callerId+"&name="+callerName;
 	}
+	if(forwardChain!="") {
+		api += "&fwd="+forwardChain;
+	}
+	if(ringGroupPos!="") {
+		api += "&grp="+ringGroupPos;
+	}
+	if(ringGroupWait) {
+		api += "&ringgroup=1";
+	}
 	if(typeof Android !== "undefined" && Android !== null) {
 		if(typeof Android.getVersionName !== "undefined" && Android.getVersionName !== null) {
 			api = api + "&ver="+Android.getVersionName();
@@ -565,10 +585,15 @@ function checkCalleeOnline(waitForCallee) {
 		api = api + "&ver="+clientVersion;
 	}
 	gLog('checkCalleeOnline api',api);
-	xhrTimeout = 30*1000;
+	let saveXhrTimeout = xhrTimeout;
+	if(ringGroupWait) {
+		// the ring group responds once a member has picked up
+		xhrTimeout = 120*1000;
+	}
 	ajaxFetch(new XMLHttpRequest(), "GET", api, function(xhr) {
 		calleeOnlineStatus(xhr.responseText,waitForCallee);
 	}, errorAction);
+	xhrTimeout = saveXhrTimeout;
 }
 
 function calleeOnlineStatus(onlineStatus,waitForCallee) {
@@ -600,6 +625,19 @@ function calleeOnlineStatus(onlineStatus,waitForCallee) {
 		return;
 	}
 
+	if(onlineStatus=="ringgroup") {
+		// calleeID is a group ID: wait for a member to pick up
+		showStatus("Ringing...",-1);
+		checkCalleeOnline(waitForCallee,true);
+		return;
+	}
+
+	if(onlineStatus.startsWith("forward|")) {
+		// callee has forwarded this call (offline or busy)
+		forwardCall(onlineStatus.substring(8));
+		return;
+	}
+
 	// callee is not available
 	// TODO here we could act on "busy" and "notavail"
 
@@ -642,6 +680,18 @@ function calleeOnlineStatus(onlineStatus,waitForCallee) {
 	calleeOfflineAction(onlineStatus,waitForCallee);
 }
 
+function forwardCall(url) {
+	console.log('forwardCall '+url);
+	showStatus("Forwarding call...",-1);
+	if(url.startsWith("/user/")) {
+		// keep our id and name
+		url += "&callerId="+callerId+"&name="+callerName;
+	}
+	setTimeout(function() {
+		window.location.href = url;
+	},1500);
+}
+
 function calleeOnlineAction(from) {
 	gLog('calleeOnlineAction from='+from+' dialAfterCalleeOnline='+dialAfterCalleeOnline);
 	if(!notificationSound) {
@@ -1238,6 +1288,9 @@ function connectSignaling(message,openedFunc) {
 	let tryingToOpenWebSocket = true;
     var wsUrl = wsAddr;
 	wsUrl += "&callerId="+callerId+"&name="+callerName; //+"&ver="+clientVersion;
+	if(forwardChain!="") {
+		wsUrl += "&fwd="+forwardChain;
+	}
 	if(typeof Android !== "undefined" && Android !== null) {
 		if(typeof Android.getVersionName !== "undefined" && Android.getVersionName !== null) {
 			wsUrl = wsUrl + "&ver="+Android.getVersionName();
@@ -1266,7 +1319,7 @@ function connectSignaling(message,openedFunc) {
 		var messages = evt.data.split('\n');
 		for (var i = 0; i < messages.length; i++) {
 			signalingCommand(messages[i]);
-			if(!peerCon || peerCon.iceConnectionState=="closed") {
+			if(!onHold && (!peerCon || peerCon.iceConnectionState=="closed")) {
 				break;
 			}
 		}
@@ -1315,7 +1368,10 @@ function signalingCommand(message) {
 	}
 	gLog('signaling cmd',cmd);
 
-	if(cmd=="calleeAnswer") {
+	if(cmd=="turnCred") {
+		setTurnCredentials(payload);
+
+	} else if(cmd=="calleeAnswer") {
 		if(contactAutoStore) {
 			if(callerId!=="" && callerId!=="undefined") {
 				let api = apiPath+"/setcontact?id="+callerId+"&contactID="+calleeID; //+"&name="+newName;
@@ -1601,6 +1657,31 @@ function signalingCommand(message) {
 			console.log("ignore cancel",payload);
 		}
 
+	} else if(cmd=="forward") {
+		// callee did not answer; "cancel|" follows
+		forwardCall(payload);
+
+	} else if(cmd=="waitStatus") {
+		// the callee is in another call
+		if(payload=="waiting") {
+			showStatus("Call waiting... the callee is in another call",-1);
+		} else if(payload=="connecting") {
+			showStatus(connectingText,-1);
+		} else if(payload.startsWith("busy:")) {
+			hangupWithBusySound(false,"Busy: "+payload.substring(5));
+		} else if(payload=="rejected") {
+			hangupWithBusySound(false,"Call rejected");
+		} else {
+			// timeout, unavailable
+			hangupWithBusySound(false,"No answer");
+		}
+
+	} else if(cmd=="hold") {
+		holdCall();
+
+	} else if(cmd=="unhold") {
+		unholdCall();
+
 	} else if(cmd=="sessionDuration") {
 		// longest possible call duration
 		sessionDuration = parseInt(payload);
@@ -1626,6 +1707,46 @@ function signalingCommand(message) {
 	}
 }
 
+function holdCall() {
+	// the callee has put us on hold: our peer connection ends, wsConn stays open for "unhold"
+	console.log('hold');
+	onHold = true;
+	stopTimer();
+	rtcConnect = false;
+	mediaConnect = false;
+	if(dataChannel) {
+		dataChannel.onclose = null;
+		dataChannel.close();
+		dataChannel = null;
+	}
+	if(peerCon) {
+		peerCon.onconnectionstatechange = null;
+		peerCon.close();
+	}
+	if(remoteVideoFrame) {
+		remoteVideoFrame.pause();
+		remoteVideoFrame.srcObject = null;
+		remoteVideoHide();
+	}
+	remoteStream = null;
+	if(localStream) {
+		const audioTracks = localStream.getAudioTracks();
+		if(audioTracks.length>0) {
+			audioTracks[0].enabled = false; // mute
+		}
+	}
+	showStatus("On hold...",-1);
+}
+
+function unholdCall() {
+	// the callee is back: dial again on the same wsConn
+	console.log('unhold');
+	onHold = false;
+	dialing = true;
+	showStatus(connectingText,-1);
+	dial2();
+}
+
 function wsSend(message) {
 	if(wsConn==null || wsConn.readyState!=1) {
 		gLog('wsSend connectSignaling() '+message);
@@ -2090,6 +2211,7 @@ function hangup(mustDisconnectCallee,mustcheckCalleeOnline,message) {
 		return;
 	}
 	doneHangup = true;
+	onHold = false;
 
 	gLog('hangup msg='+message+' '+mustDisconnectCallee);
 	if(message!="") {
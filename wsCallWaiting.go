@@ -0,0 +1,365 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Call waiting.
+// A callee client that supports call waiting sends "callWaiting|true" (after init).
+// While such a callee is in a call, /online does not report "busy" and one more
+// caller may connect. It is held in hub.WaitingCaller; everything it sends (except
+// cancel and msg) is queued until the callee decides. Once its callerOffer arrives:
+//   callee         <- "callWaiting|{CallerInfo json}"
+//   waiting caller <- "waitStatus|waiting"
+// The callee answers with one of:
+//   "callWaitingAccept|hangup" end the current call (current caller <- "cancel|c")
+//                              and connect the waiting caller
+//   "callWaitingAccept|hold"   same, but the current caller gets "hold|" and stays
+//                              ws-connected in hub.HeldCaller
+//   "callWaitingReject|"       waiting caller <- "waitStatus|rejected"
+//   "callWaitingBusy|text"     waiting caller <- "waitStatus|busy:text"; stored as missed call
+// After an accept the callee ends its peer connection and sends "init" as usual; with
+// this init the waiting caller gets "waitStatus|connecting" and its callerOffer is
+// delivered. If the waiting caller hangs up first, callee <- "callWaitingEnded|".
+// A caller that is neither accepted nor rejected within maxRingSecs gets "waitStatus|timeout".
+// While a caller is on hold, the callee may send:
+//   "callWaitingSwap|"         the current caller (if any) goes on hold, the held caller
+//                              gets "unhold|" with the next callee init and sends a new callerOffer
+//   "callWaitingDrop|"         end the held call (held caller <- "cancel|dropped")
+// If the held caller hangs up, callee <- "heldCallerEnded|".
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"encoding/json"
+)
+
+// a waiting caller sends its ice candidates before the callee decides
+const maxWaitingCallerCmds = 64
+
+type waitingCallerCmd struct {
+	cmd string
+	payload string
+}
+
+// acceptsWaitingCallerLocked tells if one more caller may connect while the callee is busy
+// HubMutex must be (r)locked
+func (h *Hub) acceptsWaitingCallerLocked() bool {
+	readConfigLock.RLock()
+	myCallWaiting := callWaiting
+	readConfigLock.RUnlock()
+	return myCallWaiting && h.callWaiting && h.WaitingCaller==nil && h.HeldCaller==nil &&
+		h.nextCaller==nil && h.CalleeClient!=nil && h.suspendedCallee==nil
+}
+
+// holdWaitingCaller makes client the waiting caller; false if call waiting is not possible
+func (h *Hub) holdWaitingCaller(client *WsClient) bool {
+	h.HubMutex.Lock()
+	if h.CallerClient==nil || !h.acceptsWaitingCallerLocked() {
+		h.HubMutex.Unlock()
+		return false
+	}
+	client.isCallee = false
+	h.WaitingCaller = client
+	h.HubMutex.Unlock()
+
+	readConfigLock.RLock()
+	myMaxRingSecs := maxRingSecs
+	readConfigLock.RUnlock()
+	if myMaxRingSecs>0 {
+		timerWheel.AfterFunc(time.Duration(myMaxRingSecs)*time.Second, func() {
+			h.removeWaitingCaller(client, "timeout", true)
+		})
+	}
+	fmt.Printf("%s (%s) caller waiting (%s) %s\n",
+		client.connType, client.calleeID, client.callerID, client.RemoteAddr)
+	return true
+}
+
+func (h *Hub) isWaitingCaller(client *WsClient) bool {
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	return h.WaitingCaller==client
+}
+
+// waitingCallerCmd is processCmd() for the waiting caller
+func (c *WsClient) waitingCallerCmd(cmd string, payload string) {
+	switch cmd {
+	case "callerOffer":
+		c.hub.HubMutex.Lock()
+		if c.hub.WaitingCaller!=c || c.waitingOffer!="" {
+			c.hub.HubMutex.Unlock()
+			return
+		}
+		c.waitingOffer = payload
+		calleeClient := c.hub.CalleeClient
+		c.hub.HubMutex.Unlock()
+		if calleeClient==nil {
+			return
+		}
+		callerInfo := CallerInfo{c.RemoteAddr, c.callerName, time.Now().Unix(), c.callerID, ""}
+		callerInfoJson,err := json.Marshal(callerInfo)
+		if err!=nil {
+			fmt.Printf("# %s (%s) callWaiting json err=%v\n", c.connType, c.calleeID, err)
+			return
+		}
+		fmt.Printf("%s (%s) CALL WAITING☎️  %s <- %s (%s)\n",
+			c.connType, c.calleeID, calleeClient.RemoteAddr, c.RemoteAddr, c.callerID)
+		calleeClient.Write([]byte("callWaiting|"+string(callerInfoJson)))
+		c.Write([]byte("waitStatus|waiting"))
+	case "cancel":
+		c.hub.removeWaitingCaller(c, "hangup", true)
+	case "msg":
+		cleanMsg := strings.Replace(payload, "\n", " ", -1)
+		cleanMsg = strings.Replace(cleanMsg, "\r", " ", -1)
+		c.callerTextMsg = strings.TrimSpace(cleanMsg)
+	case "check":
+		c.Write([]byte("confirm|"+payload))
+	case "heartbeat", "dummy", "log", "missedcall":
+		// nothing to do while waiting
+	default:
+		// ice candidates etc. are delivered once the call is accepted
+		c.hub.HubMutex.Lock()
+		if len(c.waitingCmds) < maxWaitingCallerCmds {
+			c.waitingCmds = append(c.waitingCmds, waitingCallerCmd{cmd, payload})
+		}
+		c.hub.HubMutex.Unlock()
+	}
+}
+
+// removeWaitingCaller ends call waiting for client (if it is still the waiting caller)
+// status is sent to the waiting caller ("rejected", "busy:text", "timeout", ...)
+func (h *Hub) removeWaitingCaller(client *WsClient, status string, storeMissedCall bool) bool {
+	h.HubMutex.Lock()
+	if client==nil {
+		client = h.WaitingCaller
+	}
+	if client==nil || h.WaitingCaller!=client {
+		h.HubMutex.Unlock()
+		return false
+	}
+	h.WaitingCaller = nil
+	calleeClient := h.CalleeClient
+	offered := client.waitingOffer!=""
+	h.HubMutex.Unlock()
+
+	fmt.Printf("%s (%s) waiting caller removed (%s) %s (%s)\n",
+		client.connType, client.calleeID, status, client.RemoteAddr, client.callerID)
+	// its OnClose must not touch the current call
+	client.detached.Set(true)
+	if status=="hangup" {
+		if calleeClient!=nil && offered {
+			calleeClient.Write([]byte("callWaitingEnded|"))
+		}
+	} else {
+		client.Write([]byte("waitStatus|"+status))
+		client.Close("call waiting "+status)
+	}
+	if storeMissedCall && offered {
+		// add missed call if dbUser.StoreMissedCalls is set
+		userKey := client.calleeID + "_" + strconv.FormatInt(int64(h.registrationStartTime),10)
+		var dbUser DbUser
+		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+		if err!=nil {
+			fmt.Printf("# %s (%s) failed to get dbUser\n",client.connType,client.calleeID)
+		} else if dbUser.StoreMissedCalls {
+			addMissedCall(client.calleeID, CallerInfo{client.RemoteAddr, client.callerName,
+				time.Now().Unix(), client.callerID, client.callerTextMsg}, "call waiting "+status)
+		}
+	}
+	return true
+}
+
+// acceptWaitingCaller ends the current call; the waiting caller is connected with the
+// next callee init (see connectNextCaller)
+// mode: "hangup" or "hold"
+func (h *Hub) acceptWaitingCaller(mode string) {
+	h.HubMutex.Lock()
+	waiting := h.WaitingCaller
+	calleeClient := h.CalleeClient
+	if waiting==nil || calleeClient==nil || waiting.waitingOffer=="" || h.nextCaller!=nil ||
+			(mode=="hold" && h.HeldCaller!=nil) {
+		h.HubMutex.Unlock()
+		return
+	}
+	h.WaitingCaller = nil
+	h.nextCaller = waiting
+	current := h.CallerClient
+	h.HubMutex.Unlock()
+
+	fmt.Printf("%s (%s) accept waiting caller (%s) %s (%s)\n",
+		calleeClient.connType, calleeClient.calleeID, mode, waiting.RemoteAddr, waiting.callerID)
+	h.endCurrentCall(calleeClient, current, mode, "callee accepts waiting caller ("+mode+")")
+}
+
+// swapHeldCaller puts the current caller on hold and connects the held caller
+func (h *Hub) swapHeldCaller() {
+	h.HubMutex.Lock()
+	held := h.HeldCaller
+	calleeClient := h.CalleeClient
+	if held==nil || calleeClient==nil || h.nextCaller!=nil {
+		h.HubMutex.Unlock()
+		return
+	}
+	h.HeldCaller = nil
+	h.nextCaller = held
+	current := h.CallerClient
+	h.HubMutex.Unlock()
+
+	fmt.Printf("%s (%s) swap held caller %s (%s)\n",
+		calleeClient.connType, calleeClient.calleeID, held.RemoteAddr, held.callerID)
+	if current==nil {
+		if calleeClient.calleeInitReceived.Get() {
+			// the callee is not in a call and ready for the next one
+			h.connectNextCaller()
+		}
+		return
+	}
+	h.endCurrentCall(calleeClient, current, "hold", "callee swaps held caller")
+}
+
+// endCurrentCall ends the call of the callee with current
+// mode "hold": current stays ws-connected as HeldCaller; otherwise it is hung up
+// cause starts with "callee": not a missed call
+func (h *Hub) endCurrentCall(calleeClient *WsClient, current *WsClient, mode string, cause string) {
+	if current!=nil {
+		held := false
+		if mode=="hold" && current.isOnline.Get() {
+			h.HubMutex.Lock()
+			if h.HeldCaller==nil {
+				h.HeldCaller = current
+				held = true
+			}
+			h.HubMutex.Unlock()
+		}
+		if held {
+			current.Write([]byte("hold|"))
+		} else {
+			// its cancel and OnClose must not end the next call
+			current.detached.Set(true)
+			current.Write([]byte("cancel|c"))
+		}
+	}
+	calleeClient.peerConHasEnded(cause)
+	h.HubMutex.Lock()
+	if h.CallerClient==current {
+		h.CallerClient = nil
+	}
+	h.HubMutex.Unlock()
+	err := StoreCallerIpInHubMap(calleeClient.globalCalleeID, "", false)
+	if err!=nil {
+		fmt.Printf("# %s (%s) end current call clr callerIp err=%v\n",
+			calleeClient.connType, calleeClient.calleeID, err)
+	}
+}
+
+// connectNextCaller makes the accepted waiting caller (or the unheld caller) the caller
+// called on callee init, when the callee is ready for the next call
+func (h *Hub) connectNextCaller() {
+	h.HubMutex.Lock()
+	next := h.nextCaller
+	if next==nil {
+		h.HubMutex.Unlock()
+		return
+	}
+	h.nextCaller = nil
+	offer := next.waitingOffer
+	queuedCmds := next.waitingCmds
+	next.waitingOffer = ""
+	next.waitingCmds = nil
+	h.HubMutex.Unlock()
+
+	if !next.isOnline.Get() {
+		// hung up meanwhile
+		return
+	}
+	fmt.Printf("%s (%s) connect next caller %s (%s)\n",
+		next.connType, next.calleeID, next.RemoteAddr, next.callerID)
+	h.attachCaller(next, h.WsClientID)
+	if offer=="" {
+		// the held caller sends a new callerOffer
+		next.Write([]byte("unhold|"))
+		return
+	}
+	next.Write([]byte("waitStatus|connecting"))
+	next.processCmd("callerOffer", offer)
+	for _,queued := range queuedCmds {
+		next.processCmd(queued.cmd, queued.payload)
+	}
+}
+
+// isHeldCaller tells if client is on hold or accepted but not yet connected
+func (h *Hub) isHeldCaller(client *WsClient) bool {
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	return h.HeldCaller==client || h.nextCaller==client
+}
+
+func (h *Hub) hasNextCaller() bool {
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	return h.nextCaller!=nil
+}
+
+// heldCallerCmd is processCmd() for the held caller and for the accepted waiting caller
+func (c *WsClient) heldCallerCmd(cmd string, payload string) {
+	switch cmd {
+	case "cancel":
+		c.hub.removeHeldCaller(c, "hangup")
+	case "check":
+		c.Write([]byte("confirm|"+payload))
+	case "callerOffer", "heartbeat", "dummy", "log", "missedcall", "msg":
+		// nothing to do while held
+	default:
+		// ice candidates of the accepted waiting caller are delivered with its callerOffer
+		c.hub.HubMutex.Lock()
+		if c.waitingOffer!="" && len(c.waitingCmds) < maxWaitingCallerCmds {
+			c.waitingCmds = append(c.waitingCmds, waitingCallerCmd{cmd, payload})
+		}
+		c.hub.HubMutex.Unlock()
+	}
+}
+
+// removeHeldCaller ends the held caller client (or the accepted one, not yet connected)
+// client==nil: all of them
+// status is sent to the held caller ("dropped", "unavailable"); "hangup": it has hung up
+func (h *Hub) removeHeldCaller(client *WsClient, status string) bool {
+	var removed []*WsClient
+	h.HubMutex.Lock()
+	if h.HeldCaller!=nil && (client==nil || h.HeldCaller==client) {
+		removed = append(removed, h.HeldCaller)
+		h.HeldCaller = nil
+	}
+	if h.nextCaller!=nil && (client==nil || h.nextCaller==client) {
+		removed = append(removed, h.nextCaller)
+		h.nextCaller = nil
+	}
+	calleeClient := h.CalleeClient
+	h.HubMutex.Unlock()
+
+	for _,held := range removed {
+		fmt.Printf("%s (%s) held caller removed (%s) %s (%s)\n",
+			held.connType, held.calleeID, status, held.RemoteAddr, held.callerID)
+		// its OnClose must not touch the current call
+		held.detached.Set(true)
+		if status=="hangup" {
+			if calleeClient!=nil {
+				calleeClient.Write([]byte("heldCallerEnded|"))
+			}
+		} else {
+			held.Write([]byte("cancel|"+status))
+			held.Close("held caller "+status)
+		}
+	}
+	return len(removed)>0
+}
+
+// dropHeldCaller ends the held call on request of the callee
+func (h *Hub) dropHeldCaller() {
+	h.HubMutex.RLock()
+	held := h.HeldCaller
+	h.HubMutex.RUnlock()
+	if held!=nil {
+		h.removeHeldCaller(held, "dropped")
+	}
+}
@@ -2,7 +2,7 @@
 //
 // Method serve() is the Websocket handler for http-to-ws upgrade.
 // Method receiveProcess() is the Websocket signaling handler.
-// KeepAliveMgr takes care of keeping ws-clients connected.
+// setPingDeadline() takes care of keeping ws-clients connected (see timerWheel.go).
 
 package main
 
@@ -45,7 +45,6 @@ const (
 	//   after another 20s the server declares the client dead - 100s after the clients last ping
 )
 
-var keepAliveMgr *KeepAliveMgr
 var ErrWriteNotConnected = errors.New("Write not connected")
 
 type WsClient struct {
@@ -68,6 +67,13 @@ type WsClient struct {
 	callerName string
 	clientVersion string
 	callerTextMsg string
+	fwdChain string // callee IDs this call was forwarded from (see callForward.go)
+	forwarded atombool.AtomBool // caller was sent "forward|" (not a missed call)
+	ringGroup string // caller was sent here by a group ID (see ringGroup.go)
+	ringGroupMember int
+	deviceName string // callee device (see wsDevices.go)
+	forkRinging bool // forked call is ringing on this device (hub.deviceMutex)
+	forkQueue [][]byte // held answer and candidates of this device (hub.deviceMutex)
 	pingSent uint64
 	pongReceived uint64
 	pongSent uint64
@@ -76,6 +82,17 @@ type WsClient struct {
 	isCallee bool
 	clearOnCloseDone bool
 	autologin bool
+	protocol int // signaling protocol version (see wsSignaling.go)
+	lastSentMsgID uint64 // atomic; v2 envelope id
+	pingTimer *WheelTimer // sends the next ping (see setPingDeadline)
+	closeRequested atombool.AtomBool // Close() was called by the server
+	detached atombool.AtomBool // denied; not attached to the hub
+	resumeMutex sync.Mutex // guards the following three (see wsResume.go)
+	resumeQueue [][]byte
+	queueing bool
+	resumedBy *WsClient
+	waitingOffer string // callerOffer of a waiting caller; guarded by hub.HubMutex
+	waitingCmds []waitingCallerCmd // queued while waiting; guarded by hub.HubMutex
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
@@ -91,11 +108,6 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		fmt.Printf("serve url=%s tls=%v\n", r.URL.String(), tls)
 	}
 
-	if keepAliveMgr==nil {
-		keepAliveMgr = NewKeepAliveMgr()
-		go keepAliveMgr.Run()
-	}
-
 	remoteAddr := r.RemoteAddr
 	realIpFromRevProxy := r.Header.Get("X-Real-Ip")
 	if realIpFromRevProxy!="" {
@@ -160,6 +172,34 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	if ok && len(url_arg_array[0]) > 0 {
 		auto = url_arg_array[0]
 	}
+
+	resumeToken := ""
+	url_arg_array, ok = r.URL.Query()["resume"]
+	if ok && len(url_arg_array[0]) > 0 {
+		resumeToken = url_arg_array[0]
+	}
+
+	fwdChain := ""
+	url_arg_array, ok = r.URL.Query()["fwd"]
+	if ok && len(url_arg_array[0]) > 0 {
+		fwdChain = url_arg_array[0]
+	}
+
+	ringGroup := ""
+	ringGroupMember := 0
+	url_arg_array, ok = r.URL.Query()["grp"]
+	if ok && len(url_arg_array[0]) > 0 {
+		group := lookupRingGroup(strings.ToLower(url_arg_array[0]))
+		url_arg_array, ok = r.URL.Query()["gm"]
+		if group!=nil && ok && len(url_arg_array[0]) > 0 {
+			idx,err := strconv.Atoi(url_arg_array[0])
+			if err==nil && idx>=0 && idx<len(group.members) &&
+					group.members[idx].calleeID==wsClientData.calleeID {
+				ringGroup = group.id
+				ringGroupMember = idx
+			}
+		}
+	}
 	//fmt.Printf("serve callerID=%s callerName=%s ver=%s\n", callerID, callerName, clientVersion)
 
 	upgrader := websocket.NewUpgrader()
@@ -167,6 +207,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
 	}
+	upgrader.Subprotocols = []string{signalingV2Subprotocol}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		fmt.Printf("# Upgrade err=%v\n", err)
@@ -191,15 +232,20 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	}
 	client.callerID = callerID
 	client.callerName = callerName
+	client.fwdChain = fwdChain
+	client.ringGroup = ringGroup
+	client.ringGroupMember = ringGroupMember
+	client.deviceName = wsClientData.deviceName
+	client.protocol = signalingProtocol(r)
 	if tls {
 		client.connType = "serveWss"
 	} else {
 		client.connType = "serveWs"
 	}
 
-	keepAliveMgr.Add(wsConn)
+	client.pingTimer = timerWheel.NewTimer(client.pingDeadlineReached)
 	// set the time for sending the next ping
-	keepAliveMgr.SetPingDeadline(wsConn, pingPeriod, client) // now + pingPeriod secs
+	client.setPingDeadline(pingPeriod) // now + pingPeriod secs
 
 	client.isOnline.Set(true)
 	client.RemoteAddr = remoteAddr
@@ -215,7 +261,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		wsConn.SetReadDeadline(time.Time{})
 		// set the time for sending the next ping
 		// so whenever client sends some data, we postpone our next ping by pingPeriod secs
-		keepAliveMgr.SetPingDeadline(wsConn, pingPeriod, client) // now + pingPeriod secs
+		client.setPingDeadline(pingPeriod) // now + pingPeriod secs
 
 		switch messageType {
 		case websocket.TextMessage:
@@ -242,7 +288,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		// clear read deadline for now; we set it again when we send the next ping
 		wsConn.SetReadDeadline(time.Time{})
 		// set the time for sending the next ping: now + pingPeriod secs
-		keepAliveMgr.SetPingDeadline(wsConn, pingPeriod, client) // now + pingPeriod secs
+		client.setPingDeadline(pingPeriod) // now + pingPeriod secs
 		client.pongReceived++
 	})
 
@@ -255,7 +301,7 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		// clear read deadline for now; we set it again when we send the next ping
 		wsConn.SetReadDeadline(time.Time{})
 		// set the time for sending the next ping: now + pingPeriod secs
-		keepAliveMgr.SetPingDeadline(wsConn, pingPeriod, client) // now + pingPeriod secs
+		client.setPingDeadline(pingPeriod) // now + pingPeriod secs
 		// send the pong
 		wsConn.WriteMessage(websocket.PongMessage, nil)
 		atomic.AddInt64(&pongSentCounter, 1)
@@ -263,8 +309,16 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 	})
 
 	wsConn.OnClose(func(c *websocket.Conn, err error) {
-		keepAliveMgr.Delete(c)
+		timerWheel.Stop(client.pingTimer)
 		client.isOnline.Set(false) // prevent close() from closing this already closed connection
+		if client.deviceName!="" && client.hub.removeDevice(client) {
+			// one of several devices of the callee; the session continues
+			return
+		}
+		if client.detached.Get() {
+			// this client was never attached to the hub; don't touch the hub
+			return
+		}
 		if client.isCallee {
 			if logWantedFor("wsclose") {
 				if err!=nil {
@@ -273,6 +327,19 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 					fmt.Printf("%s (%s) callee close noerr\n", client.connType, client.calleeID)
 				}
 			}
+			if client.hub.suspendCallee(client) {
+				// the callee may resume this session within the grace window
+				return
+			}
+			if client.deviceName!="" && client.hub.hasDevices() {
+				// another device of the callee takes over the session
+				if client.isConnectedToPeer.Get() {
+					client.peerConHasEnded("close📴")
+				}
+				if client.hub.promoteDevice(client) {
+					return
+				}
+			}
 		} else {
 			if logWantedFor("wsclose") {
 				if err!=nil {
@@ -281,6 +348,17 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 					fmt.Printf("%s (%s) caller close noerr\n", client.connType, client.calleeID)
 				}
 			}
+			if client.hub.removeWaitingCaller(client, "hangup", true) {
+				// waiting caller has hung up; the current call is not affected
+				return
+			}
+			if client.hub.removeHeldCaller(client, "hangup") {
+				// held caller has hung up; the current call is not affected
+				return
+			}
+
+			// a forked call that is still ringing
+			client.hub.endForkRinging(client, true, "caller hangup")
 
 			if !client.reached14s.Get() {
 				// shut down the callee on early caller hangup
@@ -316,7 +394,35 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		}
 	})
 
-	if hub.CalleeClient==nil {
+	if resumeToken!="" {
+		// callee reconnecting after losing its ws-connection (see wsResume.go)
+		if !hub.resumeCallee(client, resumeToken) {
+			fmt.Printf("# %s (%s) resume denied ws=%d %s\n", client.connType,
+				client.calleeID, wsClientID64, client.RemoteAddr)
+			client.detached.Set(true)
+			client.Write([]byte("cancel|resume"))
+			client.Close("resume denied")
+		}
+	} else if wsClientData.extraDevice {
+		// another device of the callee (see wsDevices.go)
+		wsClientMutex.Lock()
+		delete(wsClientMap, wsClientID64)
+		wsClientMutex.Unlock()
+		if !hub.addDevice(client) {
+			fmt.Printf("# %s (%s) device %s denied ws=%d %s\n", client.connType,
+				client.calleeID, client.deviceName, wsClientID64, client.RemoteAddr)
+			client.detached.Set(true)
+			client.Write([]byte("cancel|busy"))
+			client.Close("device denied")
+		}
+	} else if hub.isCalleeSuspended() {
+		// callee is expected to resume; no new caller
+		fmt.Printf("%s (%s) callee suspended; deny ws=%d %s\n", client.connType,
+			client.calleeID, wsClientID64, client.RemoteAddr)
+		client.detached.Set(true)
+		client.Write([]byte("cancel|busy"))
+		client.Close("callee suspended")
+	} else if hub.CalleeClient==nil {
 		// callee client (1st client)
 		if logWantedFor("wsclient") {
 			fmt.Printf("%s (%s) callee conn ws=%d %s\n", client.connType,
@@ -333,7 +439,11 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		hub.CallerClient = nil
 		hub.ServiceStartTime = time.Now().Unix()
 		hub.ConnectedToPeerSecs = 0
+		calleeHidden := hub.IsCalleeHidden
 		hub.HubMutex.Unlock()
+		// forward the hidden state to the hub registry (for the other nodes)
+		SetCalleeHiddenState(client.globalCalleeID, calleeHidden)
+		webhookFire(client.calleeID, WebhookEvent{Event:"online"})
 
 		if !strings.HasPrefix(client.calleeID,"random") {
 			// get values related to talk- and service-time for this callee from the db
@@ -344,157 +454,187 @@ func serve(w http.ResponseWriter, r *http.Request, tls bool) {
 		hub.CallDurationSecs = 0
 		//fmt.Printf("%s talkSecs=%d startTime=%d serviceSecs=%d\n",
 		//	client.connType, hub.ConnectedToPeerSecs, hub.ServiceStartTime, hub.ServiceDurationSecs)
-	} else if hub.CallerClient==nil {
+	} else if hub.CallerClient==nil && !hub.hasNextCaller() {
 		// caller client (2nd client)
-		if logWantedFor("attach") {
-			fmt.Printf("%s (%s) caller conn ws=%d (%s) %s\n", client.connType, client.calleeID,
-				wsClientID64, callerID, client.RemoteAddr)
-		}
+		hub.attachCaller(client, wsClientID64)
+	} else if hub.holdWaitingCaller(client) {
+		// 3rd client: held while the callee is in a call (see wsCallWaiting.go)
+	} else {
+		// can be ignored
+		//fmt.Printf("# %s (%s/%s) CallerClient already set [%s] %s ws=%d\n",
+		//	client.connType, client.calleeID, client.globalCalleeID, hub.CallerClient.RemoteAddr,
+		//	client.RemoteAddr, wsClientID64)
+	}
+}
 
-		client.isCallee = false
-		client.callerOfferForwarded.Set(false)
-		client.reached14s.Set(false)
-		hub.HubMutex.Lock()
-		hub.CallDurationSecs = 0
-		hub.CallerClient = client
-		hub.lastCallerContactTime = time.Now().Unix()
-		hub.HubMutex.Unlock()
+// attachCaller makes client the caller of this hub
+func (hub *Hub) attachCaller(client *WsClient, wsClientID64 uint64) {
+	if logWantedFor("attach") {
+		fmt.Printf("%s (%s) caller conn ws=%d (%s) %s\n", client.connType, client.calleeID,
+			wsClientID64, client.callerID, client.RemoteAddr)
+	}
 
-		go func() {
-			delaySecs := 14
-			// incoming caller will get removed if there is no peerConnect after 14s
-			// (it can take up to 14 seconds in some cases for a devices to get fully out of deep sleep)
-			myCallerContactTime := hub.lastCallerContactTime
-
-			//fmt.Printf("%s (%s) caller conn 14s delay start\n", client.connType, client.calleeID)
-			time.Sleep(time.Duration(delaySecs) * time.Second)
-			//fmt.Printf("%s (%s) caller conn 14s delay end\n", client.connType, client.calleeID)
-
-			hub.HubMutex.RLock()
-			if hub.CalleeClient==nil {
-				// this happens a lot
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("%s (%s) no peercon check: callee gone (hub.CalleeClient==nil)\n",
-				//	client.connType, client.calleeID)
-				return
-			}
-			if hub.CallerClient==nil {
-				// caller already gone
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("%s (%s) no peercon check: caller gone (hub.CallerClient==nil)\n",
-				//	client.connType, client.calleeID)
-				return
-			}
-			if !hub.CallerClient.isOnline.Get() {
-				// this helps us to NOT throw a false NO PEERCON when the caller hanged up early
-				// we don't ws-disconnect the caller on peercon, so we can detect a hangup shortly after
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("%s (%s) no peercon check: !CallerClient.isOnline\n",
-				//	client.connType, client.calleeID)
-				return
-			}
-			if !hub.CallerClient.callerOfferForwarded.Get() {
-				// caller has not sent a calleroffer yet -> it has hanged up early
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("%s (%s) no peercon check: !CallerClient.callerOfferForwarded\n",
-				//	client.connType, client.calleeID)
-				return
-			}
-			if hub.CalleeClient.isConnectedToPeer.Get() {
-				// peercon steht; no peercon meldung nicht nötig; force caller ws-disconnect
-				hub.HubMutex.RUnlock()
-				//fmt.Printf("%s (%s) no peercon check: CalleeClient.isConnectedToPeer\n",
-				//	client.connType, client.calleeID)
+	client.isCallee = false
+	client.callerOfferForwarded.Set(false)
+	client.reached14s.Set(false)
+	hub.HubMutex.Lock()
+	hub.CallDurationSecs = 0
+	hub.CallerClient = client
+	hub.lastCallerContactTime = time.Now().Unix()
+	hub.HubMutex.Unlock()
+
+	if turnPort>0 {
+		// issue turn credentials for this call; caller.js will add them to ICE_config
+		turnCred,err := newTurnCredentials(client.globalCalleeID, turnCredValidSecs(hub))
+		if err!=nil {
+			fmt.Printf("# %s (%s) caller newTurnCredentials err=%v\n", client.connType, client.calleeID, err)
+		} else {
+			client.Write([]byte(turnCred))
+		}
+	}
 
-				client.reached14s.Set(true) // caller onClose will not anymore disconnect session/peercon
+	go func() {
+		delaySecs := 14
+		// incoming caller will get removed if there is no peerConnect after 14s
+		// (it can take up to 14 seconds in some cases for a devices to get fully out of deep sleep)
+		myCallerContactTime := hub.lastCallerContactTime
 
-				if hub.CalleeClient.isMediaConnectedToPeer.Get() {
-					// now force-disconnect caller
-					// but only if already media connected
-					readConfigLock.RLock()
-					myDisconCallerOnPeerConnected := disconCallerOnPeerConnected
-					readConfigLock.RUnlock()
-					if myDisconCallerOnPeerConnected {
-						if hub.CallerClient != nil {
-							if logWantedFor("attachex") {
-								fmt.Printf("%s (%s) 14s reached -> force caller ws-disconnect\n",
-									client.connType, client.calleeID)
-							}
-							hub.CallerClient.Close("disconCallerAfter14s")
+		//fmt.Printf("%s (%s) caller conn 14s delay start\n", client.connType, client.calleeID)
+		time.Sleep(time.Duration(delaySecs) * time.Second)
+		//fmt.Printf("%s (%s) caller conn 14s delay end\n", client.connType, client.calleeID)
+
+		hub.HubMutex.RLock()
+		if hub.CalleeClient==nil {
+			// this happens a lot
+			hub.HubMutex.RUnlock()
+			//fmt.Printf("%s (%s) no peercon check: callee gone (hub.CalleeClient==nil)\n",
+			//	client.connType, client.calleeID)
+			return
+		}
+		if hub.CallerClient==nil {
+			// caller already gone
+			hub.HubMutex.RUnlock()
+			//fmt.Printf("%s (%s) no peercon check: caller gone (hub.CallerClient==nil)\n",
+			//	client.connType, client.calleeID)
+			return
+		}
+		if !hub.CallerClient.isOnline.Get() {
+			// this helps us to NOT throw a false NO PEERCON when the caller hanged up early
+			// we don't ws-disconnect the caller on peercon, so we can detect a hangup shortly after
+			hub.HubMutex.RUnlock()
+			//fmt.Printf("%s (%s) no peercon check: !CallerClient.isOnline\n",
+			//	client.connType, client.calleeID)
+			return
+		}
+		if !hub.CallerClient.callerOfferForwarded.Get() {
+			// caller has not sent a calleroffer yet -> it has hanged up early
+			hub.HubMutex.RUnlock()
+			//fmt.Printf("%s (%s) no peercon check: !CallerClient.callerOfferForwarded\n",
+			//	client.connType, client.calleeID)
+			return
+		}
+		if hub.CalleeClient.isConnectedToPeer.Get() {
+			// peercon steht; no peercon meldung nicht nötig; force caller ws-disconnect
+			// (but a caller that may be put on hold needs its ws-connection; see wsCallWaiting.go)
+			callWaiting := hub.callWaiting
+			hub.HubMutex.RUnlock()
+			//fmt.Printf("%s (%s) no peercon check: CalleeClient.isConnectedToPeer\n",
+			//	client.connType, client.calleeID)
+
+			client.reached14s.Set(true) // caller onClose will not anymore disconnect session/peercon
+
+			if hub.CalleeClient.isMediaConnectedToPeer.Get() {
+				// now force-disconnect caller
+				// but only if already media connected
+				readConfigLock.RLock()
+				myDisconCallerOnPeerConnected := disconCallerOnPeerConnected
+				readConfigLock.RUnlock()
+				if myDisconCallerOnPeerConnected && !callWaiting {
+					if hub.CallerClient != nil {
+						if logWantedFor("attachex") {
+							fmt.Printf("%s (%s) 14s reached -> force caller ws-disconnect\n",
+								client.connType, client.calleeID)
 						}
+						hub.CallerClient.Close("disconCallerAfter14s")
 					}
 				}
-				return
 			}
+			return
+		}
 
-			if hub!=nil && myCallerContactTime != hub.lastCallerContactTime {
-				// this callee is engaged with a new caller session already (myCallerContactTime is outdated)
-				hub.HubMutex.RUnlock()
-				fmt.Printf("%s (%s) no peercon check: outdated %d not %d\n",
-					client.connType, client.calleeID, myCallerContactTime, hub.lastCallerContactTime)
-				return
-			}
+		if hub.isForkRinging() {
+			// the devices of the callee are still ringing
+			hub.HubMutex.RUnlock()
+			return
+		}
 
-			// both sides still ws-connected, calleroffer was received, but after 14s still no peer-connect
-			// this is a webrtc issue
-			fmt.Printf("%s (%s) NO PEERCON📵 %ds %s <- %s (%s) %v ua=%s\n",
-				client.connType, client.calleeID, delaySecs, hub.CalleeClient.RemoteAddr, 
-				hub.CallerClient.RemoteAddr, hub.CallerClient.callerID, hub.CallerClient.isOnline.Get(),
-				hub.CallerClient.userAgent)
-
-			// NOTE: msg MUST NOT contain apostroph (') characters
-			msg := "Unable to establish a direct P2P connection. "+
-			  "This might be a WebRTC related issue with your browser/WebView. "+
-			  "Or with the browser/WebView on the other side. "+
-			  "It could also be a firewall issue. "+
-			  "On Android, run <a href=\"/webcall/android/#webview\">WebRTC-Check</a> "+
-			  "to test your System WebView."
-			hub.CallerClient.Write([]byte("status|"+msg))
-			if strings.HasPrefix(hub.CalleeClient.calleeID,"answie") ||
-				strings.HasPrefix(hub.CalleeClient.calleeID,"talkback") {
-				// the problem can't be the callee side, if callee is answie or talkback
-				// so in this case don't send msg to callee
-			} else {
-				hub.CalleeClient.Write([]byte("status|"+msg))
-			}
+		if hub!=nil && myCallerContactTime != hub.lastCallerContactTime {
+			// this callee is engaged with a new caller session already (myCallerContactTime is outdated)
 			hub.HubMutex.RUnlock()
+			fmt.Printf("%s (%s) no peercon check: outdated %d not %d\n",
+				client.connType, client.calleeID, myCallerContactTime, hub.lastCallerContactTime)
+			return
+		}
 
-			// add missed call if dbUser.StoreMissedCalls is set
-			userKey := client.calleeID + "_" + strconv.FormatInt(int64(client.hub.registrationStartTime),10)
-			var dbUser DbUser
-			err := kvMain.Get(dbUserBucket, userKey, &dbUser)
-			if err!=nil {
-				fmt.Printf("# %s (%s) failed to get dbUser\n",client.connType,client.calleeID)
-			} else if dbUser.StoreMissedCalls {
-				addMissedCall(hub.CalleeClient.calleeID,
-					CallerInfo{hub.CallerClient.RemoteAddr, hub.CallerClient.callerName,
-					time.Now().Unix(), hub.CallerClient.callerID, hub.CalleeClient.callerTextMsg}, "NO PEERCON")
-			}
+		// both sides still ws-connected, calleroffer was received, but after 14s still no peer-connect
+		// this is a webrtc issue
+		fmt.Printf("%s (%s) NO PEERCON📵 %ds %s <- %s (%s) %v ua=%s\n",
+			client.connType, client.calleeID, delaySecs, hub.CalleeClient.RemoteAddr, 
+			hub.CallerClient.RemoteAddr, hub.CallerClient.callerID, hub.CallerClient.isOnline.Get(),
+			hub.CallerClient.userAgent)
+
+		// NOTE: msg MUST NOT contain apostroph (') characters
+		msg := "Unable to establish a direct P2P connection. "+
+		  "This might be a WebRTC related issue with your browser/WebView. "+
+		  "Or with the browser/WebView on the other side. "+
+		  "It could also be a firewall issue. "+
+		  "On Android, run <a href=\"/webcall/android/#webview\">WebRTC-Check</a> "+
+		  "to test your System WebView."
+		hub.CallerClient.Write([]byte("status|"+msg))
+		if strings.HasPrefix(hub.CalleeClient.calleeID,"answie") ||
+			strings.HasPrefix(hub.CalleeClient.calleeID,"talkback") {
+			// the problem can't be the callee side, if callee is answie or talkback
+			// so in this case don't send msg to callee
+		} else {
+			hub.CalleeClient.Write([]byte("status|"+msg))
+		}
+		hub.HubMutex.RUnlock()
+
+		// add missed call if dbUser.StoreMissedCalls is set
+		userKey := client.calleeID + "_" + strconv.FormatInt(int64(client.hub.registrationStartTime),10)
+		var dbUser DbUser
+		err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+		if err!=nil {
+			fmt.Printf("# %s (%s) failed to get dbUser\n",client.connType,client.calleeID)
+		} else if dbUser.StoreMissedCalls {
+			addMissedCall(hub.CalleeClient.calleeID,
+				CallerInfo{hub.CallerClient.RemoteAddr, hub.CallerClient.callerName,
+				time.Now().Unix(), hub.CallerClient.callerID, hub.CalleeClient.callerTextMsg}, "NO PEERCON")
+		}
 
-			hub.HubMutex.Lock()
-			hub.CallerClient = nil
-			hub.HubMutex.Unlock()
+		hub.HubMutex.Lock()
+		hub.CallerClient = nil
+		hub.HubMutex.Unlock()
 
-			// clear CallerIpInHubMap
-			err = StoreCallerIpInHubMap(client.globalCalleeID, "", false)
-			if err!=nil {
-				// err "key not found": callee has already signed off - can be ignored
-				if strings.Index(err.Error(),"key not found")<0 {
-					fmt.Printf("# %s (%s) NO PEERCON clear callerIpInHub err=%v\n",
-						client.connType, client.calleeID, err)
-				}
+		// clear CallerIpInHubMap
+		err = StoreCallerIpInHubMap(client.globalCalleeID, "", false)
+		if err!=nil {
+			// err "key not found": callee has already signed off - can be ignored
+			if strings.Index(err.Error(),"key not found")<0 {
+				fmt.Printf("# %s (%s) NO PEERCON clear callerIpInHub err=%v\n",
+					client.connType, client.calleeID, err)
 			}
-		}()
+		}
+	}()
 
-	} else {
-		// can be ignored
-		//fmt.Printf("# %s (%s/%s) CallerClient already set [%s] %s ws=%d\n",
-		//	client.connType, client.calleeID, client.globalCalleeID, hub.CallerClient.RemoteAddr,
-		//	client.RemoteAddr, wsClientID64)
-	}
 }
 
 func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
+	if c.protocol==signalingV2 {
+		c.receiveEnvelope(message)
+		return
+	}
+
 	// check message integrity: cmd's can not be longer than 32 chars
 	checkLen := 32
 	if len(message) < checkLen {
@@ -518,8 +658,36 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 	//fmt.Printf("_ %s (%s) receive isCallee=%v %s %s\n",
 	//	c.connType, c.calleeID, c.isCallee, c.RemoteAddr, cliWsConn.RemoteAddr().String())
 
-	cmd := tok[0]
-	payload := tok[1]
+	c.processCmd(tok[0], tok[1])
+}
+
+// processCmd executes or forwards a signaling command; for both protocol versions
+func (c *WsClient) processCmd(cmd string, payload string) {
+	// message is forwarded as is; Write() converts it if the other client uses v2
+	message := v1Message(cmd, payload)
+	if c.detached.Get() {
+		// not (or no longer) attached to the hub
+		return
+	}
+	if !c.isCallee && c.hub!=nil && c.hub.isWaitingCaller(c) {
+		c.waitingCallerCmd(cmd, payload)
+		return
+	}
+	if !c.isCallee && c.hub!=nil && c.hub.isHeldCaller(c) {
+		c.heldCallerCmd(cmd, payload)
+		return
+	}
+	if c.deviceName!="" && c.hub!=nil {
+		if !c.isCallee && c.hub.isDevice(c) {
+			c.deviceCmd(cmd, payload)
+			return
+		}
+		if c.isCallee && c.hub.forkRingingCmd(c, cmd, payload) {
+			// answer or pickup of the primary device during a forked call
+			return
+		}
+	}
+
 	if cmd=="init" {
 		// note: c == c.hub.CalleeClient
 		if !c.isCallee {
@@ -573,6 +741,10 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 		if c.Write([]byte("sessionId|"+codetag)) != nil {
 			return
 		}
+		// allow the callee to resume after losing its ws-connection (see wsResume.go)
+		if resumeToken := c.hub.calleeResumeToken(); resumeToken!="" {
+			c.Write([]byte("resumeToken|"+resumeToken))
+		}
 
 		if !strings.HasPrefix(c.calleeID,"answie") && !strings.HasPrefix(c.calleeID,"talkback") {
 			if clientUpdateBelowVersion!="" && !c.autologin {
@@ -599,14 +771,15 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 			// err can be ignored
 			kvCalls.Get(dbWaitingCaller,c.calleeID,&waitingCallerSlice)
 			// before we send waitingCallerSlice
-			// we remove all entries that are older than 10min
+			// we remove all entries that are older than waitingCallerTTL
+			// (the whole slice expires waitingCallerTTL after the last caller was added)
 			countOutdated:=0
 			for idx := range waitingCallerSlice {
 				//fmt.Printf("%s (idx=%d of %d)\n", c.connType,idx,len(waitingCallerSlice))
 				if idx >= len(waitingCallerSlice) {
 					break
 				}
-				if time.Now().Unix() - waitingCallerSlice[idx].CallTime > 10*60 {
+				if time.Now().Unix() - waitingCallerSlice[idx].CallTime > int64(waitingCallerTTL/time.Second) {
 					// remove outdated caller from waitingCallerSlice
 					waitingCallerSlice = append(waitingCallerSlice[:idx],
 						waitingCallerSlice[idx+1:]...)
@@ -617,7 +790,8 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 			if countOutdated>0 {
 				fmt.Printf("%s (%s) deleted %d outdated from waitingCallerSlice\n",
 					c.connType, c.calleeID, countOutdated)
-				err = kvCalls.Put(dbWaitingCaller, c.calleeID, waitingCallerSlice, true) // skipConfirm
+				err = kvCalls.PutWithExpiry(dbWaitingCaller, c.calleeID, waitingCallerSlice,
+					time.Now().Add(waitingCallerTTL))
 				if err!=nil {
 					fmt.Printf("# %s (%s) failed to store dbWaitingCaller\n",c.connType,c.calleeID)
 				}
@@ -639,6 +813,8 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 		//if logWantedFor("login") {
 		//	fmt.Printf("%s (%s) callee init done\n", c.connType, c.calleeID)
 		//}
+		// an accepted waiting caller or an unheld caller (see wsCallWaiting.go)
+		c.hub.connectNextCaller()
 		return
 	}
 
@@ -741,6 +917,22 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 		fmt.Printf("%s (%s) CALL☎️  %s <- %s (%s) v=%s ua=%s\n",
 			c.connType, c.calleeID, c.hub.CalleeClient.RemoteAddr,
 				c.RemoteAddr, c.callerID, c.clientVersion, c.userAgent)
+		webhookFire(c.calleeID, WebhookEvent{Event:"incoming", CallerID:c.callerID, CallerName:c.callerName})
+
+		// ring all devices of the callee (see wsDevices.go)
+		c.hub.forkCallerOffer(c, message)
+
+		if turnPort>0 {
+			// issue turn credentials for this call; must arrive at the callee before callerOffer
+			turnCred,err := newTurnCredentials(c.globalCalleeID, turnCredValidSecs(c.hub))
+			if err!=nil {
+				fmt.Printf("# %s (%s) CALL newTurnCredentials err=%v\n", c.connType, c.calleeID, err)
+			} else if c.hub.CalleeClient.Write([]byte(turnCred)) != nil {
+				fmt.Printf("# %s (%s) CALL CalleeClient.Write(turnCred) fail\n", c.connType, c.calleeID)
+				c.hub.HubMutex.RUnlock()
+				return
+			}
+		}
 
 		// forward the callerOffer message to the callee client
 		if c.hub.CalleeClient.Write(message) != nil {
@@ -779,9 +971,13 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 		}
 		c.hub.HubMutex.RUnlock()
 
-		if c.hub.maxRingSecs>0 {
-			// if callee does NOT pickup the call after c.hub.maxRingSecs, callee will be disconnected
-			c.hub.setDeadline(c.hub.maxRingSecs,"serveWs ringsecs")
+		myMaxRingSecs := c.hub.maxRingSecs
+		if c.ringGroup!="" {
+			myMaxRingSecs = ringGroupRingSecs(c.ringGroup, c.ringGroupMember, myMaxRingSecs)
+		}
+		if myMaxRingSecs>0 {
+			// if callee does NOT pickup the call after myMaxRingSecs, callee will be disconnected
+			c.hub.setDeadline(myMaxRingSecs,"serveWs ringsecs")
 		}
 		// this is (also) needed for turn AuthHandler: store caller RemoteAddr
 		err := StoreCallerIpInHubMap(c.globalCalleeID, c.RemoteAddr, false)
@@ -845,6 +1041,9 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 				}
 			}
 			c.hub.HubMutex.RUnlock()
+			if !c.isCallee {
+				c.hub.endForkRinging(c, true, "caller cancel")
+			}
 		}
 		return
 	}
@@ -938,6 +1137,57 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 		return
 	}
 
+	if cmd=="callWaiting" {
+		// callee client supports call waiting (see wsCallWaiting.go)
+		if c.isCallee && c.hub!=nil {
+			c.hub.HubMutex.Lock()
+			c.hub.callWaiting = payload=="true"
+			c.hub.HubMutex.Unlock()
+		}
+		return
+	}
+
+	if cmd=="ringGroupCalls" {
+		// callee client supports parallel group calls (see ringGroup.go)
+		if c.isCallee && c.hub!=nil {
+			c.hub.HubMutex.Lock()
+			c.hub.ringGroupCalls = payload=="true"
+			c.hub.HubMutex.Unlock()
+		}
+		return
+	}
+
+	if cmd=="groupPickup" || cmd=="groupReject" {
+		if c.isCallee {
+			c.ringGroupAnswer(payload, cmd=="groupPickup")
+		}
+		return
+	}
+
+	if cmd=="callWaitingAccept" || cmd=="callWaitingReject" || cmd=="callWaitingBusy" ||
+			cmd=="callWaitingSwap" || cmd=="callWaitingDrop" {
+		if !c.isCallee || c.hub==nil {
+			return
+		}
+		if cmd=="callWaitingAccept" {
+			mode := "hangup"
+			if payload=="hold" {
+				mode = "hold"
+			}
+			c.hub.acceptWaitingCaller(mode)
+		} else if cmd=="callWaitingSwap" {
+			c.hub.swapHeldCaller()
+		} else if cmd=="callWaitingDrop" {
+			c.hub.dropHeldCaller()
+		} else if cmd=="callWaitingReject" {
+			// this is NOT a missed call if callee denies the call
+			c.hub.removeWaitingCaller(nil, "rejected", false)
+		} else {
+			c.hub.removeWaitingCaller(nil, "busy:"+payload, true)
+		}
+		return
+	}
+
 	if cmd=="pickupWaitingCaller" {
 		// for callee only
 		// payload = ip:port
@@ -1035,6 +1285,8 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 			}
 			c.hub.CallerClient.Write(message)
 			c.pickupSent.Set(true)
+			webhookFire(c.calleeID, WebhookEvent{Event:"answered", CallerID:c.hub.CallerClient.callerID,
+				CallerName:c.hub.CallerClient.callerName})
 		}
 		c.hub.HubMutex.RUnlock()
 		c.hub.setDeadline(0,"pickup")
@@ -1223,6 +1475,10 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 			}
 		}
 		c.hub.HubMutex.RUnlock()
+		if !c.isCallee {
+			// the caller is peer connected to the device that picked up a forked call
+			c.hub.deliverForkPickup()
+		}
 		return
 	}
 
@@ -1245,6 +1501,7 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 				if c.hub.CalleeClient!=nil {
 					c.hub.CalleeClient.Write(message)
 				}
+				c.hub.forkToDevices(message)
 			}
 			c.hub.HubMutex.RUnlock()
 		}
@@ -1253,7 +1510,23 @@ func (c *WsClient) receiveProcess(message []byte, cliWsConn *websocket.Conn) {
 	}
 }
 
+// Write sends a "cmd|payload" message; for v2 clients it is sent as a SignalingEnvelope
 func (c *WsClient) Write(b []byte) error {
+	if c.queueOrForward(b) {
+		// callee is suspended or has resumed on a new connection
+		return nil
+	}
+	return c.send(b)
+}
+
+func (c *WsClient) send(b []byte) error {
+	if c.protocol==signalingV2 {
+		b = c.encodeEnvelope(b)
+	}
+	return c.writeMessage(b)
+}
+
+func (c *WsClient) writeMessage(b []byte) error {
 	max := len(b); if max>22 { max = 22 }
 	if !c.isOnline.Get() {
 		//fmt.Printf("# %s Write (%s) to %s callee=%v peerCon=%v NOT ONLINE\n",
@@ -1329,6 +1602,8 @@ func (c *WsClient) peerConHasEnded(cause string) {
 		callerRemoteAddr := ""
 		callerID := ""
 		callerName := ""
+		callerRingGroup := ""
+		callerForwarded := false
 		c.hub.HubMutex.RLock()
 		if c.hub.CalleeClient!=nil {
 			calleeRemoteAddr = c.hub.CalleeClient.RemoteAddrNoPort
@@ -1337,6 +1612,8 @@ func (c *WsClient) peerConHasEnded(cause string) {
 			callerRemoteAddr = c.hub.CallerClient.RemoteAddrNoPort
 			callerID = c.hub.CallerClient.callerID
 			callerName = c.hub.CallerClient.callerName
+			callerRingGroup = c.hub.CallerClient.ringGroup
+			callerForwarded = c.hub.CallerClient.forwarded.Get()
 
 			// clear recentTurnCalleeIps[ipNoPort] entry (if this was a relay session)
 			recentTurnCalleeIpMutex.Lock()
@@ -1348,21 +1625,31 @@ func (c *WsClient) peerConHasEnded(cause string) {
 			c.connType, c.calleeID, //peerType,
 			c.hub.CallDurationSecs, localPeerCon, remotePeerCon,
 			calleeRemoteAddr, callerRemoteAddr, callerID, cause)
+		webhookFire(c.calleeID, WebhookEvent{Event:"ended", CallerID:callerID, CallerName:callerName,
+			DurationSecs:c.hub.CallDurationSecs, Local:localPeerCon, Remote:remotePeerCon, Cause:cause})
 
 		// add an entry to missed calls, but only if hub.CallDurationSecs==0
 		// if caller cancels via hangup button, then this is the only addMissedCall() and contains msgtext
 		// this is NOT a missed call if callee denies the call
 		if c.hub.CallDurationSecs<=0 && !strings.HasPrefix(cause,"callee") {
-			// add missed call if dbUser.StoreMissedCalls is set
-			userKey := c.calleeID + "_" + strconv.FormatInt(int64(c.hub.registrationStartTime),10)
-			var dbUser DbUser
-			err := kvMain.Get(dbUserBucket, userKey, &dbUser)
-			if err!=nil {
-				fmt.Printf("# %s (%s) failed to get dbUser err=%v\n",c.connType,c.calleeID,err)
-			} else if dbUser.StoreMissedCalls {
-				//fmt.Printf("%s (%s) store missedCall msg=(%s)\n", c.connType, c.calleeID, c.callerTextMsg)
-				addMissedCall(c.calleeID, CallerInfo{callerRemoteAddr, callerName, time.Now().Unix(),
+			if callerForwarded {
+				// the call was passed on (see callForward.go)
+			} else if callerRingGroup!="" {
+				// missed by the group (see ringGroup.go)
+				ringGroupMissedCall(callerRingGroup, CallerInfo{callerRemoteAddr, callerName, time.Now().Unix(),
 					callerID, c.callerTextMsg}, cause)
+			} else {
+				// add missed call if dbUser.StoreMissedCalls is set
+				userKey := c.calleeID + "_" + strconv.FormatInt(int64(c.hub.registrationStartTime),10)
+				var dbUser DbUser
+				err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+				if err!=nil {
+					fmt.Printf("# %s (%s) failed to get dbUser err=%v\n",c.connType,c.calleeID,err)
+				} else if dbUser.StoreMissedCalls {
+					//fmt.Printf("%s (%s) store missedCall msg=(%s)\n", c.connType, c.calleeID, c.callerTextMsg)
+					addMissedCall(c.calleeID, CallerInfo{callerRemoteAddr, callerName, time.Now().Unix(),
+						callerID, c.callerTextMsg}, cause)
+				}
 			}
 		}
 
@@ -1392,6 +1679,7 @@ func (c *WsClient) peerConHasEnded(cause string) {
 }
 
 func (c *WsClient) Close(reason string) {
+	c.closeRequested.Set(true)
 	if c.isOnline.Get() {
 		if logWantedFor("wsclose") {
 			fmt.Printf("wsclient Close %s callee=%v %s\n", c.calleeID, c.isCallee, reason)
@@ -1407,7 +1695,7 @@ func (c *WsClient) SendPing(maxWaitMS int) {
 	}
 
 	// set the time for sending the next ping in pingPeriod secs from now
-	keepAliveMgr.SetPingDeadline(c.wsConn, pingPeriod, c)
+	c.setPingDeadline(pingPeriod)
 
 	// we expect a pong (or anything) from the client within max 20 secs from now
 	if maxWaitMS<0 {
@@ -1423,71 +1711,18 @@ func (c *WsClient) SendPing(maxWaitMS int) {
 }
 
 
-// KeepAliveMgr done with kind support from lesismal of github.com/lesismal/nbio
-// Keeping many idle clients alive: https://github.com/lesismal/nbio/issues/92 
-type KeepAliveMgr struct {
-	mux       sync.RWMutex
-	clients   map[*websocket.Conn]struct{}
-}
-
-func NewKeepAliveMgr() *KeepAliveMgr {
-	return &KeepAliveMgr{
-		clients: make(map[*websocket.Conn]struct{}),
-	}
-}
-
-type KeepAliveSessionData struct {
-	pingSendTime time.Time
-	client *WsClient
-}
-
-func (kaMgr *KeepAliveMgr) SetPingDeadline(wsConn *websocket.Conn, secs int, client *WsClient) {
-	// set the absolute time for sending the next ping
-	wsConn.SetSession(&KeepAliveSessionData{
-		time.Now().Add(time.Duration(secs)*time.Second), client})
-}
-
-func (kaMgr *KeepAliveMgr) Add(c *websocket.Conn) {
-	kaMgr.mux.Lock()
-	defer kaMgr.mux.Unlock()
-	kaMgr.clients[c] = struct{}{}
-}
-
-func (kaMgr *KeepAliveMgr) Delete(c *websocket.Conn) {
-	kaMgr.mux.Lock()
-	defer kaMgr.mux.Unlock()
-	delete(kaMgr.clients,c)
+// setPingDeadline (re)schedules the next ping in secs from now
+// any data received from the client postpones the ping
+func (c *WsClient) setPingDeadline(secs int) {
+	timerWheel.Reset(c.pingTimer, time.Duration(secs)*time.Second)
 }
 
-func (kaMgr *KeepAliveMgr) Run() {
-	ticker := time.NewTicker(2*time.Second)
-	defer ticker.Stop()
-	for {
-		<-ticker.C
-		if shutdownStarted.Get() {
-			break
-		}
-		kaMgr.mux.RLock()
-		myClients := make([]*websocket.Conn, len(kaMgr.clients))
-		i:=0
-		for wsConn := range kaMgr.clients {
-			myClients[i] = wsConn
-			i++
-		}
-		kaMgr.mux.RUnlock()
-
-		var nPing int64 = 0
-		timeNow := time.Now()
-		for _,wsConn := range myClients {
-			keepAliveSessionData := wsConn.Session().(*KeepAliveSessionData)
-			if keepAliveSessionData!=nil {
-				if timeNow.After(keepAliveSessionData.pingSendTime) {
-					keepAliveSessionData.client.SendPing(-1)
-					nPing++
-				}
-			}
-		}
-		atomic.AddInt64(&pingSentCounter, nPing)
+// pingDeadlineReached is called by timerWheel
+func (c *WsClient) pingDeadlineReached() {
+	if !c.isOnline.Get() {
+		// OnClose has stopped the timer; but it may have been re-armed in the meantime
+		return
 	}
+	c.SendPing(-1)
+	atomic.AddInt64(&pingSentCounter, 1)
 }
-
@@ -0,0 +1,552 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Several devices of one callee.
+// A callee client may log in with url arg device=<name>. Without it, the device name is
+// taken from the user agent (e.g. "android-app", "windows-firefox"); not for multiCallees.
+// If the same callee logs in again from another device, while the first one is still
+// online, the new client does not replace the first one, but joins its hub (hub.Devices),
+// up to maxDevices clients per callee. hub.CalleeClient remains the primary device.
+// A login with the same user agent name as the primary device is taken for a relogin
+// of that device (as without devices).
+// A callerOffer is then forked to all devices:
+//   each device <- "forked|<number of devices>"
+//   each device <- turn credentials, callerOffer, callerInfo and ua (as usual)
+// While ringing, the answers and candidates of the devices are held by the server.
+// The first device to send "pickup|" (before it is peer connected) gets the call:
+// it becomes hub.CalleeClient, its held messages are delivered to the caller and all
+// other devices receive "cancel|answered elsewhere". Its "pickup" reaches the caller
+// as soon as the peer connection is up. A device may decline with "cancel|"; if all
+// devices decline, the caller gets "cancel|c". If the caller hangs up or the ring
+// deadline is reached, all devices get "cancel|c".
+// If the primary device logs out, another device takes its place.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"unicode"
+	"net/http"
+)
+
+// the number of messages held per device while ringing
+const maxForkQueue = 128
+
+const maxDeviceNameLen = 24
+
+// cleanDeviceName returns url arg device, reduced to a short name
+func cleanDeviceName(device string) string {
+	var name []rune
+	for _,r := range device {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r=='-' || r=='_' || r=='.' {
+			name = append(name, r)
+		}
+		if len(name) >= maxDeviceNameLen {
+			break
+		}
+	}
+	return string(name)
+}
+
+// deviceNameFromUserAgent returns a device name for clients that do not send device=
+func deviceNameFromUserAgent(userAgent string) string {
+	platform := "web"
+	for _,p := range []struct{ key, name string }{
+		{"Android", "android"}, {"iPhone", "iphone"}, {"iPad", "ipad"},
+		{"Windows", "windows"}, {"Macintosh", "mac"}, {"Linux", "linux"},
+	} {
+		if strings.Contains(userAgent, p.key) {
+			platform = p.name
+			break
+		}
+	}
+	browser := "browser"
+	switch {
+	case strings.Contains(userAgent, "; wv)"):
+		// Android WebView: the WebCall app
+		browser = "app"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "firefox"
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "edge"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "safari"
+	}
+	return platform+"-"+browser
+}
+
+// primaryDeviceName returns the device name of CalleeClient
+func (h *Hub) primaryDeviceName() string {
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	if h.CalleeClient==nil {
+		return ""
+	}
+	return h.CalleeClient.deviceName
+}
+
+// acceptsDevice tells if another device may join the session of this callee
+func (h *Hub) acceptsDevice() bool {
+	readConfigLock.RLock()
+	myMaxDevices := maxDevices
+	readConfigLock.RUnlock()
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	if h.CalleeClient==nil || h.CalleeClient.deviceName=="" || !h.CalleeClient.isOnline.Get() ||
+			h.suspendedCallee!=nil {
+		return false
+	}
+	h.deviceMutex.Lock()
+	defer h.deviceMutex.Unlock()
+	return len(h.Devices)+1 < myMaxDevices
+}
+
+// loginDevice answers /login for another device of a callee that is logged in already
+func loginDevice(w http.ResponseWriter, r *http.Request, hub *Hub, urlID string, device string,
+		dbEntry DbEntry, dbUser DbUser, clientVersion string, remoteAddrWithPort string, serviceSecs int) {
+	if !hub.acceptsDevice() {
+		fmt.Printf("/login (%s) device %s denied %s v=%s\n", urlID, device, remoteAddrWithPort, clientVersion)
+		fmt.Fprintf(w,"fatal")
+		return
+	}
+	globalID := ""
+	hub.HubMutex.RLock()
+	if hub.CalleeClient!=nil {
+		globalID = hub.CalleeClient.globalCalleeID
+	}
+	hub.HubMutex.RUnlock()
+
+	wsClientMutex.Lock()
+	wsClientID := getNewWsClientID()
+	wsClientMap[wsClientID] = wsClientDataType{hub, dbEntry, dbUser, urlID, globalID, clientVersion, false,
+		device, true}
+	wsClientMutex.Unlock()
+
+	// the device must connect within 22s
+	timerWheel.AfterFunc(22 * time.Second, func() {
+		wsClientMutex.Lock()
+		delete(wsClientMap, wsClientID)
+		wsClientMutex.Unlock()
+	})
+
+	fmt.Printf("/login (%s) device %s ws=%d %s v=%s\n", urlID, device, wsClientID, remoteAddrWithPort, clientVersion)
+	fmt.Fprintf(w, "%s|%d|%s|%d|%v|%v",
+		onlineWsAddr(r, wsClientID),
+		dbUser.ConnectedToPeerSecs,
+		outboundIP,
+		serviceSecs,
+		dbUser.Int2&1 != 0,
+		dbUser.Int2&4 != 0)
+}
+
+// addDevice attaches client as an additional device; false if this is not possible (anymore)
+func (h *Hub) addDevice(client *WsClient) bool {
+	if !h.acceptsDevice() {
+		return false
+	}
+	client.isCallee = false
+	h.deviceMutex.Lock()
+	h.Devices = append(h.Devices, client)
+	count := len(h.Devices)+1
+	h.deviceMutex.Unlock()
+	fmt.Printf("%s (%s) device %s joined (%d) %s\n",
+		client.connType, client.calleeID, client.deviceName, count, client.RemoteAddr)
+	return true
+}
+
+func (h *Hub) isDevice(client *WsClient) bool {
+	h.deviceMutex.Lock()
+	defer h.deviceMutex.Unlock()
+	for _,device := range h.Devices {
+		if device==client {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) hasDevices() bool {
+	h.deviceMutex.Lock()
+	defer h.deviceMutex.Unlock()
+	return len(h.Devices)>0
+}
+
+func (h *Hub) isForkRinging() bool {
+	h.deviceMutex.Lock()
+	defer h.deviceMutex.Unlock()
+	return h.forkRinging
+}
+
+// allDevicesLocked returns the primary device plus the other devices
+// HubMutex must be (r)locked (for CalleeClient) and deviceMutex locked
+func (h *Hub) allDevicesLocked() []*WsClient {
+	var devices []*WsClient
+	if h.CalleeClient!=nil {
+		devices = append(devices, h.CalleeClient)
+	}
+	return append(devices, h.Devices...)
+}
+
+// removeDevice is called when a device (other than the primary) closes its connection
+func (h *Hub) removeDevice(client *WsClient) bool {
+	h.deviceMutex.Lock()
+	found := false
+	for i,device := range h.Devices {
+		if device==client {
+			h.Devices = append(h.Devices[:i], h.Devices[i+1:]...)
+			found = true
+			break
+		}
+	}
+	h.deviceMutex.Unlock()
+	if !found {
+		return false
+	}
+	fmt.Printf("%s (%s) device %s left %s\n", client.connType, client.calleeID, client.deviceName, client.RemoteAddr)
+	h.forkDecline(client, "device left")
+	return true
+}
+
+// promoteDevice replaces the primary device (client), which is closing, by another device
+func (h *Hub) promoteDevice(client *WsClient) bool {
+	h.HubMutex.Lock()
+	h.deviceMutex.Lock()
+	if h.CalleeClient!=client || len(h.Devices)==0 {
+		h.deviceMutex.Unlock()
+		h.HubMutex.Unlock()
+		return false
+	}
+	next := h.Devices[0]
+	h.Devices = h.Devices[1:]
+	next.isCallee = true
+	next.calleeInitReceived.Set(true)
+	next.clearOnCloseDone = false
+	h.CalleeClient = next
+	h.deviceMutex.Unlock()
+	h.HubMutex.Unlock()
+	fmt.Printf("%s (%s) device %s replaces %s %s\n",
+		client.connType, client.calleeID, next.deviceName, client.deviceName, next.RemoteAddr)
+	h.forkDecline(client, "device left")
+	return true
+}
+
+// closeDevices disconnects all devices but the primary one (the callee is logging out)
+func (h *Hub) closeDevices(comment string) {
+	h.deviceMutex.Lock()
+	devices := h.Devices
+	h.Devices = nil
+	h.deviceMutex.Unlock()
+	for _,device := range devices {
+		device.detached.Set(true)
+		device.Close(comment)
+	}
+}
+
+// forkCallerOffer sends "forked|" to all devices and the call setup to all devices but
+// the primary one (which is served by the callerOffer code as usual)
+// HubMutex must be (r)locked
+func (h *Hub) forkCallerOffer(caller *WsClient, message []byte) {
+	h.deviceMutex.Lock()
+	if len(h.Devices)==0 {
+		h.deviceMutex.Unlock()
+		return
+	}
+	h.forkRinging = true
+	h.forkPickup = nil
+	devices := h.allDevicesLocked()
+	for _,device := range devices {
+		device.forkRinging = true
+		device.forkQueue = nil
+	}
+	h.deviceMutex.Unlock()
+
+	fmt.Printf("%s (%s) CALL forked to %d devices <- %s (%s)\n",
+		caller.connType, caller.calleeID, len(devices), caller.RemoteAddr, caller.callerID)
+	for _,device := range devices {
+		device.Write([]byte("forked|"+strconv.Itoa(len(devices))))
+	}
+	for _,device := range devices[1:] {
+		if turnPort>0 {
+			turnCred,err := newTurnCredentials(caller.globalCalleeID, turnCredValidSecs(h))
+			if err!=nil {
+				fmt.Printf("# %s (%s) fork newTurnCredentials err=%v\n", caller.connType, caller.calleeID, err)
+			} else {
+				device.Write([]byte(turnCred))
+			}
+		}
+		device.Write(message)
+		if caller.callerID!="" || caller.callerName!="" {
+			device.Write([]byte("callerInfo|"+caller.callerID+":"+caller.callerName))
+		}
+		device.Write([]byte("ua|"+caller.userAgent))
+	}
+}
+
+// forkToDevices hands a message of the caller to the ringing devices (but not the primary)
+func (h *Hub) forkToDevices(message []byte) {
+	h.deviceMutex.Lock()
+	if !h.forkRinging {
+		h.deviceMutex.Unlock()
+		return
+	}
+	var ringing []*WsClient
+	for _,device := range h.Devices {
+		if device.forkRinging {
+			ringing = append(ringing, device)
+		}
+	}
+	h.deviceMutex.Unlock()
+	for _,device := range ringing {
+		device.Write(message)
+	}
+}
+
+// forkRingingCmd holds or handles a message of a ringing device; false if not ringing
+func (h *Hub) forkRingingCmd(c *WsClient, cmd string, payload string) bool {
+	h.deviceMutex.Lock()
+	if !h.forkRinging || !c.forkRinging {
+		h.deviceMutex.Unlock()
+		return false
+	}
+	switch cmd {
+	case "pickup":
+		h.deviceMutex.Unlock()
+		h.forkPickupBy(c, payload)
+	case "cancel":
+		h.deviceMutex.Unlock()
+		h.forkDecline(c, "declined")
+	case "calleeAnswer", "calleeOffer", "calleeCandidate":
+		if len(c.forkQueue) < maxForkQueue {
+			c.forkQueue = append(c.forkQueue, []byte(cmd+"|"+payload))
+		}
+		h.deviceMutex.Unlock()
+	default:
+		h.deviceMutex.Unlock()
+		return false
+	}
+	return true
+}
+
+// forkPickupBy gives the call to the device that picked up first
+func (h *Hub) forkPickupBy(winner *WsClient, payload string) {
+	h.HubMutex.Lock()
+	h.deviceMutex.Lock()
+	if !h.forkRinging || !winner.forkRinging {
+		h.deviceMutex.Unlock()
+		h.HubMutex.Unlock()
+		return
+	}
+	h.forkRinging = false
+	h.forkPickup = winner
+	h.forkPickupMsg = payload
+	queue := winner.forkQueue
+	winner.forkQueue = nil
+	var losers []*WsClient
+	for _,device := range h.allDevicesLocked() {
+		if device.forkRinging && device!=winner {
+			losers = append(losers, device)
+		}
+		device.forkRinging = false
+		device.forkQueue = nil
+	}
+	if old := h.CalleeClient; old!=nil && old!=winner {
+		// the winner becomes the primary device
+		for i,device := range h.Devices {
+			if device==winner {
+				h.Devices[i] = old
+				break
+			}
+		}
+		winner.isCallee = true
+		winner.calleeInitReceived.Set(false)
+		winner.pickupSent.Set(false)
+		winner.clearOnCloseDone = old.clearOnCloseDone
+		winner.callerTextMsg = old.callerTextMsg
+		old.isCallee = false
+		h.CalleeClient = winner
+	}
+	caller := h.CallerClient
+	h.deviceMutex.Unlock()
+	h.HubMutex.Unlock()
+
+	fmt.Printf("%s (%s) fork picked up by device %s (%d others) %s\n",
+		winner.connType, winner.calleeID, winner.deviceName, len(losers), winner.RemoteAddr)
+	for _,device := range losers {
+		device.Write([]byte("cancel|answered elsewhere"))
+	}
+	// the ring deadline is not needed anymore
+	h.setDeadline(0,"fork pickup")
+	if caller!=nil {
+		for _,message := range queue {
+			caller.Write(message)
+		}
+	}
+}
+
+// deliverForkPickup sends the pickup of the winning device, once the caller is peer connected
+func (h *Hub) deliverForkPickup() {
+	h.deviceMutex.Lock()
+	winner := h.forkPickup
+	if winner==nil || !winner.isConnectedToPeer.Get() {
+		h.deviceMutex.Unlock()
+		return
+	}
+	h.forkPickup = nil
+	payload := h.forkPickupMsg
+	h.deviceMutex.Unlock()
+	if !winner.pickupSent.Get() {
+		winner.processCmd("pickup", payload)
+	}
+}
+
+// forkDecline takes client off the ringing devices; if none is left ringing, the call ends
+// HubMutex must not be locked
+func (h *Hub) forkDecline(client *WsClient, comment string) {
+	h.HubMutex.RLock()
+	h.deviceMutex.Lock()
+	if !h.forkRinging || !client.forkRinging {
+		h.deviceMutex.Unlock()
+		h.HubMutex.RUnlock()
+		return
+	}
+	client.forkRinging = false
+	client.forkQueue = nil
+	left := 0
+	for _,device := range h.allDevicesLocked() {
+		if device.forkRinging {
+			left++
+		}
+	}
+	caller := h.CallerClient
+	h.deviceMutex.Unlock()
+	h.HubMutex.RUnlock()
+	fmt.Printf("%s (%s) fork %s by device %s (%d ringing) %s\n",
+		client.connType, client.calleeID, comment, client.deviceName, left, client.RemoteAddr)
+	if left==0 {
+		if caller!=nil && h.endForkRinging(caller, false, "all devices "+comment) {
+			caller.Write([]byte("cancel|c"))
+		}
+	}
+}
+
+// endForkRinging cancels all ringing devices; false if the call was not (or no longer) ringing
+// HubMutex must not be locked
+func (h *Hub) endForkRinging(caller *WsClient, missed bool, comment string) bool {
+	h.HubMutex.RLock()
+	h.deviceMutex.Lock()
+	if !h.forkRinging {
+		h.deviceMutex.Unlock()
+		h.HubMutex.RUnlock()
+		return false
+	}
+	h.forkRinging = false
+	var ringing []*WsClient
+	for _,device := range h.allDevicesLocked() {
+		if device.forkRinging {
+			ringing = append(ringing, device)
+		}
+		device.forkRinging = false
+		device.forkQueue = nil
+	}
+	h.deviceMutex.Unlock()
+	h.HubMutex.RUnlock()
+
+	fmt.Printf("%s (%s) fork ended (%s) %d ringing <- %s\n",
+		caller.connType, caller.calleeID, comment, len(ringing), caller.RemoteAddr)
+	for _,device := range ringing {
+		device.Write([]byte("cancel|c"))
+	}
+	StoreCallerIpInHubMap(caller.globalCalleeID, "", false)
+	if missed {
+		h.forkMissedCall(caller, comment)
+	}
+	return true
+}
+
+// forkMissedCall stores a forked call that nobody picked up as missed call
+// HubMutex must not be locked
+func (h *Hub) forkMissedCall(caller *WsClient, cause string) {
+	if caller.forwarded.Get() {
+		// the caller was forwarded to another callee
+		return
+	}
+	textMsg := ""
+	h.HubMutex.RLock()
+	if calleeClient := h.CalleeClient; calleeClient!=nil {
+		textMsg = calleeClient.callerTextMsg
+	}
+	h.HubMutex.RUnlock()
+	callerInfo := CallerInfo{caller.RemoteAddr, caller.callerName, time.Now().Unix(), caller.callerID, textMsg}
+	if caller.ringGroup!="" {
+		ringGroupMissedCall(caller.ringGroup, callerInfo, cause)
+		return
+	}
+	userKey := caller.calleeID + "_" + strconv.FormatInt(h.registrationStartTime,10)
+	var dbUser DbUser
+	err := kvMain.Get(dbUserBucket, userKey, &dbUser)
+	if err!=nil {
+		fmt.Printf("# %s (%s) fork failed to get dbUser err=%v\n", caller.connType, caller.calleeID, err)
+	} else if dbUser.StoreMissedCalls {
+		addMissedCall(caller.calleeID, callerInfo, cause)
+	}
+}
+
+// deviceCmd is processCmd() for a device other than the primary one
+func (c *WsClient) deviceCmd(cmd string, payload string) {
+	if c.hub.forkRingingCmd(c, cmd, payload) {
+		return
+	}
+	switch cmd {
+	case "init":
+		c.Write([]byte("sessionId|"+codetag))
+	case "check":
+		c.Write([]byte("confirm|"+payload))
+	case "heartbeat", "dummy", "log", "cancel", "pickup":
+		// not in a call
+	default:
+		if logWantedFor("wsreceive") {
+			fmt.Printf("%s (%s) device %s ignore %s %s\n",
+				c.connType, c.calleeID, c.deviceName, cmd, c.RemoteAddr)
+		}
+	}
+}
+
+// deviceState is shown by /dumponline
+func (h *Hub) deviceState(client *WsClient) string {
+	h.deviceMutex.Lock()
+	defer h.deviceMutex.Unlock()
+	if client.isConnectedToPeer.Get() {
+		return "in call"
+	}
+	if h.forkPickup==client {
+		return "answering"
+	}
+	if h.forkRinging && client.forkRinging {
+		return "ringing"
+	}
+	return "idle"
+}
+
+// dumpDevices returns name, address and state of all devices (for /dumponline)
+func (h *Hub) dumpDevices() []string {
+	h.HubMutex.RLock()
+	h.deviceMutex.Lock()
+	if len(h.Devices)==0 {
+		h.deviceMutex.Unlock()
+		h.HubMutex.RUnlock()
+		return nil
+	}
+	devices := h.allDevicesLocked()
+	h.deviceMutex.Unlock()
+	h.HubMutex.RUnlock()
+	var lines []string
+	for _,device := range devices {
+		lines = append(lines, fmt.Sprintf("  device %-12s %-15s %-9s %s",
+			device.deviceName, device.RemoteAddrNoPort, h.deviceState(device), device.clientVersion))
+	}
+	return lines
+}
@@ -14,8 +14,21 @@ import (
 type Hub struct {
 	CalleeClient *WsClient
 	CallerClient *WsClient
-	timer *time.Timer // expires when durationSecs ends; terminates session
-	timerCanceled chan struct{}
+	deadline *WheelTimer // ring or talk deadline (see setDeadline); terminates session
+	deadlineMutex sync.Mutex
+	resumeToken string // see wsResume.go
+	suspendedCallee *WsClient // callee lost its ws-connection and may resume
+	resumeTimer *WheelTimer // ends the grace window of suspendedCallee
+	WaitingCaller *WsClient // 2nd caller, while the callee is in a call (see wsCallWaiting.go)
+	HeldCaller *WsClient // caller on hold
+	nextCaller *WsClient // accepted waiting caller or unheld caller; connected on the next callee init
+	callWaiting bool // callee client supports call waiting
+	ringGroupCalls bool // callee client supports parallel group calls (see ringGroup.go)
+	Devices []*WsClient // more devices of the callee, besides CalleeClient (see wsDevices.go)
+	deviceMutex sync.Mutex // guards Devices and the fork state; may be locked while HubMutex is locked
+	forkRinging bool // callerOffer was forked to the devices; nobody picked up yet
+	forkPickup *WsClient // device that picked up; its pickup is delivered when peer connected
+	forkPickupMsg string
 	exitFunc func(*WsClient, string)
 	IsUnHiddenForCallerAddr string
 	ConnectedCallerIp string
@@ -48,70 +61,136 @@ func newHub(maxRingSecs int, maxTalkSecsIfNoP2p int, startTime int64) *Hub {
 	}
 }
 
+// setDeadline replaces the current ring or talk deadline; secs=0 only cancels it
 func (h *Hub) setDeadline(secs int, comment string) {
-	if h.timer!=nil {
+	h.deadlineMutex.Lock()
+	defer h.deadlineMutex.Unlock()
+	if h.deadline!=nil {
 		if logWantedFor("deadline") {
 			fmt.Printf("setDeadline (%s) cancel running timer; new secs=%d (%s)\n",
-				h.CalleeClient.calleeID, secs, comment)
+				h.calleeIdForLog(), secs, comment)
 		}
-		// cancel running timer early (trigger h.timer.C below)
-		h.timerCanceled <- struct{}{}
-		// let running timer be canceled before we (might) set a new one
-		time.Sleep(10 * time.Millisecond)
+		// if the timer has expired already, deadlineReached() will find that it is not current
+		timerWheel.Stop(h.deadline)
+		h.deadline = nil
 	}
 
 	if(secs>0) {
 		if logWantedFor("deadline") {
-			fmt.Printf("setDeadline (%s) create %ds (%s)\n", h.CalleeClient.calleeID, secs, comment)
+			fmt.Printf("setDeadline (%s) create %ds (%s)\n", h.calleeIdForLog(), secs, comment)
 		}
-		h.timer = time.NewTimer(time.Duration(secs) * time.Second)
-		h.timerCanceled = make(chan struct{})
-		go func() {
-			timeStart := time.Now()
-			select {
-			case <-h.timer.C:
-				// timer event: we need to disconnect the (relayed) clients (if still connected)
-				h.timer = nil
-				if h.CalleeClient!=nil && h.CalleeClient.isConnectedToPeer.Get() {
-					fmt.Printf("setDeadline (%s) reached; quit session now (secs=%d %v)\n",
-						h.CalleeClient.calleeID, secs, timeStart.Format("2006-01-02 15:04:05"))
-					calleeID := ""
-					if h.CalleeClient!=nil {
-						calleeID = h.CalleeClient.calleeID
-					}
-					if h.CallerClient!=nil {
-						var message = []byte("cancel|s")
-						fmt.Printf("setDeadline (%s) send to caller (%s) %s\n",
-							calleeID, message, h.CallerClient.RemoteAddr)
-						h.CallerClient.Write(message)
-						// in response, caller will send msgboxText to server and will hangup
-					}
-
-					// we wait for msg|... (to set callerTextMsg)
-					time.Sleep(1 * time.Second)
-					if h.CalleeClient!=nil && h.CalleeClient.isConnectedToPeer.Get() {
-						var message = []byte("cancel|c")
-						// only cancel callee if canceling caller wasn't possible
-						fmt.Printf("setDeadline (%s) send to callee (%s) %s\n",
-							calleeID, message, h.CalleeClient.RemoteAddr)
-						h.CalleeClient.Write(message)
-
-						// NOTE: peerConHasEnded() may call us back / this is why we set h.timer = nil first
-						h.CalleeClient.peerConHasEnded(fmt.Sprintf("deadline%d",secs))
-					}
-				}
-			case <-h.timerCanceled:
-				if logWantedFor("deadline") {
-					fmt.Printf("setDeadline (%s) timerCanceled (secs=%d %v)\n",
-						h.CalleeClient.calleeID, secs, timeStart.Format("2006-01-02 15:04:05"))
-				}
-				if h.timer!=nil {
-					h.timer.Stop()
-				}
-				h.timer = nil
+		timeStart := time.Now()
+		var timer *WheelTimer
+		// timer is assigned before it is scheduled, so the callback can compare it to h.deadline
+		timer = timerWheel.NewTimer(func() {
+			h.deadlineReached(timer, secs, timeStart)
+		})
+		h.deadline = timer
+		timerWheel.Reset(timer, time.Duration(secs) * time.Second)
+	}
+}
+
+// deadlineReached is called by timerWheel; timer is the deadline that has expired
+func (h *Hub) deadlineReached(timer *WheelTimer, secs int, timeStart time.Time) {
+	h.deadlineMutex.Lock()
+	if h.deadline!=timer {
+		// canceled or replaced while expiring
+		h.deadlineMutex.Unlock()
+		if logWantedFor("deadline") {
+			fmt.Printf("setDeadline (%s) timerCanceled (secs=%d %v)\n",
+				h.calleeIdForLog(), secs, timeStart.Format("2006-01-02 15:04:05"))
+		}
+		return
+	}
+	h.deadline = nil
+	h.deadlineMutex.Unlock()
+
+	// timer event: we need to disconnect the (relayed) clients (if still connected)
+	calleeClient := h.CalleeClient
+	forked := calleeClient!=nil && h.isForkRinging()
+	if calleeClient==nil || (!calleeClient.isConnectedToPeer.Get() && !forked) {
+		return
+	}
+	calleeID := calleeClient.calleeID
+	fmt.Printf("setDeadline (%s) reached; quit session now (secs=%d %v)\n",
+		calleeID, secs, timeStart.Format("2006-01-02 15:04:05"))
+	h.HubMutex.RLock()
+	callerClient := h.CallerClient
+	h.HubMutex.RUnlock()
+	var forkCaller *WsClient
+	if forked && callerClient!=nil && h.endForkRinging(callerClient, false, "ring timeout") {
+		// the missed call is stored after msg|
+		forkCaller = callerClient
+	}
+	if callerClient!=nil && !calleeClient.pickupSent.Get() && !calleeClient.isMediaConnectedToPeer.Get() {
+		// maxRingSecs: callee did not answer
+		forwardUrl := ""
+		if callerClient.ringGroup!="" {
+			// hunt group: try the next member
+			if group := lookupRingGroup(callerClient.ringGroup); group!=nil {
+				forwardUrl = group.nextMemberURL(callerClient.ringGroupMember)
 			}
-		}()
+		} else {
+			forwardUrl = h.forwardNoAnswerURL(calleeID, callerClient.fwdChain)
+		}
+		if forwardUrl!="" {
+			fmt.Printf("setDeadline (%s) forward noanswer -> %s %s\n",
+				calleeID, forwardUrl, callerClient.RemoteAddr)
+			callerClient.forwarded.Set(true)
+			callerClient.Write([]byte("forward|"+forwardUrl))
+		}
+	}
+	if callerClient!=nil {
+		var message = []byte("cancel|s")
+		fmt.Printf("setDeadline (%s) send to caller (%s) %s\n",
+			calleeID, message, callerClient.RemoteAddr)
+		callerClient.Write(message)
+		// in response, caller will send msgboxText to server and will hangup
+	}
+
+	// we wait for msg|... (to set callerTextMsg)
+	// if the caller hangs up in the meantime, peerConHasEnded() cancels this via setDeadline(0)
+	h.deadlineMutex.Lock()
+	if h.deadline==nil {
+		var cancelTimer *WheelTimer
+		cancelTimer = timerWheel.NewTimer(func() {
+			h.cancelCalleeAfterDeadline(cancelTimer, calleeID, secs, forkCaller)
+		})
+		h.deadline = cancelTimer
+		timerWheel.Reset(cancelTimer, 1 * time.Second)
 	}
+	h.deadlineMutex.Unlock()
+}
+
+func (h *Hub) cancelCalleeAfterDeadline(timer *WheelTimer, calleeID string, secs int, forkCaller *WsClient) {
+	h.deadlineMutex.Lock()
+	if h.deadline!=timer {
+		h.deadlineMutex.Unlock()
+		return
+	}
+	h.deadline = nil
+	h.deadlineMutex.Unlock()
+
+	calleeClient := h.CalleeClient
+	if calleeClient!=nil && calleeClient.isConnectedToPeer.Get() {
+		var message = []byte("cancel|c")
+		// only cancel callee if canceling caller wasn't possible
+		fmt.Printf("setDeadline (%s) send to callee (%s) %s\n",
+			calleeID, message, calleeClient.RemoteAddr)
+		calleeClient.Write(message)
+
+		// NOTE: peerConHasEnded() calls setDeadline(0) / this is why we cleared h.deadline first
+		calleeClient.peerConHasEnded(fmt.Sprintf("deadline%d",secs))
+	} else if forkCaller!=nil {
+		h.forkMissedCall(forkCaller, fmt.Sprintf("deadline%d",secs))
+	}
+}
+
+func (h *Hub) calleeIdForLog() string {
+	if calleeClient := h.CalleeClient; calleeClient!=nil {
+		return calleeClient.calleeID
+	}
+	return ""
 }
 
 func (h *Hub) doBroadcast(message []byte) {
@@ -178,6 +257,10 @@ func (h *Hub) doUnregister(client *WsClient, comment string) {
 		client.isMediaConnectedToPeer.Set(false)
 		client.pickupSent.Set(false)
 
+		h.removeWaitingCaller(nil, "unavailable", true)
+		h.removeHeldCaller(nil, "unavailable")
+		h.closeDevices("unregister "+comment)
+
 		// remove callee from hubMap; delete wsClientID from wsClientMap
 		h.exitFunc(client,comment)
 
@@ -190,19 +273,6 @@ func (h *Hub) doUnregister(client *WsClient, comment string) {
 		}
 		h.CalleeClient = nil
 		h.HubMutex.Unlock()
-/*
-		if h.timer!=nil {
-			if logWantedFor("deadline") {
-				fmt.Printf("doUnregister clear old timer\n")
-			}
-			h.timerCanceled <- struct{}{}
-			if !h.timer.Stop() {
-				time.Sleep(10 * time.Millisecond)
-			}
-			h.timer=nil
-		}
-*/
-//		setDeadline(0,"doUnregister")
 	} else {
 		if logWantedFor("hub") {
 			fmt.Printf("hub (%s) unregister caller peercon=%v (%s)\n",
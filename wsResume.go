@@ -0,0 +1,204 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Signaling session resumption.
+// On "init" the callee receives "resumeToken|<token>" (one token per login).
+// If the callee's websocket drops while it is peer connected (mobile network
+// handover), the hub is kept for resumeGraceSecs: CallerClient, call timing and
+// ConnectedCallerIp stay in place and all messages to the callee are queued.
+// Within the grace window the callee may reconnect with the wsid it already has:
+//   /ws?wsid=<wsid>&resume=<token>
+// The new connection takes over the state of the old one and receives
+// "resumed|<number of queued messages>", followed by the queued messages.
+// callee.js resumes this way while in a call; otherwise it logs in again.
+// If the grace window expires, the callee is unregistered just like on a
+// ws-disconnect without resumption. A new /login of the callee ends the grace
+// window right away (see httpLogin).
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strconv"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// a caller will hardly send more than this during the grace window (ice candidates)
+const maxResumeQueue = 256
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _,err := rand.Read(b); err!=nil {
+		fmt.Printf("# newResumeToken err=%v\n", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// calleeResumeToken returns the resume token of this hub; it is created on the first call
+func (h *Hub) calleeResumeToken() string {
+	h.HubMutex.Lock()
+	defer h.HubMutex.Unlock()
+	if h.resumeToken=="" {
+		h.resumeToken = newResumeToken()
+	}
+	return h.resumeToken
+}
+
+func (h *Hub) isCalleeSuspended() bool {
+	h.HubMutex.RLock()
+	defer h.HubMutex.RUnlock()
+	return h.suspendedCallee!=nil
+}
+
+// suspendCallee is called by OnClose of the callee client; it returns false if the
+// callee can not resume (and must be unregistered now)
+func (h *Hub) suspendCallee(client *WsClient) bool {
+	readConfigLock.RLock()
+	graceSecs := resumeGraceSecs
+	readConfigLock.RUnlock()
+	if graceSecs<=0 || shutdownStarted.Get() || client.closeRequested.Get() ||
+			!client.isConnectedToPeer.Get() {
+		return false
+	}
+
+	h.HubMutex.Lock()
+	defer h.HubMutex.Unlock()
+	if h.CalleeClient!=client || h.resumeToken=="" || h.suspendedCallee!=nil {
+		return false
+	}
+	client.resumeMutex.Lock()
+	client.queueing = true
+	client.resumeQueue = nil
+	client.resumeMutex.Unlock()
+	h.suspendedCallee = client
+	var timer *WheelTimer
+	// timer is assigned before it is scheduled, so the callback can compare it to resumeTimer
+	timer = timerWheel.NewTimer(func() {
+		h.endSuspension(timer, "resume timeout")
+	})
+	h.resumeTimer = timer
+	timerWheel.Reset(timer, time.Duration(graceSecs)*time.Second)
+	fmt.Printf("%s (%s) callee suspended; may resume within %ds %s\n",
+		client.connType, client.calleeID, graceSecs, client.RemoteAddr)
+	return true
+}
+
+// endSuspension unregisters the suspended callee
+// timer==nil: end the grace window now (for any suspended callee)
+func (h *Hub) endSuspension(timer *WheelTimer, reason string) bool {
+	h.HubMutex.Lock()
+	client := h.suspendedCallee
+	if client==nil || (timer!=nil && h.resumeTimer!=timer) {
+		// resumed or ended already
+		h.HubMutex.Unlock()
+		return false
+	}
+	h.suspendedCallee = nil
+	timerWheel.Stop(h.resumeTimer)
+	h.resumeTimer = nil
+	h.HubMutex.Unlock()
+
+	client.resumeMutex.Lock()
+	dropped := len(client.resumeQueue)
+	client.queueing = false
+	client.resumeQueue = nil
+	client.resumeMutex.Unlock()
+	fmt.Printf("%s (%s) callee not resumed (%s) dropped=%d\n",
+		client.connType, client.calleeID, reason, dropped)
+
+	// same as OnClose without resumption
+	onCloseMsg := "close📴 "+reason
+	if client.isConnectedToPeer.Get() {
+		client.peerConHasEnded(onCloseMsg)
+	}
+	h.doUnregister(client, onCloseMsg)
+	return true
+}
+
+// resumeCallee lets client take over the suspended callee, if token is valid
+func (h *Hub) resumeCallee(client *WsClient, token string) bool {
+	// until the queued messages are delivered, new messages for client get queued as well
+	client.resumeMutex.Lock()
+	client.queueing = true
+	client.resumeMutex.Unlock()
+
+	h.HubMutex.Lock()
+	old := h.suspendedCallee
+	if old==nil || h.resumeToken=="" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(h.resumeToken))!=1 {
+		h.HubMutex.Unlock()
+		client.resumeMutex.Lock()
+		client.queueing = false
+		client.resumeMutex.Unlock()
+		return false
+	}
+	h.suspendedCallee = nil
+	timerWheel.Stop(h.resumeTimer)
+	h.resumeTimer = nil
+
+	// take over the callee state
+	client.isCallee = true
+	client.calleeInitReceived.Set(old.calleeInitReceived.Get())
+	client.isConnectedToPeer.Set(old.isConnectedToPeer.Get())
+	client.isMediaConnectedToPeer.Set(old.isMediaConnectedToPeer.Get())
+	client.pickupSent.Set(old.pickupSent.Get())
+	client.callerTextMsg = old.callerTextMsg
+	client.clearOnCloseDone = old.clearOnCloseDone
+	h.CalleeClient = client
+	h.HubMutex.Unlock()
+
+	// from now on, messages written to the old client are forwarded to client
+	old.resumeMutex.Lock()
+	queue := old.resumeQueue
+	old.resumeQueue = nil
+	old.queueing = false
+	old.resumedBy = client
+	old.resumeMutex.Unlock()
+
+	fmt.Printf("%s (%s) callee resumed; replay %d %s <- %s\n",
+		client.connType, client.calleeID, len(queue), client.RemoteAddr, old.RemoteAddr)
+	client.send([]byte("resumed|"+strconv.Itoa(len(queue))))
+	for _,message := range queue {
+		client.send(message)
+	}
+	// deliver what was queued during the replay
+	for {
+		client.resumeMutex.Lock()
+		queue = client.resumeQueue
+		client.resumeQueue = nil
+		if len(queue)==0 {
+			client.queueing = false
+			client.resumeMutex.Unlock()
+			break
+		}
+		client.resumeMutex.Unlock()
+		for _,message := range queue {
+			client.send(message)
+		}
+	}
+	return true
+}
+
+// queueOrForward is called by Write(); it returns true if message was queued or forwarded
+func (c *WsClient) queueOrForward(message []byte) bool {
+	c.resumeMutex.Lock()
+	if next := c.resumedBy; next!=nil {
+		c.resumeMutex.Unlock()
+		next.Write(message)
+		return true
+	}
+	if !c.queueing {
+		c.resumeMutex.Unlock()
+		return false
+	}
+	if len(c.resumeQueue) < maxResumeQueue {
+		c.resumeQueue = append(c.resumeQueue, message)
+	} else {
+		fmt.Printf("# %s (%s) resume queue full; drop %d bytes\n", c.connType, c.calleeID, len(message))
+	}
+	c.resumeMutex.Unlock()
+	return true
+}
@@ -0,0 +1,191 @@
+// WebCall Copyright 2022 timur.mobi. All rights reserved.
+//
+// Signaling protocol versions:
+// v1: every ws message is "cmd|payload"; the payload must not contain '|'.
+//     This is what the current web clients and the Android clients use.
+// v2: every ws message is a JSON SignalingEnvelope. A client selects v2 on /ws upgrade
+//     with subprotocol "webcall.v2" (Sec-WebSocket-Protocol) or with url arg proto=2.
+// Both versions use the same commands and payloads, only the framing differs:
+//   client: {"v":2,"type":"callerOffer","id":7,"payload":"{\"type\":\"offer\",...}"}
+//   server: {"v":2,"type":"ack","ack":7}
+//   server: {"v":2,"type":"error","ack":7,"error":{"code":"unknown-type","text":"..."}}
+//   server: {"v":2,"type":"calleeAnswer","id":12,"payload":"..."}
+// The server acks every client message that carries an id, once it is processed.
+// Clients may ack server messages the same way. Malformed messages and unknown
+// types are answered with an error envelope (v1 silently drops them).
+// Messages between a v1 and a v2 client are converted by WsClient.Write();
+// a payload containing '|' can not be delivered intact to a v1 client.
+
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	signalingV1 = 1
+	signalingV2 = 2
+	signalingV2Subprotocol = "webcall.v2"
+	maxSignalingTypeLen = 32
+)
+
+type SignalingEnvelope struct {
+	V int `json:"v"`
+	Type string `json:"type"`
+	ID uint64 `json:"id,omitempty"`
+	Ack uint64 `json:"ack,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Error *SignalingError `json:"error,omitempty"`
+}
+
+type SignalingError struct {
+	Code string `json:"code"`
+	Text string `json:"text,omitempty"`
+}
+
+// SignalingError codes
+const (
+	sigErrMalformed = "malformed"
+	sigErrVersion = "unsupported-version"
+	sigErrUnknownType = "unknown-type"
+)
+
+// signalingCmds holds the commands a client may send
+// true: processed by the server; false: forwarded to the other client
+var signalingCmds = map[string]bool{
+	"init": true,
+	"dummy": true,
+	"msg": true,
+	"missedcall": true,
+	"callerOffer": true,
+	"rtcConnect": true,
+	"cancel": true,
+	"calleeHidden": true,
+	"dialsoundsmuted": true,
+	"pickupWaitingCaller": true,
+	"callWaiting": true,
+	"callWaitingAccept": true,
+	"callWaitingReject": true,
+	"callWaitingBusy": true,
+	"callWaitingSwap": true,
+	"callWaitingDrop": true,
+	"ringGroupCalls": true,
+	"groupPickup": true,
+	"groupReject": true,
+	"deleteMissedCall": true,
+	"pickup": true,
+	"heartbeat": true,
+	"check": true,
+	"log": true,
+	"calleeOffer": false,
+	"calleeAnswer": false,
+	"callerAnswer": false,
+	"callerOfferUpd": false,
+	"calleeCandidate": false,
+	"callerCandidate": false,
+}
+
+// signalingProtocol returns the protocol version requested on /ws upgrade
+func signalingProtocol(r *http.Request) int {
+	for _,proto := range strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if strings.TrimSpace(proto)==signalingV2Subprotocol {
+			return signalingV2
+		}
+	}
+	if r.URL.Query().Get("proto")=="2" {
+		return signalingV2
+	}
+	return signalingV1
+}
+
+// receiveEnvelope is the v2 counterpart of the "cmd|payload" parsing in receiveProcess()
+func (c *WsClient) receiveEnvelope(message []byte) {
+	cmd,payload,reply := decodeEnvelope(message)
+	if cmd=="" {
+		if reply!=nil {
+			max := len(message); if max>32 { max = 32 }
+			fmt.Printf("# %s (%s) receive envelope %s %s (%s)\n",
+				c.connType, c.calleeID, reply.Error.Code, c.RemoteAddr, message[:max])
+			c.writeEnvelope(*reply)
+		}
+		return
+	}
+	c.processCmd(cmd, payload)
+	if reply!=nil {
+		// the ack is sent once the message is processed
+		c.writeEnvelope(*reply)
+	}
+}
+
+// decodeEnvelope parses a v2 message into cmd and payload (as of a v1 "cmd|payload" message)
+// reply is the ack (to be sent after cmd is processed) or, if cmd=="", the error to be sent
+// cmd=="" and reply==nil: an ack from the client, nothing to do
+func decodeEnvelope(message []byte) (string,string,*SignalingEnvelope) {
+	var env SignalingEnvelope
+	err := json.Unmarshal(message, &env)
+	if err!=nil {
+		return "","",signalingErrorEnvelope(0, sigErrMalformed, "invalid json")
+	}
+	if env.V!=0 && env.V!=signalingV2 {
+		return "","",signalingErrorEnvelope(env.ID, sigErrVersion, fmt.Sprintf("v=%d",env.V))
+	}
+	if env.Type=="ack" {
+		// client has received one of our messages
+		return "","",nil
+	}
+	if env.Type=="" || len(env.Type)>maxSignalingTypeLen {
+		return "","",signalingErrorEnvelope(env.ID, sigErrMalformed, "missing or invalid type")
+	}
+	if _,ok := signalingCmds[env.Type]; !ok {
+		return "","",signalingErrorEnvelope(env.ID, sigErrUnknownType, env.Type)
+	}
+	if env.ID>0 {
+		return env.Type, env.Payload, &SignalingEnvelope{Type:"ack", Ack:env.ID}
+	}
+	return env.Type, env.Payload, nil
+}
+
+// encodeEnvelope converts a v1 message ("cmd|payload") into a v2 envelope
+func (c *WsClient) encodeEnvelope(message []byte) []byte {
+	data,err := json.Marshal(envelopeFromV1(message, atomic.AddUint64(&c.lastSentMsgID,1)))
+	if err!=nil {
+		// string fields only; can not happen
+		fmt.Printf("# %s (%s) encodeEnvelope err=%v\n", c.connType, c.calleeID, err)
+	}
+	return data
+}
+
+// envelopeFromV1 splits a v1 message at the first '|'; the payload may contain more of them
+func envelopeFromV1(message []byte, id uint64) SignalingEnvelope {
+	env := SignalingEnvelope{V:signalingV2, ID:id}
+	if idxPipe := bytes.IndexByte(message, '|'); idxPipe>=0 {
+		env.Type = string(message[:idxPipe])
+		env.Payload = string(message[idxPipe+1:])
+	} else {
+		env.Type = string(message)
+	}
+	return env
+}
+
+// v1Message is the "cmd|payload" message forwarded by processCmd()
+func v1Message(cmd string, payload string) []byte {
+	return []byte(cmd+"|"+payload)
+}
+
+func signalingErrorEnvelope(ack uint64, code string, text string) *SignalingEnvelope {
+	return &SignalingEnvelope{Type:"error", Ack:ack, Error:&SignalingError{code,text}}
+}
+
+func (c *WsClient) writeEnvelope(env SignalingEnvelope) error {
+	env.V = signalingV2
+	data,err := json.Marshal(env)
+	if err!=nil {
+		return err
+	}
+	return c.writeMessage(data)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+func TestSignalingV1V2Conversion(t *testing.T) {
+	tests := []struct {
+		v1 string
+		cmd string
+		payload string
+	}{
+		{"callerOffer|{\"type\":\"offer\",\"sdp\":\"v=0\"}", "callerOffer", "{\"type\":\"offer\",\"sdp\":\"v=0\"}"},
+		{"cancel|c", "cancel", "c"},
+		{"sessionId|", "sessionId", ""},
+		{"msg|a|b|c", "msg", "a|b|c"},
+		{"callerCandidate||", "callerCandidate", "|"},
+		{"calleeAnswer|üñï|\"quoted\"", "calleeAnswer", "üñï|\"quoted\""},
+	}
+	for _,test := range tests {
+		// v1 -> v2 (to a v2 client)
+		env := envelopeFromV1([]byte(test.v1), 9)
+		if env.V!=signalingV2 || env.ID!=9 || env.Type!=test.cmd || env.Payload!=test.payload {
+			t.Fatalf("%q -> %+v", test.v1, env)
+		}
+		data,err := json.Marshal(env)
+		if err!=nil {
+			t.Fatalf("%q Marshal err=%v", test.v1, err)
+		}
+		// v2 -> v1 (from a v2 client)
+		cmd,payload,reply := decodeEnvelope(data)
+		if _,ok := signalingCmds[test.cmd]; !ok {
+			// server to client only: a client may not send it
+			if cmd!="" || reply==nil || reply.Error.Code!=sigErrUnknownType {
+				t.Fatalf("%q client may not send %q: cmd=%q reply=%+v", test.v1, test.cmd, cmd, reply)
+			}
+			continue
+		}
+		if cmd!=test.cmd || payload!=test.payload {
+			t.Fatalf("%q decoded cmd=%q payload=%q", test.v1, cmd, payload)
+		}
+		if got := string(v1Message(cmd,payload)); got!=test.v1 {
+			t.Fatalf("%q round trip %q", test.v1, got)
+		}
+	}
+}
+
+func TestSignalingDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		message string
+		cmd string
+		payload string
+		replyType string // "" = no reply
+		replyAck uint64
+		errCode string
+	}{
+		{"with id", `{"v":2,"type":"callerOffer","id":7,"payload":"x|y"}`, "callerOffer", "x|y", "ack", 7, ""},
+		{"without id", `{"v":2,"type":"rtcConnect","payload":"1"}`, "rtcConnect", "1", "", 0, ""},
+		{"v omitted", `{"type":"init","id":1}`, "init", "", "ack", 1, ""},
+		{"forwarded only", `{"v":2,"type":"calleeCandidate","id":3,"payload":"c"}`, "calleeCandidate", "c", "ack", 3, ""},
+		{"client ack", `{"v":2,"type":"ack","ack":12}`, "", "", "", 0, ""},
+		{"unknown type", `{"v":2,"type":"shutdown","id":4}`, "", "", "error", 4, sigErrUnknownType},
+		{"server only type", `{"v":2,"type":"sessionId","id":5,"payload":"x"}`, "", "", "error", 5, sigErrUnknownType},
+		{"v1 in v2", `callerOffer|{}`, "", "", "error", 0, sigErrMalformed},
+		{"bad json", `{"v":2,"type":`, "", "", "error", 0, sigErrMalformed},
+		{"no type", `{"v":2,"id":6}`, "", "", "error", 6, sigErrMalformed},
+		{"long type", `{"v":2,"type":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","id":8}`, "", "", "error", 8, sigErrMalformed},
+		{"version", `{"v":3,"type":"init","id":2}`, "", "", "error", 2, sigErrVersion},
+	}
+	for _,test := range tests {
+		cmd,payload,reply := decodeEnvelope([]byte(test.message))
+		if cmd!=test.cmd || payload!=test.payload {
+			t.Fatalf("%s: cmd=%q payload=%q", test.name, cmd, payload)
+		}
+		if test.replyType=="" {
+			if reply!=nil {
+				t.Fatalf("%s: unexpected reply %+v", test.name, reply)
+			}
+			continue
+		}
+		if reply==nil || reply.Type!=test.replyType || reply.Ack!=test.replyAck {
+			t.Fatalf("%s: reply %+v", test.name, reply)
+		}
+		if test.errCode=="" {
+			if reply.Error!=nil {
+				t.Fatalf("%s: ack with error %+v", test.name, reply.Error)
+			}
+		} else if reply.Error==nil || reply.Error.Code!=test.errCode {
+			t.Fatalf("%s: error %+v, want %s", test.name, reply.Error, test.errCode)
+		}
+	}
+}